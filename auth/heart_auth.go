@@ -49,6 +49,37 @@ func HEARTScopesHandler(resourceName string) gin.HandlerFunc {
 	}
 }
 
+// HEARTSystemScopesHandler is like HEARTScopesHandler for interactions that aren't
+// restricted to a resource type, e.g. whole-system history and bulk data exports,
+// which require scopes covering all resource types. Requests need a write scope if
+// modifies is true and otherwise a read scope, whatever their method.
+func HEARTSystemScopesHandler(modifies bool) gin.HandlerFunc {
+	allResourcesAllScope := "user/*.*"
+	allResourcesReadScope := "user/*.read"
+	allResourcesWriteScope := "user/*.write"
+	return func(c *gin.Context) {
+		_, exists := c.Get("UserInfo")
+		if exists {
+			// This is an OIDC authenticated request. Let it pass through.
+			return
+		}
+
+		if modifies {
+			if !includesAnyScope(c, allResourcesAllScope, allResourcesWriteScope) {
+				c.String(http.StatusForbidden, "You do not have permission to modify all resources")
+				c.Abort()
+				return
+			}
+		} else {
+			if !includesAnyScope(c, allResourcesAllScope, allResourcesReadScope) {
+				c.String(http.StatusForbidden, "You do not have permission to view all resources")
+				c.Abort()
+				return
+			}
+		}
+	}
+}
+
 func includesAnyScope(c *gin.Context, scopes ...string) bool {
 	grantedScopes, exists := c.Get("scopes")
 	if exists {
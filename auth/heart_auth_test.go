@@ -61,6 +61,40 @@ func (s *HEARTScopesSuite) TestPostPatientWithScopes(c *C) {
 	c.Assert(rr.Body.String(), Equals, "Hello")
 }
 
+func (s *HEARTScopesSuite) TestSystemScopes(c *C) {
+	rr := s.SetUpSystemRequest(false, "user/Patient.read")
+	c.Assert(rr.Code, Equals, http.StatusForbidden)
+	rr = s.SetUpSystemRequest(false, "user/*.read")
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	rr = s.SetUpSystemRequest(false, "user/*.*")
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	rr = s.SetUpSystemRequest(false, "user/*.write")
+	c.Assert(rr.Code, Equals, http.StatusForbidden)
+
+	rr = s.SetUpSystemRequest(true, "user/*.read")
+	c.Assert(rr.Code, Equals, http.StatusForbidden)
+	rr = s.SetUpSystemRequest(true, "user/Patient.write")
+	c.Assert(rr.Code, Equals, http.StatusForbidden)
+	rr = s.SetUpSystemRequest(true, "user/*.write")
+	c.Assert(rr.Code, Equals, http.StatusOK)
+}
+
+func (s *HEARTScopesSuite) SetUpSystemRequest(modifies bool, scopes string) *httptest.ResponseRecorder {
+	// a POST only needs read scopes unless the interaction modifies resources
+	r, err := http.NewRequest("POST", "/", nil)
+	util.CheckErr(err)
+	mockTokenIntrospection := func(c *gin.Context) {
+		c.Set("scopes", strings.Split(scopes, " "))
+	}
+
+	e := gin.New()
+	rw := httptest.NewRecorder()
+	noop := func(c *gin.Context) { c.String(http.StatusOK, "Hello") }
+	e.POST("/", mockTokenIntrospection, HEARTSystemScopesHandler(modifies), noop)
+	e.ServeHTTP(rw, r)
+	return rw
+}
+
 func (s *HEARTScopesSuite) SetUpRequest(method, scopes string) *httptest.ResponseRecorder {
 	r, err := http.NewRequest(method, "/", nil)
 	util.CheckErr(err)
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	"github.com/pkg/errors"
+)
+
+// MongoMutexOptions configures the cluster-wide locks taken by MongoMutexesMiddleware
+type MongoMutexOptions struct {
+	// How long a lock stays valid unless renewed, e.g. when the server instance holding it dies
+	TTL time.Duration
+
+	// How long a request waits for a lock held by another request before failing with 423 Locked
+	MaxWait time.Duration
+
+	// How long to wait before trying again to acquire a lock held by another request
+	PollInterval time.Duration
+}
+
+// DefaultMongoMutexOptions are reasonable defaults for MongoMutexesMiddleware
+var DefaultMongoMutexOptions = MongoMutexOptions{
+	TTL:          60 * time.Second,
+	MaxWait:      30 * time.Second,
+	PollInterval: 100 * time.Millisecond,
+}
+
+// MongoMutexesMiddleware serialises requests with the same X-Mutex-Name header across all
+// server instances sharing the given MongoDB collection. Each lock is a lease that is renewed
+// while the request runs and lapses after the TTL if its holder dies. Every acquisition of a lock
+// increments its fencing token, which is returned in the X-Mutex-Token header. Lease documents are
+// never deleted (e.g. by a TTL index) as the token would then start again from 1. If a renewal finds
+// that the lease has been lost, the request's context is cancelled so that it makes no further changes.
+func MongoMutexesMiddleware(collection *mongo.Collection, options MongoMutexOptions) gin.HandlerFunc {
+	mutexes := &mongoMutexes{collection, options}
+
+	return func(c *gin.Context) {
+
+		mutexName := c.GetHeader("X-Mutex-Name")
+		db := c.GetHeader("Db")
+
+		if db != "" {
+			// assume re-entrant call (via HandleContext() in routing.go)
+
+		} else if mutexName != "" {
+			owner := uuid.Must(uuid.NewRandom()).String()
+			token, err := mutexes.lock(c.Request.Context(), mutexName, owner)
+			if err != nil {
+				fmt.Printf("[mongo_mutexes] %s: lock failed: %+v\n", mutexName, err)
+				outcome := models.CreateOpOutcome("error", "lock-error", "", err.Error())
+				if errors.Cause(err) == errMutexWaitExceeded {
+					c.AbortWithStatusJSON(http.StatusLocked, outcome)
+				} else {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, outcome)
+				}
+				return
+			}
+
+			ctx, cancel := context.WithCancel(c.Request.Context())
+			c.Request = c.Request.WithContext(ctx)
+			stopRenewing := mutexes.keepRenewing(mutexName, owner, cancel)
+			defer func() {
+				stopRenewing()
+				cancel()
+				mutexes.unlock(mutexName, owner)
+			}()
+
+			c.Set("MutexToken", token)
+			c.Header("X-Mutex-Token", strconv.FormatInt(token, 10))
+			c.Header("X-Mutex-Used", "1")
+		} else {
+			c.Header("X-Mutex-Used", "0")
+		}
+
+		c.Next()
+	}
+}
+
+var errMutexWaitExceeded = errors.New("timed out waiting for the mutex to be released by another request")
+
+type mongoMutexes struct {
+	collection *mongo.Collection
+	options    MongoMutexOptions
+}
+
+// lock waits until the lease is acquired, returning its fencing token
+func (m *mongoMutexes) lock(ctx context.Context, mutexName string, owner string) (token int64, err error) {
+	deadline := time.Now().Add(m.options.MaxWait)
+	for {
+		acquired, err := m.tryLock(ctx, mutexName, owner)
+		if err != nil {
+			return 0, errors.Wrapf(err, "acquiring mutex %s", mutexName)
+		}
+		if acquired {
+			return m.fencingToken(ctx, mutexName, owner)
+		}
+
+		if time.Now().After(deadline) {
+			return 0, errors.Wrapf(errMutexWaitExceeded, "mutex %s", mutexName)
+		}
+		delay := m.options.PollInterval + time.Duration(rand.Int63n(int64(m.options.PollInterval)))
+		select {
+		case <-ctx.Done():
+			return 0, errors.Wrapf(ctx.Err(), "waiting for mutex %s", mutexName)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// tryLock takes over the lease if it doesn't exist or has expired. Otherwise the upsert
+// fails with a duplicate key error as the lease document already exists.
+func (m *mongoMutexes) tryLock(ctx context.Context, mutexName string, owner string) (acquired bool, err error) {
+	now := time.Now()
+	filter := bson.NewDocument(
+		bson.EC.String("_id", mutexName),
+		bson.EC.SubDocumentFromElements("expires", bson.EC.Time("$lte", now)),
+	)
+	update := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set",
+			bson.EC.String("owner", owner),
+			bson.EC.Time("expires", now.Add(m.options.TTL)),
+		),
+		bson.EC.SubDocumentFromElements("$inc", bson.EC.Int64("token", 1)),
+	)
+	_, err = m.collection.UpdateOne(ctx, filter, update, updateopt.Upsert(true))
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mongoMutexes) fencingToken(ctx context.Context, mutexName string, owner string) (int64, error) {
+	filter := bson.NewDocument(
+		bson.EC.String("_id", mutexName),
+		bson.EC.String("owner", owner),
+	)
+	cursor, err := m.collection.Find(ctx, filter, findopt.Limit(1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading fencing token of mutex %s", mutexName)
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		return 0, errors.Errorf("lease of mutex %s lost before reading its fencing token (%v)", mutexName, cursor.Err())
+	}
+	var doc bson.Document
+	err = cursor.Decode(&doc)
+	if err != nil {
+		return 0, errors.Wrapf(err, "decoding lease of mutex %s", mutexName)
+	}
+	token, err := doc.LookupErr("token")
+	if err != nil {
+		return 0, errors.Wrapf(err, "lease of mutex %s has no fencing token", mutexName)
+	}
+	return token.Int64(), nil
+}
+
+// keepRenewing extends the lease periodically until the returned function is called,
+// calling lost if the lease has expired and been taken over by another request
+func (m *mongoMutexes) keepRenewing(mutexName string, owner string, lost func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(m.options.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !m.setExpiry(mutexName, owner, time.Now().Add(m.options.TTL)) {
+					lost()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (m *mongoMutexes) unlock(mutexName string, owner string) {
+	// the lease document is kept so that its fencing token keeps increasing
+	m.setExpiry(mutexName, owner, time.Now())
+}
+
+// setExpiry returns false if the lease is no longer held by the owner (errors aren't taken as
+// the lease being lost, as it may still be held)
+func (m *mongoMutexes) setExpiry(mutexName string, owner string, expires time.Time) (held bool) {
+	filter := bson.NewDocument(
+		bson.EC.String("_id", mutexName),
+		bson.EC.String("owner", owner),
+	)
+	update := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set", bson.EC.Time("expires", expires)),
+	)
+	result, err := m.collection.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		fmt.Printf("[mongo_mutexes] %s: failed to update lease: %s\n", mutexName, err.Error())
+	} else if result.MatchedCount == 0 {
+		fmt.Printf("[mongo_mutexes] %s: lease was lost (expired and taken over by another request)\n", mutexName)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+type MongoMutexesTestSuite struct {
+	suite.Suite
+	DBServer   *dbtest.DBServer
+	dbDir      string
+	client     *mongo.Client
+	collection *mongo.Collection
+	options    MongoMutexOptions
+}
+
+func TestMongoMutexesTestSuite(t *testing.T) {
+	suite.Run(t, new(MongoMutexesTestSuite))
+}
+
+func (m *MongoMutexesTestSuite) SetupSuite() {
+	var err error
+	m.dbDir, err = ioutil.TempDir("", "mongo_mutexes_test")
+	if err != nil {
+		panic(err)
+	}
+
+	m.DBServer = &dbtest.DBServer{}
+	m.DBServer.SetPath(m.dbDir)
+	mgoSession := m.DBServer.Session()
+	defer mgoSession.Close()
+	serverUri := mgoSession.LiveServers()[0]
+	m.client, err = mongo.Connect(context.TODO(), "mongodb://"+serverUri)
+	if err != nil {
+		panic(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+}
+
+func (m *MongoMutexesTestSuite) SetupTest() {
+	m.collection = m.client.Database("fhir-test").Collection("mutexes")
+	m.options = MongoMutexOptions{
+		TTL:          time.Second,
+		MaxWait:      300 * time.Millisecond,
+		PollInterval: 20 * time.Millisecond,
+	}
+}
+
+func (m *MongoMutexesTestSuite) TearDownTest() {
+	m.collection.Drop(context.Background())
+}
+
+func (m *MongoMutexesTestSuite) TearDownSuite() {
+	m.client.Disconnect(context.TODO())
+	m.DBServer.Stop()
+	m.DBServer.Wipe()
+	os.RemoveAll(m.dbDir)
+}
+
+func (m *MongoMutexesTestSuite) TestTryLockExpiryAndTakeover() {
+	mutexes := &mongoMutexes{m.collection, m.options}
+	ctx := context.Background()
+
+	acquired, err := mutexes.tryLock(ctx, "m1", "owner1")
+	m.NoError(err)
+	m.True(acquired)
+
+	// held by owner1 until it expires
+	acquired, err = mutexes.tryLock(ctx, "m1", "owner2")
+	m.NoError(err)
+	m.False(acquired)
+
+	// other mutexes are independent
+	acquired, err = mutexes.tryLock(ctx, "m2", "owner2")
+	m.NoError(err)
+	m.True(acquired)
+
+	// an expired lease is taken over and can no longer be renewed by its previous holder
+	m.True(mutexes.setExpiry("m1", "owner1", time.Now().Add(-time.Second)))
+	acquired, err = mutexes.tryLock(ctx, "m1", "owner2")
+	m.NoError(err)
+	m.True(acquired)
+	m.False(mutexes.setExpiry("m1", "owner1", time.Now().Add(m.options.TTL)))
+	m.True(mutexes.setExpiry("m1", "owner2", time.Now().Add(m.options.TTL)))
+}
+
+func (m *MongoMutexesTestSuite) TestFencingTokenIncrements() {
+	mutexes := &mongoMutexes{m.collection, m.options}
+	ctx := context.Background()
+
+	token1, err := mutexes.lock(ctx, "m1", "owner1")
+	m.NoError(err)
+	mutexes.unlock("m1", "owner1")
+
+	token2, err := mutexes.lock(ctx, "m1", "owner2")
+	m.NoError(err)
+	m.Equal(token1+1, token2)
+
+	// taking over an expired lease also increments the token
+	m.True(mutexes.setExpiry("m1", "owner2", time.Now().Add(-time.Second)))
+	token3, err := mutexes.lock(ctx, "m1", "owner3")
+	m.NoError(err)
+	m.Equal(token2+1, token3)
+
+	// the lease documents are never deleted, so there is no index apart from _id's
+	MongoMutexesMiddleware(m.collection, m.options)
+	cursor, err := m.collection.Indexes().List(ctx)
+	m.NoError(err)
+	defer cursor.Close(ctx)
+	var indexes []string
+	for cursor.Next(ctx) {
+		var index bson.Document
+		m.NoError(cursor.Decode(&index))
+		indexes = append(indexes, index.Lookup("name").StringValue())
+	}
+	m.Equal([]string{"_id_"}, indexes)
+}
+
+func (m *MongoMutexesTestSuite) TestLockedAfterMaxWait() {
+	mutexes := &mongoMutexes{m.collection, m.options}
+	acquired, err := mutexes.tryLock(context.Background(), "m1", "other-instance")
+	m.NoError(err)
+	m.True(acquired)
+
+	e := gin.New()
+	e.Use(MongoMutexesMiddleware(m.collection, m.options))
+	e.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Mutex-Name", "m1")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	m.Equal(http.StatusLocked, w.Code)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Mutex-Name", "m2")
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	m.Equal(http.StatusOK, w.Code)
+	m.Equal("1", w.Header().Get("X-Mutex-Token"))
+}
+
+func (m *MongoMutexesTestSuite) TestLostLeaseCancelsRequest() {
+	m.options.TTL = 300 * time.Millisecond
+	e := gin.New()
+	e.Use(MongoMutexesMiddleware(m.collection, m.options))
+	e.GET("/", func(c *gin.Context) {
+		// another request takes over the lease
+		filter := bson.NewDocument(bson.EC.String("_id", "m1"))
+		update := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("owner", "other-instance")))
+		_, err := m.collection.UpdateOne(context.Background(), filter, update)
+		m.NoError(err)
+
+		select {
+		case <-c.Request.Context().Done():
+			c.Status(http.StatusLocked)
+		case <-time.After(5 * time.Second):
+			c.Status(http.StatusOK)
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Mutex-Name", "m1")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	m.Equal(http.StatusLocked, w.Code)
+}
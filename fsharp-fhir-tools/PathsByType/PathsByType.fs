@@ -41,8 +41,31 @@ let getPathTypes (filename: string) =
     
     pathTypes
 
-[<EntryPoint>]
-let main argv =
+// top-level elements of each resource marked as part of its summary, except for
+// id, meta and implicitRules which are in the summary of every resource
+let getSummaryElements (filename: string) =
+
+    let file = Elements.Load(filename)
+    let resources =
+        file.Entry
+        |> Array.map (fun e -> e.Resource)
+        |> Array.filter (fun r -> r.Kind = "resource" && r.Abstract = Some false)
+
+    seq {
+        for resource in resources do
+            let snapshots = resource.Snapshot |> Option.toArray
+            let elements =
+                snapshots
+                |> Array.collect (fun s -> s.Element)
+                |> Array.filter (fun e -> e.IsSummary = Some true)
+                |> Array.map (fun e -> e.Id.Split('.'))
+                |> Array.filter (fun parts -> parts.Length = 2)
+                |> Array.map (fun parts -> parts.[1])
+                |> Array.filter (fun name -> name <> "id" && name <> "meta" && name <> "implicitRules")
+            yield resource.Id, elements
+    }
+
+let printHeader () =
     printfn "// -----------------------------------------"
     printfn "// Generated by FHIR PathsByType Utility"
     printfn "// -----------------------------------------"
@@ -50,14 +73,29 @@ let main argv =
     printfn "package models2"
     printfn ""
 
-    let types = Seq.concat [
-                    getPathTypes """STU3\profiles-resources.json"""
-                    getPathTypes """STU3\profiles-types.json"""
-                ] |> Seq.sortBy fst
+[<EntryPoint>]
+let main argv =
+    printHeader ()
+
+    match argv with
+    | [| "summary" |] ->
+        let resources = getSummaryElements """STU3\profiles-resources.json""" |> Seq.sortBy fst
+
+        printfn """var summaryElements = map[string][]string {"""
+        for resourceType, elements in resources do
+            let quoted = elements |> Array.map (sprintf "\"%s\"") |> String.concat ", "
+            printfn """    "%s": {%s},""" resourceType quoted
+        printfn "}"
+
+    | _ ->
+        let types = Seq.concat [
+                        getPathTypes """STU3\profiles-resources.json"""
+                        getPathTypes """STU3\profiles-types.json"""
+                    ] |> Seq.sortBy fst
 
-    printfn """var fhirTypes = map[string]string {"""
-    for path, t in types do
-        printfn """    "%s": "%s",""" path t
-    printfn "}"
+        printfn """var fhirTypes = map[string]string {"""
+        for path, t in types do
+            printfn """    "%s": "%s",""" path t
+        printfn "}"
 
     0 // exit code
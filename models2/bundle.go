@@ -75,3 +75,18 @@ func (b *ShallowBundle) GetAllReferences() (references []string, err error) {
 
 	return visitor.GetReferences(), nil
 }
+
+// GetReferences returns the references made by the entry's resource
+func (e *ShallowBundleEntryComponent) GetReferences() (references []string, err error) {
+	if e.Resource == nil {
+		return nil, nil
+	}
+
+	visitor := NewFhirVisitorCollectReferences()
+	err = WalkFHIRjson(e.Resource.JsonBytes(), visitor)
+	if err != nil {
+		return nil, errors.Wrap(err, "WalkFHIRjson error")
+	}
+
+	return visitor.GetReferences(), nil
+}
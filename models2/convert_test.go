@@ -114,6 +114,46 @@ func TestEncryptionOfMedicareIdentifier(t *testing.T) {
 	}
 }
 
+func TestCanonicalQuantity(t *testing.T) {
+	jsonBytes := []byte(`{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": { "text": "cholesterol" },
+		"valueQuantity": { "value": 193.5, "unit": "mg/dL", "system": "http://unitsofmeasure.org", "code": "mg/dL" },
+		"component": [
+			{ "code": { "text": "lbs" }, "valueQuantity": { "value": 185, "unit": "lbs", "system": "http://unitsofmeasure.org", "code": "[lb_av]" } },
+			{ "code": { "text": "other" }, "valueQuantity": { "value": 185, "unit": "lbs" } }
+		]
+	}`)
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+	assert.Nil(t, err)
+
+	bsonBytes, err := bson.Marshal(&bsonDoc)
+	assert.Nil(t, err)
+	var doc struct {
+		ValueQuantity bson.M   `bson:"valueQuantity"`
+		Component     []bson.M `bson:"component"`
+	}
+	assert.Nil(t, bson.Unmarshal(bsonBytes, &doc))
+
+	// converted exactly to the canonical unit, g/m3 for mg/dL and g for [lb_av]
+	assert.Equal(t, bson.M{
+		"code": "g.m-3",
+		"value": bson.M{Gofhir__from: 1934.5, Gofhir__to: 1935.5, Gofhir__num: 1935.0, Gofhir__strNum: "1935"},
+	}, doc.ValueQuantity[QuantityCanonicalField])
+	canonical := doc.Component[0]["valueQuantity"].(bson.M)[QuantityCanonicalField].(bson.M)
+	assert.Equal(t, "g", canonical["code"])
+	assert.Equal(t, "83914.58845", canonical["value"].(bson.M)[Gofhir__strNum])
+
+	// quantities without UCUM units are left alone
+	_, found := doc.Component[1]["valueQuantity"].(bson.M)[QuantityCanonicalField]
+	assert.False(t, found)
+
+	backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson), "should get back original json")
+}
+
 func printBSON(bsonDoc *bson.D) {
 	bsonBytes, err := bson.Marshal(bsonDoc)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"time"
 	"fmt"
 	"math"
+	"math/big"
 	"strings"
 
 	"github.com/eug48/fhir/utils"
@@ -21,6 +22,10 @@ const Gofhir__num = "__num"
 const Gofhir__from = "__from"
 const Gofhir__to = "__to"
 
+// QuantityCanonicalField is added to quantities with UCUM units and holds { code, value } with the
+// value converted to the canonical UCUM unit, so that quantities given in different units can be compared
+const QuantityCanonicalField = "__canonical"
+
 
 // Converts a FHIR JSON Resource into BSON for storage in MongoDB
 // Does several transformations:
@@ -29,6 +34,7 @@ const Gofhir__to = "__to"
 //   - converts extensions from { url, value } to { url: { value } } to enable better MongoDB queries
 //   - converts decimal numbers to { __from, __to, __num, __strNum } for FHIR conformance
 //   - converts dates to { __from, __to, __strDate } for FHIR conformance
+//   - adds the value of quantities with UCUM units in canonical units (QuantityCanonicalField)
 //   - optionally encrypts certain fields
 func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, transformReferencesMap map[string]string) (out bson.D, err error) {
 
@@ -138,6 +144,12 @@ func convertValue(pos positionInfo, value []byte, dataType jsonparser.ValueType,
 			return nil, errors.Wrapf(err, "ObjectEach failed at %s", pos.pathHere)
 		}
 
+		if pos.atQuantity() {
+			if canonical := convertCanonicalQuantity(value); canonical != nil {
+				subDoc = append(subDoc, bson.DocElem{Name: QuantityCanonicalField, Value: canonical})
+			}
+		}
+
 		return subDoc, nil
 
 	case jsonparser.Array:
@@ -300,6 +312,62 @@ func convertDateValue(jsonBytes []byte, pos positionInfo) (elem interface{}, err
 	return
 }
 
+// convertCanonicalQuantity returns { code, value } for a quantity with a UCUM unit, where code is the
+// canonical unit and value is a decimal { __from, __to, __num, __strNum } converted to it exactly.
+// Quantities that can't be converted (e.g. with other units or no value) return nil.
+func convertCanonicalQuantity(jsonBytes []byte) interface{} {
+	system, _ := jsonparser.GetString(jsonBytes, "system")
+	code, _ := jsonparser.GetString(jsonBytes, "code")
+	valueBytes, dataType, _, err := jsonparser.Get(jsonBytes, "value")
+	if system != utils.UCUMSystem || code == "" || err != nil || dataType != jsonparser.Number {
+		return nil
+	}
+	unit, err := utils.ParseUCUM(code)
+	if err != nil {
+		debug("convertCanonicalQuantity: %s", err)
+		return nil
+	}
+	num := utils.ParseNumber(string(valueBytes))
+	if num.Value == nil {
+		return nil
+	}
+
+	value := unit.Convert(num.Value)
+	numValue, _ := value.Float64()
+	numFrom, _ := unit.Convert(num.RangeLowIncl()).Float64()
+	numTo, _ := unit.Convert(num.RangeHighExcl()).Float64()
+	return []bson.DocElem{
+		bson.DocElem{Name: "code", Value: unit.Canonical()},
+		bson.DocElem{Name: "value", Value: []bson.DocElem{
+			bson.DocElem{Name: Gofhir__from, Value: numFrom},
+			bson.DocElem{Name: Gofhir__to, Value: numTo},
+			bson.DocElem{Name: Gofhir__num, Value: numValue},
+			bson.DocElem{Name: Gofhir__strNum, Value: exactDecimalString(value)},
+		}},
+	}
+}
+
+// exactDecimalString returns the decimal representation of r, or a fraction if it has no finite one
+func exactDecimalString(r *big.Rat) string {
+	denom := new(big.Int).Set(r.Denom())
+	digits := 0
+	for _, factor := range []int64{2, 5} {
+		count := 0
+		f := big.NewInt(factor)
+		for new(big.Int).Mod(denom, f).Sign() == 0 {
+			denom.Quo(denom, f)
+			count++
+		}
+		if count > digits {
+			digits = count
+		}
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return r.RatString()
+	}
+	return r.FloatString(digits)
+}
+
 // FHIR requires a decimal's string representation to be preserved exactly
 // so we store a string representation of decimals
 func convertNumberValue(jsonBytes []byte, pos positionInfo) (elem interface{}, err error) {
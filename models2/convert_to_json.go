@@ -141,7 +141,7 @@ func processDocument(out *bytes.Buffer, bsonDoc []bson.DocElem) (err error) {
 		debug("processDocument: %s", elem.Name)
 
 		switch elem.Name {
-		case "reference__id", "reference__type", "reference__external":
+		case "reference__id", "reference__type", "reference__external", SearchIndexField, QuantityCanonicalField:
 			continue // i.e. skip
 		}
 
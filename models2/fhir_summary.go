@@ -0,0 +1,48 @@
+package models2
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SummaryElements returns the top-level elements of a resource type that are part of its summary
+// (isSummary in the STU3 StructureDefinitions, see fhir_summary_elements.go), with choice elements
+// expanded (see ElementNames). The id, meta and implicitRules elements of all resources are also part
+// of the summary. If the resource type isn't known false is returned.
+func SummaryElements(resourceType string) ([]string, bool) {
+	elements, found := summaryElements[resourceType]
+	if !found {
+		return nil, false
+	}
+	names := []string{"id", "meta", "implicitRules"}
+	for _, element := range elements {
+		names = append(names, ElementNames(resourceType, element)...)
+	}
+	return names, true
+}
+
+// ElementNames returns the JSON property names of a top-level element of a resource type. This
+// is just the element itself unless it is a choice element, e.g. Observation.value[x] (or just
+// "value") is returned as valueQuantity, valueCodeableConcept, valueString etc.
+func ElementNames(resourceType string, element string) []string {
+	element = strings.TrimSuffix(element, "[x]")
+	prefix := resourceType + "." + element
+	if _, found := fhirTypes[prefix]; found {
+		return []string{element}
+	}
+
+	var names []string
+	for path := range fhirTypes {
+		if len(path) <= len(prefix) || !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		typeName := path[len(prefix):]
+		if unicode.IsUpper(rune(typeName[0])) && !strings.Contains(typeName, ".") {
+			names = append(names, element+typeName)
+		}
+	}
+	if len(names) == 0 {
+		return []string{element}
+	}
+	return names
+}
@@ -0,0 +1,128 @@
+// -----------------------------------------
+// Generated by FHIR PathsByType Utility
+// -----------------------------------------
+
+// FHIR version: STU3
+// Files: profiles-resources.json
+
+package models2
+
+var summaryElements = map[string][]string {
+    "Account": {"identifier", "status", "type", "name", "subject", "period", "active", "balance", "coverage", "owner", "description"},
+    "ActivityDefinition": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact", "kind", "code"},
+    "AdverseEvent": {"identifier", "category", "type", "subject", "date", "reaction", "location", "seriousness", "outcome", "recorder", "eventParticipant", "description", "suspectEntity", "subjectMedicalHistory", "referenceDocument", "study"},
+    "AllergyIntolerance": {"identifier", "clinicalStatus", "verificationStatus", "type", "category", "criticality", "code", "patient", "asserter"},
+    "Appointment": {"identifier", "status", "serviceCategory", "serviceType", "specialty", "appointmentType", "reason", "start", "end"},
+    "AppointmentResponse": {"identifier", "appointment", "participantType", "actor", "participantStatus"},
+    "AuditEvent": {"type", "subtype", "action", "recorded", "outcome", "outcomeDesc", "purposeOfEvent"},
+    "Basic": {"identifier", "code", "subject", "created", "author"},
+    "Binary": {"contentType", "securityContext"},
+    "BodySite": {"identifier", "active", "code", "patient"},
+    "Bundle": {"identifier", "type", "total", "link", "entry", "signature"},
+    "CapabilityStatement": {"url", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "kind", "instantiates", "software", "implementation", "fhirVersion", "acceptUnknown", "format", "patchFormat", "implementationGuide", "profile"},
+    "CarePlan": {"identifier", "definition", "basedOn", "replaces", "partOf", "status", "intent", "category", "title", "description", "subject", "context", "period", "author", "addresses"},
+    "CareTeam": {"identifier", "status", "category", "name", "subject", "context", "period", "managingOrganization"},
+    "ChargeItem": {"identifier", "definition", "status", "code", "subject", "context", "occurrence[x]", "quantity", "bodysite", "enterer", "enteredDate", "account"},
+    "Claim": {"status"},
+    "ClaimResponse": {"status"},
+    "ClinicalImpression": {"identifier", "status", "code", "description", "subject", "context", "effective[x]", "date", "assessor"},
+    "CodeSystem": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "caseSensitive", "valueSet", "hierarchyMeaning", "compositional", "versionNeeded", "content", "count", "filter", "property"},
+    "Communication": {"identifier", "definition", "basedOn", "partOf", "status", "notDone", "notDoneReason", "context", "reasonCode", "reasonReference"},
+    "CommunicationRequest": {"identifier", "basedOn", "replaces", "groupIdentifier", "status", "priority", "occurrence[x]", "authoredOn", "requester"},
+    "CompartmentDefinition": {"url", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "code", "search", "resource"},
+    "Composition": {"identifier", "status", "type", "class", "subject", "encounter", "date", "author", "title", "confidentiality", "attester", "custodian", "relatesTo", "event"},
+    "ConceptMap": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "source[x]", "target[x]"},
+    "Condition": {"identifier", "clinicalStatus", "verificationStatus", "severity", "code", "bodySite", "subject", "context", "onset[x]", "abatement[x]", "assertedDate", "asserter"},
+    "Consent": {"identifier", "status", "category", "patient", "period", "dateTime", "consentingParty", "actor", "action", "organization", "source[x]", "policyRule", "securityLabel", "purpose", "dataPeriod", "data"},
+    "Contract": {"identifier", "issued", "applies", "subject", "type", "subType"},
+    "Coverage": {"identifier", "status", "type", "policyHolder", "subscriber", "subscriberId", "beneficiary", "period", "payor", "dependent", "sequence", "order", "network"},
+    "DataElement": {"url", "identifier", "version", "status", "experimental", "date", "publisher", "name", "title", "contact", "useContext", "jurisdiction", "stringency", "element"},
+    "DetectedIssue": {"identifier", "status", "category", "severity", "patient", "date", "author", "implicated"},
+    "Device": {"udi", "status"},
+    "DeviceComponent": {"identifier", "type", "lastSystemChange", "source", "parent", "operationalStatus", "parameterGroup", "measurementPrinciple", "productionSpecification", "languageCode"},
+    "DeviceMetric": {"identifier", "type", "unit", "source", "parent", "operationalStatus", "color", "category", "measurementPeriod", "calibration"},
+    "DeviceRequest": {"identifier", "definition", "basedOn", "priorRequest", "groupIdentifier", "status", "intent", "priority", "code[x]", "subject", "context", "occurrence[x]", "authoredOn", "requester", "performerType", "performer", "reasonCode", "reasonReference"},
+    "DeviceUseStatement": {"status", "subject", "timing[x]", "device"},
+    "DiagnosticReport": {"identifier", "status", "category", "code", "subject", "context", "effective[x]", "issued", "performer", "image"},
+    "DocumentManifest": {"masterIdentifier", "identifier", "status", "type", "subject", "created", "author", "recipient", "source", "description", "content", "related"},
+    "DocumentReference": {"masterIdentifier", "identifier", "status", "docStatus", "type", "class", "subject", "created", "indexed", "author", "authenticator", "custodian", "relatesTo", "description", "securityLabel", "content", "context"},
+    "EligibilityRequest": {"status"},
+    "EligibilityResponse": {"status"},
+    "Encounter": {"identifier", "status", "class", "type", "subject", "episodeOfCare", "participant", "appointment", "reason"},
+    "Endpoint": {"identifier", "status", "connectionType", "name", "managingOrganization", "period", "payloadType", "payloadMimeType", "address"},
+    "EnrollmentRequest": {"status"},
+    "EnrollmentResponse": {"status"},
+    "EpisodeOfCare": {"identifier", "status", "type", "diagnosis", "patient", "managingOrganization", "period"},
+    "ExpansionProfile": {"url", "identifier", "version", "name", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "fixedVersion", "excludedSystem", "includeDesignations", "designation", "includeDefinition", "activeOnly", "excludeNested", "excludeNotForUI", "excludePostCoordinated", "displayLanguage", "limitedExpansion"},
+    "ExplanationOfBenefit": {"status"},
+    "FamilyMemberHistory": {"identifier", "definition", "status", "notDone", "notDoneReason", "patient", "date", "name", "relationship", "gender", "age[x]", "estimatedAge", "deceased[x]", "reasonCode", "reasonReference"},
+    "Flag": {"identifier", "category", "status", "period", "subject", "encounter", "code", "author"},
+    "Goal": {"identifier", "status", "category", "priority", "description", "subject", "start[x]", "target", "expressedBy"},
+    "GraphDefinition": {"url", "version", "name", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "start", "profile"},
+    "Group": {"identifier", "active", "type", "actual", "code", "name", "quantity"},
+    "GuidanceResponse": {"requestId", "identifier", "module", "status"},
+    "HealthcareService": {"identifier", "active", "providedBy", "category", "type", "specialty", "location", "name", "comment", "photo"},
+    "ImagingManifest": {"identifier", "patient", "authoringTime", "author", "description", "study"},
+    "ImagingStudy": {"uid", "accession", "identifier", "availability", "modalityList", "patient", "context", "started", "basedOn", "referrer", "interpreter", "endpoint", "numberOfSeries", "numberOfInstances", "procedureReference", "procedureCode", "reason", "description", "series"},
+    "Immunization": {"status", "notGiven", "vaccineCode", "patient", "date", "primarySource"},
+    "ImmunizationRecommendation": {"identifier", "patient", "recommendation"},
+    "ImplementationGuide": {"url", "version", "name", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "fhirVersion", "dependency", "package", "global", "page"},
+    "Library": {"url", "identifier", "version", "name", "title", "status", "experimental", "type", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact"},
+    "Linkage": {"active", "author", "item"},
+    "List": {"identifier", "status", "mode", "title", "code", "subject", "date", "source"},
+    "Location": {"identifier", "status", "operationalStatus", "name", "description", "mode", "type", "physicalType", "managingOrganization"},
+    "Measure": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact", "disclaimer", "scoring", "compositeScoring", "type", "riskAdjustment", "rateAggregation", "rationale", "clinicalRecommendationStatement", "improvementNotation", "definition", "guidance", "set"},
+    "MeasureReport": {"identifier", "status", "type", "measure", "patient", "date", "reportingOrganization", "period"},
+    "Media": {"identifier", "basedOn", "type", "subtype", "view", "subject", "occurrence[x]", "operator", "bodySite", "device", "height", "width", "frames", "duration"},
+    "Medication": {"code", "status", "isBrand", "isOverTheCounter", "manufacturer"},
+    "MedicationAdministration": {"identifier", "definition", "partOf", "status", "medication[x]", "subject", "context", "effective[x]", "performer", "notGiven"},
+    "MedicationDispense": {"identifier", "status", "medication[x]", "subject", "context", "performer", "authorizingPrescription", "notDone"},
+    "MedicationRequest": {"identifier", "definition", "basedOn", "groupIdentifier", "status", "intent", "priority", "medication[x]", "subject", "authoredOn", "requester"},
+    "MedicationStatement": {"identifier", "basedOn", "partOf", "context", "status", "category", "medication[x]", "effective[x]", "dateAsserted", "informationSource", "subject", "taken"},
+    "MessageDefinition": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "base", "parent", "replaces", "event", "category"},
+    "MessageHeader": {"event", "destination", "receiver", "sender", "timestamp", "enterer", "author", "source", "responsible", "reason", "response", "focus"},
+    "NamingSystem": {"name", "status", "kind", "date", "publisher", "contact", "responsible", "useContext", "jurisdiction"},
+    "NutritionOrder": {"identifier", "status", "patient", "dateTime", "orderer"},
+    "Observation": {"identifier", "basedOn", "status", "code", "subject", "effective[x]", "issued", "performer", "value[x]", "related", "component"},
+    "OperationDefinition": {"url", "version", "name", "status", "kind", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "idempotent", "code", "base", "resource", "system", "type", "instance"},
+    "OperationOutcome": {"issue"},
+    "Organization": {"identifier", "active", "type", "name", "partOf"},
+    "Parameters": {"parameter"},
+    "Patient": {"identifier", "active", "name", "telecom", "gender", "birthDate", "deceased[x]", "address", "animal", "managingOrganization", "link"},
+    "PaymentNotice": {"status"},
+    "PaymentReconciliation": {"status"},
+    "Person": {"identifier", "name", "telecom", "gender", "birthDate", "address", "managingOrganization", "active"},
+    "PlanDefinition": {"url", "identifier", "version", "name", "title", "type", "status", "experimental", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact"},
+    "Practitioner": {"identifier", "active", "name", "telecom", "address", "gender", "birthDate"},
+    "PractitionerRole": {"identifier", "active", "period", "practitioner", "organization", "code", "specialty", "location", "telecom"},
+    "Procedure": {"identifier", "definition", "basedOn", "partOf", "status", "notDone", "notDoneReason", "category", "code", "subject", "context", "performed[x]", "performer", "location", "reasonCode", "reasonReference", "bodySite", "outcome"},
+    "ProcedureRequest": {"identifier", "definition", "basedOn", "replaces", "requisition", "status", "intent", "priority", "doNotPerform", "category", "code", "subject", "context", "occurrence[x]", "asNeeded[x]", "authoredOn", "requester", "performerType", "performer", "reasonCode", "reasonReference", "specimen", "bodySite"},
+    "ProcessRequest": {"status"},
+    "ProcessResponse": {"status"},
+    "Provenance": {"target", "recorded"},
+    "Questionnaire": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact", "code", "subjectType"},
+    "QuestionnaireResponse": {"identifier", "basedOn", "parent", "questionnaire", "status", "subject", "context", "authored", "author", "source"},
+    "ReferralRequest": {"identifier", "definition", "basedOn", "replaces", "groupIdentifier", "status", "intent", "type", "priority", "serviceRequested", "subject", "context", "occurrence[x]", "authoredOn", "requester", "specialty", "recipient", "reasonCode", "reasonReference"},
+    "RelatedPerson": {"identifier", "active", "patient", "relationship", "name", "telecom", "gender", "birthDate", "address"},
+    "RequestGroup": {"identifier", "definition", "basedOn", "replaces", "groupIdentifier", "status", "intent", "priority", "subject", "context", "authoredOn", "author"},
+    "ResearchStudy": {"identifier", "title", "protocol", "partOf", "status", "category", "focus", "contact", "keyword", "jurisdiction", "enrollment", "period", "sponsor", "principalInvestigator", "site"},
+    "ResearchSubject": {"identifier", "status", "period", "study", "individual", "assignedArm", "actualArm"},
+    "RiskAssessment": {"identifier", "basedOn", "parent", "status", "method", "code", "subject", "context", "occurrence[x]", "condition", "performer", "reason[x]"},
+    "Schedule": {"identifier", "active", "serviceCategory", "serviceType", "specialty", "actor", "planningHorizon"},
+    "SearchParameter": {"url", "version", "name", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "code", "base", "type", "derivedFrom", "description"},
+    "Sequence": {"identifier", "type", "coordinateSystem", "patient", "specimen", "device", "performer", "quantity", "referenceSeq", "variant", "observedSeq", "quality", "readCoverage", "repository", "pointer"},
+    "ServiceDefinition": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "effectivePeriod", "useContext", "jurisdiction", "contact"},
+    "Slot": {"identifier", "serviceCategory", "serviceType", "specialty", "appointmentType", "schedule", "status", "start", "end", "overbooked"},
+    "Specimen": {"identifier", "accessionIdentifier", "status", "type", "subject", "receivedTime"},
+    "StructureDefinition": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "keyword", "fhirVersion", "kind", "abstract", "contextType", "context", "contextInvariant", "type", "baseDefinition", "derivation"},
+    "StructureMap": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "structure", "import", "group"},
+    "Subscription": {"status", "contact", "end", "reason", "criteria", "error", "channel", "tag"},
+    "Substance": {"identifier", "status", "category", "code", "description", "instance", "ingredient"},
+    "SupplyDelivery": {"identifier", "basedOn", "partOf", "status", "patient", "type", "suppliedItem", "occurrence[x]", "supplier", "destination", "receiver"},
+    "SupplyRequest": {"identifier", "status", "category", "priority", "orderedItem", "occurrence[x]", "authoredOn", "requester", "supplier", "reason[x]", "deliverFrom", "deliverTo"},
+    "Task": {"identifier", "definition[x]", "basedOn", "groupIdentifier", "partOf", "status", "statusReason", "businessStatus", "intent", "priority", "code", "description", "focus", "for", "context", "executionPeriod", "authoredOn", "lastModified", "requester", "owner", "reason"},
+    "TestReport": {"identifier", "name", "status", "testScript", "result", "score", "tester", "issued"},
+    "TestScript": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction"},
+    "ValueSet": {"url", "identifier", "version", "name", "title", "status", "experimental", "date", "publisher", "contact", "useContext", "jurisdiction", "immutable", "extensible"},
+    "VisionPrescription": {"identifier", "status", "patient", "dateWritten", "prescriber"},
+}
@@ -67,6 +67,9 @@ func (r *Resource) SearchIncludesOfType(resourceType string) []*Resource {
 	}
 	return out
 }
+func (r *Resource) AddSearchInclude(included *Resource) {
+	r.searchIncludes = append(r.searchIncludes, included)
+}
 
 func (r *Resource) Unmarshal(v interface{}) error {
 	// debug("Resource.Unmarshal: %s", r.jsonBytes)
@@ -265,6 +268,8 @@ func (r *Resource) GetBSON() (interface{}, error) {
 		// debug("setBson: bsonDoc2 now %+v", bsonDoc2)
 	}
 
+	bsonDoc2 = addSearchIndex(r.resourceType, bsonDoc2)
+
 	r.cachedBson = &bsonDoc2
 	return bsonDoc2, err
 }
@@ -414,3 +419,112 @@ func NewResourceFromJsonBytes(jsonBytes []byte) (resource *Resource, err error)
 	}
 	return resource, nil
 }
+
+// SubsettedTag is the meta tag marking a resource that has had some of its elements removed,
+// e.g. when returned for a search with _summary or _elements
+var SubsettedTag = []bson.DocElem{
+	{Name: "system", Value: "http://hl7.org/fhir/v3/ObservationValue"},
+	{Name: "code", Value: "SUBSETTED"},
+	{Name: "display", Value: "subsetted"},
+}
+
+// Subset returns a copy of the resource with only the top-level elements for which keep returns
+// true (or all of them if keep is nil), tagged as SUBSETTED. The id, resourceType and meta
+// elements are always kept, and the extensions of a primitive element (e.g. _birthDate) are kept
+// along with the element itself.
+func (r *Resource) Subset(keep func(element string) bool) (*Resource, error) {
+	doc, err := r.GetBSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "Subset: GetBSON failed")
+	}
+
+	elems := doc.([]bson.DocElem)
+	subset := make([]bson.DocElem, 0, len(elems)+1)
+	hasMeta := false
+	for _, elem := range elems {
+		switch elem.Name {
+		case "_id", "resourceType":
+			subset = append(subset, elem)
+		case "meta":
+			meta, err := subsettedMeta(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			subset = append(subset, bson.DocElem{Name: "meta", Value: meta})
+			hasMeta = true
+		default:
+			element := elem.Name
+			if element == "__id" {
+				element = "_id"
+			}
+			if len(element) > 1 && element[0] == '_' {
+				element = element[1:]
+			}
+			if keep == nil || keep(element) {
+				subset = append(subset, elem)
+			}
+		}
+	}
+	if !hasMeta {
+		meta, _ := subsettedMeta([]bson.DocElem{})
+		subset = append(subset, bson.DocElem{Name: "meta", Value: meta})
+	}
+
+	subsetted, err := NewResourceFromBSON(subset)
+	if err != nil {
+		return nil, errors.Wrap(err, "Subset: NewResourceFromBSON failed")
+	}
+	subsetted.searchIncludes = r.searchIncludes
+	return subsetted, nil
+}
+
+// subsettedMeta returns a copy of a resource's meta element with the SUBSETTED tag added
+func subsettedMeta(value interface{}) ([]bson.DocElem, error) {
+	var meta []bson.DocElem
+	switch value := value.(type) {
+	case []bson.DocElem:
+		meta = value
+	case bson.D:
+		meta = value
+	case *[]bson.DocElem:
+		meta = *value
+	default:
+		return nil, fmt.Errorf("subsettedMeta: bad type: %T", value)
+	}
+
+	copied := make([]bson.DocElem, 0, len(meta)+1)
+	foundTags := false
+	for _, elem := range meta {
+		if elem.Name == "tag" {
+			tags, _ := elem.Value.([]interface{})
+			if !hasSubsettedTag(tags) {
+				tags = append(append([]interface{}{}, tags...), SubsettedTag)
+			}
+			elem = bson.DocElem{Name: "tag", Value: tags}
+			foundTags = true
+		}
+		copied = append(copied, elem)
+	}
+	if !foundTags {
+		copied = append(copied, bson.DocElem{Name: "tag", Value: []interface{}{SubsettedTag}})
+	}
+	return copied, nil
+}
+
+func hasSubsettedTag(tags []interface{}) bool {
+	for _, tag := range tags {
+		var elems []bson.DocElem
+		switch tag := tag.(type) {
+		case []bson.DocElem:
+			elems = tag
+		case bson.D:
+			elems = tag
+		}
+		for _, elem := range elems {
+			if elem.Name == "code" && elem.Value == "SUBSETTED" {
+				return true
+			}
+		}
+	}
+	return false
+}
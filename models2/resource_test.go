@@ -0,0 +1,49 @@
+package models2
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubset(t *testing.T) {
+	resource, err := NewResourceFromJsonBytes([]byte(`{"resourceType":"Patient","id":"123","meta":{"versionId":"1"},"text":{"status":"generated","div":"<div>Jane</div>"},"gender":"female","birthDate":"1980-02-01","_birthDate":{"extension":[{"url":"http://example.org/time","valueString":"08:00"}]}}`))
+	assert.Nil(t, err)
+
+	subset, err := resource.Subset(func(element string) bool { return element == "birthDate" })
+	assert.Nil(t, err)
+	assert.Equal(t, "123", subset.Id())
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"123","meta":{"versionId":"1","tag":[{"system":"http://hl7.org/fhir/v3/ObservationValue","code":"SUBSETTED","display":"subsetted"}]},"birthDate":"1980-02-01","_birthDate":{"extension":[{"url":"http://example.org/time","valueString":"08:00"}]}}`, string(subset.JsonBytes()))
+
+	// subsetting again doesn't add another tag
+	subset, err = subset.Subset(nil)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"123","meta":{"versionId":"1","tag":[{"system":"http://hl7.org/fhir/v3/ObservationValue","code":"SUBSETTED","display":"subsetted"}]},"birthDate":"1980-02-01","_birthDate":{"extension":[{"url":"http://example.org/time","valueString":"08:00"}]}}`, string(subset.JsonBytes()))
+}
+
+func TestSummaryElements(t *testing.T) {
+	elements, found := SummaryElements("Patient")
+	assert.True(t, found)
+	assert.Contains(t, elements, "birthDate")
+	assert.Contains(t, elements, "deceasedBoolean")
+	assert.Contains(t, elements, "deceasedDateTime")
+	assert.NotContains(t, elements, "text")
+	assert.NotContains(t, elements, "photo")
+
+	elements, found = SummaryElements("ImagingManifest")
+	assert.True(t, found)
+	assert.Contains(t, elements, "study")
+
+	_, found = SummaryElements("DomainResource")
+	assert.False(t, found)
+}
+
+func TestElementNames(t *testing.T) {
+	assert.Equal(t, []string{"status"}, ElementNames("Observation", "status"))
+	assert.Equal(t, []string{"unknown"}, ElementNames("Observation", "unknown"))
+
+	names := ElementNames("Condition", "onset[x]")
+	sort.Strings(names)
+	assert.Equal(t, []string{"onsetAge", "onsetDateTime", "onsetPeriod", "onsetRange", "onsetString"}, names)
+}
@@ -0,0 +1,43 @@
+package models2
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SearchIndexField is the top-level field in the BSON of stored resources that holds the values of
+// custom search parameters (and the positions of Locations), which are extracted from resources when
+// they are stored. It is left out when resources are converted back to JSON.
+const SearchIndexField = "__search"
+
+// SearchIndexer extracts the values of custom search parameters (and the positions of Locations) from
+// the BSON of a resource, returning nil if there aren't any. If set, GetBSON stores these values in the
+// SearchIndexField.
+var SearchIndexer func(resourceType string, doc []bson.DocElem) bson.D
+
+// addSearchIndex appends the values of custom search parameters to the BSON of a resource
+func addSearchIndex(resourceType string, doc []bson.DocElem) []bson.DocElem {
+	if SearchIndexer == nil {
+		return doc
+	}
+	values := SearchIndexer(resourceType, doc)
+	if len(values) == 0 {
+		return doc
+	}
+	return append(doc, bson.DocElem{Name: SearchIndexField, Value: values})
+}
+
+// ElementType returns the type of a child element of a resource or data type, e.g. "date" for
+// Patient.birthDate or "HumanName" for Patient.name. For backbone elements, which don't have a
+// type of their own, the path of the element (e.g. Patient.contact) is returned instead so that
+// their children can be looked up in turn.
+func ElementType(parent string, element string) (string, bool) {
+	path := parent + "." + element
+	t, found := fhirTypes[path]
+	if !found {
+		return "", false
+	}
+	if t == "BackboneElement" || t == "Element" {
+		return path, true
+	}
+	return t, true
+}
@@ -0,0 +1,363 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/eug48/fhir/models"
+)
+
+// fhirPath is a parsed path in the subset of FHIRPath supported by FHIRPath Patch operations
+type fhirPath []fhirPathStep
+
+type fhirPathStep struct {
+	name     string // element name, or empty for functions
+	index    int    // -1 when not indexed
+	function string // first, last or where
+	// criterion of where(), e.g. system = 'http://example.org'
+	wherePath  fhirPath
+	whereValue interface{}
+}
+
+// parseFHIRPath parses expressions like Patient.name.where(use='official').given[0]
+func parseFHIRPath(expression string) (fhirPath, error) {
+	var path fhirPath
+	for _, segment := range splitOutsideQuotes(expression, '.') {
+		step, err := parseFHIRPathStep(strings.TrimSpace(segment))
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, step)
+	}
+	return path, nil
+}
+
+func parseFHIRPathStep(segment string) (fhirPathStep, error) {
+	step := fhirPathStep{index: -1}
+
+	// trailing indexer
+	if strings.HasSuffix(segment, "]") {
+		open := strings.LastIndex(segment, "[")
+		if open < 0 {
+			return step, fmt.Errorf("unmatched ] in %s", segment)
+		}
+		index, err := strconv.Atoi(segment[open+1 : len(segment)-1])
+		if err != nil || index < 0 {
+			return step, fmt.Errorf("invalid index in %s", segment)
+		}
+		step.index = index
+		segment = segment[:open]
+	}
+
+	switch {
+	case segment == "first()" || segment == "last()":
+		step.function = strings.TrimSuffix(segment, "()")
+	case strings.HasPrefix(segment, "where(") && strings.HasSuffix(segment, ")"):
+		step.function = "where"
+		criterion := splitOutsideQuotes(segment[len("where("):len(segment)-1], '=')
+		if len(criterion) != 2 {
+			return step, fmt.Errorf("only where() with a single equality is supported: %s", segment)
+		}
+		var err error
+		step.wherePath, err = parseFHIRPath(strings.TrimSpace(criterion[0]))
+		if err != nil {
+			return step, err
+		}
+		step.whereValue, err = parseFHIRPathLiteral(strings.TrimSpace(criterion[1]))
+		if err != nil {
+			return step, err
+		}
+	case isFHIRPathIdentifier(segment):
+		step.name = segment
+	default:
+		return step, fmt.Errorf("unsupported FHIRPath expression: %s", segment)
+	}
+	return step, nil
+}
+
+func isFHIRPathIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFHIRPathLiteral(literal string) (interface{}, error) {
+	switch {
+	case len(literal) >= 2 && strings.HasPrefix(literal, "'") && strings.HasSuffix(literal, "'"):
+		unescaped := strings.Replace(literal[1:len(literal)-1], `\'`, `'`, -1)
+		return strings.Replace(unescaped, `\\`, `\`, -1), nil
+	case literal == "true":
+		return true, nil
+	case literal == "false":
+		return false, nil
+	default:
+		if _, err := strconv.ParseFloat(literal, 64); err != nil {
+			return nil, fmt.Errorf("unsupported FHIRPath literal: %s", literal)
+		}
+		return json.Number(literal), nil
+	}
+}
+
+// splitOutsideQuotes splits s at each sep that isn't within quotes or parentheses
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '\'':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case s[i] == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// fhirPathNode is an element selected by a path, along with where it is stored so it can be changed
+type fhirPathNode struct {
+	value  interface{}
+	parent map[string]interface{} // nil for the resource itself
+	name   string
+	index  int          // index within parent[name], or -1 if it doesn't repeat
+	goType reflect.Type // type of the element in the models package, if known
+}
+
+func (n fhirPathNode) set(value interface{}) error {
+	if n.parent == nil {
+		return fmt.Errorf("cannot replace the whole resource")
+	}
+	if n.index < 0 {
+		n.parent[n.name] = value
+	} else {
+		n.parent[n.name].([]interface{})[n.index] = value
+	}
+	return nil
+}
+
+func (n fhirPathNode) remove() error {
+	if n.parent == nil {
+		return fmt.Errorf("cannot delete the whole resource")
+	}
+	if n.index < 0 {
+		delete(n.parent, n.name)
+		delete(n.parent, "_"+n.name) // extensions of primitives
+		return nil
+	}
+	list := n.parent[n.name].([]interface{})
+	list = append(list[:n.index], list[n.index+1:]...)
+	if len(list) == 0 {
+		delete(n.parent, n.name)
+	} else {
+		n.parent[n.name] = list
+	}
+	return nil
+}
+
+// childRepeats returns true if the named child element has a maximum cardinality greater than one
+func (n fhirPathNode) childRepeats(name string) bool {
+	if n.goType == nil {
+		return false
+	}
+	field, found := modelField(n.goType, name)
+	return found && field.Kind() == reflect.Slice
+}
+
+// modelField returns the type of the field of a models struct with the given JSON name
+func modelField(structType reflect.Type, jsonName string) (reflect.Type, bool) {
+	for structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Anonymous {
+			if fieldType, found := modelField(field.Type, jsonName); found {
+				return fieldType, true
+			}
+			continue
+		}
+		tagName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tagName == jsonName {
+			fieldType := field.Type
+			for fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			return fieldType, true
+		}
+	}
+	return nil, false
+}
+
+// elementType returns the type of the items of a slice type, or the type itself otherwise
+func elementType(t reflect.Type) reflect.Type {
+	if t != nil && t.Kind() == reflect.Slice {
+		t = t.Elem()
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	return t
+}
+
+// evaluate returns the elements of a resource selected by the path
+func (p fhirPath) evaluate(resource map[string]interface{}) ([]fhirPathNode, error) {
+	root := fhirPathNode{value: resource, index: -1}
+	resourceType, _ := resource["resourceType"].(string)
+	if model := models.StructForResourceName(resourceType); model != nil {
+		root.goType = reflect.TypeOf(model)
+	}
+
+	// paths normally start with the resource type, which selects the resource itself
+	if len(p) > 0 && p[0].name != "" && p[0].name == resourceType {
+		first := p[0]
+		first.name = ""
+		p = append(fhirPath{first}, p[1:]...)
+	}
+	return p.evaluateFrom([]fhirPathNode{root})
+}
+
+func (p fhirPath) evaluateFrom(nodes []fhirPathNode) ([]fhirPathNode, error) {
+	for _, step := range p {
+		var next []fhirPathNode
+		switch {
+		case step.name != "":
+			for _, node := range nodes {
+				next = append(next, node.children(step.name)...)
+			}
+		case step.function == "first":
+			next = nodes
+			if len(nodes) > 1 {
+				next = nodes[:1]
+			}
+		case step.function == "last":
+			next = nodes
+			if len(nodes) > 1 {
+				next = nodes[len(nodes)-1:]
+			}
+		case step.function == "where":
+			for _, node := range nodes {
+				matches, err := step.wherePath.evaluateFrom([]fhirPathNode{node})
+				if err != nil {
+					return nil, err
+				}
+				for _, match := range matches {
+					if jsonEqual(match.value, step.whereValue) {
+						next = append(next, node)
+						break
+					}
+				}
+			}
+		default:
+			// the resource type at the start of a path
+			next = nodes
+		}
+
+		if step.index >= 0 {
+			if step.index < len(next) {
+				next = next[step.index : step.index+1]
+			} else {
+				next = nil
+			}
+		}
+		nodes = next
+	}
+	return nodes, nil
+}
+
+// children returns the child elements with the given name, which may be that of a choice
+// element (e.g. value for valueQuantity)
+func (n fhirPathNode) children(name string) []fhirPathNode {
+	object, isObject := n.value.(map[string]interface{})
+	if !isObject {
+		return nil
+	}
+
+	var keys []string
+	if _, exists := object[name]; exists {
+		keys = []string{name}
+	} else {
+		for key := range object {
+			if len(key) > len(name) && strings.HasPrefix(key, name) && unicode.IsUpper(rune(key[len(name)])) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	var children []fhirPathNode
+	for _, key := range keys {
+		var goType reflect.Type
+		if n.goType != nil {
+			goType, _ = modelField(n.goType, key)
+		}
+		child := fhirPathNode{parent: object, name: key, index: -1, goType: elementType(goType)}
+		if list, isList := object[key].([]interface{}); isList {
+			for i, item := range list {
+				child.value = item
+				child.index = i
+				children = append(children, child)
+			}
+		} else {
+			child.value = object[key]
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// evaluateSingle returns the single element selected by the path
+func (p fhirPath) evaluateSingle(resource map[string]interface{}) (fhirPathNode, error) {
+	nodes, err := p.evaluate(resource)
+	if err != nil {
+		return fhirPathNode{}, err
+	}
+	if len(nodes) != 1 {
+		return fhirPathNode{}, fmt.Errorf("path refers to %d elements instead of one", len(nodes))
+	}
+	return nodes[0], nil
+}
+
+// evaluateList returns the element containing the list selected by the path, along with the list's name
+func (p fhirPath) evaluateList(resource map[string]interface{}) (parent map[string]interface{}, name string, err error) {
+	last := p[len(p)-1]
+	if last.name == "" || last.index >= 0 {
+		return nil, "", fmt.Errorf("path must end with the name of a list")
+	}
+	var container fhirPathNode
+	if len(p) == 1 {
+		container = fhirPathNode{value: resource}
+	} else {
+		container, err = p[:len(p)-1].evaluateSingle(resource)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	parent, isObject := container.value.(map[string]interface{})
+	if !isObject {
+		return nil, "", fmt.Errorf("path doesn't refer to a list")
+	}
+	if _, isList := parent[last.name].([]interface{}); !isList && parent[last.name] != nil {
+		return nil, "", fmt.Errorf("%s isn't a list", last.name)
+	}
+	return parent, last.name, nil
+}
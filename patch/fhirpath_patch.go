@@ -0,0 +1,272 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FHIRPathPatch is a FHIRPath Patch (http://hl7.org/fhir/fhirpatch.html) represented as a Parameters resource.
+//
+// Paths are restricted to a simple subset of FHIRPath: element names optionally followed by an index
+// (e.g. Patient.name[0].given), the first() and last() functions and where() with a single equality
+// criterion (e.g. Patient.identifier.where(system='http://example.org').value).
+type FHIRPathPatch []FHIRPathPatchOperation
+
+// FHIRPathPatchOperation is a single operation within a FHIRPath Patch
+type FHIRPathPatchOperation struct {
+	Type        string
+	Path        string
+	Name        string
+	Value       interface{}
+	Index       int
+	Source      int
+	Destination int
+}
+
+// ParseFHIRPathPatch parses and validates the JSON of a Parameters resource containing a FHIRPath Patch
+func ParseFHIRPathPatch(parametersJSON []byte) (FHIRPathPatch, error) {
+	decoded, err := decodeJSON(parametersJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIRPath Patch: %s", err)
+	}
+	parameters, isObject := decoded.(map[string]interface{})
+	if !isObject || parameters["resourceType"] != "Parameters" {
+		return nil, fmt.Errorf("FHIRPath Patch must be a Parameters resource")
+	}
+
+	var operations FHIRPathPatch
+	for i, parameter := range objectList(parameters["parameter"]) {
+		if parameter["name"] != "operation" {
+			return nil, fmt.Errorf("FHIRPath Patch parameter %d is not named operation", i)
+		}
+
+		op := FHIRPathPatchOperation{Index: -1, Source: -1, Destination: -1}
+		for _, part := range objectList(parameter["part"]) {
+			name, _ := part["name"].(string)
+			switch name {
+			case "type":
+				op.Type, _ = primitivePartValue(part).(string)
+			case "path":
+				op.Path, _ = primitivePartValue(part).(string)
+			case "name":
+				op.Name, _ = primitivePartValue(part).(string)
+			case "value":
+				op.Value = partValue(part)
+			case "index", "source", "destination":
+				number, isNumber := primitivePartValue(part).(json.Number)
+				value, err := strconv.Atoi(string(number))
+				if !isNumber || err != nil || value < 0 {
+					return nil, fmt.Errorf("FHIRPath Patch operation %d has an invalid %s", i, name)
+				}
+				switch name {
+				case "index":
+					op.Index = value
+				case "source":
+					op.Source = value
+				case "destination":
+					op.Destination = value
+				}
+			}
+		}
+
+		if op.Path == "" {
+			return nil, fmt.Errorf("FHIRPath Patch operation %d is missing a path", i)
+		}
+		if _, err := parseFHIRPath(op.Path); err != nil {
+			return nil, fmt.Errorf("FHIRPath Patch operation %d has an invalid path: %s", i, err)
+		}
+		missing := ""
+		switch op.Type {
+		case "add":
+			if op.Name == "" {
+				missing = "name"
+			} else if op.Value == nil {
+				missing = "value"
+			}
+		case "insert":
+			if op.Value == nil {
+				missing = "value"
+			} else if op.Index < 0 {
+				missing = "index"
+			}
+		case "replace":
+			if op.Value == nil {
+				missing = "value"
+			}
+		case "move":
+			if op.Source < 0 {
+				missing = "source"
+			} else if op.Destination < 0 {
+				missing = "destination"
+			}
+		case "delete":
+		default:
+			return nil, fmt.Errorf("FHIRPath Patch operation %d has an unknown type: %s", i, op.Type)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("FHIRPath Patch operation %d (%s) is missing a %s", i, op.Type, missing)
+		}
+
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// objectList returns the JSON objects within a JSON array
+func objectList(value interface{}) []map[string]interface{} {
+	items, _ := value.([]interface{})
+	objects := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if object, isObject := item.(map[string]interface{}); isObject {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
+
+// primitivePartValue returns the value[x] of a Parameters part, or nil if it doesn't have one
+func primitivePartValue(part map[string]interface{}) interface{} {
+	for key, value := range part {
+		if len(key) > len("value") && strings.HasPrefix(key, "value") && unicode.IsUpper(rune(key[len("value")])) {
+			return value
+		}
+	}
+	return nil
+}
+
+// partValue returns the value[x] of a Parameters part or, for complex values given as nested parts,
+// an object with a member for each part (parts with repeated names become arrays)
+func partValue(part map[string]interface{}) interface{} {
+	if value := primitivePartValue(part); value != nil {
+		return value
+	}
+	subParts := objectList(part["part"])
+	if len(subParts) == 0 {
+		return nil
+	}
+
+	object := make(map[string]interface{})
+	for _, subPart := range subParts {
+		name, _ := subPart["name"].(string)
+		value := partValue(subPart)
+		if name == "" || value == nil {
+			continue
+		}
+		switch existing := object[name].(type) {
+		case nil:
+			object[name] = value
+		case []interface{}:
+			object[name] = append(existing, value)
+		default:
+			object[name] = []interface{}{existing, value}
+		}
+	}
+	return object
+}
+
+// Apply applies the operations in order; the patch fails as a whole if any of them fails
+func (p FHIRPathPatch) Apply(resourceJSON []byte) ([]byte, error) {
+	decoded, err := decodeJSON(resourceJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode resource: %s", err)
+	}
+	resource, isObject := decoded.(map[string]interface{})
+	if !isObject {
+		return nil, fmt.Errorf("resource is not a JSON object")
+	}
+	before := deepCopy(resource).(map[string]interface{})
+
+	for i, op := range p {
+		err = op.apply(resource)
+		if err != nil {
+			return nil, errorf("FHIRPath Patch operation %d (%s %s) failed: %s", i, op.Type, op.Path, err)
+		}
+	}
+
+	if err := checkResourceUnchanged(before, resource); err != nil {
+		return nil, err
+	}
+	return encodeJSON(resource)
+}
+
+func (op FHIRPathPatchOperation) apply(resource map[string]interface{}) error {
+	path, _ := parseFHIRPath(op.Path)
+
+	switch op.Type {
+	case "add":
+		target, err := path.evaluateSingle(resource)
+		if err != nil {
+			return err
+		}
+		object, isObject := target.value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("path doesn't refer to an element that can have children")
+		}
+		value := deepCopy(op.Value)
+		existing, exists := object[op.Name]
+		if existingList, isList := existing.([]interface{}); isList {
+			object[op.Name] = append(existingList, value)
+		} else if exists {
+			return fmt.Errorf("%s already exists and doesn't repeat", op.Name)
+		} else if target.childRepeats(op.Name) {
+			object[op.Name] = []interface{}{value}
+		} else {
+			object[op.Name] = value
+		}
+		return nil
+
+	case "insert", "move":
+		parent, name, err := path.evaluateList(resource)
+		if err != nil {
+			return err
+		}
+		list, _ := parent[name].([]interface{})
+		if op.Type == "insert" {
+			if op.Index > len(list) {
+				return fmt.Errorf("index %d is out of bounds", op.Index)
+			}
+			list = append(list, nil)
+			copy(list[op.Index+1:], list[op.Index:])
+			list[op.Index] = deepCopy(op.Value)
+		} else {
+			if op.Source >= len(list) || op.Destination >= len(list) {
+				return fmt.Errorf("source or destination is out of bounds")
+			}
+			item := list[op.Source]
+			list = append(list[:op.Source], list[op.Source+1:]...)
+			list = append(list, nil)
+			copy(list[op.Destination+1:], list[op.Destination:])
+			list[op.Destination] = item
+		}
+		parent[name] = list
+		return nil
+
+	case "replace":
+		target, err := path.evaluateSingle(resource)
+		if err != nil {
+			return err
+		}
+		return target.set(deepCopy(op.Value))
+
+	case "delete":
+		targets, err := path.evaluate(resource)
+		if err != nil {
+			return err
+		}
+		switch len(targets) {
+		case 0:
+			// nothing to delete
+			return nil
+		case 1:
+			return targets[0].remove()
+		default:
+			return fmt.Errorf("path refers to %d elements", len(targets))
+		}
+
+	default:
+		return fmt.Errorf("unknown operation type")
+	}
+}
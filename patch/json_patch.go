@@ -0,0 +1,282 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPatch is a JSON Patch document (https://tools.ietf.org/html/rfc6902)
+type JSONPatch []JSONPatchOperation
+
+// JSONPatchOperation is a single operation within a JSON Patch document
+type JSONPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// ParseJSONPatch parses and validates a JSON Patch document
+func ParseJSONPatch(data []byte) (JSONPatch, error) {
+	var operations JSONPatch
+	err := json.Unmarshal(data, &operations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON Patch document: %s", err)
+	}
+
+	for i, op := range operations {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("JSON Patch operation %d (%s) is missing a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parseJSONPointer(op.From); err != nil {
+				return nil, fmt.Errorf("JSON Patch operation %d (%s) has an invalid from: %s", i, op.Op, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("JSON Patch operation %d has an unknown op: %s", i, op.Op)
+		}
+		if _, err := parseJSONPointer(op.Path); err != nil {
+			return nil, fmt.Errorf("JSON Patch operation %d (%s) has an invalid path: %s", i, op.Op, err)
+		}
+	}
+	return operations, nil
+}
+
+// Apply applies the operations in order; the patch fails as a whole if any of them fails
+func (p JSONPatch) Apply(resourceJSON []byte) ([]byte, error) {
+	doc, err := decodeJSON(resourceJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode resource: %s", err)
+	}
+	before, isObject := doc.(map[string]interface{})
+	if !isObject {
+		return nil, fmt.Errorf("resource is not a JSON object")
+	}
+	before = deepCopy(before).(map[string]interface{})
+
+	for i, op := range p {
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, errorf("JSON Patch operation %d (%s %s) failed: %s", i, op.Op, op.Path, err)
+		}
+	}
+
+	after, isObject := doc.(map[string]interface{})
+	if !isObject {
+		return nil, errorf("patched resource is not a JSON object")
+	}
+	if err := checkResourceUnchanged(before, after); err != nil {
+		return nil, err
+	}
+	return encodeJSON(after)
+}
+
+func (op JSONPatchOperation) value() (interface{}, error) {
+	return decodeJSON(*op.Value)
+}
+
+func (op JSONPatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, _ := parseJSONPointer(op.Path)
+	switch op.Op {
+	case "add":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parseJSONPointer(op.From)
+		if len(path) > len(from) && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move a value into one of its children")
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, _ := parseJSONPointer(op.From)
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(value))
+	case "test":
+		expected, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(expected, actual) {
+			return nil, fmt.Errorf("value differs")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op")
+	}
+}
+
+// parseJSONPointer splits a JSON Pointer (https://tools.ietf.org/html/rfc6901) into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON Pointer must start with /: %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses a reference token used to index an array of the given length
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index out of bounds: %d", index)
+	}
+	return index, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, exists := node[token]
+			if !exists {
+				return nil, fmt.Errorf("member %s doesn't exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("cannot index a primitive value with %s", token)
+		}
+	}
+	return doc, nil
+}
+
+// updateParent calls update with the container referenced by all but the last token of path, returning
+// the document with the container replaced by the one update returns (arrays may need to be reallocated)
+func updateParent(doc interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, exists := node[path[0]]
+		if !exists {
+			return nil, fmt.Errorf("member %s doesn't exist", path[0])
+		}
+		newChild, err := updateParent(child, path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = newChild
+		return node, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := updateParent(node[index], path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = newChild
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot index a primitive value with %s", path[0])
+	}
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		// replaces the whole document
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add to a primitive value")
+		}
+	})
+}
+
+func removeValue(doc interface{}, path []string) (newDoc interface{}, removed interface{}, err error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	newDoc, err = updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, exists := node[token]
+			if !exists {
+				return nil, fmt.Errorf("member %s doesn't exist", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove from a primitive value")
+		}
+	})
+	return
+}
@@ -0,0 +1,129 @@
+// Package patch implements the FHIR patch interaction (http://hl7.org/fhir/http.html#patch),
+// supporting both JSON Patch (RFC 6902) documents and FHIRPath Patch Parameters resources.
+// Patches operate on the JSON representation of a resource.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// JSONPatchContentType is the media type of JSON Patch documents
+const JSONPatchContentType = "application/json-patch+json"
+
+// Patch is a set of changes to a resource
+type Patch interface {
+	// Apply returns the JSON representation of the resource after applying the patch
+	Apply(resourceJSON []byte) ([]byte, error)
+}
+
+// Error indicates that a patch could not be applied to a resource, e.g. because a path
+// doesn't exist or a test operation failed (HTTP 422)
+type Error struct {
+	msg string
+}
+
+func (e Error) Error() string {
+	return e.msg
+}
+
+func errorf(format string, a ...interface{}) Error {
+	return Error{msg: fmt.Sprintf(format, a...)}
+}
+
+// decodeJSON decodes JSON into generic maps and slices, keeping numbers as json.Number
+// so that decimals don't lose precision
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// encodeJSON is the inverse of decodeJSON; it doesn't escape HTML characters
+func encodeJSON(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// deepCopy copies a value returned by decodeJSON
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// jsonEqual compares values returned by decodeJSON, treating numbers as equal if they have the same value
+func jsonEqual(a, b interface{}) bool {
+	switch va := a.(type) {
+	case json.Number:
+		vb, isNumber := b.(json.Number)
+		if !isNumber {
+			return false
+		}
+		fa, _, errA := big.ParseFloat(string(va), 10, 256, big.ToNearestEven)
+		fb, _, errB := big.ParseFloat(string(vb), 10, 256, big.ToNearestEven)
+		if errA != nil || errB != nil {
+			return va == vb
+		}
+		return fa.Cmp(fb) == 0
+	case map[string]interface{}:
+		vb, isMap := b.(map[string]interface{})
+		if !isMap || len(va) != len(vb) {
+			return false
+		}
+		for key, item := range va {
+			other, exists := vb[key]
+			if !exists || !jsonEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		vb, isSlice := b.([]interface{})
+		if !isSlice || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !jsonEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// checkResourceUnchanged returns an error if a patch changed the type or id of a resource
+func checkResourceUnchanged(before, after map[string]interface{}) error {
+	for _, key := range []string{"resourceType", "id"} {
+		if !jsonEqual(before[key], after[key]) {
+			return errorf("patch must not change the %s of a resource", key)
+		}
+	}
+	return nil
+}
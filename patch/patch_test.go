@@ -0,0 +1,127 @@
+package patch
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PatchSuite struct{}
+
+var _ = Suite(&PatchSuite{})
+
+const testPatient = `{"resourceType":"Patient","id":"p1","active":true,"birthDate":"1934-06-09","name":[{"use":"official","family":"Duck","given":["Donald"]},{"use":"nickname","given":["Don"]}],"identifier":[{"system":"http://example.org/mrn","value":"123"}],"extension":[{"url":"http://example.org/weight","valueDecimal":10.10}]}`
+
+func applyJSONPatch(c *C, patchJSON string) (string, error) {
+	p, err := ParseJSONPatch([]byte(patchJSON))
+	c.Assert(err, IsNil)
+	result, err := p.Apply([]byte(testPatient))
+	return string(result), err
+}
+
+func applyFHIRPathPatch(c *C, parametersJSON string) (string, error) {
+	p, err := ParseFHIRPathPatch([]byte(parametersJSON))
+	c.Assert(err, IsNil)
+	result, err := p.Apply([]byte(testPatient))
+	return string(result), err
+}
+
+func fhirPathOperation(parts string) string {
+	return `{"resourceType":"Parameters","parameter":[{"name":"operation","part":[` + parts + `]}]}`
+}
+
+func (s *PatchSuite) TestJSONPatchOperations(c *C) {
+	result, err := applyJSONPatch(c, `[
+		{"op":"test","path":"/name/0/family","value":"Duck"},
+		{"op":"replace","path":"/active","value":false},
+		{"op":"add","path":"/name/0/given/-","value":"Fauntleroy"},
+		{"op":"remove","path":"/name/1"},
+		{"op":"copy","from":"/birthDate","path":"/deceasedDateTime"},
+		{"op":"move","from":"/identifier","path":"/otherIdentifier"}
+	]`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, `{"active":false,"birthDate":"1934-06-09","deceasedDateTime":"1934-06-09","extension":[{"url":"http://example.org/weight","valueDecimal":10.10}],"id":"p1","name":[{"family":"Duck","given":["Donald","Fauntleroy"],"use":"official"}],"otherIdentifier":[{"system":"http://example.org/mrn","value":"123"}],"resourceType":"Patient"}`)
+}
+
+func (s *PatchSuite) TestJSONPatchFailures(c *C) {
+	_, err := applyJSONPatch(c, `[{"op":"test","path":"/name/0/family","value":"Mouse"}]`)
+	c.Assert(err, FitsTypeOf, Error{})
+	_, err = applyJSONPatch(c, `[{"op":"remove","path":"/gender"}]`)
+	c.Assert(err, FitsTypeOf, Error{})
+	_, err = applyJSONPatch(c, `[{"op":"add","path":"/name/5","value":{}}]`)
+	c.Assert(err, FitsTypeOf, Error{})
+	_, err = applyJSONPatch(c, `[{"op":"replace","path":"/id","value":"p2"}]`)
+	c.Assert(err, FitsTypeOf, Error{})
+
+	// numbers are compared by value
+	_, err = applyJSONPatch(c, `[{"op":"test","path":"/extension/0/valueDecimal","value":10.1}]`)
+	c.Assert(err, IsNil)
+
+	_, err = ParseJSONPatch([]byte(`[{"op":"frobnicate","path":"/active"}]`))
+	c.Assert(err, ErrorMatches, ".*unknown op.*")
+	_, err = ParseJSONPatch([]byte(`[{"op":"add","path":"active","value":true}]`))
+	c.Assert(err, ErrorMatches, ".*invalid path.*")
+	_, err = ParseJSONPatch([]byte(`{"op":"add"}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *PatchSuite) TestFHIRPathPatchReplaceAndDelete(c *C) {
+	result, err := applyFHIRPathPatch(c, `{"resourceType":"Parameters","parameter":[
+		{"name":"operation","part":[{"name":"type","valueCode":"replace"},{"name":"path","valueString":"Patient.birthDate"},{"name":"value","valueDate":"1934-06-10"}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.name.where(use='nickname')"}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.active"}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.gender"}]}
+	]}`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, `{"birthDate":"1934-06-10","extension":[{"url":"http://example.org/weight","valueDecimal":10.10}],"id":"p1","identifier":[{"system":"http://example.org/mrn","value":"123"}],"name":[{"family":"Duck","given":["Donald"],"use":"official"}],"resourceType":"Patient"}`)
+}
+
+func (s *PatchSuite) TestFHIRPathPatchAdd(c *C) {
+	// gender doesn't repeat, telecom does
+	result, err := applyFHIRPathPatch(c, `{"resourceType":"Parameters","parameter":[
+		{"name":"operation","part":[{"name":"type","valueCode":"add"},{"name":"path","valueString":"Patient"},{"name":"name","valueString":"gender"},{"name":"value","valueCode":"male"}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"add"},{"name":"path","valueString":"Patient"},{"name":"name","valueString":"telecom"},{"name":"value","part":[{"name":"system","valueCode":"phone"},{"name":"value","valueString":"555"}]}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"add"},{"name":"path","valueString":"Patient.name[0]"},{"name":"name","valueString":"given"},{"name":"value","valueString":"Fauntleroy"}]}
+	]}`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Matches, `.*"gender":"male".*`)
+	c.Assert(result, Matches, `.*"telecom":\[\{"system":"phone","value":"555"\}\].*`)
+	c.Assert(result, Matches, `.*"given":\["Donald","Fauntleroy"\].*`)
+
+	_, err = applyFHIRPathPatch(c, fhirPathOperation(`{"name":"type","valueCode":"add"},{"name":"path","valueString":"Patient"},{"name":"name","valueString":"birthDate"},{"name":"value","valueDate":"2000-01-01"}`))
+	c.Assert(err, ErrorMatches, ".*already exists.*")
+}
+
+func (s *PatchSuite) TestFHIRPathPatchInsertAndMove(c *C) {
+	result, err := applyFHIRPathPatch(c, `{"resourceType":"Parameters","parameter":[
+		{"name":"operation","part":[{"name":"type","valueCode":"insert"},{"name":"path","valueString":"Patient.name.first().given"},{"name":"index","valueInteger":0},{"name":"value","valueString":"Mr"}]},
+		{"name":"operation","part":[{"name":"type","valueCode":"move"},{"name":"path","valueString":"Patient.name"},{"name":"source","valueInteger":1},{"name":"destination","valueInteger":0}]}
+	]}`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Matches, `.*"name":\[\{"given":\["Don"\],"use":"nickname"\},\{"family":"Duck","given":\["Mr","Donald"\],"use":"official"\}\].*`)
+
+	_, err = applyFHIRPathPatch(c, fhirPathOperation(`{"name":"type","valueCode":"insert"},{"name":"path","valueString":"Patient.name"},{"name":"index","valueInteger":5},{"name":"value","valueString":"x"}`))
+	c.Assert(err, FitsTypeOf, Error{})
+}
+
+func (s *PatchSuite) TestFHIRPathPatchReplaceNeedsSingleMatch(c *C) {
+	_, err := applyFHIRPathPatch(c, fhirPathOperation(`{"name":"type","valueCode":"replace"},{"name":"path","valueString":"Patient.name.use"},{"name":"value","valueCode":"old"}`))
+	c.Assert(err, ErrorMatches, ".*refers to 2 elements.*")
+
+	result, err := applyFHIRPathPatch(c, fhirPathOperation(`{"name":"type","valueCode":"replace"},{"name":"path","valueString":"Patient.identifier.where(system='http://example.org/mrn').value"},{"name":"value","valueString":"456"}`))
+	c.Assert(err, IsNil)
+	c.Assert(result, Matches, `.*"value":"456".*`)
+}
+
+func (s *PatchSuite) TestParseFHIRPathPatchErrors(c *C) {
+	_, err := ParseFHIRPathPatch([]byte(`{"resourceType":"Patient"}`))
+	c.Assert(err, NotNil)
+	_, err = ParseFHIRPathPatch([]byte(fhirPathOperation(`{"name":"type","valueCode":"upsert"},{"name":"path","valueString":"Patient.active"}`)))
+	c.Assert(err, ErrorMatches, ".*unknown type.*")
+	_, err = ParseFHIRPathPatch([]byte(fhirPathOperation(`{"name":"type","valueCode":"replace"},{"name":"path","valueString":"Patient.active"}`)))
+	c.Assert(err, ErrorMatches, ".*missing a value.*")
+	_, err = ParseFHIRPathPatch([]byte(fhirPathOperation(`{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.name.select(given)"}`)))
+	c.Assert(err, ErrorMatches, ".*invalid path.*")
+}
@@ -0,0 +1,144 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CompartmentDefParam stands for the resource that defines a compartment in CompartmentDefinitions
+const CompartmentDefParam = "{def}"
+
+// CompartmentDefinitions gives the search parameters that put resources in the Patient and Encounter
+// compartments, from the STU3 CompartmentDefinitions (http://hl7.org/fhir/STU3/compartmentdefinition.html).
+// A resource is in the compartment of e.g. Patient/123 if any of these parameters refer to Patient/123.
+var CompartmentDefinitions = map[string]map[string][]string{
+	"Patient": map[string][]string{
+		"Account":                    []string{"subject"},
+		"AdverseEvent":               []string{"subject"},
+		"AllergyIntolerance":         []string{"patient", "recorder", "asserter"},
+		"Appointment":                []string{"actor"},
+		"AppointmentResponse":        []string{"actor"},
+		"AuditEvent":                 []string{"patient"},
+		"Basic":                      []string{"patient", "author"},
+		"BodySite":                   []string{"patient"},
+		"CarePlan":                   []string{"patient", "performer"},
+		"CareTeam":                   []string{"patient", "participant"},
+		"ChargeItem":                 []string{"subject"},
+		"Claim":                      []string{"patient", "payee"},
+		"ClaimResponse":              []string{"patient"},
+		"ClinicalImpression":         []string{"subject"},
+		"Communication":              []string{"subject", "sender", "recipient"},
+		"CommunicationRequest":       []string{"subject", "sender", "recipient", "requester"},
+		"Composition":                []string{"subject", "author", "attester"},
+		"Condition":                  []string{"patient", "asserter"},
+		"Consent":                    []string{"patient"},
+		"Coverage":                   []string{"policy-holder", "subscriber", "beneficiary", "payor"},
+		"DetectedIssue":              []string{"patient"},
+		"DeviceRequest":              []string{"subject", "performer"},
+		"DeviceUseStatement":         []string{"subject"},
+		"DiagnosticReport":           []string{"subject"},
+		"DocumentManifest":           []string{"subject", "author", "recipient"},
+		"DocumentReference":          []string{"subject", "author"},
+		"EligibilityRequest":         []string{"patient"},
+		"Encounter":                  []string{"patient"},
+		"EnrollmentRequest":          []string{"subject"},
+		"EpisodeOfCare":              []string{"patient"},
+		"ExplanationOfBenefit":       []string{"patient", "payee"},
+		"FamilyMemberHistory":        []string{"patient"},
+		"Flag":                       []string{"patient"},
+		"Goal":                       []string{"patient"},
+		"Group":                      []string{"member"},
+		"ImagingManifest":            []string{"patient", "author"},
+		"ImagingStudy":               []string{"patient"},
+		"Immunization":               []string{"patient"},
+		"ImmunizationRecommendation": []string{"patient"},
+		"List":                       []string{"subject", "source"},
+		"MeasureReport":              []string{"patient"},
+		"Media":                      []string{"subject"},
+		"MedicationAdministration":   []string{"patient", "performer", "subject"},
+		"MedicationDispense":         []string{"subject", "patient", "receiver"},
+		"MedicationRequest":          []string{"subject"},
+		"MedicationStatement":        []string{"subject"},
+		"NutritionOrder":             []string{"patient"},
+		"Observation":                []string{"subject", "performer"},
+		"Patient":                    []string{"{def}", "link"},
+		"Person":                     []string{"patient"},
+		"Procedure":                  []string{"patient", "performer"},
+		"ProcedureRequest":           []string{"subject", "performer"},
+		"Provenance":                 []string{"patient"},
+		"QuestionnaireResponse":      []string{"subject", "author"},
+		"ReferralRequest":            []string{"patient", "requester"},
+		"RelatedPerson":              []string{"patient"},
+		"RequestGroup":               []string{"subject", "participant"},
+		"ResearchSubject":            []string{"individual"},
+		"RiskAssessment":             []string{"subject"},
+		"Schedule":                   []string{"actor"},
+		"Specimen":                   []string{"subject"},
+		"SupplyDelivery":             []string{"patient"},
+		"SupplyRequest":              []string{"requester"},
+		"VisionPrescription":         []string{"patient"},
+	},
+	"Encounter": map[string][]string{
+		"CarePlan":                 []string{"context"},
+		"CareTeam":                 []string{"context"},
+		"ChargeItem":               []string{"context"},
+		"Claim":                    []string{"encounter"},
+		"ClinicalImpression":       []string{"context"},
+		"Communication":            []string{"context"},
+		"CommunicationRequest":     []string{"context"},
+		"Composition":              []string{"encounter"},
+		"Condition":                []string{"context"},
+		"DeviceRequest":            []string{"encounter"},
+		"DiagnosticReport":         []string{"context"},
+		"DocumentManifest":         []string{"related-ref"},
+		"DocumentReference":        []string{"encounter"},
+		"Encounter":                []string{"{def}"},
+		"ExplanationOfBenefit":     []string{"encounter"},
+		"ImagingStudy":             []string{"context"},
+		"List":                     []string{"encounter"},
+		"Media":                    []string{"context"},
+		"MedicationAdministration": []string{"context"},
+		"MedicationRequest":        []string{"context"},
+		"NutritionOrder":           []string{"encounter"},
+		"Observation":              []string{"context"},
+		"Procedure":                []string{"context"},
+		"ProcedureRequest":         []string{"context"},
+		"QuestionnaireResponse":    []string{"context"},
+		"RequestGroup":             []string{"context"},
+		"RiskAssessment":           []string{"encounter"},
+		"VisionPrescription":       []string{"encounter"},
+	},
+}
+
+// CompartmentResourceTypes returns the resource types that can be in a compartment, starting with the
+// compartment's own type
+func CompartmentResourceTypes(compartment string) []string {
+	var resourceTypes []string
+	for resourceType := range CompartmentDefinitions[compartment] {
+		if resourceType != compartment {
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+	sort.Strings(resourceTypes)
+	if _, ok := CompartmentDefinitions[compartment][compartment]; ok {
+		resourceTypes = append([]string{compartment}, resourceTypes...)
+	}
+	return resourceTypes
+}
+
+// CompartmentFilter returns a _filter expression that matches the resources of a type that are in the
+// compartments of the given ids, or an empty string if the resource type can't be in the compartment
+func CompartmentFilter(compartment string, resourceType string, ids []string) string {
+	var comparisons []string
+	for _, param := range CompartmentDefinitions[compartment][resourceType] {
+		for _, id := range ids {
+			if param == CompartmentDefParam {
+				comparisons = append(comparisons, fmt.Sprintf("%s eq \"%s\"", IDParam, id))
+			} else {
+				comparisons = append(comparisons, fmt.Sprintf("%s eq \"%s/%s\"", param, compartment, id))
+			}
+		}
+	}
+	return strings.Join(comparisons, " or ")
+}
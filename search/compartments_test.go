@@ -0,0 +1,55 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type CompartmentSuite struct{}
+
+var _ = Suite(&CompartmentSuite{})
+
+func (s *CompartmentSuite) TestCompartmentDefinitionsUseReferenceParameters(c *C) {
+	for compartment, resourceTypes := range CompartmentDefinitions {
+		for resourceType, params := range resourceTypes {
+			for _, param := range params {
+				if param == CompartmentDefParam {
+					c.Assert(resourceType, Equals, compartment)
+					continue
+				}
+				info, ok := SearchParameterDictionary[resourceType][param]
+				c.Assert(ok, Equals, true, Commentf("%s.%s", resourceType, param))
+				c.Assert(info.Type, Equals, "reference", Commentf("%s.%s", resourceType, param))
+				if len(info.Targets) > 0 && !contains(info.Targets, "Any") {
+					c.Assert(contains(info.Targets, compartment), Equals, true, Commentf("%s.%s", resourceType, param))
+				}
+			}
+		}
+	}
+}
+
+func (s *CompartmentSuite) TestCompartmentResourceTypes(c *C) {
+	resourceTypes := CompartmentResourceTypes("Patient")
+	c.Assert(resourceTypes[0], Equals, "Patient")
+	c.Assert(contains(resourceTypes, "Observation"), Equals, true)
+	c.Assert(contains(resourceTypes, "Practitioner"), Equals, false)
+
+	resourceTypes = CompartmentResourceTypes("Encounter")
+	c.Assert(resourceTypes[0], Equals, "Encounter")
+	c.Assert(contains(resourceTypes, "Patient"), Equals, false)
+
+	c.Assert(CompartmentResourceTypes("Practitioner"), HasLen, 0)
+}
+
+func (s *CompartmentSuite) TestCompartmentFilter(c *C) {
+	c.Assert(CompartmentFilter("Patient", "Observation", []string{"123"}), Equals, `subject eq "Patient/123" or performer eq "Patient/123"`)
+	c.Assert(CompartmentFilter("Patient", "Patient", []string{"123"}), Equals, `_id eq "123" or link eq "Patient/123"`)
+	c.Assert(CompartmentFilter("Encounter", "Observation", []string{"e1", "e2"}), Equals, `context eq "Encounter/e1" or context eq "Encounter/e2"`)
+	c.Assert(CompartmentFilter("Encounter", "Patient", []string{"e1"}), Equals, "")
+	c.Assert(CompartmentFilter("Patient", "Observation", nil), Equals, "")
+
+	// the filters are valid _filter expressions
+	for _, resourceType := range CompartmentResourceTypes("Patient") {
+		_, err := ParseFilterExpression(resourceType, CompartmentFilter("Patient", resourceType, []string{"123"}))
+		c.Assert(err, IsNil, Commentf(resourceType))
+	}
+}
@@ -0,0 +1,67 @@
+package search
+
+// compositeSearchParameters are the STU3 composite search parameters, which are missing from the
+// generated SearchParameterDictionary. Composites refer to the parameters whose values make up
+// the composite value, in order.
+var compositeSearchParameters = []SearchParamInfo{
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "code-value-quantity",
+		Type:       "composite",
+		Composites: []string{"code", "value-quantity"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "code-value-concept",
+		Type:       "composite",
+		Composites: []string{"code", "value-concept"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "code-value-date",
+		Type:       "composite",
+		Composites: []string{"code", "value-date"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "code-value-string",
+		Type:       "composite",
+		Composites: []string{"code", "value-string"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "component-code-value-quantity",
+		Type:       "composite",
+		Composites: []string{"component-code", "component-value-quantity"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "component-code-value-concept",
+		Type:       "composite",
+		Composites: []string{"component-code", "component-value-concept"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "combo-code-value-quantity",
+		Type:       "composite",
+		Composites: []string{"combo-code", "combo-value-quantity"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "combo-code-value-concept",
+		Type:       "composite",
+		Composites: []string{"combo-code", "combo-value-concept"},
+	},
+	SearchParamInfo{
+		Resource:   "Observation",
+		Name:       "related",
+		Type:       "composite",
+		Composites: []string{"related-target", "related-type"},
+	},
+}
+
+func init() {
+	for _, info := range compositeSearchParameters {
+		SearchParameterDictionary[info.Resource][info.Name] = info
+	}
+}
@@ -0,0 +1,142 @@
+package search
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PageCursor marks the position of the last resource on a page of search results, so that the
+// next page can be found with a range query on the sort keys rather than by skipping over all the
+// preceding results. Values holds the resource's value for each of the query's sort options, and
+// ID its resource id, which is used as the final tiebreaker.
+type PageCursor struct {
+	Values []interface{}
+	ID     string
+}
+
+// NewPageCursor creates a cursor positioned after the given resource, which must be the last
+// result of a search run with the given options. A nil cursor is returned if the results cannot
+// be paged by cursor, which is the case when sorting on a path that crosses an array, as MongoDB
+// then sorts on the smallest (or largest) element rather than on a single value. It is also the
+// case for searches with _summary or _elements, as the sort values may not have been returned,
+// and when sorting by the relevance of a full-text search or by distance.
+func NewPageCursor(resource *models2.Resource, options *QueryOptions) (*PageCursor, error) {
+	if options.ElementsProjection(resource.ResourceType()) != nil {
+		return nil, nil
+	}
+	for _, sort := range options.Sort {
+		if strings.Contains(sort.Parameter.Paths[0].Path, "[]") || sort.Parameter.Type == "score" || sort.Parameter.Type == "distance" {
+			return nil, nil
+		}
+	}
+
+	doc, err := resource.GetBSON()
+	if err != nil {
+		return nil, err
+	}
+	elems, _ := cursorDocElems(doc)
+
+	cursor := &PageCursor{ID: resource.Id(), Values: make([]interface{}, len(options.Sort))}
+	for i, sort := range options.Sort {
+		field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
+		cursor.Values[i] = lookupCursorValue(elems, strings.Split(field, "."))
+	}
+	return cursor, nil
+}
+
+// ParsePageCursor decodes a cursor from its opaque token
+func ParsePageCursor(token string) (*PageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding into a bson.D preserves the field order of embedded documents (such as the
+	// __from/__to ranges of dates), which MongoDB needs when comparing them.
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	cursor := &PageCursor{}
+	foundID := false
+	for _, elem := range doc {
+		switch elem.Name {
+		case "v":
+			values, ok := elem.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cursor values are a %T", elem.Value)
+			}
+			cursor.Values = values
+		case "id":
+			cursor.ID, foundID = elem.Value.(string)
+		}
+	}
+	if !foundID {
+		return nil, fmt.Errorf("cursor has no id")
+	}
+	return cursor, nil
+}
+
+// Token encodes the cursor as an opaque string suitable for use in a URL
+func (c *PageCursor) Token() string {
+	values := c.Values
+	if values == nil {
+		values = []interface{}{}
+	}
+	data, err := bson.Marshal(bson.D{bson.DocElem{Name: "v", Value: values}, bson.DocElem{Name: "id", Value: c.ID}})
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// lookupCursorValue finds the value at a (dotted) field path in a resource's BSON representation,
+// returning nil if it isn't present
+func lookupCursorValue(elems []bson.DocElem, field []string) interface{} {
+	for _, elem := range elems {
+		if elem.Name != field[0] {
+			continue
+		}
+		embedded, isDoc := cursorDocElems(elem.Value)
+		if len(field) == 1 {
+			if isDoc {
+				return bson.D(embedded)
+			}
+			return elem.Value
+		}
+		if isDoc {
+			return lookupCursorValue(embedded, field[1:])
+		}
+		// a specific array index, e.g. name.0.family
+		array, isArray := elem.Value.([]interface{})
+		index, err := strconv.Atoi(field[1])
+		if !isArray || err != nil || index < 0 || index >= len(array) {
+			return nil
+		}
+		if len(field) == 2 {
+			return array[index]
+		}
+		if embedded, isDoc := cursorDocElems(array[index]); isDoc {
+			return lookupCursorValue(embedded, field[2:])
+		}
+		return nil
+	}
+	return nil
+}
+
+func cursorDocElems(value interface{}) ([]bson.DocElem, bool) {
+	switch value := value.(type) {
+	case []bson.DocElem:
+		return value, true
+	case bson.D:
+		return value, true
+	case *[]bson.DocElem:
+		return *value, true
+	}
+	return nil, false
+}
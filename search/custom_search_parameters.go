@@ -0,0 +1,569 @@
+package search
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CustomSearchParameter is a search parameter defined at runtime by a SearchParameter resource. Its
+// values are extracted from resources when they are stored, into the models2.SearchIndexField of their
+// BSON, and searches match against those values. Resources stored before the parameter was registered
+// need to be reindexed for their values to be found.
+type CustomSearchParameter struct {
+	ID      string // the id of the SearchParameter resource
+	Code    string
+	Type    string
+	Base    []string
+	Targets []string
+
+	paths []customSearchPath
+}
+
+type customSearchPath struct {
+	Resource string
+	Steps    []customSearchStep
+}
+
+// customSearchStep selects the children of an element (or of a resource, for the first step)
+type customSearchStep struct {
+	Element      string
+	ExtensionURL string            // for extension elements, the url of the extensions to select
+	TypeFilter   string            // restricts the element to values of this type, e.g. with as(Quantity)
+	Names        map[string]string // the JSON names of the element, with the type of each
+}
+
+// customSearchParameterTypes are the types of the values that can be searched with each type of search
+// parameter
+var customSearchParameterTypes = map[string][]string{
+	"date":      {"date", "dateTime", "instant", "Period", "Timing"},
+	"number":    {"decimal", "integer", "positiveInt", "unsignedInt"},
+	"quantity":  {"Quantity", "Age", "Count", "Distance", "Duration", "Money", "SimpleQuantity"},
+	"reference": {"Reference"},
+	"string":    {"string", "markdown", "HumanName", "Address"},
+	"token":     {"boolean", "code", "id", "string", "Coding", "CodeableConcept", "Identifier", "ContactPoint"},
+	"uri":       {"uri", "oid"},
+}
+
+// customSearchIndexKeys are the fields that are indexed for each type of value, relative to the value.
+// Names and addresses are matched on several fields at once, which a single index can't help with.
+var customSearchIndexKeys = map[string][]string{
+	"date":            {"__from", "__to"},
+	"dateTime":        {"__from", "__to"},
+	"instant":         {""},
+	"Period":          {"start.__from", "end.__to"},
+	"Timing":          {"event.__from", "event.__to"},
+	"decimal":         {"__from", "__to"},
+	"integer":         {""},
+	"positiveInt":     {""},
+	"unsignedInt":     {""},
+	"Quantity":        {"code", "value.__from"},
+	"Age":             {"code", "value.__from"},
+	"Count":           {"code", "value.__from"},
+	"Distance":        {"code", "value.__from"},
+	"Duration":        {"code", "value.__from"},
+	"Money":           {"code", "value.__from"},
+	"SimpleQuantity":  {"code", "value.__from"},
+	"Reference":       {"reference__id", "reference__type"},
+	"string":          {""},
+	"markdown":        {""},
+	"boolean":         {""},
+	"code":            {""},
+	"id":              {""},
+	"uri":             {""},
+	"oid":             {""},
+	"Coding":          {"code", "system"},
+	"CodeableConcept": {"coding.code", "coding.system"},
+	"Identifier":      {"value", "system"},
+	"ContactPoint":    {"value"},
+}
+
+var customSearchParameters = make(map[string]*CustomSearchParameter)
+var customSearchParametersLock sync.RWMutex
+
+func init() {
+	models2.SearchIndexer = SearchIndex
+}
+
+var customSearchCodeRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9\-_]*$`)
+
+// NewCustomSearchParameter checks the definition of a custom search parameter in a SearchParameter
+// resource with the given id, returning an error if it isn't supported or conflicts with another search
+// parameter. The expression (or, failing that, the xpath) is limited to unions of paths through
+// elements, such as "Patient.extension('http://example.org/birthPlace').value | Patient.address.city".
+func NewCustomSearchParameter(id string, definition *models.SearchParameter) (*CustomSearchParameter, error) {
+	if !customSearchCodeRegex.MatchString(definition.Code) {
+		return nil, fmt.Errorf("SearchParameter code \"%s\" is invalid", definition.Code)
+	}
+	if _, supported := customSearchParameterTypes[definition.Type]; !supported {
+		return nil, fmt.Errorf("SearchParameter type \"%s\" is not supported", definition.Type)
+	}
+	if len(definition.Base) == 0 {
+		return nil, fmt.Errorf("SearchParameter must have a base")
+	}
+
+	var paths []customSearchPath
+	var err error
+	switch {
+	case definition.Expression != "":
+		paths, err = parseCustomSearchExpression(definition.Expression)
+	case definition.Xpath != "":
+		paths, err = parseCustomSearchXPath(definition.Xpath)
+	default:
+		err = fmt.Errorf("SearchParameter must have an expression")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	param := &CustomSearchParameter{
+		ID:      id,
+		Code:    definition.Code,
+		Type:    definition.Type,
+		Base:    definition.Base,
+		Targets: definition.Target,
+		paths:   paths,
+	}
+	for _, path := range paths {
+		if !contains(param.Base, path.Resource) {
+			return nil, fmt.Errorf("SearchParameter expression refers to %s, which isn't a base", path.Resource)
+		}
+	}
+
+	customSearchParametersLock.RLock()
+	defer customSearchParametersLock.RUnlock()
+	for _, resource := range param.Base {
+		if _, known := SearchParameterDictionary[resource]; !known {
+			return nil, fmt.Errorf("SearchParameter base %s is not a known resource type", resource)
+		}
+		if len(param.paramInfo(resource).Paths) == 0 {
+			return nil, fmt.Errorf("SearchParameter expression doesn't select any %s values of %s resources", param.Type, resource)
+		}
+		if err := param.checkConflicts(resource); err != nil {
+			return nil, err
+		}
+	}
+	return param, nil
+}
+
+// checkConflicts returns an error if the parameter's code is already used by another search parameter
+func (p *CustomSearchParameter) checkConflicts(resource string) error {
+	if _, defined := SearchParameterDictionary[resource][p.Code]; !defined {
+		return nil
+	}
+	for id, other := range customSearchParameters {
+		if other.Code == p.Code && contains(other.Base, resource) {
+			if id == p.ID {
+				return nil
+			}
+			return fmt.Errorf("Search parameter \"%s\" of %s is already defined by SearchParameter/%s", p.Code, resource, id)
+		}
+	}
+	return fmt.Errorf("Search parameter \"%s\" of %s is already defined", p.Code, resource)
+}
+
+// RegisterCustomSearchParameter registers a custom search parameter, replacing any earlier version of it
+func RegisterCustomSearchParameter(p *CustomSearchParameter) error {
+	customSearchParametersLock.Lock()
+	defer customSearchParametersLock.Unlock()
+
+	for _, resource := range p.Base {
+		if err := p.checkConflicts(resource); err != nil {
+			return err
+		}
+	}
+	if previous, registered := customSearchParameters[p.ID]; registered {
+		previous.unregister()
+	}
+	for _, resource := range p.Base {
+		GlobalRegistry().RegisterParameterInfo(p.paramInfo(resource))
+	}
+	customSearchParameters[p.ID] = p
+	return nil
+}
+
+// UnregisterCustomSearchParameter removes the custom search parameter defined by the SearchParameter
+// with the given id, if there is one
+func UnregisterCustomSearchParameter(id string) {
+	customSearchParametersLock.Lock()
+	defer customSearchParametersLock.Unlock()
+
+	if p, registered := customSearchParameters[id]; registered {
+		p.unregister()
+		delete(customSearchParameters, id)
+	}
+}
+
+func (p *CustomSearchParameter) unregister() {
+	for _, resource := range p.Base {
+		GlobalRegistry().UnregisterParameterInfo(resource, p.Code)
+	}
+}
+
+// CustomSearchParameterResourceTypes returns the resource types that custom search parameters apply to
+func CustomSearchParameterResourceTypes() []string {
+	customSearchParametersLock.RLock()
+	defer customSearchParametersLock.RUnlock()
+
+	var resourceTypes []string
+	for _, p := range customSearchParameters {
+		for _, resource := range p.Base {
+			if !contains(resourceTypes, resource) {
+				resourceTypes = append(resourceTypes, resource)
+			}
+		}
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// paramInfo returns the SearchParamInfo of the parameter for a resource type, which has a path into the
+// search index for each type of value that the parameter's expression selects
+func (p *CustomSearchParameter) paramInfo(resource string) SearchParamInfo {
+	info := SearchParamInfo{
+		Resource: resource,
+		Name:     p.Code,
+		Type:     p.Type,
+		Targets:  p.Targets,
+	}
+	for _, valueType := range p.valueTypes(resource) {
+		info.Paths = append(info.Paths, SearchParamPath{
+			Path: fmt.Sprintf("%s.%s.[]%s", models2.SearchIndexField, p.Code, valueType),
+			Type: valueType,
+		})
+	}
+	return info
+}
+
+// valueTypes returns the searchable types of the values the parameter's expression selects from a
+// resource type
+func (p *CustomSearchParameter) valueTypes(resource string) []string {
+	var valueTypes []string
+	for _, valueType := range customSearchParameterTypes[p.Type] {
+		for _, path := range p.paths {
+			if path.Resource == resource && path.selects(valueType) {
+				valueTypes = append(valueTypes, valueType)
+				break
+			}
+		}
+	}
+	return valueTypes
+}
+
+// IndexSpecs returns the MongoDB indexes that searches with the parameter need, in the format of
+// indexes.conf (<collection_name>.<key>_1 or <collection_name>.(<key1>_1, <key2>_1, ...))
+func (p *CustomSearchParameter) IndexSpecs() []string {
+	var specs []string
+	for _, resource := range p.Base {
+		collection := models.PluralizeLowerResourceName(resource)
+		for _, valueType := range p.valueTypes(resource) {
+			field := fmt.Sprintf("%s.%s.%s", models2.SearchIndexField, p.Code, valueType)
+			var keys []string
+			for _, key := range customSearchIndexKeys[valueType] {
+				if key == "" {
+					keys = append(keys, field+"_1")
+				} else {
+					keys = append(keys, field+"."+key+"_1")
+				}
+			}
+			switch len(keys) {
+			case 0:
+			case 1:
+				specs = append(specs, collection+"."+keys[0])
+			default:
+				specs = append(specs, collection+".("+strings.Join(keys, ", ")+")")
+			}
+		}
+	}
+	return specs
+}
+
+// SearchIndex returns the values stored in the models2.SearchIndexField of a resource: those of its
+// custom search parameters and, for Locations, their position as a GeoJSON point
+func SearchIndex(resourceType string, doc []bson.DocElem) bson.D {
+	index := CustomSearchIndex(resourceType, doc)
+	if resourceType == "Location" {
+		if position := locationPosition(doc); position != nil {
+			name := strings.TrimPrefix(nearIndexField, models2.SearchIndexField+".")
+			index = append(index, bson.DocElem{Name: name, Value: position})
+		}
+	}
+	return index
+}
+
+// CustomSearchIndex extracts the values of the custom search parameters of a resource type from the
+// BSON of a resource, grouped by parameter and then by type, or returns nil if there aren't any
+func CustomSearchIndex(resourceType string, doc []bson.DocElem) bson.D {
+	customSearchParametersLock.RLock()
+	defer customSearchParametersLock.RUnlock()
+
+	var params []*CustomSearchParameter
+	for _, p := range customSearchParameters {
+		if contains(p.Base, resourceType) {
+			params = append(params, p)
+		}
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Code < params[j].Code })
+
+	var index bson.D
+	for _, p := range params {
+		values := make(map[string][]interface{})
+		for _, path := range p.paths {
+			if path.Resource == resourceType {
+				path.extract(doc, values)
+			}
+		}
+
+		var byType bson.D
+		for _, valueType := range customSearchParameterTypes[p.Type] {
+			if len(values[valueType]) > 0 {
+				byType = append(byType, bson.DocElem{Name: valueType, Value: values[valueType]})
+			}
+		}
+		if len(byType) > 0 {
+			index = append(index, bson.DocElem{Name: p.Code, Value: byType})
+		}
+	}
+	return index
+}
+
+// selects returns true if the path selects values of the given type
+func (path customSearchPath) selects(valueType string) bool {
+	for _, t := range path.Steps[len(path.Steps)-1].Names {
+		if t == valueType {
+			return true
+		}
+	}
+	return false
+}
+
+// extract adds the values the path selects from the BSON of a resource to values, by type
+func (path customSearchPath) extract(doc []bson.DocElem, values map[string][]interface{}) {
+	current := []interface{}{doc}
+	var types []string
+	for _, step := range path.Steps {
+		var next []interface{}
+		types = nil
+		for _, value := range current {
+			elems, isDoc := cursorDocElems(value)
+			if !isDoc {
+				continue
+			}
+			for _, elem := range elems {
+				t, selected := step.Names[elem.Name]
+				if !selected {
+					continue
+				}
+				for _, child := range flattenBSONArray(elem.Value) {
+					if step.ExtensionURL != "" {
+						// extensions are stored as { url: { value[x], extension, ... } }
+						extension, isDoc := cursorDocElems(child)
+						if !isDoc || len(extension) != 1 || extension[0].Name != step.ExtensionURL {
+							continue
+						}
+						child = extension[0].Value
+					}
+					next = append(next, child)
+					types = append(types, t)
+				}
+			}
+		}
+		current = next
+	}
+
+	for i, value := range current {
+		values[types[i]] = append(values[types[i]], value)
+	}
+}
+
+func flattenBSONArray(value interface{}) []interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var values []interface{}
+		for _, v := range value {
+			if v != nil {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	return []interface{}{value}
+}
+
+var customSearchSegmentRegex = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9]*)(?:\((.*)\))?$`)
+var customSearchWhereURLRegex = regexp.MustCompile(`^url\s*=\s*'([^']*)'$`)
+var customSearchXPathSegmentRegex = regexp.MustCompile(`^(?:f:)?([A-Za-z][A-Za-z0-9]*)(?:\[@url\s*=\s*'([^']*)'\])?$`)
+
+// parseCustomSearchExpression parses the FHIRPath expression of a custom search parameter. Extensions
+// are selected with extension('url') or extension.where(url='url'), and elements can be restricted to
+// values of a single type with as(type), ofType(type) or "(path as type)".
+func parseCustomSearchExpression(expression string) ([]customSearchPath, error) {
+	var paths []customSearchPath
+	for _, union := range splitCustomSearchExpression(expression, '|') {
+		union = strings.TrimSpace(union)
+		for strings.HasPrefix(union, "(") && strings.HasSuffix(union, ")") {
+			union = strings.TrimSpace(union[1 : len(union)-1])
+		}
+
+		typeFilter := ""
+		if parts := splitCustomSearchExpression(union, ' '); len(parts) == 3 && parts[1] == "as" {
+			union, typeFilter = parts[0], parts[2]
+		}
+
+		segments := splitCustomSearchExpression(union, '.')
+		if len(segments) < 2 {
+			return nil, fmt.Errorf("SearchParameter expression \"%s\" is not supported", union)
+		}
+		var steps []customSearchStep
+		for _, segment := range segments[1:] {
+			segment = strings.TrimSpace(segment)
+			m := customSearchSegmentRegex.FindStringSubmatch(segment)
+			if m == nil {
+				return nil, fmt.Errorf("SearchParameter expression \"%s\" is not supported", segment)
+			}
+			name, argument, isFunction := m[1], m[2], strings.HasSuffix(segment, ")")
+			var previous *customSearchStep
+			if len(steps) > 0 {
+				previous = &steps[len(steps)-1]
+			}
+
+			switch {
+			case !isFunction:
+				steps = append(steps, customSearchStep{Element: name})
+			case name == "extension":
+				url := strings.Trim(argument, "'")
+				if len(url) != len(argument)-2 || url == "" {
+					return nil, fmt.Errorf("SearchParameter expression \"%s\" is not supported", segment)
+				}
+				steps = append(steps, customSearchStep{Element: name, ExtensionURL: url})
+			case name == "where" && previous != nil && isExtensionElement(previous.Element) && previous.ExtensionURL == "":
+				urlMatch := customSearchWhereURLRegex.FindStringSubmatch(strings.TrimSpace(argument))
+				if urlMatch == nil {
+					return nil, fmt.Errorf("SearchParameter expression \"%s\" is not supported", segment)
+				}
+				previous.ExtensionURL = urlMatch[1]
+			case (name == "as" || name == "ofType") && previous != nil && previous.TypeFilter == "":
+				previous.TypeFilter = strings.TrimSpace(argument)
+			default:
+				return nil, fmt.Errorf("SearchParameter expression \"%s\" is not supported", segment)
+			}
+		}
+		if typeFilter != "" {
+			steps[len(steps)-1].TypeFilter = typeFilter
+		}
+
+		path, err := newCustomSearchPath(strings.TrimSpace(segments[0]), steps)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// parseCustomSearchXPath parses the XPath of a custom search parameter, which is only used if it doesn't
+// have an expression, e.g. "f:Patient/f:extension[@url='http://example.org/birthPlace']/f:valueString"
+func parseCustomSearchXPath(xpath string) ([]customSearchPath, error) {
+	var paths []customSearchPath
+	for _, union := range splitCustomSearchExpression(xpath, '|') {
+		segments := splitCustomSearchExpression(strings.TrimSpace(union), '/')
+		var resource string
+		var steps []customSearchStep
+		for i, segment := range segments {
+			m := customSearchXPathSegmentRegex.FindStringSubmatch(strings.TrimSpace(segment))
+			if m == nil || (m[2] != "" && !isExtensionElement(m[1])) {
+				return nil, fmt.Errorf("SearchParameter xpath \"%s\" is not supported", segment)
+			}
+			if i == 0 {
+				resource = m[1]
+			} else {
+				steps = append(steps, customSearchStep{Element: m[1], ExtensionURL: m[2]})
+			}
+		}
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("SearchParameter xpath \"%s\" is not supported", union)
+		}
+
+		path, err := newCustomSearchPath(resource, steps)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// newCustomSearchPath looks up the JSON names and types of each step of a path, following the types of
+// the elements from the resource type
+func newCustomSearchPath(resource string, steps []customSearchStep) (customSearchPath, error) {
+	if _, known := SearchParameterDictionary[resource]; !known {
+		return customSearchPath{}, fmt.Errorf("SearchParameter expression refers to unknown resource type %s", resource)
+	}
+
+	parents := []string{resource}
+	for i := range steps {
+		step := &steps[i]
+		step.Names = make(map[string]string)
+		var children []string
+		for _, parent := range parents {
+			for _, name := range models2.ElementNames(parent, step.Element) {
+				t, found := models2.ElementType(parent, name)
+				if !found || (step.TypeFilter != "" && t != step.TypeFilter) {
+					continue
+				}
+				step.Names[name] = t
+				if !contains(children, t) {
+					children = append(children, t)
+				}
+			}
+		}
+		if len(step.Names) == 0 {
+			return customSearchPath{}, fmt.Errorf("SearchParameter expression refers to unknown element %s of %s", step.Element, strings.Join(parents, ", "))
+		}
+		if step.ExtensionURL != "" && !isExtensionElement(step.Element) {
+			return customSearchPath{}, fmt.Errorf("SearchParameter expression selects %s by url, which only extensions have", step.Element)
+		}
+		if step.ExtensionURL == "" && isExtensionElement(step.Element) {
+			// extensions are stored by url (see models2.ConvertJsonToGoFhirBSON)
+			return customSearchPath{}, fmt.Errorf("SearchParameter expression must select extensions by url")
+		}
+		parents = children
+	}
+	return customSearchPath{Resource: resource, Steps: steps}, nil
+}
+
+func isExtensionElement(element string) bool {
+	return element == "extension" || element == "modifierExtension"
+}
+
+// splitCustomSearchExpression splits an expression at a separator, other than within quotes, parentheses
+// or square brackets
+func splitCustomSearchExpression(expression string, sep rune) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i, r := range expression {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(' || r == '[':
+			depth++
+		case r == ')' || r == ']':
+			depth--
+		case r == sep && depth == 0:
+			if part := expression[start:i]; sep != ' ' || part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	return append(parts, expression[start:])
+}
@@ -0,0 +1,170 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type CustomSearchParameterSuite struct{}
+
+var _ = Suite(&CustomSearchParameterSuite{})
+
+const indigenousStatusURL = "http://hl7.org.au/fhir/StructureDefinition/indigenous-status"
+
+func indigenousStatusDefinition() *models.SearchParameter {
+	return &models.SearchParameter{
+		Code:       "indigenous-status",
+		Base:       []string{"Patient"},
+		Type:       "token",
+		Expression: "Patient.extension('" + indigenousStatusURL + "').value",
+	}
+}
+
+func (s *CustomSearchParameterSuite) TestParseCustomSearchExpression(c *C) {
+	paths, err := parseCustomSearchExpression("Patient.extension('" + indigenousStatusURL + "').value")
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 1)
+	c.Assert(paths[0].Resource, Equals, "Patient")
+	c.Assert(paths[0].Steps, HasLen, 2)
+	c.Assert(paths[0].Steps[0].ExtensionURL, Equals, indigenousStatusURL)
+	c.Assert(paths[0].Steps[0].Names, DeepEquals, map[string]string{"extension": "Extension"})
+	c.Assert(paths[0].Steps[1].Names["valueCoding"], Equals, "Coding")
+	c.Assert(paths[0].Steps[1].Names["valueString"], Equals, "string")
+
+	paths, err = parseCustomSearchExpression("Patient.extension.where(url='" + indigenousStatusURL + "').value.as(Coding) | Patient.contact.name")
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 2)
+	c.Assert(paths[0].Steps[0].ExtensionURL, Equals, indigenousStatusURL)
+	c.Assert(paths[0].Steps[1].Names, DeepEquals, map[string]string{"valueCoding": "Coding"})
+	c.Assert(paths[1].Steps[0].Names, DeepEquals, map[string]string{"contact": "Patient.contact"})
+	c.Assert(paths[1].Steps[1].Names, DeepEquals, map[string]string{"name": "HumanName"})
+
+	paths, err = parseCustomSearchExpression("(Observation.value as Quantity)")
+	c.Assert(err, IsNil)
+	c.Assert(paths[0].Steps[0].Names, DeepEquals, map[string]string{"valueQuantity": "Quantity"})
+
+	paths, err = parseCustomSearchXPath("f:Patient/f:extension[@url='" + indigenousStatusURL + "']/f:valueCoding")
+	c.Assert(err, IsNil)
+	c.Assert(paths[0].Steps[0].ExtensionURL, Equals, indigenousStatusURL)
+	c.Assert(paths[0].Steps[1].Names, DeepEquals, map[string]string{"valueCoding": "Coding"})
+
+	for _, unsupported := range []string{
+		"Patient",
+		"Patient.foo",
+		"Patient.extension.value",
+		"Patient.name.where(use='official')",
+		"Patient.managingOrganization.resolve()",
+		"Foo.bar",
+	} {
+		_, err = parseCustomSearchExpression(unsupported)
+		c.Assert(err, NotNil, Commentf("%s", unsupported))
+	}
+}
+
+func (s *CustomSearchParameterSuite) TestNewCustomSearchParameter(c *C) {
+	p, err := NewCustomSearchParameter("1", indigenousStatusDefinition())
+	c.Assert(err, IsNil)
+	info := p.paramInfo("Patient")
+	c.Assert(info.Type, Equals, "token")
+	c.Assert(info.Paths, DeepEquals, []SearchParamPath{
+		SearchParamPath{Path: "__search.indigenous-status.[]boolean", Type: "boolean"},
+		SearchParamPath{Path: "__search.indigenous-status.[]code", Type: "code"},
+		SearchParamPath{Path: "__search.indigenous-status.[]id", Type: "id"},
+		SearchParamPath{Path: "__search.indigenous-status.[]string", Type: "string"},
+		SearchParamPath{Path: "__search.indigenous-status.[]Coding", Type: "Coding"},
+		SearchParamPath{Path: "__search.indigenous-status.[]CodeableConcept", Type: "CodeableConcept"},
+		SearchParamPath{Path: "__search.indigenous-status.[]Identifier", Type: "Identifier"},
+		SearchParamPath{Path: "__search.indigenous-status.[]ContactPoint", Type: "ContactPoint"},
+	})
+
+	definition := indigenousStatusDefinition()
+	definition.Expression += ".as(Coding)"
+	p, err = NewCustomSearchParameter("1", definition)
+	c.Assert(err, IsNil)
+	c.Assert(p.IndexSpecs(), DeepEquals, []string{
+		"patients.(__search.indigenous-status.Coding.code_1, __search.indigenous-status.Coding.system_1)",
+	})
+
+	invalid := []*models.SearchParameter{
+		&models.SearchParameter{Code: "_foo", Base: []string{"Patient"}, Type: "token", Expression: "Patient.gender"},
+		&models.SearchParameter{Code: "name", Base: []string{"Patient"}, Type: "string", Expression: "Patient.name"},
+		&models.SearchParameter{Code: "foo", Base: []string{"Patient"}, Type: "composite", Expression: "Patient.gender"},
+		&models.SearchParameter{Code: "foo", Base: []string{"Patient"}, Type: "date", Expression: "Patient.gender"},
+		&models.SearchParameter{Code: "foo", Base: []string{"Patient"}, Type: "token", Expression: "Practitioner.gender"},
+		&models.SearchParameter{Code: "foo", Base: []string{"Patient"}, Type: "token"},
+	}
+	for _, definition := range invalid {
+		_, err = NewCustomSearchParameter("2", definition)
+		c.Assert(err, NotNil, Commentf("%+v", definition))
+	}
+}
+
+func (s *CustomSearchParameterSuite) TestRegisterCustomSearchParameter(c *C) {
+	p, err := NewCustomSearchParameter("1", indigenousStatusDefinition())
+	c.Assert(err, IsNil)
+	c.Assert(RegisterCustomSearchParameter(p), IsNil)
+	defer UnregisterCustomSearchParameter("1")
+
+	info, ok := SearchParameterDictionary["Patient"]["indigenous-status"]
+	c.Assert(ok, Equals, true)
+	c.Assert(info, DeepEquals, p.paramInfo("Patient"))
+	c.Assert(CustomSearchParameterResourceTypes(), DeepEquals, []string{"Patient"})
+
+	// the same code can't be defined by another SearchParameter
+	_, err = NewCustomSearchParameter("2", indigenousStatusDefinition())
+	c.Assert(err, ErrorMatches, ".*already defined by SearchParameter/1")
+
+	UnregisterCustomSearchParameter("1")
+	_, ok = SearchParameterDictionary["Patient"]["indigenous-status"]
+	c.Assert(ok, Equals, false)
+	c.Assert(CustomSearchParameterResourceTypes(), HasLen, 0)
+}
+
+func (s *CustomSearchParameterSuite) TestCustomSearchIndex(c *C) {
+	p, err := NewCustomSearchParameter("1", indigenousStatusDefinition())
+	c.Assert(err, IsNil)
+	c.Assert(RegisterCustomSearchParameter(p), IsNil)
+	defer UnregisterCustomSearchParameter("1")
+
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"extension": [
+			{ "url": "http://example.org/other", "valueString": "other" },
+			{ "url": "` + indigenousStatusURL + `", "valueCoding": { "system": "https://healthterminologies.gov.au/fhir/CodeSystem/australian-indigenous-status-1", "code": "4" } }
+		],
+		"gender": "female"
+	}`))
+	c.Assert(err, IsNil)
+
+	doc, err := resource.GetBSON()
+	c.Assert(err, IsNil)
+	elems := doc.([]bson.DocElem)
+	last := elems[len(elems)-1]
+	c.Assert(last.Name, Equals, models2.SearchIndexField)
+	index := last.Value.(bson.D)
+	c.Assert(index, HasLen, 1)
+	c.Assert(index[0].Name, Equals, "indigenous-status")
+	byType := index[0].Value.(bson.D)
+	c.Assert(byType, HasLen, 1)
+	c.Assert(byType[0].Name, Equals, "Coding")
+	c.Assert(byType[0].Value, DeepEquals, []interface{}{[]bson.DocElem{
+		bson.DocElem{Name: "system", Value: "https://healthterminologies.gov.au/fhir/CodeSystem/australian-indigenous-status-1"},
+		bson.DocElem{Name: "code", Value: "4"},
+	}})
+
+	// the search index isn't part of the resource's JSON
+	converted, err := models2.NewResourceFromBSON(elems)
+	c.Assert(err, IsNil)
+	c.Assert(string(converted.JsonBytes()), Not(Matches), "(?s).*__search.*")
+
+	// resources without values for the parameter don't have a search index
+	UnregisterCustomSearchParameter("1")
+	doc, err = resource.GetBSON()
+	c.Assert(err, IsNil)
+	for _, elem := range doc.([]bson.DocElem) {
+		c.Assert(elem.Name, Not(Equals), models2.SearchIndexField)
+	}
+}
@@ -0,0 +1,626 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The _filter parameter applies to all resources but is missing from the generated SearchParameterDictionary
+func init() {
+	for resource, params := range SearchParameterDictionary {
+		params[FilterParam] = SearchParamInfo{
+			Resource: resource,
+			Name:     FilterParam,
+			Type:     "filter",
+		}
+	}
+}
+
+// filterOperators are the comparison operators of the _filter syntax
+var filterOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "lt": true, "ge": true, "le": true,
+	"ap": true, "sa": true, "eb": true, "pr": true, "po": true, "ss": true, "sb": true, "in": true, "ni": true, "re": true,
+}
+
+// supportedFilterOperators are the comparison operators that can be used with each type of search
+// parameter. The others aren't meaningful for the type.
+var supportedFilterOperators = map[string][]string{
+	"string":    []string{"eq", "ne", "co", "sw", "ew", "pr"},
+	"token":     []string{"eq", "ne", "ss", "sb", "in", "ni", "pr"},
+	"reference": []string{"eq", "ne", "re", "pr"},
+	"uri":       []string{"eq", "ne", "pr"},
+	"date":      []string{"eq", "ne", "gt", "lt", "ge", "le", "ap", "sa", "eb", "po", "pr"},
+	"number":    []string{"eq", "ne", "gt", "lt", "ge", "le", "ap", "sa", "eb", "pr"},
+	"quantity":  []string{"eq", "ne", "gt", "lt", "ge", "le", "ap", "sa", "eb", "pr"},
+	"composite": []string{"eq", "ne"},
+}
+
+// FilterExpression is a parsed _filter search (http://hl7.org/fhir/search_filter.html): comparisons
+// of search parameters with values, combined with and, or, not and parentheses. Like in most
+// languages, and takes precedence over or. Comparisons have the Param and Value set and one of
+// the comparison operators (eq, ne, co, ...) as their Operator, while logical expressions have
+// the and, or or not Operator and Operands. Comparisons of referenced resources, such as
+// subject:Patient.name eq peters, have the chain Operator, the reference parameter as their Param,
+// the Type of the referenced resources and the comparison of those resources as their Operand.
+type FilterExpression struct {
+	Operator string
+	Operands []*FilterExpression
+	Param    SearchParamInfo
+	Type     string
+	Value    string
+}
+
+func (e *FilterExpression) String() string {
+	switch e.Operator {
+	case "and", "or":
+		operands := make([]string, len(e.Operands))
+		for i, operand := range e.Operands {
+			operands[i] = operand.String()
+			if operand.Operator == "and" || operand.Operator == "or" {
+				operands[i] = "(" + operands[i] + ")"
+			}
+		}
+		return strings.Join(operands, " "+e.Operator+" ")
+	case "not":
+		return "not (" + e.Operands[0].String() + ")"
+	case "chain":
+		return e.Param.Name + ":" + e.Type + "." + e.Operands[0].String()
+	default:
+		value := strings.Replace(e.Value, "\\", "\\\\", -1)
+		value = strings.Replace(value, "\"", "\\\"", -1)
+		return fmt.Sprintf("%s %s \"%s\"", e.Param.Name, e.Operator, value)
+	}
+}
+
+// usesChains tests if the expression compares referenced resources
+func (e *FilterExpression) usesChains() bool {
+	if e.Operator == "chain" {
+		return true
+	}
+	for _, operand := range e.Operands {
+		if operand.usesChains() {
+			return true
+		}
+	}
+	return false
+}
+
+// filterUnsupportedError is returned for valid _filter searches using features that aren't implemented
+type filterUnsupportedError string
+
+func (e filterUnsupportedError) Error() string {
+	return string(e)
+}
+
+// ParseFilterExpression parses a _filter search of a resource type
+func ParseFilterExpression(resource string, value string) (*FilterExpression, error) {
+	tokens, err := tokenizeFilterExpression(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty expression")
+	}
+	parser := &filterExpressionParser{resource: resource, tokens: tokens}
+	expression, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos].text)
+	}
+	return expression, nil
+}
+
+// filterToken is a word, parenthesis or (quoted) string of a _filter search
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// keyword returns the lowercase text of unquoted tokens, so that operators can be told apart from values
+func (t filterToken) keyword() string {
+	if t.quoted {
+		return ""
+	}
+	return strings.ToLower(t.text)
+}
+
+func tokenizeFilterExpression(value string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case unicode.IsSpace(runes[i]):
+		case runes[i] == '(' || runes[i] == ')':
+			tokens = append(tokens, filterToken{text: string(runes[i])})
+		case runes[i] == '"':
+			var text []rune
+			end := i + 1
+			for ; end < len(runes) && runes[end] != '"'; end++ {
+				if runes[end] == '\\' && end+1 < len(runes) {
+					end++
+				}
+				text = append(text, runes[end])
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, filterToken{text: string(text), quoted: true})
+			i = end
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i:end])})
+			i = end - 1
+		}
+	}
+	return tokens, nil
+}
+
+type filterExpressionParser struct {
+	resource string
+	tokens   []filterToken
+	pos      int
+}
+
+func (p *filterExpressionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].keyword()
+	}
+	return ""
+}
+
+func (p *filterExpressionParser) parseOr() (*FilterExpression, error) {
+	var operands []*FilterExpression
+	for {
+		operand, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if p.peek() != "or" {
+			return newFilterOperation("or", operands), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *filterExpressionParser) parseAnd() (*FilterExpression, error) {
+	var operands []*FilterExpression
+	for {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if p.peek() != "and" {
+			return newFilterOperation("and", operands), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *filterExpressionParser) parseNot() (*FilterExpression, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	switch token := p.peek(); token {
+	case "not":
+		p.pos++
+		if p.peek() != "(" {
+			return nil, errors.New("missing ( after not")
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterExpression{Operator: "not", Operands: []*FilterExpression{operand}}, nil
+	case "(":
+		p.pos++
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return operand, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("unexpected %s", token)
+	default:
+		return p.parseComparison()
+	}
+}
+
+// parseComparison parses a comparison of a search parameter (paramPath compareOp compValue)
+func (p *filterExpressionParser) parseComparison() (*FilterExpression, error) {
+	if p.pos+3 > len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	name, operator, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	p.pos += 3
+
+	if name.quoted || value.text == "" || (!value.quoted && (value.text == "(" || value.text == ")")) {
+		return nil, fmt.Errorf("invalid comparison %s %s %s", name.text, operator.text, value.text)
+	}
+	op := operator.keyword()
+	if !filterOperators[op] {
+		return nil, fmt.Errorf("unknown operator %s", operator.text)
+	}
+	if strings.Contains(name.text, "[") || strings.HasPrefix(name.text, HasParam) {
+		return nil, filterUnsupportedError(fmt.Sprintf("filtered parameters (%s) are not supported", name.text))
+	}
+	return newFilterComparison(p.resource, name.text, op, value.text)
+}
+
+// newFilterComparison creates the comparison of a resource's search parameter, or of the resources it
+// references if the parameter path is chained (e.g. subject:Patient.name)
+func newFilterComparison(resource string, path string, op string, value string) (*FilterExpression, error) {
+	name, chained := path, ""
+	if dot := strings.Index(path, "."); dot >= 0 {
+		name, chained = path[:dot], path[dot+1:]
+	}
+	referencedType := ""
+	if colon := strings.Index(name, ":"); colon >= 0 && chained != "" {
+		name, referencedType = name[:colon], name[colon+1:]
+	}
+
+	info, ok := SearchParameterDictionary[resource][name]
+	if !ok {
+		return nil, fmt.Errorf("unknown search parameter %s", name)
+	}
+	if chained != "" {
+		if info.Type != "reference" {
+			return nil, fmt.Errorf("%s is not a reference parameter", name)
+		}
+		chainedType, err := filterReferencedType(info, referencedType)
+		if err != nil {
+			return nil, err
+		}
+		comparison, err := newFilterComparison(chainedType, chained, op, value)
+		if err != nil {
+			return nil, err
+		}
+		return &FilterExpression{Operator: "chain", Operands: []*FilterExpression{comparison}, Param: info, Type: chainedType}, nil
+	}
+
+	if !contains(supportedFilterOperators[info.Type], op) {
+		return nil, filterUnsupportedError(fmt.Sprintf("%s is not supported for the %s parameter", op, name))
+	}
+	if op == "pr" {
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("pr needs true or false (not %s)", value)
+		}
+	}
+	return &FilterExpression{Operator: op, Param: info, Value: value}, nil
+}
+
+// filterReferencedType returns the type of the resources referenced by a chained comparison, which
+// must be given (e.g. subject:Patient.name) unless the reference parameter has a single target
+func filterReferencedType(info SearchParamInfo, referencedType string) (string, error) {
+	if referencedType == "" {
+		if len(info.Targets) != 1 || info.Targets[0] == "Any" {
+			return "", fmt.Errorf("the type of the resources referenced by %s must be given (%s:[type])", info.Name, info.Name)
+		}
+		return info.Targets[0], nil
+	}
+	if _, ok := SearchParameterDictionary[referencedType]; !ok || !(contains(info.Targets, referencedType) || contains(info.Targets, "Any")) {
+		return "", fmt.Errorf("%s can't reference %s resources", info.Name, referencedType)
+	}
+	return referencedType, nil
+}
+
+// newFilterOperation combines operands, flattening nested operations with the same operator
+func newFilterOperation(operator string, operands []*FilterExpression) *FilterExpression {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	var flattened []*FilterExpression
+	for _, operand := range operands {
+		if operand.Operator == operator {
+			flattened = append(flattened, operand.Operands...)
+		} else {
+			flattened = append(flattened, operand)
+		}
+	}
+	return &FilterExpression{Operator: operator, Operands: flattened}
+}
+
+// createFilterQueryObject compiles a _filter search into the query objects of the search parameters
+// it compares, which are combined with $and, $or and $nor
+func (m *MongoSearcher) createFilterQueryObject(f *FilterExpressionParam) bson.M {
+	return m.createFilterExpressionObject(f.Expression)
+}
+
+func (m *MongoSearcher) createFilterExpressionObject(e *FilterExpression) bson.M {
+	switch e.Operator {
+	case "and", "or":
+		operands := make([]bson.M, len(e.Operands))
+		for i, operand := range e.Operands {
+			operands[i] = m.createFilterExpressionObject(operand)
+		}
+		return bson.M{"$" + e.Operator: operands}
+	case "not":
+		return bson.M{"$nor": []bson.M{m.createFilterExpressionObject(e.Operands[0])}}
+	case "chain":
+		// the referenced resources are looked up before the $match, see createChainedFilterPipelineStages
+		panic(createInternalServerError("", "_filter chain compiled without a $lookup"))
+	case "in":
+		return m.createFilterCodesObject(e.Param, m.valueSetCodes(e.Value))
+	case "ni":
+		return bson.M{"$nor": []bson.M{m.createFilterCodesObject(e.Param, m.valueSetCodes(e.Value))}}
+	case "ss", "sb":
+		return m.createFilterCodesObject(e.Param, m.subsumptionCodes(e.Operator, e.Value))
+	case "pr":
+		info := e.Param.clone()
+		info.Modifier = "missing"
+		return m.createMissingQueryObject(ParseMissingParam(strconv.FormatBool(e.Value != "true"), info))
+	case "ne":
+		if e.Param.Type != "number" && e.Param.Type != "quantity" {
+			return bson.M{"$nor": []bson.M{m.createFilterComparisonObject(e.Param, "eq", e.Value)}}
+		}
+	case "po":
+		// the date overlaps the value: it neither starts after it nor ends before it
+		return bson.M{"$and": []bson.M{
+			m.createFilterExpressionObject(&FilterExpression{Operator: "pr", Param: e.Param, Value: "true"}),
+			bson.M{"$nor": []bson.M{
+				m.createFilterComparisonObject(e.Param, "sa", e.Value),
+				m.createFilterComparisonObject(e.Param, "eb", e.Value),
+			}},
+		}}
+	}
+	return m.createFilterComparisonObject(e.Param, e.Operator, e.Value)
+}
+
+// createFilterComparisonObject creates the query object of a comparison, using the search parameter's
+// prefixes and modifiers where they are equivalent
+func (m *MongoSearcher) createFilterComparisonObject(info SearchParamInfo, operator string, value string) bson.M {
+	info = info.clone()
+	switch info.Type {
+	case "string":
+		if operator == "co" {
+			info.Modifier = "contains"
+		} else {
+			info.Modifier = operator
+		}
+		return m.createStringQueryObject(&StringParam{info, value})
+	case "date", "number", "quantity":
+		value = operator + value
+	case "uri":
+		value = escape(value)
+	}
+	if info.Type != "uri" {
+		value = strings.Replace(value, ",", "\\,", -1)
+	}
+	return m.createParamObjects([]SearchParam{info.CreateSearchParam(value)})[0]
+}
+
+// createChainedFilterPipelineStages creates the stages of a _filter search comparing referenced
+// resources: a $lookup of the resources referenced by each path of each chain, followed by a $match
+// of the whole expression with the chained comparisons made on the looked up resources
+func (m *MongoSearcher) createChainedFilterPipelineStages(f *FilterExpressionParam) []bson.M {
+	var lookups []bson.M
+	expression := lookupFilterChains(f.Expression, "", &lookups)
+	return append(lookups, bson.M{"$match": m.createFilterExpressionObject(expression)})
+}
+
+// lookupFilterChains adds the $lookup stages of an expression's chains, returning the expression
+// with each chain replaced by comparisons of the fields the referenced resources are looked up into
+func lookupFilterChains(e *FilterExpression, prefix string, lookups *[]bson.M) *FilterExpression {
+	switch e.Operator {
+	case "and", "or", "not":
+		operands := make([]*FilterExpression, len(e.Operands))
+		for i, operand := range e.Operands {
+			operands[i] = lookupFilterChains(operand, prefix, lookups)
+		}
+		return &FilterExpression{Operator: e.Operator, Operands: operands}
+	case "chain":
+		// a resource matches if any resource referenced by any of the paths does
+		operands := make([]*FilterExpression, len(e.Param.Paths))
+		for i, path := range e.Param.Paths {
+			as := "_lookup" + strconv.Itoa(len(*lookups))
+			*lookups = append(*lookups, bson.M{"$lookup": bson.M{
+				"from":         models.PluralizeLowerResourceName(e.Type),
+				"localField":   prefix + convertSearchPathToMongoField(path.Path) + ".reference__id",
+				"foreignField": "_id",
+				"as":           as,
+			}})
+			operands[i] = lookupFilterChains(e.Operands[0], as+".", lookups)
+		}
+		return newFilterOperation("or", operands)
+	}
+	if prefix == "" {
+		return e
+	}
+	info := e.Param.clone()
+	for i, path := range info.Paths {
+		info.Paths[i].Path = prefix + path.Path
+	}
+	return &FilterExpression{Operator: e.Operator, Param: info, Value: e.Value}
+}
+
+// createFilterCodesObject matches any of the codes (as system|code token values)
+func (m *MongoSearcher) createFilterCodesObject(info SearchParamInfo, codes []string) bson.M {
+	if len(codes) == 0 {
+		return bson.M{"_id": bson.M{"$in": []string{}}}
+	}
+	operands := make([]bson.M, len(codes))
+	for i, code := range codes {
+		operands[i] = m.createFilterComparisonObject(info, "eq", code)
+	}
+	return bson.M{"$or": operands}
+}
+
+// valueSetCodes returns the codes of the ValueSet with the given canonical URL (which may end with
+// |version), taken from its expansion or else from the concepts and systems its compose includes.
+// All the codes of an included system are listed if its CodeSystem is found, and are otherwise
+// matched with system| as the codes may have been defined elsewhere.
+func (m *MongoSearcher) valueSetCodes(canonical string) []string {
+	var valueSet models.ValueSet
+	m.findCanonicalResource("ValueSet", canonical, &valueSet)
+
+	var codes []string
+	if valueSet.Expansion != nil {
+		var addContains func(contains []models.ValueSetExpansionContainsComponent)
+		addContains = func(contains []models.ValueSetExpansionContainsComponent) {
+			for _, c := range contains {
+				if c.Code != "" {
+					codes = append(codes, c.System+"|"+c.Code)
+				}
+				addContains(c.Contains)
+			}
+		}
+		addContains(valueSet.Expansion.Contains)
+		return codes
+	}
+	if valueSet.Compose == nil {
+		return nil
+	}
+
+	excluded := make(map[string]bool)
+	for _, exclude := range valueSet.Compose.Exclude {
+		if len(exclude.Concept) == 0 || len(exclude.Filter) > 0 || len(exclude.ValueSet) > 0 {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("ValueSet %s excludes more than a list of concepts, which isn't supported", canonical)))
+		}
+		for _, concept := range exclude.Concept {
+			excluded[exclude.System+"|"+concept.Code] = true
+		}
+	}
+	for _, include := range valueSet.Compose.Include {
+		if len(include.Filter) > 0 {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("ValueSet %s filters the concepts of %s, which isn't supported", canonical, include.System)))
+		}
+		var includeCodes []string
+		switch {
+		case len(include.Concept) > 0:
+			for _, concept := range include.Concept {
+				includeCodes = append(includeCodes, include.System+"|"+concept.Code)
+			}
+		case include.System != "":
+			includeCodes = m.codeSystemCodes(include.System)
+		}
+		for _, other := range include.ValueSet {
+			includeCodes = append(includeCodes, m.valueSetCodes(other)...)
+		}
+		for _, code := range includeCodes {
+			if !excluded[code] {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes
+}
+
+// codeSystemCodes returns all the codes of a code system, or system| if its CodeSystem isn't found
+func (m *MongoSearcher) codeSystemCodes(system string) []string {
+	resources := m.findTerminologyResources("CodeSystem", bson.M{"url": system})
+	if len(resources) == 0 {
+		return []string{system + "|"}
+	}
+	var codeSystem models.CodeSystem
+	unmarshalTerminologyResource(resources[0], &codeSystem)
+
+	var codes []string
+	var addConcepts func(concepts []models.CodeSystemConceptDefinitionComponent)
+	addConcepts = func(concepts []models.CodeSystemConceptDefinitionComponent) {
+		for _, concept := range concepts {
+			codes = append(codes, system+"|"+concept.Code)
+			addConcepts(concept.Concept)
+		}
+	}
+	addConcepts(codeSystem.Concept)
+	return codes
+}
+
+// subsumptionCodes returns the codes that a system|code value subsumes (ss), which are the code and
+// its descendants, or that it is subsumed by (sb), which are the code and its ancestors, as defined
+// by the concept hierarchy of the code system's CodeSystem
+func (m *MongoSearcher) subsumptionCodes(operator string, value string) []string {
+	parts := strings.SplitN(value, "|", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s needs a system|code (not %s)", FilterParam, operator, value)))
+	}
+	system, code := parts[0], parts[1]
+	var codeSystem models.CodeSystem
+	m.findCanonicalResource("CodeSystem", system, &codeSystem)
+
+	var codes []string
+	var find func(concepts []models.CodeSystemConceptDefinitionComponent, ancestors []string) bool
+	find = func(concepts []models.CodeSystemConceptDefinitionComponent, ancestors []string) bool {
+		for _, concept := range concepts {
+			if concept.Code == code {
+				if operator == "sb" {
+					codes = append(ancestors, code)
+				} else {
+					codes = []string{code}
+					var addDescendants func(concepts []models.CodeSystemConceptDefinitionComponent)
+					addDescendants = func(concepts []models.CodeSystemConceptDefinitionComponent) {
+						for _, descendant := range concepts {
+							codes = append(codes, descendant.Code)
+							addDescendants(descendant.Concept)
+						}
+					}
+					addDescendants(concept.Concept)
+				}
+				return true
+			}
+			if find(concept.Concept, append(ancestors[:len(ancestors):len(ancestors)], concept.Code)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !find(codeSystem.Concept, nil) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: code %s isn't defined by CodeSystem %s", FilterParam, code, system)))
+	}
+	for i, c := range codes {
+		codes[i] = system + "|" + c
+	}
+	return codes
+}
+
+// findCanonicalResource unmarshals the ValueSet or CodeSystem with the given canonical URL, which may end with |version
+func (m *MongoSearcher) findCanonicalResource(resourceType string, canonical string, resource interface{}) {
+	parts := strings.SplitN(canonical, "|", 2)
+	query := bson.M{"url": parts[0]}
+	if len(parts) == 2 {
+		query["version"] = parts[1]
+	}
+	resources := m.findTerminologyResources(resourceType, query)
+	if len(resources) == 0 {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s %s not found", FilterParam, resourceType, canonical)))
+	}
+	unmarshalTerminologyResource(resources[0], resource)
+}
+
+// findTerminologyResources finds ValueSets and CodeSystems in the searched database, or with the
+// findResourcesFunc of searchers that don't have one
+func (m *MongoSearcher) findTerminologyResources(resourceType string, query bson.M) []*models2.Resource {
+	find := m.findResources
+	if m.findResourcesFunc != nil {
+		find = m.findResourcesFunc
+	}
+	resources, err := find(resourceType, query)
+	if err != nil {
+		panic(createInternalServerError("", err.Error()))
+	}
+	return resources
+}
+
+func unmarshalTerminologyResource(resource *models2.Resource, into interface{}) {
+	if err := json.Unmarshal(resource.JsonBytes(), into); err != nil {
+		panic(createInternalServerError("", fmt.Sprintf("%s/%s is invalid: %s", resource.ResourceType(), resource.Id(), err)))
+	}
+}
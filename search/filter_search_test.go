@@ -0,0 +1,78 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type FilterSearchSuite struct{}
+
+var _ = Suite(&FilterSearchSuite{})
+
+func (s *FilterSearchSuite) TestParseFilterExpression(c *C) {
+	e, err := ParseFilterExpression("Patient", "family eq peters")
+	c.Assert(err, IsNil)
+	c.Assert(e.Operator, Equals, "eq")
+	c.Assert(e.Param.Name, Equals, "family")
+	c.Assert(e.Value, Equals, "peters")
+
+	e, err = ParseFilterExpression("Patient", `given sw "J" and family eq "O\"Brien" or birthdate lt 1990`)
+	c.Assert(err, IsNil)
+	c.Assert(e.Operator, Equals, "or")
+	c.Assert(e.Operands[0].Operator, Equals, "and")
+	c.Assert(e.Operands[0].Operands[1].Value, Equals, `O"Brien`)
+	c.Assert(e.String(), Equals, `(given sw "J" and family eq "O\"Brien") or birthdate lt "1990"`)
+
+	e, err = ParseFilterExpression("Patient", "NOT(gender eq male) and (name pr true or (birthdate ge 1980 and birthdate le 1990))")
+	c.Assert(err, IsNil)
+	c.Assert(e.String(), Equals, `not (gender eq "male") and (name pr "true" or (birthdate ge "1980" and birthdate le "1990"))`)
+
+	e, err = ParseFilterExpression("Observation", "subject:Patient.general-practitioner:Practitioner.name eq peters or not (performer:Practitioner.gender eq male)")
+	c.Assert(err, IsNil)
+	c.Assert(e.Operands[0].Operator, Equals, "chain")
+	c.Assert(e.Operands[0].Param.Name, Equals, "subject")
+	c.Assert(e.Operands[0].Type, Equals, "Patient")
+	c.Assert(e.Operands[0].Operands[0].Type, Equals, "Practitioner")
+	c.Assert(e.Operands[0].Operands[0].Operands[0].Param.Resource, Equals, "Practitioner")
+	c.Assert(e.usesChains(), Equals, true)
+	c.Assert(e.String(), Equals, `subject:Patient.general-practitioner:Practitioner.name eq "peters" or not (performer:Practitioner.gender eq "male")`)
+
+	// the type can be left out of references to a single type
+	e, err = ParseFilterExpression("Encounter", "patient.gender eq female and class in http://hl7.org/fhir/ValueSet/v3-ActEncounterCode")
+	c.Assert(err, IsNil)
+	c.Assert(e.Operands[0].Type, Equals, "Patient")
+	c.Assert(e.Operands[1].Operator, Equals, "in")
+	c.Assert(e.String(), Equals, `patient:Patient.gender eq "female" and class in "http://hl7.org/fhir/ValueSet/v3-ActEncounterCode"`)
+
+	for _, invalid := range []string{
+		"",
+		"family",
+		"family eq",
+		"family xx peters",
+		"foo eq bar",
+		"family eq peters and",
+		"(family eq peters",
+		"family eq peters)",
+		"not gender eq male",
+		"family eq \"peters",
+		"name pr maybe",
+		"general-practitioner.name eq peters",
+		"general-practitioner:Patient.name eq peters",
+		"general-practitioner:Practitioner.foo eq peters",
+		"gender.name eq peters",
+	} {
+		_, err = ParseFilterExpression("Patient", invalid)
+		c.Assert(err, NotNil, Commentf("%s", invalid))
+		_, unsupported := err.(filterUnsupportedError)
+		c.Assert(unsupported, Equals, false, Commentf("%s", invalid))
+	}
+
+	for _, unsupported := range []string{
+		"general-practitioner[name eq peters].active eq true",
+		"gender co male",
+		"birthdate sw 1990",
+		"_content eq peters",
+	} {
+		_, err = ParseFilterExpression("Patient", unsupported)
+		c.Assert(err, FitsTypeOf, filterUnsupportedError(""), Commentf("%s", unsupported))
+	}
+}
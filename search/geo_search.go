@@ -0,0 +1,420 @@
+package search
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The position of a Location is stored as a GeoJSON point in the models2.SearchIndexField when it is
+// saved, as MongoDB's geospatial queries and indexes can't use the latitude and longitude elements.
+// Searches sorted by distance store the distance of each result in the same sub-document.
+const (
+	nearIndexField     = models2.SearchIndexField + ".__near"
+	distanceIndexField = models2.SearchIndexField + ".__distance"
+)
+
+// ucumSystem is the system of the units of near-distance quantities
+const ucumSystem = "http://unitsofmeasure.org"
+
+// earthRadius is the radius (in metres) that MongoDB uses to convert distances to radians
+const earthRadius = 6378100.0
+
+// ucumDistanceUnits are the UCUM codes of the units that near search distances can be given in, with
+// their length in metres
+var ucumDistanceUnits = map[string]float64{
+	"mm":      0.001,
+	"cm":      0.01,
+	"m":       1,
+	"km":      1000,
+	"[in_i]":  0.0254,
+	"[ft_i]":  0.3048,
+	"[yd_i]":  0.9144,
+	"[mi_i]":  1609.344,
+	"[nmi_i]": 1852,
+}
+
+// The near and near-distance parameters of Locations have no paths in the generated
+// SearchParameterDictionary, as they aren't simple tokens and quantities
+func init() {
+	params := SearchParameterDictionary["Location"]
+	params["near"] = SearchParamInfo{
+		Resource: "Location",
+		Name:     "near",
+		Type:     "near",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: nearIndexField, Type: "Point"},
+		},
+	}
+	params["near-distance"] = SearchParamInfo{
+		Resource: "Location",
+		Name:     "near-distance",
+		Type:     "near-distance",
+	}
+}
+
+// NearParam represents a search for Locations near a position.  The following
+// description is from the FHIR R4 specification:
+//
+// Search for locations where the location.position is near to, or within a
+// specified distance of, the provided coordinates expressed as
+// [latitude]|[longitude]|[distance]|[units] (using the WGS84 datum, see notes).
+// If the units are omitted, then kms should be assumed.
+//
+// The STU3 form, [latitude]:[longitude] with the distance in a separate
+// near-distance parameter, is also accepted.  A Distance of 0 matches
+// Locations at any distance.
+type NearParam struct {
+	SearchParamInfo
+	Latitude  float64
+	Longitude float64
+	Distance  float64
+	Units     string
+}
+
+func (n *NearParam) getInfo() SearchParamInfo {
+	return n.SearchParamInfo
+}
+
+func (n *NearParam) setInfo(info SearchParamInfo) {
+	n.SearchParamInfo = info
+}
+
+func (n *NearParam) getQueryParamAndValue() (string, string) {
+	value := formatCoordinate(n.Latitude) + "|" + formatCoordinate(n.Longitude)
+	if n.Distance > 0 {
+		value += "|" + formatCoordinate(n.Distance) + "|" + n.Units
+	}
+	return queryParamAndValue(n.SearchParamInfo, value)
+}
+
+// DistanceInMetres returns the greatest distance of the Locations to find, or 0 for any distance
+func (n *NearParam) DistanceInMetres() float64 {
+	return n.Distance * ucumDistanceUnits[n.Units]
+}
+
+// ParseNearParam parses a near query string and returns a pointer to a
+// NearParam based on the query and the parameter definition.
+func ParseNearParam(paramStr string, info SearchParamInfo) *NearParam {
+	invalid := func(reason string) *Error {
+		return createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s", info.Name, reason))
+	}
+
+	var split []string
+	if strings.Contains(paramStr, "|") {
+		split = escapeFriendlySplit(paramStr, '|')
+	} else {
+		split = strings.Split(paramStr, ":")
+	}
+	if len(split) < 2 || len(split) > 4 {
+		panic(invalid("expected latitude|longitude|distance|units"))
+	}
+
+	n := &NearParam{SearchParamInfo: info, Units: "km"}
+	var err error
+	if n.Latitude, err = strconv.ParseFloat(split[0], 64); err != nil || math.Abs(n.Latitude) > 90 {
+		panic(invalid(fmt.Sprintf("%s is not a latitude", split[0])))
+	}
+	if n.Longitude, err = strconv.ParseFloat(split[1], 64); err != nil || math.Abs(n.Longitude) > 180 {
+		panic(invalid(fmt.Sprintf("%s is not a longitude", split[1])))
+	}
+	if len(split) > 2 && split[2] != "" {
+		if n.Distance, err = strconv.ParseFloat(split[2], 64); err != nil || n.Distance <= 0 || math.IsInf(n.Distance, 0) {
+			panic(invalid(fmt.Sprintf("%s is not a distance", split[2])))
+		}
+	}
+	if len(split) > 3 && split[3] != "" {
+		n.Units = unescape(split[3])
+		if _, known := ucumDistanceUnits[n.Units]; !known {
+			panic(invalid(fmt.Sprintf("%s is not a UCUM unit of distance", n.Units)))
+		}
+	}
+	return n
+}
+
+// NearDistanceParam represents the STU3 near-distance parameter, which gives the
+// distance of a near search as a quantity, e.g. 10|http://unitsofmeasure.org|km.
+// It is combined with the near parameter by Query.Params.
+type NearDistanceParam struct {
+	SearchParamInfo
+	Distance float64
+	Units    string
+}
+
+func (n *NearDistanceParam) getInfo() SearchParamInfo {
+	return n.SearchParamInfo
+}
+
+func (n *NearDistanceParam) setInfo(info SearchParamInfo) {
+	n.SearchParamInfo = info
+}
+
+func (n *NearDistanceParam) getQueryParamAndValue() (string, string) {
+	return queryParamAndValue(n.SearchParamInfo, formatCoordinate(n.Distance)+"|"+ucumSystem+"|"+n.Units)
+}
+
+// ParseNearDistanceParam parses a near-distance query string and returns a
+// pointer to a NearDistanceParam based on the query and the parameter definition.
+func ParseNearDistanceParam(paramStr string, info SearchParamInfo) *NearDistanceParam {
+	q := ParseQuantityParam(paramStr, info)
+	n := &NearDistanceParam{SearchParamInfo: info, Units: q.Code}
+	if n.Units == "" {
+		n.Units = "km"
+	}
+	if q.Prefix != "" && q.Prefix != EQ && q.Prefix != LE {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", info.Name)))
+	}
+	var err error
+	if q.Number.Value == nil {
+		err = fmt.Errorf("%s is not a distance", paramStr)
+	} else if n.Distance, _ = q.Number.Value.Float64(); n.Distance <= 0 {
+		err = fmt.Errorf("%s is not a distance", paramStr)
+	} else if q.System != "" && q.System != ucumSystem {
+		err = fmt.Errorf("units must be from %s", ucumSystem)
+	} else if _, known := ucumDistanceUnits[n.Units]; !known {
+		err = fmt.Errorf("%s is not a UCUM unit of distance", n.Units)
+	}
+	if err != nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s", info.Name, err)))
+	}
+	return n
+}
+
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// combineNearDistance applies a near-distance parameter to the near parameter without a distance that
+// it qualifies, returning the parameters without the near-distance parameter
+func combineNearDistance(params []SearchParam) []SearchParam {
+	var distance *NearDistanceParam
+	var near []*NearParam
+	var combined []SearchParam
+	for _, param := range params {
+		switch p := param.(type) {
+		case *NearDistanceParam:
+			if distance != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" can only be given once", p.Name)))
+			}
+			distance = p
+			continue
+		case *NearParam:
+			near = append(near, p)
+		case *OrParam:
+			for _, item := range p.Items {
+				switch item := item.(type) {
+				case *NearDistanceParam:
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" can only have one value", item.Name)))
+				case *NearParam:
+					near = append(near, item)
+				}
+			}
+		}
+		combined = append(combined, param)
+	}
+	if distance == nil {
+		return params
+	}
+
+	if len(near) == 0 {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" needs a \"near\" parameter", distance.Name)))
+	}
+	for _, n := range near {
+		if n.Distance > 0 {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" can't be combined with a \"near\" parameter that has a distance", distance.Name)))
+		}
+		n.Distance = distance.Distance
+		n.Units = distance.Units
+	}
+	return combined
+}
+
+// usesNearSearch returns true if the query parameters include a near search
+func usesNearSearch(queryParams URLQueryParameters, resource string) bool {
+	for _, queryParam := range queryParams.All() {
+		param, modifier, _ := ParseParamNameModifierAndPostFix(queryParam.Key)
+		if modifier == "" && SearchParameterDictionary[resource][param].Type == "near" {
+			return true
+		}
+	}
+	return false
+}
+
+// SortsByDistance returns true if the results should be ordered by their distance from the position of
+// a near search
+func (o *QueryOptions) SortsByDistance() bool {
+	for _, sort := range o.Sort {
+		if sort.Parameter.Type == "distance" {
+			return true
+		}
+	}
+	return false
+}
+
+func distanceSortParam(near SearchParamInfo) SearchParamInfo {
+	return SearchParamInfo{
+		Resource: near.Resource,
+		Name:     near.Name,
+		Type:     "distance",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: distanceIndexField, Type: "decimal"},
+		},
+	}
+}
+
+// sortNearParam returns the near search whose position results are sorted by their distance from
+func sortNearParam(params []SearchParam) *NearParam {
+	var near *NearParam
+	for _, param := range params {
+		switch p := param.(type) {
+		case *NearParam:
+			if near != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" by distance needs a single \"near\" position"))
+			}
+			near = p
+		case *OrParam:
+			if _, isNear := p.Items[0].(*NearParam); isNear {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" by distance needs a single \"near\" position"))
+			}
+		}
+	}
+	if near == nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+	}
+	return near
+}
+
+// locationPosition returns the position of a Location as a GeoJSON point, or nil if it doesn't have one
+func locationPosition(doc []bson.DocElem) bson.D {
+	var position []bson.DocElem
+	for _, elem := range doc {
+		if elem.Name == "position" {
+			position, _ = cursorDocElems(elem.Value)
+		}
+	}
+	var longitude, latitude float64
+	var hasLongitude, hasLatitude bool
+	for _, elem := range position {
+		switch elem.Name {
+		case "longitude":
+			longitude, hasLongitude = decimalValue(elem.Value)
+		case "latitude":
+			latitude, hasLatitude = decimalValue(elem.Value)
+		}
+	}
+	if !hasLongitude || !hasLatitude || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return nil
+	}
+	return geoJSONPoint(longitude, latitude)
+}
+
+// decimalValue returns the value of a decimal stored by models2.ConvertJsonToGoFhirBSON
+func decimalValue(value interface{}) (float64, bool) {
+	elems, _ := cursorDocElems(value)
+	for _, elem := range elems {
+		if elem.Name == models2.Gofhir__strNum {
+			if s, isString := elem.Value.(string); isString {
+				f, err := strconv.ParseFloat(s, 64)
+				return f, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+func geoJSONPoint(longitude, latitude float64) bson.D {
+	return bson.D{
+		bson.DocElem{Name: "type", Value: "Point"},
+		bson.DocElem{Name: "coordinates", Value: []interface{}{longitude, latitude}},
+	}
+}
+
+// createNearQueryObject selects the Locations within the distance of a near search, using $geoWithin
+// rather than $nearSphere as it can also be used to count the results and in $or queries. The results
+// are sorted by distance with a $geoNear stage (see createGeoNearStage).
+func (m *MongoSearcher) createNearQueryObject(n *NearParam) bson.M {
+	field := convertSearchPathToMongoField(n.Paths[0].Path)
+	if n.Distance == 0 {
+		return bson.M{field: bson.M{"$exists": true}}
+	}
+	center := []interface{}{n.Longitude, n.Latitude}
+	return bson.M{field: bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{center, n.DistanceInMetres() / earthRadius}}}}
+}
+
+// createGeoNearStage creates the $geoNear pipeline stage of searches sorted by distance, which finds the
+// results of the query and adds their distance (in metres). It needs the 2dsphere index of indexes.conf.
+func (m *MongoSearcher) createGeoNearStage(params []SearchParam, query bson.M) bson.M {
+	for _, param := range params {
+		if _, isText := param.(*FullTextParam); isText {
+			// $text can only be used in the first stage of a pipeline, as can $geoNear
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" by distance can't be combined with \"_text\" or \"_content\""))
+		}
+	}
+	near := sortNearParam(params)
+	return bson.M{"$geoNear": bson.M{
+		"near":          geoJSONPoint(near.Longitude, near.Latitude),
+		"key":           convertSearchPathToMongoField(near.Paths[0].Path),
+		"distanceField": distanceIndexField,
+		"spherical":     true,
+		"query":         query,
+	}}
+}
+
+// matchesGeoWithin evaluates a $geoWithin $centerSphere query against GeoJSON points
+func matchesGeoWithin(values []interface{}, argument interface{}) bool {
+	shape, _ := argument.(bson.M)
+	sphere, isSphere := shape["$centerSphere"].([]interface{})
+	if !isSphere || len(sphere) != 2 {
+		panic(createInternalServerError("", fmt.Sprintf("$geoWithin shape %#v is not supported by the in-memory searcher", argument)))
+	}
+	center, _ := sphere[0].([]interface{})
+	radius, _ := sphere[1].(float64)
+	return anyValue(values, func(value interface{}) bool {
+		longitude, latitude, isPoint := pointCoordinates(value)
+		return isPoint && angularDistance(center[0].(float64), center[1].(float64), longitude, latitude) <= radius
+	})
+}
+
+// setMemoryDistances stores the distance of each document from the position of a near search where
+// sortMemoryDocuments will find it, like a $geoNear stage does
+func setMemoryDistances(documents []memoryDocument, near *NearParam) {
+	for _, document := range documents {
+		for _, value := range lookupValues(document.doc, mongoFieldParts(near.Paths[0].Path)) {
+			longitude, latitude, isPoint := pointCoordinates(value)
+			index, isDoc := document.doc[models2.SearchIndexField].(bson.M)
+			if isPoint && isDoc {
+				index[strings.TrimPrefix(distanceIndexField, models2.SearchIndexField+".")] = angularDistance(near.Longitude, near.Latitude, longitude, latitude) * earthRadius
+			}
+		}
+	}
+}
+
+// pointCoordinates returns the coordinates of a GeoJSON point in a normalized document
+func pointCoordinates(value interface{}) (longitude, latitude float64, ok bool) {
+	point, isDoc := value.(bson.M)
+	if !isDoc || point["type"] != "Point" {
+		return 0, 0, false
+	}
+	coordinates, _ := point["coordinates"].([]interface{})
+	if len(coordinates) != 2 {
+		return 0, 0, false
+	}
+	longitude, isLongitude := coordinates[0].(float64)
+	latitude, isLatitude := coordinates[1].(float64)
+	return longitude, latitude, isLongitude && isLatitude
+}
+
+// angularDistance returns the angle (in radians) between two positions, given in degrees, using the
+// haversine formula
+func angularDistance(longitude1, latitude1, longitude2, latitude2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	lat1, lat2 := toRadians(latitude1), toRadians(latitude2)
+	dLat := lat2 - lat1
+	dLong := toRadians(longitude2 - longitude1)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
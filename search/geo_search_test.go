@@ -0,0 +1,138 @@
+package search
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type GeoSearchSuite struct{}
+
+var _ = Suite(&GeoSearchSuite{})
+
+func (s *GeoSearchSuite) TestParseNearParam(c *C) {
+	q := Query{Resource: "Location", Query: "near=-37.8136|144.9631|5|[mi_i]"}
+	params := q.Params()
+	c.Assert(params, HasLen, 1)
+	near, ok := params[0].(*NearParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(near.Latitude, Equals, -37.8136)
+	c.Assert(near.Longitude, Equals, 144.9631)
+	c.Assert(near.DistanceInMetres(), Equals, 5*1609.344)
+	p, v := near.getQueryParamAndValue()
+	c.Assert(p, Equals, "near")
+	c.Assert(v, Equals, "-37.8136|144.9631|5|[mi_i]")
+
+	// kilometres are assumed
+	near = ParseNearParam("-37.8136|144.9631|5", SearchParameterDictionary["Location"]["near"])
+	c.Assert(near.DistanceInMetres(), Equals, 5000.0)
+
+	// without a distance, Locations at any distance match
+	near = ParseNearParam("-37.8136|144.9631", SearchParameterDictionary["Location"]["near"])
+	c.Assert(near.Distance, Equals, 0.0)
+
+	for _, invalid := range []string{"-37.8136", "-97|144.9631", "-37.8136|foo", "-37.8136|144.9631|-5", "-37.8136|144.9631|5|furlong", "1|2|3|km|5"} {
+		q = Query{Resource: "Location", Query: "near=" + invalid}
+		c.Assert(func() { q.Params() }, PanicMatches, "HTTP 400.*", Commentf(invalid))
+	}
+}
+
+func (s *GeoSearchSuite) TestNearDistance(c *C) {
+	q := Query{Resource: "Location", Query: "near=-37.8136:144.9631&near-distance=2|http://unitsofmeasure.org|km&name=Clinic"}
+	params := q.Params()
+	c.Assert(params, HasLen, 2)
+	near, ok := params[0].(*NearParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(near.Latitude, Equals, -37.8136)
+	c.Assert(near.DistanceInMetres(), Equals, 2000.0)
+	_, ok = params[1].(*StringParam)
+	c.Assert(ok, Equals, true)
+
+	for _, invalid := range []string{
+		"near-distance=2|http://unitsofmeasure.org|km",
+		"near=-37.8136|144.9631|5|km&near-distance=2|http://unitsofmeasure.org|km",
+		"near=-37.8136:144.9631&near-distance=2|http://unitsofmeasure.org|kg",
+		"near=-37.8136:144.9631&near-distance=2|http://snomed.info/sct|km",
+		"near=-37.8136:144.9631&near-distance=2,3",
+	} {
+		q = Query{Resource: "Location", Query: invalid}
+		c.Assert(func() { q.Params() }, PanicMatches, "HTTP 400.*", Commentf(invalid))
+	}
+}
+
+func (s *GeoSearchSuite) TestSortByDistance(c *C) {
+	q := Query{Resource: "Location", Query: "near=-37.8136|144.9631|5&_sort=near"}
+	o := q.Options()
+	c.Assert(o.SortsByDistance(), Equals, true)
+	c.Assert(q.UsesPipeline(), Equals, true)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get("_sort"), Equals, "near")
+
+	for _, invalid := range []string{"name=Clinic&_sort=near", "near=-37.8136|144.9631&_sort=-near", "near=-37.8136|144.9631&_sort=near-distance"} {
+		q = Query{Resource: "Location", Query: invalid}
+		c.Assert(func() { q.Options() }, PanicMatches, "HTTP 400.*", Commentf(invalid))
+	}
+
+	// results sorted by distance can't be paged by cursor
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{ "resourceType": "Location", "id": "a" }`))
+	c.Assert(err, IsNil)
+	q = Query{Resource: "Location", Query: "near=-37.8136|144.9631&_sort=near"}
+	cursor, err := NewPageCursor(resource, q.Options())
+	c.Assert(err, IsNil)
+	c.Assert(cursor, IsNil)
+}
+
+func (s *GeoSearchSuite) TestSearchIndexHasLocationPosition(c *C) {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Location",
+		"id": "a",
+		"position": { "longitude": 144.9631, "latitude": -37.8136 }
+	}`))
+	c.Assert(err, IsNil)
+	asBSON, err := resource.GetBSON()
+	c.Assert(err, IsNil)
+	doc := normalizeBSON(asBSON).(bson.M)
+	c.Assert(lookupValues(doc, mongoFieldParts(nearIndexField)), DeepEquals, []interface{}{
+		bson.M{"type": "Point", "coordinates": []interface{}{144.9631, -37.8136}},
+	})
+
+	resource, err = models2.NewResourceFromJsonBytes([]byte(`{ "resourceType": "Location", "id": "b", "name": "Nowhere" }`))
+	c.Assert(err, IsNil)
+	asBSON, err = resource.GetBSON()
+	c.Assert(err, IsNil)
+	c.Assert(lookupValues(normalizeBSON(asBSON), mongoFieldParts(nearIndexField)), HasLen, 0)
+}
+
+func (s *GeoSearchSuite) TestMatchesNearQuery(c *C) {
+	m := &MongoSearcher{}
+	point := func(longitude, latitude float64) bson.M {
+		return bson.M{models2.SearchIndexField: normalizeBSON(bson.D{
+			bson.DocElem{Name: "__near", Value: geoJSONPoint(longitude, latitude)},
+		})}
+	}
+	melbourne := point(144.9631, -37.8136)
+	geelong := point(144.3617, -38.1499) // about 64 km away
+	sydney := point(151.2093, -33.8688)  // about 714 km away
+
+	query := m.createParamObjects([]SearchParam{ParseNearParam("-37.8136|144.9631|100|km", SearchParameterDictionary["Location"]["near"])})[0]
+	c.Assert(matchesQuery(melbourne, query), Equals, true)
+	c.Assert(matchesQuery(geelong, query), Equals, true)
+	c.Assert(matchesQuery(sydney, query), Equals, false)
+	c.Assert(matchesQuery(bson.M{}, query), Equals, false)
+
+	query = m.createParamObjects([]SearchParam{ParseNearParam("-37.8136|144.9631|10|km", SearchParameterDictionary["Location"]["near"])})[0]
+	c.Assert(matchesQuery(geelong, query), Equals, false)
+
+	query = m.createParamObjects([]SearchParam{ParseNearParam("-37.8136|144.9631", SearchParameterDictionary["Location"]["near"])})[0]
+	c.Assert(matchesQuery(sydney, query), Equals, true)
+	c.Assert(matchesQuery(bson.M{}, query), Equals, false)
+}
+
+func (s *GeoSearchSuite) TestAngularDistance(c *C) {
+	metres := angularDistance(144.9631, -37.8136, 151.2093, -33.8688) * earthRadius
+	c.Assert(math.Abs(metres-714000) < 2000, Equals, true, Commentf(fmt.Sprint(metres)))
+	c.Assert(angularDistance(144.9631, -37.8136, 144.9631, -37.8136), Equals, 0.0)
+}
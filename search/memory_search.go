@@ -0,0 +1,819 @@
+package search
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore provides a MemorySearcher with the resources to search
+type MemoryStore interface {
+	// Resources returns the current versions of all resources of the given type, in the order they were created.
+	// The returned resources must not be shared with other callers as search includes are added to them.
+	Resources(resourceType string) ([]*models2.Resource, error)
+}
+
+// MemorySearcher implements FHIR searches over resources held in memory. Search parameters are
+// compiled into the same BSON query objects used by the MongoSearcher, which are then evaluated
+// against each resource's BSON representation, so search semantics match the Mongo backend.
+type MemorySearcher struct {
+	store             MemoryStore
+	compiler          *MongoSearcher
+	countTotalResults bool
+
+	// documents loaded during the current search, by resource type
+	collections map[string][]memoryDocument
+}
+
+type memoryDocument struct {
+	resource *models2.Resource
+	doc      bson.M
+}
+
+type memoryFilter func(doc bson.M) bool
+
+// NewMemorySearcher creates a new instance of a MemorySearcher for the given store
+func NewMemorySearcher(store MemoryStore, countTotalResults, enableCISearches bool) *MemorySearcher {
+	m := &MemorySearcher{
+		store:             store,
+		compiler:          &MongoSearcher{countTotalResults: countTotalResults, enableCISearches: enableCISearches},
+		countTotalResults: countTotalResults,
+	}
+	m.compiler.findResourcesFunc = m.findResources
+	return m
+}
+
+// Search takes a Query and returns a set of results (Resources).
+func (m *MemorySearcher) Search(query Query) (resources []*models2.Resource, total uint32, err error) {
+	m.collections = make(map[string][]memoryDocument)
+	options := query.Options()
+	if options.Cursor != nil {
+		// cursors are only generated by the MongoSearcher
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+	}
+	if options.UsesIterate() {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_include:iterate\" is not supported"))
+	}
+
+	matches, err := m.find(query.Resource, query.Params())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if m.countTotalResults || options.Summary == "count" {
+		total = uint32(len(matches))
+	}
+	if options.Summary == "count" {
+		// results should be an empty slice
+		return resources, total, nil
+	}
+
+	if options.SortsByDistance() {
+		setMemoryDistances(matches, sortNearParam(query.Params()))
+	}
+	sortMemoryDocuments(matches, options.Sort)
+
+	// support for _offset and _count
+	if options.Offset > 0 {
+		if options.Offset >= len(matches) {
+			matches = nil
+		} else {
+			matches = matches[options.Offset:]
+		}
+	}
+	if options.Count > 0 && len(matches) > options.Count {
+		matches = matches[:options.Count]
+	}
+
+	err = m.addIncludes(query.Resource, matches, options)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Search: addIncludes failed")
+	}
+
+	for _, match := range matches {
+		resources = append(resources, match.resource)
+	}
+
+	// support for _summary and _elements
+	if projection := options.ElementsProjection(query.Resource); projection != nil {
+		err = subsetResources(resources, projection)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: subsetResources failed")
+		}
+	}
+	return resources, total, nil
+}
+
+// collection returns (and caches) the documents of a resource type
+func (m *MemorySearcher) collection(resourceType string) ([]memoryDocument, error) {
+	if documents, loaded := m.collections[resourceType]; loaded {
+		return documents, nil
+	}
+
+	resources, err := m.store.Resources(resourceType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load %s resources", resourceType)
+	}
+	documents := make([]memoryDocument, len(resources))
+	for i, resource := range resources {
+		asBSON, err := resource.GetBSON()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetBSON failed for %s/%s", resourceType, resource.Id())
+		}
+		documents[i] = memoryDocument{
+			resource: resource,
+			doc:      normalizeBSON(asBSON).(bson.M),
+		}
+	}
+	m.collections[resourceType] = documents
+	return documents, nil
+}
+
+// findResources returns the resources of a type matching a query, for the compiler's _filter terminology operators
+func (m *MemorySearcher) findResources(resourceType string, query bson.M) ([]*models2.Resource, error) {
+	documents, err := m.collection(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	var resources []*models2.Resource
+	for _, document := range documents {
+		if matchesQuery(document.doc, query) {
+			resources = append(resources, document.resource)
+		}
+	}
+	return resources, nil
+}
+
+// find returns the documents of a resource type matching all the search parameters
+func (m *MemorySearcher) find(resourceType string, params []SearchParam) ([]memoryDocument, error) {
+	filters := make([]memoryFilter, len(params))
+	for i, param := range params {
+		filter, err := m.createFilter(param)
+		if err != nil {
+			return nil, err
+		}
+		filters[i] = filter
+	}
+
+	documents, err := m.collection(resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []memoryDocument
+	for _, document := range documents {
+		if allFiltersMatch(filters, document.doc) {
+			matches = append(matches, document)
+		}
+	}
+	return matches, nil
+}
+
+func allFiltersMatch(filters []memoryFilter, doc bson.M) bool {
+	for _, filter := range filters {
+		if !filter(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemorySearcher) createFilter(param SearchParam) (memoryFilter, error) {
+	switch p := param.(type) {
+	case *FullTextParam:
+		// full-text searches need a MongoDB text index
+		panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", p.Name)))
+	case *OrParam:
+		if usesChainedSearch(p) || usesReverseChainedSearch(p) {
+			filters := make([]memoryFilter, len(p.Items))
+			for i, item := range p.Items {
+				filter, err := m.createFilter(item)
+				if err != nil {
+					return nil, err
+				}
+				filters[i] = filter
+			}
+			return func(doc bson.M) bool {
+				for _, filter := range filters {
+					if filter(doc) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+	case *ReferenceParam:
+		switch ref := p.Reference.(type) {
+		case ChainedQueryReference:
+			if p.isExternalChainedSearch() {
+				return m.createChainedFilter(p, ref)
+			}
+		case ReverseChainedQueryReference:
+			return m.createReverseChainedFilter(p, ref)
+		}
+	case *FilterExpressionParam:
+		if p.Expression.usesChains() {
+			return m.createFilterExpressionFilter(p.Expression)
+		}
+	}
+
+	query := m.compiler.createParamObjects([]SearchParam{param})[0]
+	return func(doc bson.M) bool {
+		return matchesQuery(doc, query)
+	}, nil
+}
+
+// createChainedFilter matches resources referencing a resource of the chained type that itself matches the chained query
+func (m *MemorySearcher) createChainedFilter(r *ReferenceParam, ref ChainedQueryReference) (memoryFilter, error) {
+	return m.createReferencingFilter(r.Paths, ref.Type, ref.ChainedQuery.Params())
+}
+
+// createReferencingFilter matches resources referencing (at any of the paths) a resource of the given type matching all the search parameters
+func (m *MemorySearcher) createReferencingFilter(paths []SearchParamPath, resourceType string, params []SearchParam) (memoryFilter, error) {
+	chainedMatches, err := m.find(resourceType, params)
+	if err != nil {
+		return nil, err
+	}
+	matchingIds := make(map[string]bool, len(chainedMatches))
+	for _, match := range chainedMatches {
+		matchingIds[match.resource.Id()] = true
+	}
+
+	return func(doc bson.M) bool {
+		for _, path := range paths {
+			for _, id := range referenceIdsAt(doc, path.Path, resourceType) {
+				if matchingIds[id] {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// createFilterExpressionFilter matches a _filter search comparing referenced resources, whose chains are matched like chained searches
+func (m *MemorySearcher) createFilterExpressionFilter(e *FilterExpression) (memoryFilter, error) {
+	switch e.Operator {
+	case "and", "or", "not":
+		filters := make([]memoryFilter, len(e.Operands))
+		for i, operand := range e.Operands {
+			filter, err := m.createFilterExpressionFilter(operand)
+			if err != nil {
+				return nil, err
+			}
+			filters[i] = filter
+		}
+		operator := e.Operator
+		return func(doc bson.M) bool {
+			switch operator {
+			case "and":
+				return allFiltersMatch(filters, doc)
+			case "or":
+				for _, filter := range filters {
+					if filter(doc) {
+						return true
+					}
+				}
+				return false
+			default:
+				return !filters[0](doc)
+			}
+		}, nil
+	case "chain":
+		chained := &FilterExpressionParam{SearchParameterDictionary[e.Type][FilterParam], e.Operands[0]}
+		return m.createReferencingFilter(e.Param.Paths, e.Type, []SearchParam{chained})
+	}
+
+	query := m.compiler.createFilterExpressionObject(e)
+	return func(doc bson.M) bool {
+		return matchesQuery(doc, query)
+	}, nil
+}
+
+// createReverseChainedFilter matches resources referenced by a resource of another type matching the _has query
+func (m *MemorySearcher) createReverseChainedFilter(r *ReferenceParam, ref ReverseChainedQueryReference) (memoryFilter, error) {
+	referencingMatches, err := m.find(ref.Type, ref.Query.Params())
+	if err != nil {
+		return nil, err
+	}
+	referencedIds := make(map[string]bool)
+	for _, match := range referencingMatches {
+		for _, path := range r.Paths {
+			for _, id := range referenceIdsAt(match.doc, path.Path, r.Targets[0]) {
+				referencedIds[id] = true
+			}
+		}
+	}
+
+	return func(doc bson.M) bool {
+		id, _ := doc["_id"].(string)
+		return referencedIds[id]
+	}, nil
+}
+
+// addIncludes attaches _include and _revinclude resources to the matching resources
+func (m *MemorySearcher) addIncludes(resourceType string, matches []memoryDocument, options *QueryOptions) error {
+	if len(options.Include) == 0 && len(options.RevInclude) == 0 {
+		return nil
+	}
+
+	byId := make(map[string]*models2.Resource, len(matches))
+	for _, match := range matches {
+		byId[match.resource.Id()] = match.resource
+	}
+	added := make(map[string]bool)
+	addInclude := func(resource *models2.Resource, included *models2.Resource) {
+		key := resource.Id() + " " + included.ResourceType() + "/" + included.Id()
+		if !added[key] {
+			added[key] = true
+			resource.AddSearchInclude(included)
+		}
+	}
+
+	for _, incl := range options.Include {
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, inclTarget := range incl.Parameter.Targets {
+				if inclTarget == "Any" {
+					continue
+				}
+				targets, err := m.collection(inclTarget)
+				if err != nil {
+					return err
+				}
+				targetsById := make(map[string]*models2.Resource, len(targets))
+				for _, target := range targets {
+					targetsById[target.resource.Id()] = target.resource
+				}
+
+				for _, match := range matches {
+					for _, id := range referenceIdsAt(match.doc, inclPath.Path, inclTarget) {
+						if target, found := targetsById[id]; found {
+							addInclude(match.resource, target)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, incl := range options.RevInclude {
+		// we only want parameters that have the search resource as their target
+		if !isValidTarget(resourceType, incl.Parameter) {
+			continue
+		}
+		referencing, err := m.collection(incl.Parameter.Resource)
+		if err != nil {
+			return err
+		}
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, other := range referencing {
+				for _, id := range referenceIdsAt(other.doc, inclPath.Path, resourceType) {
+					if resource, found := byId[id]; found {
+						addInclude(resource, other.resource)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// referenceIdsAt returns the ids of local references of the given type at a search path
+func referenceIdsAt(doc bson.M, path string, referenceType string) []string {
+	var ids []string
+	for _, value := range expandArrays(lookupValues(doc, mongoFieldParts(path))) {
+		reference, isDoc := value.(bson.M)
+		if !isDoc {
+			continue
+		}
+		if refType, _ := reference["reference__type"].(string); referenceType != "" && refType != referenceType {
+			continue
+		}
+		if id, isString := reference["reference__id"].(string); isString {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func mongoFieldParts(path string) []string {
+	return strings.Split(convertSearchPathToMongoField(path), ".")
+}
+
+// normalizeBSON converts the output of models2.ConvertJsonToGoFhirBSON into nested bson.M documents
+func normalizeBSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return normalizeBSON([]bson.DocElem(v))
+	case []bson.DocElem:
+		doc := make(bson.M, len(v))
+		for _, elem := range v {
+			doc[elem.Name] = normalizeBSON(elem.Value)
+		}
+		return doc
+	case bson.M:
+		doc := make(bson.M, len(v))
+		for key, elem := range v {
+			doc[key] = normalizeBSON(elem)
+		}
+		return doc
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, elem := range v {
+			array[i] = normalizeBSON(elem)
+		}
+		return array
+	case *int32:
+		return *v
+	case *int64:
+		return *v
+	default:
+		return v
+	}
+}
+
+/******************************************************************************
+ * EVALUATION OF MONGO QUERY OBJECTS
+ ******************************************************************************/
+
+// matchesQuery evaluates a MongoDB query object (as created by the MongoSearcher) against a document
+func matchesQuery(doc interface{}, query bson.M) bool {
+	for key, criteria := range query {
+		switch key {
+		case "$or":
+			matched := false
+			for _, subQuery := range queryList(criteria) {
+				if matchesQuery(doc, subQuery) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$and":
+			for _, subQuery := range queryList(criteria) {
+				if !matchesQuery(doc, subQuery) {
+					return false
+				}
+			}
+		case "$nor":
+			for _, subQuery := range queryList(criteria) {
+				if matchesQuery(doc, subQuery) {
+					return false
+				}
+			}
+		default:
+			if !matchesField(lookupValues(doc, strings.Split(key, ".")), criteria) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func queryList(criteria interface{}) []bson.M {
+	switch list := criteria.(type) {
+	case []bson.M:
+		return list
+	case []interface{}:
+		queries := make([]bson.M, 0, len(list))
+		for _, item := range list {
+			if query, ok := item.(bson.M); ok {
+				queries = append(queries, query)
+			}
+		}
+		return queries
+	}
+	panic(createInternalServerError("", fmt.Sprintf("invalid query list: %#v", criteria)))
+}
+
+// lookupValues returns the values at a dotted path, traversing arrays like MongoDB does
+func lookupValues(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case bson.M:
+		child, found := v[parts[0]]
+		if !found {
+			return nil
+		}
+		return lookupValues(child, parts[1:])
+	case []interface{}:
+		if index, err := strconv.Atoi(parts[0]); err == nil {
+			if index < len(v) {
+				return lookupValues(v[index], parts[1:])
+			}
+			return nil
+		}
+		var results []interface{}
+		for _, elem := range v {
+			if _, isDoc := elem.(bson.M); isDoc {
+				results = append(results, lookupValues(elem, parts)...)
+			}
+		}
+		return results
+	}
+	return nil
+}
+
+// expandArrays returns the values together with the elements of any arrays amongst them
+func expandArrays(values []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, value := range values {
+		if array, isArray := value.([]interface{}); isArray {
+			expanded = append(expanded, array...)
+		}
+		expanded = append(expanded, value)
+	}
+	return expanded
+}
+
+func isOperatorDocument(criteria interface{}) (bson.M, bool) {
+	doc, isDoc := criteria.(bson.M)
+	if !isDoc || len(doc) == 0 {
+		return nil, false
+	}
+	for key := range doc {
+		if !isQueryOperator(key) || key == "$or" || key == "$and" || key == "$nor" {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func matchesField(values []interface{}, criteria interface{}) bool {
+	if operators, isOperators := isOperatorDocument(criteria); isOperators {
+		for operator, argument := range operators {
+			if !matchesOperator(values, operator, argument) {
+				return false
+			}
+		}
+		return true
+	}
+	return anyValue(values, func(value interface{}) bool {
+		return valuesEqual(value, criteria)
+	})
+}
+
+func anyValue(values []interface{}, predicate func(interface{}) bool) bool {
+	for _, value := range expandArrays(values) {
+		if predicate(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesOperator(values []interface{}, operator string, argument interface{}) bool {
+	switch operator {
+	case "$exists":
+		exists, _ := argument.(bool)
+		return (len(values) > 0) == exists
+	case "$ne":
+		return !anyValue(values, func(value interface{}) bool {
+			return valuesEqual(value, argument)
+		})
+	case "$in", "$nin":
+		list := reflect.ValueOf(argument)
+		found := anyValue(values, func(value interface{}) bool {
+			for i := 0; i < list.Len(); i++ {
+				if valuesEqual(value, list.Index(i).Interface()) {
+					return true
+				}
+			}
+			return false
+		})
+		return found == (operator == "$in")
+	case "$not":
+		return !matchesField(values, argument)
+	case "$regex":
+		return anyValue(values, func(value interface{}) bool {
+			return valuesEqual(value, bson.RegEx{Pattern: fmt.Sprint(argument)})
+		})
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyValue(values, func(value interface{}) bool {
+			cmp, comparable := compareValues(value, argument)
+			if !comparable {
+				return false
+			}
+			switch operator {
+			case "$gt":
+				return cmp > 0
+			case "$gte":
+				return cmp >= 0
+			case "$lt":
+				return cmp < 0
+			default:
+				return cmp <= 0
+			}
+		})
+	case "$elemMatch":
+		for _, value := range values {
+			array, isArray := value.([]interface{})
+			if !isArray {
+				continue
+			}
+			for _, elem := range array {
+				var matched bool
+				if _, isOperators := isOperatorDocument(argument); isOperators {
+					matched = matchesField([]interface{}{elem}, argument)
+				} else if query, isQuery := argument.(bson.M); isQuery {
+					matched = matchesQuery(elem, query)
+				}
+				if matched {
+					return true
+				}
+			}
+		}
+		return false
+	case "$geoWithin":
+		return matchesGeoWithin(values, argument)
+	}
+	panic(createInternalServerError("", fmt.Sprintf("query operator %s is not supported by the in-memory searcher", operator)))
+}
+
+var memoryRegexCache sync.Map
+
+func valuesEqual(value interface{}, criteria interface{}) bool {
+	switch c := criteria.(type) {
+	case bson.RegEx:
+		s, isString := value.(string)
+		if !isString {
+			return false
+		}
+		pattern := c.Pattern
+		if strings.Contains(c.Options, "i") {
+			pattern = "(?i)" + pattern
+		}
+		re, cached := memoryRegexCache.Load(pattern)
+		if !cached {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("invalid regular expression: %s", c.Pattern)))
+			}
+			re, _ = memoryRegexCache.LoadOrStore(pattern, compiled)
+		}
+		return re.(*regexp.Regexp).MatchString(s)
+	case nil:
+		return value == nil
+	}
+
+	if cmp, comparable := compareValues(value, criteria); comparable {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(value, criteria)
+}
+
+// compareValues compares two scalar values of the same kind
+func compareValues(a, b interface{}) (cmp int, comparable bool) {
+	if aNum, isNum := toBigFloat(a); isNum {
+		if bNum, isNum := toBigFloat(b); isNum {
+			return aNum.Cmp(bNum), true
+		}
+		return 0, false
+	}
+
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case !a:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func toBigFloat(value interface{}) (*big.Float, bool) {
+	switch v := value.(type) {
+	case float64:
+		return big.NewFloat(v), true
+	case float32:
+		return big.NewFloat(float64(v)), true
+	case int:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int32:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int64:
+		return new(big.Float).SetInt64(v), true
+	}
+	return nil, false
+}
+
+/******************************************************************************
+ * SORTING
+ ******************************************************************************/
+
+func sortMemoryDocuments(documents []memoryDocument, sortOptions []SortOption) {
+	if len(sortOptions) == 0 {
+		return
+	}
+
+	keys := make([][]interface{}, len(documents))
+	for i, document := range documents {
+		keys[i] = make([]interface{}, len(sortOptions))
+		for j, option := range sortOptions {
+			// Note: If there are multiple paths, we only look at the first one (like the MongoSearcher)
+			values := lookupValues(document.doc, mongoFieldParts(option.Parameter.Paths[0].Path))
+			keys[i][j] = sortKey(values, option.Descending)
+		}
+	}
+
+	indexes := make([]int, len(documents))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(x, y int) bool {
+		for j, option := range sortOptions {
+			cmp := compareSortValues(keys[indexes[x]][j], keys[indexes[y]][j])
+			if option.Descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	sorted := make([]memoryDocument, len(documents))
+	for i, index := range indexes {
+		sorted[i] = documents[index]
+	}
+	copy(documents, sorted)
+}
+
+// sortKey returns the value MongoDB sorts a document by: the lowest value for ascending
+// sorts or the highest for descending sorts
+func sortKey(values []interface{}, descending bool) interface{} {
+	var key interface{}
+	for _, value := range expandArrays(values) {
+		if _, isArray := value.([]interface{}); isArray {
+			continue
+		}
+		cmp := compareSortValues(value, key)
+		if key == nil || (descending && cmp > 0) || (!descending && cmp < 0) {
+			key = value
+		}
+	}
+	return key
+}
+
+// compareSortValues orders values of any kind. Missing values sort first; embedded documents
+// (e.g. dates) are compared by their __from field.
+func compareSortValues(a, b interface{}) int {
+	if doc, isDoc := a.(bson.M); isDoc {
+		a = doc[models2.Gofhir__from]
+	}
+	if doc, isDoc := b.(bson.M); isDoc {
+		b = doc[models2.Gofhir__from]
+	}
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if cmp, comparable := compareValues(a, b); comparable {
+		return cmp
+	}
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"github.com/pkg/errors"
+	"math/big"
 	"net/http"
 	"context"
 	"regexp"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/utils"
 	"github.com/mongodb/mongo-go-driver/mongo"
 	"github.com/mongodb/mongo-go-driver/mongo/findopt"
 	"github.com/mongodb/mongo-go-driver/mongo/aggregateopt"
@@ -77,8 +79,19 @@ type MongoSearcher struct {
 	countTotalResults bool
 	enableCISearches  bool
 	readonly          bool
+
+	// the most rounds of _include:iterate and _revinclude:iterate resolution done for a search
+	maxIncludeIterations int
+
+	// finds the ValueSets and CodeSystems of _filter's terminology operators instead of findResources,
+	// for searchers without a database
+	findResourcesFunc func(resourceType string, query bson.M) ([]*models2.Resource, error)
 }
 
+// DefaultMaxIncludeIterations is the default limit on the rounds of _include:iterate and
+// _revinclude:iterate resolution done for a search
+const DefaultMaxIncludeIterations = 4
+
 func (dal *MongoSearcher) debug(format string, a ...interface{}) {
 	return
 	fmt.Println()
@@ -93,14 +106,24 @@ func (dal *MongoSearcher) debug(format string, a ...interface{}) {
 // NewMongoSearcher creates a new instance of a MongoSearcher for an already open session
 func NewMongoSearcher(db *mongo.Database, session *mongo.Session, countTotalResults, enableCISearches, readonly bool) *MongoSearcher {
 	return &MongoSearcher{
-		db:                db,
-		session:	       session,
-		countTotalResults: countTotalResults,
-		enableCISearches:  enableCISearches,
-		readonly:          readonly,
+		db:                   db,
+		session:              session,
+		countTotalResults:    countTotalResults,
+		enableCISearches:     enableCISearches,
+		readonly:             readonly,
+		maxIncludeIterations: DefaultMaxIncludeIterations,
 	}
 }
 
+// SetMaxIncludeIterations limits the rounds of _include:iterate and _revinclude:iterate resolution
+// done for a search. Values less than 1 restore the default.
+func (m *MongoSearcher) SetMaxIncludeIterations(maxIncludeIterations int) {
+	if maxIncludeIterations < 1 {
+		maxIncludeIterations = DefaultMaxIncludeIterations
+	}
+	m.maxIncludeIterations = maxIncludeIterations
+}
+
 // NewMongoSearcher creates a new instance of a MongoSearcher with a new connection
 // Call Close()
 func NewMongoSearcherForUri(mongoUri string, mongoDatabaseName string, countTotalResults, enableCISearches, readonly bool) *MongoSearcher {
@@ -118,11 +141,12 @@ func NewMongoSearcherForUri(mongoUri string, mongoDatabaseName string, countTota
 	db := client.Database(mongoDatabaseName)
 
 	return &MongoSearcher{
-		db:                db,
-		session:	       session,
-		countTotalResults: countTotalResults,
-		enableCISearches:  enableCISearches,
-		readonly:          readonly,
+		db:                   db,
+		session:              session,
+		countTotalResults:    countTotalResults,
+		enableCISearches:     enableCISearches,
+		readonly:             readonly,
+		maxIncludeIterations: DefaultMaxIncludeIterations,
 	}
 }
 
@@ -194,6 +218,12 @@ func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, tota
 
 	// Check if the query returned any errors
 	if err != nil {
+		if strings.Contains(err.Error(), "text index required") {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Full-text search of %s resources requires a text index (see indexes.conf)", query.Resource)))
+		}
+		if strings.Contains(err.Error(), "geoNear") && (strings.Contains(err.Error(), "index") || strings.Contains(err.Error(), "indices")) {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Sorting %s resources by distance requires a 2dsphere index (see indexes.conf)", query.Resource)))
+		}
 		return nil, 0, errors.Wrap(err, "Search error")
 
 		// TODO?
@@ -231,6 +261,22 @@ func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, tota
 		}
 	}
 
+	// support for _include:iterate and _revinclude:iterate
+	if options.UsesIterate() {
+		err = m.addIteratedIncludes(resources, options)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: addIteratedIncludes failed")
+		}
+	}
+
+	// tag the results of searches with _summary or _elements as SUBSETTED
+	if projection := options.ElementsProjection(query.Resource); projection != nil {
+		err = subsetResources(resources, projection)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: subsetResources failed")
+		}
+	}
+
 	// If the count wasn't already in cache, add it to cache.
 	if m.readonly && m.countTotalResults && doCount {
 		countcache := &CountCache{
@@ -261,8 +307,11 @@ func (m *MongoSearcher) aggregate(bsonQuery *BSONQuery, options *QueryOptions, d
 			// The pipeline is only being used for includes/revincludes, meaning the entire
 			// collection is being searched. It's faster just to get a total count from the
 			// collection after a find operation. The first stage in the Pipeline will
-			// always be a $match stage.
-			match := bsonQuery.Pipeline[0]["$match"]
+			// always be a $match stage, or a $geoNear stage with the same query.
+			match, isMatch := bsonQuery.Pipeline[0]["$match"]
+			if !isMatch {
+				match = bsonQuery.Pipeline[0]["$geoNear"].(bson.M)["query"]
+			}
 			intTotal, err := c.Count(context.TODO(), match, m.session)
 			if err != nil {
 				return nil, 0, err
@@ -358,29 +407,32 @@ func (m *MongoSearcher) find(bsonQuery *BSONQuery, options *QueryOptions, doCoun
 		return nil, total, nil
 	}
 
+	query := bsonQuery.Query
 	var optionsBundle *findopt.FindBundle = findopt.BundleFind(m.session)
 	if options != nil {
 		removeParallelArraySorts(options)
-		if len(options.Sort) > 0 {
-			fields := bson2.NewDocument()
-			for i := range options.Sort {
-				// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
-				field := convertSearchPathToMongoField(options.Sort[i].Parameter.Paths[0].Path)
-				if options.Sort[i].Descending {
-					fields.Set(bson2.EC.Int32(field, -1))
-				} else {
-					fields.Set(bson2.EC.Int32(field, 1))
-				}
-			}
-			optionsBundle = optionsBundle.Sort(fields)
+		fields := bson2.NewDocument()
+		for _, field := range mongoSortFields(options) {
+			fields.Set(bson2.EC.Int32(field.Name, int32(field.Value.(int))))
+		}
+		optionsBundle = optionsBundle.Sort(fields)
+		if options.Cursor != nil {
+			// support for _cursor: continue after the last result of the previous page
+			query = bson.M{}
+			merge(query, bsonQuery.Query)
+			merge(query, createCursorQueryObject(options))
 		}
 		if options.Offset > 0 {
 			optionsBundle = optionsBundle.Skip(int64(options.Offset))
 		}
 		optionsBundle = optionsBundle.Limit(int64(options.Count))
+		// support for _summary and _elements
+		if projection := options.ElementsProjection(bsonQuery.Resource); projection != nil {
+			optionsBundle = optionsBundle.Projection(bson1ToBytes(projection.MongoProjection()))
+		}
 	}
 
-	searchCursor, err := c.Find(context.TODO(), bson1ToBytes(bsonQuery.Query), optionsBundle)
+	searchCursor, err := c.Find(context.TODO(), bson1ToBytes(query), optionsBundle)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "search find operation failed")
 	}
@@ -403,6 +455,17 @@ func (m *MongoSearcher) createQueryObject(query Query) bson.M {
 }
 
 func (m *MongoSearcher) createQueryObjectFromParams(params []SearchParam) bson.M {
+	textSearches := 0
+	for _, p := range params {
+		if _, isText := p.(*FullTextParam); isText {
+			textSearches++
+		}
+	}
+	if textSearches > 1 {
+		// MongoDB only allows a single $text query
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Only one \"_text\" or \"_content\" parameter is supported"))
+	}
+
 	result := bson.M{}
 	for _, p := range m.createParamObjects(params) {
 		merge(result, p)
@@ -417,6 +480,8 @@ func (m *MongoSearcher) createParamObjects(params []SearchParam) []bson.M {
 		switch p := p.(type) {
 		case *CompositeParam:
 			results[i] = m.createCompositeQueryObject(p)
+		case *MissingParam:
+			results[i] = m.createMissingQueryObject(p)
 		case *DateParam:
 			results[i] = m.createDateQueryObject(p)
 		case *NumberParam:
@@ -433,6 +498,12 @@ func (m *MongoSearcher) createParamObjects(params []SearchParam) []bson.M {
 			results[i] = m.createURIQueryObject(p)
 		case *OrParam:
 			results[i] = m.createOrQueryObject(p)
+		case *FullTextParam:
+			results[i] = m.createFullTextQueryObject(p)
+		case *FilterExpressionParam:
+			results[i] = m.createFilterQueryObject(p)
+		case *NearParam:
+			results[i] = m.createNearQueryObject(p)
 		default:
 			// Check for custom search parameter implementations
 			builder, err := GlobalMongoRegistry().LookupBSONBuilder(p.getInfo().Type)
@@ -470,9 +541,17 @@ func (m *MongoSearcher) createPipelineObject(query Query) []bson.M {
 
 	// Process standard SearchParams
 	pipeline := []bson.M{{"$match": m.createQueryObjectFromParams(standardSearchParams)}}
+	if query.Options().SortsByDistance() {
+		// support for _sort=near: the $geoNear stage also finds the results, as it must come first
+		pipeline[0] = m.createGeoNearStage(standardSearchParams, pipeline[0]["$match"].(bson.M))
+	}
 
 	// Process chained search parameters
 	for _, p := range chainedSearchParams {
+		if filter, isFilter := p.(*FilterExpressionParam); isFilter {
+			pipeline = append(pipeline, m.createChainedFilterPipelineStages(filter)...)
+			continue
+		}
 		pipeline = append(pipeline, m.createChainedSearchPipelineStages(p)...)
 	}
 
@@ -487,21 +566,14 @@ func (m *MongoSearcher) createPipelineObject(query Query) []bson.M {
 func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *QueryOptions) []bson.M {
 	p := []bson.M{}
 
+	// support for _cursor
+	if o.Cursor != nil {
+		p = append(p, bson.M{"$match": createCursorQueryObject(o)})
+	}
+
 	// support for _sort
 	removeParallelArraySorts(o)
-	if len(o.Sort) > 0 {
-		var sortBSOND bson.D
-		for _, sort := range o.Sort {
-			// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
-			field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
-			order := 1
-			if sort.Descending {
-				order = -1
-			}
-			sortBSOND = append(sortBSOND, bson.DocElem{Name: field, Value: order})
-		}
-		p = append(p, bson.M{"$sort": sortBSOND})
-	}
+	p = append(p, bson.M{"$sort": mongoSortFields(o)})
 
 	// support for _offset
 	if o.Offset > 0 {
@@ -510,9 +582,12 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 	// support for _count
 	p = append(p, bson.M{"$limit": o.Count})
 
-	// support for _include
+	// support for _include (iterated includes are resolved after the search, see addIteratedIncludes)
 	if len(o.Include) > 0 {
 		for _, incl := range o.Include {
+			if incl.Iterate {
+				continue
+			}
 			for _, inclPath := range incl.Parameter.Paths {
 				if inclPath.Type != "Reference" {
 					continue
@@ -544,6 +619,9 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 	// support for _revinclude
 	if len(o.RevInclude) > 0 {
 		for _, incl := range o.RevInclude {
+			if incl.Iterate {
+				continue
+			}
 			// we only want parameters that have the search resource as their target
 			targetsSearchResource := false
 			for _, inclTarget := range incl.Parameter.Targets {
@@ -580,9 +658,170 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 			}
 		}
 	}
+
+	// support for _summary and _elements
+	if projection := o.ElementsProjection(resource); projection != nil {
+		project := projection.MongoProjection()
+		if projection.Included != nil {
+			// keep the included resources looked up above
+			for _, stage := range p {
+				if lookup, isLookup := stage["$lookup"]; isLookup {
+					project[lookup.(bson.M)["as"].(string)] = 1
+				}
+			}
+		}
+		p = append(p, bson.M{"$project": project})
+	}
 	return p
 }
 
+// addIteratedIncludes resolves the _include:iterate and _revinclude:iterate options, which apply to the
+// included resources as well as to the matches. The resources found by each round are fed into the next
+// until no new resources are found or maxIncludeIterations rounds have been done. As the bundle only
+// needs each included resource once, they are all attached to the first match.
+func (m *MongoSearcher) addIteratedIncludes(resources []*models2.Resource, options *QueryOptions) error {
+	if len(resources) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var next []*models2.Resource
+	add := func(resource *models2.Resource) bool {
+		key := resource.ResourceType() + "/" + resource.Id()
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		next = append(next, resource)
+		return true
+	}
+	for _, resource := range resources {
+		add(resource)
+		for _, included := range resource.SearchIncludes() {
+			add(included)
+		}
+	}
+
+	for i := 0; i < m.maxIncludeIterations && len(next) > 0; i++ {
+		found, err := m.findIteratedIncludes(next, options)
+		if err != nil {
+			return err
+		}
+		next = nil
+		for _, included := range found {
+			if add(included) {
+				resources[0].AddSearchInclude(included)
+			}
+		}
+	}
+	return nil
+}
+
+// findIteratedIncludes finds the resources that the iterated _include and _revinclude options
+// include for the given resources
+func (m *MongoSearcher) findIteratedIncludes(sources []*models2.Resource, options *QueryOptions) ([]*models2.Resource, error) {
+	docs := make([]bson.M, len(sources))
+	for i, source := range sources {
+		asBSON, err := source.GetBSON()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetBSON failed for %s/%s", source.ResourceType(), source.Id())
+		}
+		docs[i] = normalizeBSON(asBSON).(bson.M)
+	}
+
+	var found []*models2.Resource
+	for _, incl := range options.Include {
+		if !incl.Iterate {
+			continue
+		}
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, inclTarget := range incl.Parameter.Targets {
+				if inclTarget == "Any" {
+					continue
+				}
+				var ids []string
+				for i, source := range sources {
+					if source.ResourceType() == incl.Resource {
+						ids = append(ids, referenceIdsAt(docs[i], inclPath.Path, inclTarget)...)
+					}
+				}
+				if len(ids) == 0 {
+					continue
+				}
+				included, err := m.findResources(inclTarget, bson.M{"_id": bson.M{"$in": ids}})
+				if err != nil {
+					return nil, err
+				}
+				found = append(found, included...)
+			}
+		}
+	}
+
+	for _, incl := range options.RevInclude {
+		if !incl.Iterate {
+			continue
+		}
+		var ids []string
+		for _, source := range sources {
+			if isValidTarget(source.ResourceType(), incl.Parameter) {
+				ids = append(ids, source.Id())
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		var criteria []bson.M
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			// Mongo paths shouldn't have the array indicators, so remove them
+			field := strings.Replace(inclPath.Path, "[]", "", -1) + ".reference__id"
+			criteria = append(criteria, bson.M{field: bson.M{"$in": ids}})
+		}
+		if len(criteria) == 0 {
+			continue
+		}
+		included, err := m.findResources(incl.Parameter.Resource, bson.M{"$or": criteria})
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, included...)
+	}
+	return found, nil
+}
+
+// findResources returns the resources of a type matching a query
+func (m *MongoSearcher) findResources(resourceType string, query bson.M) ([]*models2.Resource, error) {
+	c := m.db.Collection(models.PluralizeLowerResourceName(resourceType))
+	cursor, err := c.Find(context.TODO(), bson1ToBytes(query), m.session)
+	if err != nil {
+		return nil, errors.Wrapf(err, "find of %s resources failed", resourceType)
+	}
+	defer cursor.Close(context.TODO())
+
+	var resources []*models2.Resource
+	for cursor.Next(context.TODO()) {
+		var document bson2.Document
+		err := cursor.Decode(&document)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding %s resource failed", resourceType)
+		}
+		resource, err := models2.NewResourceFromBSON2(&document)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewResourceFromBSON failed")
+		}
+		resources = append(resources, resource)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrapf(err, "%s cursor error", resourceType)
+	}
+	return resources, nil
+}
+
 // The SearchParam argument should be either a ReferenceParam or an OrParam.
 func (m *MongoSearcher) createChainedSearchPipelineStages(searchParam SearchParam) []bson.M {
 	// This returns stages in the pipeline that represent a chained query reference:
@@ -627,6 +866,7 @@ func (m *MongoSearcher) createChainedSearchPipelineStages(searchParam SearchPara
 	} else {
 		matchableParams = prependLookupKeyToSearchPaths(chainedRef.ChainedQuery.Params(), len(lookupRef.Paths))
 	}
+	panicOnChainedFullTextSearch(matchableParams)
 
 	stages[len(stages)-1] = bson.M{"$match": m.createQueryObjectFromParams(matchableParams)}
 
@@ -677,6 +917,7 @@ func (m *MongoSearcher) createReverseChainedSearchPipelineStages(searchParam Sea
 	} else {
 		matchableParams = prependLookupKeyToSearchPaths(revChainedRef.Query.Params(), len(lookupRef.Paths))
 	}
+	panicOnChainedFullTextSearch(matchableParams)
 
 	stages[len(stages)-1] = bson.M{"$match": m.createQueryObjectFromParams(matchableParams)}
 
@@ -802,18 +1043,180 @@ func panicOnUnsupportedFeatures(p SearchParam) {
 		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.getInfo().Name)))
 	}
 
-	// No modifiers are supported except for resource types in reference parameters
-	_, isRef := p.(*ReferenceParam)
+	// Only :missing, :exact and :contains on strings, :not and :text on tokens and resource types
+	// and :identifier on references are supported
 	modifier := p.getInfo().Modifier
-	if modifier != "" {
-		if _, ok := SearchParameterDictionary[modifier]; !isRef || !ok {
-			panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", p.getInfo().Name)))
+	if modifier != "" && !supportsModifier(p, modifier) {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", p.getInfo().Name)))
+	}
+}
+
+func supportsModifier(p SearchParam, modifier string) bool {
+	switch p := p.(type) {
+	case *MissingParam:
+		// composites don't have paths of their own
+		return len(p.Paths) > 0
+	case *StringParam:
+		return modifier == "exact" || modifier == "contains"
+	case *TokenParam:
+		return modifier == "not" || modifier == "text"
+	case *ReferenceParam:
+		_, isResourceType := SearchParameterDictionary[modifier]
+		return isResourceType || modifier == "identifier"
+	}
+	return false
+}
+
+// createFullTextQueryObject searches the collection's text index, which is configured in
+// indexes.conf. As the index may cover the whole resource, _text searches also check that the
+// required words and phrases are in the narrative (although negated words exclude resources
+// that have them anywhere).
+func (m *MongoSearcher) createFullTextQueryObject(p *FullTextParam) bson.M {
+	search, err := newMongoTextSearch(p.Expression)
+	if err != nil {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is not supported: %s", p.Name, err)))
+	}
+
+	result := bson.M{"$text": bson.M{"$search": search.Search}}
+	if p.Name == TextParam {
+		narrative := convertSearchPathToMongoField(p.Paths[0].Path)
+		var criteria []bson.M
+		for _, term := range search.AllOf {
+			criteria = append(criteria, bson.M{narrative: textRegex(term)})
+		}
+		if len(search.AnyOf) > 0 {
+			anyOf := make([]bson.M, len(search.AnyOf))
+			for i, term := range search.AnyOf {
+				anyOf[i] = bson.M{narrative: textRegex(term)}
+			}
+			criteria = append(criteria, bson.M{"$or": anyOf})
+		}
+		result["$and"] = criteria
+	}
+	return result
+}
+
+// textRegex matches text containing a word or phrase, ignoring case like MongoDB text searches
+func textRegex(term string) bson.RegEx {
+	return bson.RegEx{Pattern: regexp.QuoteMeta(term), Options: "i"}
+}
+
+// panicOnChainedFullTextSearch rejects _text and _content in chained searches, as MongoDB only
+// allows $text queries in the first stage of a pipeline
+func panicOnChainedFullTextSearch(params []SearchParam) {
+	for _, p := range params {
+		items := []SearchParam{p}
+		if or, isOr := p.(*OrParam); isOr {
+			items = or.Items
+		}
+		for _, item := range items {
+			if _, isText := item.(*FullTextParam); isText {
+				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" is not supported in chained searches", item.getInfo().Name)))
+			}
 		}
 	}
 }
 
+// createMissingQueryObject matches resources without a value at any of the parameter's
+// paths (:missing=true) or with a value at one of them (:missing=false)
+func (m *MongoSearcher) createMissingQueryObject(p *MissingParam) bson.M {
+	if !p.Missing {
+		return orPaths(func(path SearchParamPath) bson.M {
+			return bson.M{convertSearchPathToMongoField(path.Path): bson.M{"$exists": true}}
+		}, p.Paths)
+	}
+
+	criteria := make([]bson.M, len(p.Paths))
+	for i, path := range p.Paths {
+		criteria[i] = bson.M{convertSearchPathToMongoField(path.Path): bson.M{"$exists": false}}
+	}
+	if len(criteria) == 1 {
+		return criteria[0]
+	}
+	return bson.M{"$and": criteria}
+}
+
+// createCompositeQueryObject matches the values of a composite parameter's components, e.g.
+// the code and value-quantity of code-value-quantity. Components with paths within the same
+// array (e.g. Observation.component) must match the same element of that array, so their
+// criteria are combined under an $elemMatch. Components with paths in several arrays (e.g. the
+// combo-* parameters) are matched within each of them in turn.
 func (m *MongoSearcher) createCompositeQueryObject(c *CompositeParam) bson.M {
-	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	if len(c.CompositeValues) != len(c.Composites) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", c.Name)))
+	}
+
+	components := make([]SearchParamInfo, len(c.Composites))
+	for i, name := range c.Composites {
+		info, ok := SearchParameterDictionary[c.Resource][name]
+		if !ok {
+			panic(createInternalServerError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", name)))
+		}
+		components[i] = info
+	}
+
+	// Group the paths of the components by the array containing them
+	var arrays []string
+	relativePaths := make([]map[string][]SearchParamPath, len(components))
+	for i, info := range components {
+		relativePaths[i] = make(map[string][]SearchParamPath)
+		for _, p := range info.Paths {
+			array, path := splitAtLastArray(p.Path)
+			if !contains(arrays, array) {
+				arrays = append(arrays, array)
+			}
+			relativePaths[i][array] = append(relativePaths[i][array], SearchParamPath{Path: path, Type: p.Type})
+		}
+	}
+
+	var results []bson.M
+	for _, array := range arrays {
+		criteria := make([]bson.M, 0, len(components))
+		for i, info := range components {
+			paths, ok := relativePaths[i][array]
+			if !ok {
+				// this component has no path within this array
+				criteria = nil
+				break
+			}
+			component := info.clone()
+			component.Paths = paths
+			criteria = append(criteria, m.createParamObjects([]SearchParam{component.CreateSearchParam(c.CompositeValues[i])})...)
+		}
+		if criteria == nil {
+			continue
+		}
+
+		if array == "" {
+			results = append(results, bson.M{"$and": criteria})
+		} else {
+			results = append(results, bson.M{
+				convertSearchPathToMongoField(array): bson.M{"$elemMatch": bson.M{"$and": criteria}},
+			})
+		}
+	}
+
+	switch len(results) {
+	case 0:
+		panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" has components that can't be matched together", c.Name)))
+	case 1:
+		return results[0]
+	default:
+		return bson.M{"$or": results}
+	}
+}
+
+// splitAtLastArray splits a search path into the path of the innermost array it passes through
+// and the path within an element of that array, e.g. "a.[]b.c.d" into "a.[]b" and "c.d".
+// Paths that don't pass through an array, or whose leaf is the array, are returned unchanged.
+func splitAtLastArray(path string) (array string, rest string) {
+	parts := strings.Split(path, ".")
+	for i := len(parts) - 2; i >= 0; i-- {
+		if strings.HasPrefix(parts[i], "[]") {
+			return strings.Join(parts[:i+1], "."), strings.Join(parts[i+1:], ".")
+		}
+	}
+	return "", path
 }
 
 func (m *MongoSearcher) createDateQueryObject(d *DateParam) bson.M {
@@ -1114,101 +1517,108 @@ func (m *MongoSearcher) createNumberQueryObject(n *NumberParam) bson.M {
 }
 
 func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
+	if q.Number.Value == nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
+	}
+
+	var criteria []bson.M
+	if q.System == "" && q.Code == "" {
+		// [parameter]=[prefix][number] matches the value regardless of its units
+		criteria = quantityValueCriteria(q, "value", q.Number.Value, q.Number.RangeLowIncl(), q.Number.RangeHighExcl(), nil)
+	} else {
+		// Quantities with UCUM units are also stored in canonical units (see models2.ConvertJsonToGoFhirBSON)
+		// so that e.g. 5.5 mmol/L matches 5500 umol/L.  Values stored by earlier versions or in units that can't
+		// be converted still match by their code.
+		if q.System == "" || q.System == utils.UCUMSystem {
+			if unit, err := utils.ParseUCUM(q.Code); err == nil {
+				field := models2.QuantityCanonicalField
+				criteria = quantityValueCriteria(q, field+".value",
+					unit.Convert(q.Number.Value), unit.Convert(q.Number.RangeLowIncl()), unit.Convert(q.Number.RangeHighExcl()),
+					bson.M{field + ".code": unit.Canonical()})
+			}
+		}
+
+		if q.System == "" {
+			// [parameter]=[prefix][number]||[code] matches either the unit or the code
+			// (http://hl7.org/fhir/search.html#quantity)
+			criteria = append(criteria, quantityValueCriteria(q, "value", q.Number.Value, q.Number.RangeLowIncl(), q.Number.RangeHighExcl(), bson.M{"code": m.ci(q.Code)})...)
+			criteria = append(criteria, quantityValueCriteria(q, "value", q.Number.Value, q.Number.RangeLowIncl(), q.Number.RangeHighExcl(), bson.M{"unit": m.ci(q.Code)})...)
+		} else {
+			criteria = append(criteria, quantityValueCriteria(q, "value", q.Number.Value, q.Number.RangeLowIncl(), q.Number.RangeHighExcl(), bson.M{"code": m.ci(q.Code), "system": m.ci(q.System)})...)
+		}
+	}
+
 	single := func(p SearchParamPath) bson.M {
-		l, _ := q.Number.RangeLowIncl().Float64()
-		h, _ := q.Number.RangeHighExcl().Float64()
-		exact, _ := q.Number.Value.Float64()
+		if len(criteria) == 1 {
+			return buildBSON(p.Path, criteria[0])
+		}
+		// each alternative is built separately so that an $elemMatch is used for each when needed
+		alternatives := make([]bson.M, len(criteria))
+		for i := range criteria {
+			alternatives[i] = buildBSON(p.Path, criteria[i])
+		}
+		return bson.M{"$or": alternatives}
+	}
 
-		var criteria bson.M
+	return orPaths(single, q.Paths)
+}
 
-		switch q.Prefix {
-		case EQ:
-			criteria = bson.M{
-				"value.__from": bson.M{
-					"$gte": l,
-				},
-				"value.__to": bson.M{
-					"$lte":  h,
-				},
-			}
+// quantityValueCriteria returns the criteria comparing the decimal value of a quantity at field with a
+// search value, with the fields of other added to each.  A comparison that needs an $or returns each of
+// its alternatives so that they can be combined with the alternatives for the units.
+func quantityValueCriteria(q *QuantityParam, field string, value, low, high *big.Rat, other bson.M) []bson.M {
+	l, _ := low.Float64()
+	h, _ := high.Float64()
+	exact, _ := value.Float64()
 
-		case LT:
-			criteria = bson.M{
-				"value.__from": bson.M{"$lt": exact},
-			}
-		case GT:
-			criteria = bson.M{
-				"value.__to": bson.M{"$gt": exact},
-			}
-		case GE:
-			criteria = bson.M{
-				"$or": []bson.M{
-					bson.M{
-						// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
-						"value.__to": bson.M{
-							"$gte": h,
-						},
-					},
-					bson.M{
-						// "or the range of the search value fully contains the range of the target value"
-						"value.__from": bson.M{
-							"$gte": l,
-						},
-					},
+	var criteria []bson.M
+
+	switch q.Prefix {
+	case EQ:
+		criteria = []bson.M{
+			bson.M{
+				field + ".__from": bson.M{
+					"$gte": l,
 				},
-			}
-		case LE:
-			criteria = bson.M{
-				"$or": []bson.M{
-					bson.M{
-						// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
-						"value.__from": bson.M{
-							"$lte": l,
-						},
-					},
-					bson.M{
-						// "or the range of the search value fully contains the range of the target value"
-						"value.__to": bson.M{
-							"$lte": h,
-						},
-					},
+				field + ".__to": bson.M{
+					"$lte": h,
 				},
-			}
-		default:
-			// NE, SA, EB are not supported for Quantity queries
-			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
+			},
 		}
 
-		if q.System == "" {
-
-			// FIXME: need to search by both the 'units' and 'code' field...............
-			// (http://build.fhir.org/search.html#quantity)
-			// however query with $and is not working since the $and seems to need to be at the
-			// very top of the mongodb query
-			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": search by quantity with a code system not yet supported", q.Name)))
-
-			// orClause := []bson.M{
-			// 	bson.M{"code": m.ci(q.Code)},
-			// 	bson.M{"unit": m.ci(q.Code)},
-			// }
-
-			// _, haveExistingOr := criteria["$or"]
-			// if haveExistingOr {
-			// 	criteria = bson.M{
-			// 		"$and": []bson.M{ criteria, bson.M { "$or": orClause } },
-			// 	}
-			// } else {
-			// 	criteria["$or"] = orClause
-			// }
-			
-		} else {
-			criteria["code"] = m.ci(q.Code)
-			criteria["system"] = m.ci(q.System)
+	case LT:
+		criteria = []bson.M{
+			bson.M{field + ".__from": bson.M{"$lt": exact}},
 		}
-		return buildBSON(p.Path, criteria)
+	case GT:
+		criteria = []bson.M{
+			bson.M{field + ".__to": bson.M{"$gt": exact}},
+		}
+	case GE:
+		criteria = []bson.M{
+			// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
+			bson.M{field + ".__to": bson.M{"$gte": h}},
+			// "or the range of the search value fully contains the range of the target value"
+			bson.M{field + ".__from": bson.M{"$gte": l}},
+		}
+	case LE:
+		criteria = []bson.M{
+			// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
+			bson.M{field + ".__from": bson.M{"$lte": l}},
+			// "or the range of the search value fully contains the range of the target value"
+			bson.M{field + ".__to": bson.M{"$lte": h}},
+		}
+	default:
+		// NE, SA, EB are not supported for Quantity queries
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
 	}
 
-	return orPaths(single, q.Paths)
+	for _, c := range criteria {
+		for k, v := range other {
+			c[k] = v
+		}
+	}
+	return criteria
 }
 
 func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
@@ -1226,6 +1636,16 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 		case ExternalReference:
 			criteria["reference"] = m.ci(ref.URL)
 
+		case IdentifierReference:
+			if ref.System != "" {
+				criteria["identifier.system"] = m.ci(ref.System)
+			} else if !ref.AnySystem {
+				criteria["identifier.system"] = bson.M{"$exists": false}
+			}
+			if ref.Value != "" {
+				criteria["identifier.value"] = m.ci(ref.Value)
+			}
+
 		case ChainedQueryReference:
 			// This should be handled exclusively by the createPipelineObject
 			panic(createInternalServerError("", "createReferenceQueryObject should not be used to create ChainedQueryReferences"))
@@ -1240,6 +1660,30 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 	return orPaths(single, r.Paths)
 }
 
+// ReferenceFilter returns a Mongo query matching resources whose reference search parameter refers
+// to one of the given resources of targetType, or to any resource of that type if ids is empty.
+// It is used to find the resources in a compartment, e.g. for the bulk data $export operation.
+func ReferenceFilter(info SearchParamInfo, targetType string, ids []string) bson.M {
+	var paths []SearchParamPath
+	for _, p := range info.Paths {
+		if p.Type != "Resource" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	single := func(p SearchParamPath) bson.M {
+		criteria := bson.M{"reference__type": targetType}
+		if len(ids) > 0 {
+			criteria["reference__id"] = bson.M{"$in": ids}
+		}
+		return buildBSON(p.Path, criteria)
+	}
+	return orPaths(single, paths)
+}
+
 func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p SearchParamPath) bson.M {
 	criteria := bson.M{}
 	switch ref := r.Reference.(type) {
@@ -1253,32 +1697,49 @@ func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p S
 		if ref.Type != "" {
 			criteria["resourceType"] = ref.Type
 		}
-	case ExternalReference:
+	case ExternalReference, IdentifierReference:
 		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
 	}
 	return buildBSON(p.Path, criteria)
 }
 
 func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
+	// By default the parts of names and addresses have to start with the string and other
+	// strings have to match it, both case-insensitively
+	partial, whole := m.cisw, m.ci
+	switch s.Modifier {
+	case "exact":
+		partial, whole = exact, exact
+	case "contains":
+		partial, whole = m.cic, m.cic
+	// the eq, sw and ew comparisons of _filter searches
+	case "eq":
+		partial, whole = m.ci, m.ci
+	case "sw":
+		partial, whole = m.cisw, m.cisw
+	case "ew":
+		partial, whole = m.ciew, m.ciew
+	}
+
 	single := func(p SearchParamPath) bson.M {
 		switch p.Type {
 		case "HumanName":
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"family": m.cisw(s.String)},
-					bson.M{"given": m.cisw(s.String)},
+					bson.M{"text": partial(s.String)},
+					bson.M{"family": partial(s.String)},
+					bson.M{"given": partial(s.String)},
 				},
 			})
 		case "Address":
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"line": m.cisw(s.String)},
-					bson.M{"city": m.cisw(s.String)},
-					bson.M{"state": m.cisw(s.String)},
-					bson.M{"postalCode": m.cisw(s.String)},
-					bson.M{"country": m.cisw(s.String)},
+					bson.M{"text": partial(s.String)},
+					bson.M{"line": partial(s.String)},
+					bson.M{"city": partial(s.String)},
+					bson.M{"state": partial(s.String)},
+					bson.M{"postalCode": partial(s.String)},
+					bson.M{"country": partial(s.String)},
 				},
 			})
 		default:
@@ -1286,7 +1747,7 @@ func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
 				return buildBSON(p.Path, s.String)
 			}
 
-			return buildBSON(p.Path, m.ci(s.String))
+			return buildBSON(p.Path, whole(s.String))
 		}
 	}
 
@@ -1294,6 +1755,15 @@ func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
 }
 
 func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
+	switch t.Modifier {
+	case "not":
+		// resources without a matching code, including those without any code
+		matching := *t
+		matching.Modifier = ""
+		return bson.M{"$nor": []bson.M{m.createTokenQueryObject(&matching)}}
+	case "text":
+		return m.createTokenTextQueryObject(t)
+	}
 
 	var systemCriteria interface{}
 	var codeCriteria interface{}
@@ -1373,6 +1843,39 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 	return orPaths(single, t.Paths)
 }
 
+// createTokenTextQueryObject matches the text or display of codes and identifiers
+// starting with the string given to the :text modifier
+func (m *MongoSearcher) createTokenTextQueryObject(t *TokenParam) bson.M {
+	var paths []SearchParamPath
+	for _, p := range t.Paths {
+		switch p.Type {
+		case "Coding", "CodeableConcept", "Identifier":
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", t.Name)))
+	}
+
+	single := func(p SearchParamPath) bson.M {
+		switch p.Type {
+		case "Coding":
+			return buildBSON(p.Path, bson.M{"display": m.cisw(t.Code)})
+		case "Identifier":
+			return buildBSON(p.Path, bson.M{"type.text": m.cisw(t.Code)})
+		default:
+			return buildBSON(p.Path, bson.M{
+				"$or": []bson.M{
+					bson.M{"text": m.cisw(t.Code)},
+					bson.M{"coding.display": m.cisw(t.Code)},
+				},
+			})
+		}
+	}
+
+	return orPaths(single, paths)
+}
+
 func (m *MongoSearcher) createURIQueryObject(u *URIParam) bson.M {
 	single := func(p SearchParamPath) bson.M {
 		return buildBSON(p.Path, u.URI)
@@ -1475,6 +1978,78 @@ func buildBSON(path string, criteria interface{}) bson.M {
 	return result
 }
 
+// mongoSortFields returns the fields to sort on and their order, ending with _id so that results
+// have a stable order for paging
+func mongoSortFields(o *QueryOptions) bson.D {
+	var fields bson.D
+	sortsOnID := false
+	for _, sort := range o.Sort {
+		if sort.Parameter.Type == "score" {
+			// support for _sort=_score (only in pipelines, as find requires the score to be projected)
+			fields = append(fields, bson.DocElem{Name: ScoreParam, Value: bson.M{"$meta": "textScore"}})
+			continue
+		}
+		// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
+		field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
+		order := 1
+		if sort.Descending {
+			order = -1
+		}
+		fields = append(fields, bson.DocElem{Name: field, Value: order})
+		sortsOnID = sortsOnID || field == "_id"
+	}
+	if !sortsOnID {
+		fields = append(fields, bson.DocElem{Name: "_id", Value: 1})
+	}
+	return fields
+}
+
+// createCursorQueryObject selects the results that sort after the position of the query's
+// _cursor, i.e. those whose sort values (followed by their _id) come after the cursor's values
+// in the sort order. This allows the next page to be found with a range query on the sort keys.
+func createCursorQueryObject(o *QueryOptions) bson.M {
+	var after []bson.M
+	equal := bson.M{}
+	sortsOnID := false
+	for i, sort := range o.Sort {
+		field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
+		value := o.Cursor.Values[i]
+		if criteria := cursorAfterCriteria(field, value, sort.Descending); criteria != nil {
+			clause := bson.M{}
+			merge(clause, equal)
+			merge(clause, criteria)
+			after = append(after, clause)
+		}
+		merge(equal, bson.M{field: value})
+		sortsOnID = sortsOnID || field == "_id"
+	}
+	if !sortsOnID {
+		clause := bson.M{}
+		merge(clause, equal)
+		merge(clause, bson.M{"_id": bson.M{"$gt": o.Cursor.ID}})
+		after = append(after, clause)
+	}
+	return bson.M{"$or": after}
+}
+
+// cursorAfterCriteria selects the values of a sort field that come after the given value. MongoDB
+// sorts missing and null values first, so in descending order they come after everything else.
+func cursorAfterCriteria(field string, value interface{}, descending bool) bson.M {
+	switch {
+	case value == nil && descending:
+		return nil
+	case value == nil:
+		return bson.M{field: bson.M{"$ne": nil}}
+	case descending:
+		return bson.M{"$or": []bson.M{
+			bson.M{field: bson.M{"$lt": value}},
+			bson.M{field: nil},
+		}}
+	default:
+		return bson.M{field: bson.M{"$gt": value}}
+	}
+}
+
 // Fixes the array markers/indexers so "[]element.[0]target.[]product.element" becomes "element.target.product.element"
 func convertSearchPathToMongoField(path string) string {
 	indexedPath := convertBracketIndexesToDotIndexes(path)
@@ -1572,6 +2147,19 @@ func (m *MongoSearcher) ci(s string) interface{} {
 	return s
 }
 
+// Case-insensitive contains
+func (m *MongoSearcher) cic(s string) interface{} {
+	if m.enableCISearches {
+		return bson.RegEx{Pattern: regexp.QuoteMeta(s), Options: "i"}
+	}
+	return bson.RegEx{Pattern: regexp.QuoteMeta(s)}
+}
+
+// Exact match
+func exact(s string) interface{} {
+	return s
+}
+
 // Case-insensitive starts-with
 // TODO: consider case-insensitive indexes in MongoDB 3.4 (https://docs.mongodb.com/manual/core/index-case-insensitive/)
 func (m *MongoSearcher) cisw(s string) interface{} {
@@ -1581,6 +2169,14 @@ func (m *MongoSearcher) cisw(s string) interface{} {
 	return s
 }
 
+// Case-insensitive ends-with
+func (m *MongoSearcher) ciew(s string) interface{} {
+	if m.enableCISearches {
+		return bson.RegEx{Pattern: fmt.Sprintf("%s$", regexp.QuoteMeta(s)), Options: "i"}
+	}
+	return bson.RegEx{Pattern: fmt.Sprintf("%s$", regexp.QuoteMeta(s))}
+}
+
 // When multiple paths are present, they should be represented as an OR.
 // objFunc is a function that generates a single query for a path
 func orPaths(objFunc func(SearchParamPath) bson.M, paths []SearchParamPath) bson.M {
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
 	"github.com/pebbe/util"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
@@ -72,6 +73,9 @@ func (m *MongoSearchSuite) SetUpSuite(c *C) {
 		collection := models.PluralizeLowerResourceName(reflect.TypeOf(r).Elem().Name())
 		util.CheckErr(db.C(collection).Insert(r))
 	}
+
+	// A text index for _text and _content searches, as configured in indexes.conf
+	util.CheckErr(db.C("observations").EnsureIndex(mgo.Index{Key: []string{"$text:$**"}, LanguageOverride: "__language"}))
 }
 
 func (m *MongoSearchSuite) TearDownSuite(c *C) {
@@ -424,6 +428,23 @@ func (m *MongoSearchSuite) TestConditionPatientQueryByTypeAndId(c *C) {
 	c.Assert(len(results), Equals, 5)
 }
 
+func (m *MongoSearchSuite) TestReferenceFilter(c *C) {
+	info := SearchParameterDictionary["Condition"]["patient"]
+
+	o := ReferenceFilter(info, "Patient", nil)
+	c.Assert(o, DeepEquals, bson.M{"subject.reference__type": "Patient"})
+
+	o = ReferenceFilter(info, "Patient", []string{"123", "456"})
+	c.Assert(o, DeepEquals, bson.M{
+		"subject.reference__id":   bson.M{"$in": []string{"123", "456"}},
+		"subject.reference__type": "Patient",
+	})
+
+	count, err := m.Session.DB("fhir-test").C("conditions").Find(ReferenceFilter(info, "Patient", []string{"4954037118555241963"})).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 5)
+}
+
 func (m *MongoSearchSuite) TestConditionReferenceQueryObjectByPatientURL(c *C) {
 	q := Query{"Condition", "patient=http://acme.com/Patient/123456789"}
 
@@ -1706,21 +1727,25 @@ func (m *MongoSearchSuite) TestNonMatchingPatientAddressStringQuery(c *C) {
 // Test quantity searches on Quantity
 
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnit(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=185||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"valueQuantity.value.__from": bson.M{"$gte": 184.5},
-		"valueQuantity.value.__to": bson.M{"$lte": 185.5},
 		"$or": []bson.M{
-			bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-			bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+				"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+				"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+				"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
 		},
 	})
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndUnit(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=185||lbs"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
@@ -1728,7 +1753,6 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndUnit(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndCode(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=185||[lb_av]"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
@@ -1736,7 +1760,6 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndCode(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryByWrongValueAndUnit(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=186||lbs"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
@@ -1744,7 +1767,6 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByWrongValueAndUnit(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndWrongUnit(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=185||pounds"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
@@ -1754,23 +1776,47 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndWrongUnit(c *C) {
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndSystemAndCode(c *C) {
 	q := Query{"Observation", "value-quantity=185|http://unitsofmeasure.org|[lb_av]"}
 	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				// the value in grams, the canonical UCUM unit of mass
+				"valueQuantity.__canonical.value.__from": bson.M{"$gte": 83687.792265},
+				"valueQuantity.__canonical.value.__to":   bson.M{"$lte": 84141.384635},
+				"valueQuantity.__canonical.code":         "g",
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+				"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^\\[lb_av\\]$", Options: "i"},
+				"valueQuantity.system":       bson.RegEx{Pattern: "^http://unitsofmeasure\\.org$", Options: "i"},
+			},
+		},
+	})
+
+	// units that aren't UCUM are only matched by their code
+	q = Query{"Observation", "value-quantity=185|http://unitsofmeasure.org|lbs"}
+	o = m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
 		"valueQuantity.value.__from": bson.M{"$gte": 184.5},
-		"valueQuantity.value.__to": bson.M{"$lte": 185.5},
-		"valueQuantity.code":   bson.RegEx{Pattern: "^\\[lb_av\\]$", Options: "i"},
-		"valueQuantity.system": bson.RegEx{Pattern: "^http://unitsofmeasure\\.org$", Options: "i"},
+		"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+		"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+		"valueQuantity.system":       bson.RegEx{Pattern: "^http://unitsofmeasure\\.org$", Options: "i"},
 	})
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitLT(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=lt186||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"valueQuantity.value.__from": bson.M{"$lt": float64(186)},
 		"$or": []bson.M{
-			bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-			bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$lt": float64(186)},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$lt": float64(186)},
+				"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
 		},
 	})
 
@@ -1785,14 +1831,18 @@ func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitLT(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitGT(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=gt184||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"valueQuantity.value.__to": bson.M{"$gt": float64(184)},
 		"$or": []bson.M{
-			bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-			bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$gt": float64(184)},
+				"valueQuantity.code":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$gt": float64(184)},
+				"valueQuantity.unit":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
 		},
 	})
 
@@ -1807,24 +1857,25 @@ func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitGT(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitLE(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=le186||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"valueQuantity": bson.M {
-			"$and": []bson.M{
-				bson.M {
-					"$or": []bson.M{
-						bson.M{"value.__from": bson.M{"$lte": float64(185.5)}},
-						bson.M{"value.__to": bson.M{"$lte": float64(186.5)}},
-					},
-				},
-				bson.M {
-					"$or": []bson.M{
-						bson.M{"code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-						bson.M{"unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-					},
-				},
+		"$or": []bson.M{
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$lte": float64(185.5)},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$lte": float64(186.5)},
+				"valueQuantity.code":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$lte": float64(185.5)},
+				"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$lte": float64(186.5)},
+				"valueQuantity.unit":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
 			},
 		},
 	})
@@ -1840,14 +1891,26 @@ func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitLE(c *C) {
 }
 
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndUnitGE(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=ge184||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"valueQuantity.value.__from": bson.M{"$gte": float64(183.5)},
 		"$or": []bson.M{
-			bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-			bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$gte": float64(184.5)},
+				"valueQuantity.code":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": float64(183.5)},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__to": bson.M{"$gte": float64(184.5)},
+				"valueQuantity.unit":       bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": float64(183.5)},
+				"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
 		},
 	})
 
@@ -1889,19 +1952,96 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndSystemAndWrongCode(c
 	c.Assert(len(results), Equals, 0)
 }
 
+func (m *MongoSearchSuite) TestValueQuantityQueryInOtherUnits(c *C) {
+	// quantities get their value in canonical units when they are converted to BSON
+	observations := m.Session.DB("fhir-test").C("observations")
+	for _, o := range []struct {
+		id, value, code string
+	}{
+		{"potassium-mmol", "5.8", "mmol/L"},
+		{"potassium-umol", "6100", "umol/L"},
+		{"potassium-low", "4.2", "mmol/L"},
+		{"protein-mg", "80", "mg/dL"},
+	} {
+		resource, err := models2.NewResourceFromJsonBytes([]byte(fmt.Sprintf(`{
+			"resourceType": "Observation",
+			"id": "%s",
+			"status": "final",
+			"code": { "text": "%s" },
+			"valueQuantity": { "value": %s, "unit": "%s", "system": "http://unitsofmeasure.org", "code": "%s" }
+		}`, o.id, o.id, o.value, o.code, o.code)))
+		util.CheckErr(err)
+		doc, err := resource.GetBSON()
+		util.CheckErr(err)
+		util.CheckErr(observations.Insert(doc))
+		defer observations.RemoveId(resource.Id())
+	}
+	ids := func(results []*models2.Resource) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Id())
+		}
+		return ids
+	}
+
+	q := Query{"Observation", "value-quantity=gt5.5|http://unitsofmeasure.org|mmol/L&_sort=_id"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(ids(results), DeepEquals, []string{"potassium-mmol", "potassium-umol"})
+
+	q = Query{"Observation", "value-quantity=le5000|http://unitsofmeasure.org|umol/L&_sort=_id"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(ids(results), DeepEquals, []string{"potassium-low"})
+
+	q = Query{"Observation", "value-quantity=0.8|http://unitsofmeasure.org|g/L"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(ids(results), DeepEquals, []string{"protein-mg"})
+
+	// the system can be left out
+	q = Query{"Observation", "value-quantity=0.8||g/L"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(ids(results), DeepEquals, []string{"protein-mg"})
+
+	// values in units of another kind, e.g. mmol/L for g/L, don't match
+	q = Query{"Observation", "value-quantity=gt5.5|http://unitsofmeasure.org|g/L"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(results, HasLen, 0)
+
+	// the canonical values aren't part of the resources
+	q = Query{"Observation", "_id=protein-mg"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(results, HasLen, 1)
+	c.Assert(strings.Contains(string(results[0].JsonBytes()), models2.QuantityCanonicalField), Equals, false)
+}
+
 func (m *MongoSearchSuite) TestComponentValueQuantityQueryObjectByValueAndUnit(c *C) {
 	// New in STU3 - Searches component.value ONLY. This didn't exist prior to STU3 3.0.0.
 	c.Skip("Sorting by parameters that resolve to multiple paths is not supported")
 	q := Query{"Observation", "component-value-quantity=185||lbs"}
 	o := m.MongoSearcher.createQueryObject(q)
 	c.Assert(o, DeepEquals, bson.M{
-		"component": bson.M{
-			"$elemMatch": bson.M{
-				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
-				"valueQuantity.value.__to": bson.M{"$lte": 185.5},
-				"$or": []bson.M{
-					bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-					bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+		"$or": []bson.M{
+			bson.M{
+				"component": bson.M{
+					"$elemMatch": bson.M{
+						"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+						"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+						"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+					},
+				},
+			},
+			bson.M{
+				"component": bson.M{
+					"$elemMatch": bson.M{
+						"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+						"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+						"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+					},
 				},
 			},
 		},
@@ -1920,22 +2060,30 @@ func (m *MongoSearchSuite) TestComboValueQuantityQueryObjectByValueAndUnit(c *C)
 				"component": bson.M{
 					"$elemMatch": bson.M{
 						"valueQuantity.value.__from": bson.M{"$gte": 184.5},
-						"valueQuantity.value.__to": bson.M{"$lte": 185.5},
-						"$or": []bson.M{
-							bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-							bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-						},
+						"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+						"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
 					},
 				},
 			},
 			bson.M{
-				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
-				"valueQuantity.value.__to": bson.M{"$lte": 185.5},
-				"$or": []bson.M{
-					bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
-					bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^lbs$", Options: "i"}},
+				"component": bson.M{
+					"$elemMatch": bson.M{
+						"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+						"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+						"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+					},
 				},
 			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+				"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+				"valueQuantity.code":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
+			bson.M{
+				"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+				"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+				"valueQuantity.unit":         bson.RegEx{Pattern: "^lbs$", Options: "i"},
+			},
 		},
 	})
 }
@@ -2020,7 +2168,285 @@ func (m *MongoSearchSuite) TestSubscriptionURLQuery(c *C) {
 	c.Assert(len(results), Equals, 1)
 }
 
-// TODO: Test composite searches
+// Test search modifiers
+
+func (m *MongoSearchSuite) TestMissingQueryObject(c *C) {
+	q := Query{"Condition", "abatement-date:missing=true"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$and": []bson.M{
+			bson.M{"abatementDateTime": bson.M{"$exists": false}},
+			bson.M{"abatementPeriod": bson.M{"$exists": false}},
+		},
+	})
+
+	q = Query{"Condition", "abatement-date:missing=false"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"abatementDateTime": bson.M{"$exists": true}},
+			bson.M{"abatementPeriod": bson.M{"$exists": true}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestMissingQuery(c *C) {
+	q := Query{"Observation", "value-quantity:missing=false"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	q = Query{"Observation", "value-quantity:missing=true"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+}
+
+func (m *MongoSearchSuite) TestStringExactQueryObject(c *C) {
+	q := Query{"Patient", "family:exact=Peters"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": "Peters"})
+
+	q = Query{"Patient", "name:exact=Peters"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"name.text": "Peters"},
+			bson.M{"name.family": "Peters"},
+			bson.M{"name.given": "Peters"},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestStringExactQuery(c *C) {
+	q := Query{"Patient", "family:exact=Peters"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	q = Query{"Patient", "family:exact=peters"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	q = Query{"Patient", "given:exact=Sal"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestStringContainsQueryObject(c *C) {
+	q := Query{"Patient", "family:contains=ete"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": bson.RegEx{Pattern: "ete", Options: "i"}})
+}
+
+func (m *MongoSearchSuite) TestStringContainsQuery(c *C) {
+	q := Query{"Patient", "family:contains=ETE"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	q = Query{"Patient", "name:contains=ally"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+}
+
+func (m *MongoSearchSuite) TestTokenNotQueryObject(c *C) {
+	q := Query{"Condition", "code:not=http://snomed.info/sct|27836007"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$nor": []bson.M{
+			bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": bson.RegEx{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+						"code":   bson.RegEx{Pattern: "^27836007$", Options: "i"},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestTokenNotQuery(c *C) {
+	q := Query{"Condition", "code:not=http://snomed.info/sct|27836007"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+
+	q = Query{"Encounter", "status:not=finished"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestTokenTextQueryObject(c *C) {
+	q := Query{"Condition", "code:text=pertussis"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"code.text": bson.RegEx{Pattern: "^pertussis", Options: "i"}},
+			bson.M{"code.coding.display": bson.RegEx{Pattern: "^pertussis", Options: "i"}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestTokenTextQuery(c *C) {
+	q := Query{"Condition", "code:text=pertussis"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Condition", "code:text=diagnosis"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+}
+
+func (m *MongoSearchSuite) TestTokenTextSearchPanicsForCodes(c *C) {
+	q := Query{"Encounter", "status:text=finished"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"status\" modifier is invalid"))
+}
+
+func (m *MongoSearchSuite) TestReferenceIdentifierQueryObject(c *C) {
+	q := Query{"Condition", "subject:identifier=http://example.org/mrn|12345"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"subject.identifier.system": bson.RegEx{Pattern: "^http://example\\.org/mrn$", Options: "i"},
+		"subject.identifier.value":  bson.RegEx{Pattern: "^12345$", Options: "i"},
+	})
+
+	q = Query{"Condition", "subject:identifier=12345"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"subject.identifier.value": bson.RegEx{Pattern: "^12345$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestUnsupportedModifierSearchPanics(c *C) {
+	q := Query{"Patient", "family:not=Peters"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"family\" modifier is invalid"))
+
+	q = Query{"Condition", "code:exact=27836007"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code\" modifier is invalid"))
+
+	q = Query{"Observation", "code-value-quantity:missing=true"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code-value-quantity\" modifier is invalid"))
+}
+
+// Test composite searches
+
+func (m *MongoSearchSuite) TestCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt184"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$and": []bson.M{
+			bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+						"code":   bson.RegEx{Pattern: "^3141-9$", Options: "i"},
+					},
+				},
+			},
+			bson.M{"valueQuantity.value.__to": bson.M{"$gt": float64(184)}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestCodeValueQuantityQuery(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$185|http://unitsofmeasure.org|[lb_av]"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt184"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt186"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	// the HbA1c observation has a value of 8
+	q = Query{"Observation", "code-value-quantity=http://loinc.org|1234-5$gt184"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestComponentCodeValueQuantityQueryObject(c *C) {
+	// the code and value have to match the same component
+	q := Query{"Observation", "component-code-value-quantity=http://loinc.org|8480-6$gt140"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"component": bson.M{
+			"$elemMatch": bson.M{
+				"$and": []bson.M{
+					bson.M{
+						"code.coding": bson.M{
+							"$elemMatch": bson.M{
+								"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+								"code":   bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+							},
+						},
+					},
+					bson.M{"valueQuantity.value.__to": bson.M{"$gt": float64(140)}},
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestComboCodeValueConceptQueryObject(c *C) {
+	q := Query{"Observation", "combo-code-value-concept=http://loinc.org|8480-6$http://snomed.info/sct|38341003"}
+	o := m.MongoSearcher.createQueryObject(q)
+	code := bson.M{
+		"code.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+				"code":   bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+			},
+		},
+	}
+	value := bson.M{
+		"valueCodeableConcept.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": bson.RegEx{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+				"code":   bson.RegEx{Pattern: "^38341003$", Options: "i"},
+			},
+		},
+	}
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				"component": bson.M{
+					"$elemMatch": bson.M{"$and": []bson.M{code, value}},
+				},
+			},
+			bson.M{"$and": []bson.M{code, value}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestCompositeSearchWithMissingComponentPanics(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"code-value-quantity\" content is invalid"))
+}
+
+func (m *MongoSearchSuite) TestSplitAtLastArray(c *C) {
+	array, rest := splitAtLastArray("a.[]b.[]c.d.e")
+	c.Assert(array, Equals, "a.[]b.[]c")
+	c.Assert(rest, Equals, "d.e")
+
+	array, rest = splitAtLastArray("a.b.[]c")
+	c.Assert(array, Equals, "")
+	c.Assert(rest, Equals, "a.b.[]c")
+}
 
 // Test custom search
 
@@ -2518,6 +2944,86 @@ func (m *MongoSearchSuite) TestEncounterTypeQueryWithCountAndOffset(c *C) {
 	c.Assert(offset1.Id, Not(Equals), offset2.Id)
 }
 
+func (m *MongoSearchSuite) TestCursorQueryObject(c *C) {
+	q := Query{"Patient", "_sort=gender&_sort:desc=birthdate"}
+	o := q.Options()
+	o.Cursor = &PageCursor{Values: []interface{}{"male", nil}, ID: "abc"}
+	c.Assert(createCursorQueryObject(o), DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"gender": bson.M{"$gt": "male"}},
+			bson.M{"gender": "male", "birthDate": nil, "_id": bson.M{"$gt": "abc"}},
+		},
+	})
+
+	q = Query{"Patient", "_sort:desc=birthdate"}
+	o = q.Options()
+	o.Cursor = &PageCursor{Values: []interface{}{"1980"}, ID: "abc"}
+	c.Assert(createCursorQueryObject(o), DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"$or": []bson.M{
+				bson.M{"birthDate": bson.M{"$lt": "1980"}},
+				bson.M{"birthDate": nil},
+			}},
+			bson.M{"birthDate": "1980", "_id": bson.M{"$gt": "abc"}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestMongoSortFieldsEndWithID(c *C) {
+	q := Query{"Condition", "_sort:desc=onset-date"}
+	c.Assert(mongoSortFields(q.Options()), DeepEquals, bson.D{
+		bson.DocElem{Name: "onsetDateTime", Value: -1},
+		bson.DocElem{Name: "_id", Value: 1},
+	})
+
+	q = Query{"Condition", "_sort:desc=_id"}
+	c.Assert(mongoSortFields(q.Options()), DeepEquals, bson.D{
+		bson.DocElem{Name: "_id", Value: -1},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionSortWithCursorPaging(c *C) {
+	for _, sort := range []string{"_sort=onset-date", "_sort:desc=onset-date", "_sort=patient"} {
+		results, _, err := m.MongoSearcher.Search(Query{"Condition", sort})
+		util.CheckErr(err)
+		c.Assert(len(results), Equals, 6)
+		var expected []string
+		for _, result := range results {
+			expected = append(expected, result.Id())
+		}
+
+		// Page through the same results two at a time
+		var paged []string
+		q := Query{"Condition", sort + "&_count=2"}
+		for pages := 0; pages < 5; pages++ {
+			results, _, err = m.MongoSearcher.Search(q)
+			util.CheckErr(err)
+			for _, result := range results {
+				paged = append(paged, result.Id())
+			}
+			if len(results) < 2 {
+				break
+			}
+			cursor, err := NewPageCursor(results[len(results)-1], q.Options())
+			util.CheckErr(err)
+			c.Assert(cursor, NotNil)
+			q = Query{"Condition", sort + "&_count=2&_cursor=" + cursor.Token()}
+		}
+		c.Assert(paged, DeepEquals, expected)
+	}
+}
+
+func (m *MongoSearchSuite) TestCursorNotSupportedForArraySorts(c *C) {
+	q := Query{"Patient", "_sort=family&_count=1"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	cursor, err := NewPageCursor(results[0], q.Options())
+	util.CheckErr(err)
+	c.Assert(cursor, IsNil)
+}
+
 func (m *MongoSearchSuite) TestConditionSortWithMultipleSortParams(c *C) {
 	q := Query{"Condition", "_sort=patient&_sort=onset-date&_sort=code"}
 	results, _, err := m.MongoSearcher.Search(q)
@@ -2673,6 +3179,43 @@ func (m *MongoSearchSuite) TestConditionQueryForIncludeWithTargets(c *C) {
 	c.Assert(practitioner.Id(), Equals, "7045606679745586371")
 }
 
+func (m *MongoSearchSuite) TestDiagnosticReportQueryForIncludeIterate(c *C) {
+	// DiagnosticReport -> Observation -> Organization
+	q := Query{"DiagnosticReport", "_id=551262234714579397&_include:iterate=DiagnosticReport:result&_include:iterate=Observation:performer:Organization"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	c.Assert(results[0].SearchIncludes(), HasLen, 4)
+	c.Assert(results[0].SearchIncludesOfType("Observation"), HasLen, 3)
+	organizations := results[0].SearchIncludesOfType("Organization")
+	c.Assert(organizations, HasLen, 1)
+	c.Assert(organizations[0].Id(), Equals, "7045605384245533352")
+
+	// The depth limit stops after the observations
+	m.MongoSearcher.SetMaxIncludeIterations(1)
+	defer m.MongoSearcher.SetMaxIncludeIterations(DefaultMaxIncludeIterations)
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].SearchIncludes(), HasLen, 3)
+	c.Assert(results[0].SearchIncludesOfType("Organization"), HasLen, 0)
+}
+
+func (m *MongoSearchSuite) TestConditionQueryForRevIncludeIterateHasNoDuplicates(c *C) {
+	// The encounters of the condition's patient, where the encounters refer back to the (already included) patient
+	q := Query{"Condition", "_id=8664777288161060797&_include=Condition:patient&_revinclude:iterate=Encounter:patient&_include:iterate=Encounter:patient"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	c.Assert(results[0].SearchIncludes(), HasLen, 5)
+	patients := results[0].SearchIncludesOfType("Patient")
+	c.Assert(patients, HasLen, 1)
+	c.Assert(patients[0].Id(), Equals, "4954037118555241963")
+	c.Assert(results[0].SearchIncludesOfType("Encounter"), HasLen, 4)
+}
+
 func (m *MongoSearchSuite) TestPatientGenderQueryOptionsForRevInclude(c *C) {
 	q := Query{"Patient", "gender=male&_revinclude=Condition:subject&_revinclude=Encounter:patient"}
 
@@ -2751,7 +3294,6 @@ func (m *MongoSearchSuite) TestPrefixedNumberSearchPanicsForUnsupportedPrefix(c
 }
 
 func (m *MongoSearchSuite) TestPrefixedQuantitySearchPanicsForUnsupportedPrefix(c *C) {
-	c.Skip("quantity search without system not supported yet - see createQuantityQueryObject")
 	q := Query{"Observation", "value-quantity=sa1||mg"}
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"value-quantity\" content is invalid"))
 	q = Query{"Observation", "value-quantity=ne1||mg"}
@@ -2759,7 +3301,7 @@ func (m *MongoSearchSuite) TestPrefixedQuantitySearchPanicsForUnsupportedPrefix(
 }
 
 func (m *MongoSearchSuite) TestModifierSearchPanics(c *C) {
-	q := Query{"Condition", "code:text=headache"}
+	q := Query{"Condition", "code:below=headache"}
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code\" modifier is invalid"))
 }
 
@@ -2769,8 +3311,8 @@ func (m *MongoSearchSuite) TestUnsupportedSearchResultParameterPanics(c *C) {
 }
 
 func (m *MongoSearchSuite) TestUsupportedGlobalSearchParameterPanics(c *C) {
-	q := Query{"Condition", "_text=diabetes"}
-	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_UNKNOWN", "Parameter \"_text\" not understood"))
+	q := Query{"Condition", "_list=42"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_UNKNOWN", "Parameter \"_list\" not understood"))
 }
 
 func (m *MongoSearchSuite) TestDisableTotalCount(c *C) {
@@ -2867,6 +3409,309 @@ func (m *MongoSearchSuite) TestSummaryCountWithCountsDisabled(c *C) {
 	c.Assert(total, Equals, uint32(2))
 }
 
+func (m *MongoSearchSuite) TestPatientElements(c *C) {
+	q := Query{"Patient", "_elements=gender&_sort=given"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(total, Equals, uint32(2))
+
+	var patient models.Patient
+	util.CheckErr(results[0].Unmarshal(&patient))
+	c.Assert(patient.Id, Equals, "4954037118555241963")
+	c.Assert(patient.Gender, Equals, "male")
+	c.Assert(patient.Name, HasLen, 0)
+	c.Assert(patient.BirthDate, IsNil)
+	c.Assert(patient.Meta.Tag, HasLen, 1)
+	c.Assert(patient.Meta.Tag[0].Code, Equals, "SUBSETTED")
+}
+
+func (m *MongoSearchSuite) TestConditionSummaryWithIncludes(c *C) {
+	q := Query{"Condition", "_id=8664777288161060797&_include=Condition:asserter&_summary=true"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].SearchIncludes(), HasLen, 1)
+	c.Assert(results[0].SearchIncludes()[0].Id(), Equals, "4954037118555241963")
+
+	var condition models.Condition
+	util.CheckErr(results[0].Unmarshal(&condition))
+	c.Assert(condition.Code, NotNil)
+	c.Assert(condition.OnsetDateTime, NotNil)
+	c.Assert(condition.Meta.Tag, HasLen, 1)
+	c.Assert(condition.Meta.Tag[0].Code, Equals, "SUBSETTED")
+}
+
+func (m *MongoSearchSuite) TestFullTextQueryObject(c *C) {
+	q := Query{"Observation", "_content=aspirin OR paracetamol"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"$text": bson.M{"$search": "aspirin paracetamol"}})
+
+	q = Query{"Observation", "_text=aspirin tablet"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$text": bson.M{"$search": "\"aspirin\" \"tablet\""},
+		"$and": []bson.M{
+			bson.M{"text.div": bson.RegEx{Pattern: "aspirin", Options: "i"}},
+			bson.M{"text.div": bson.RegEx{Pattern: "tablet", Options: "i"}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestObservationContentSearch(c *C) {
+	q := Query{"Observation", "_content=colon"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 3)
+	c.Assert(total, Equals, uint32(3))
+
+	q = Query{"Observation", "_content=colon NOT cancer"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "5433989216383325950")
+
+	q = Query{"Observation", "_content=\"primary tumor\""}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "2098437086268740293")
+
+	q = Query{"Observation", "_content=metastasis,lymph&_sort=_score"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	// there is no narrative in these observations
+	q = Query{"Observation", "_text=colon"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestFullTextSearchPanics(c *C) {
+	q := Query{"Condition", "_content=diabetes"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Full-text search of Condition resources requires a text index (see indexes.conf)"))
+
+	q = Query{"Observation", "_content=colon&_text=cancer"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Only one \"_text\" or \"_content\" parameter is supported"))
+
+	q = Query{"Observation", "_content=(colon OR rectal) AND cancer"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_content\" content is not supported: AND can only combine words, phrases and negated words ((colon OR rectal) AND cancer)"))
+
+	q = Query{"Observation", "subject:Patient._content=Peters"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_content\" is not supported in chained searches"))
+}
+
+func (m *MongoSearchSuite) TestNearQueryObject(c *C) {
+	q := Query{"Location", "near=-37.8136|144.9631|6.3781|km"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"__search.__near": bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{[]interface{}{144.9631, -37.8136}, 0.001}}},
+	})
+
+	q = Query{"Location", "near=-37.8136|144.9631"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"__search.__near": bson.M{"$exists": true}})
+}
+
+func (m *MongoSearchSuite) TestNearSortPipeline(c *C) {
+	q := Query{"Location", "near=-37.8136|144.9631&name=Clinic&_sort=near"}
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+	c.Assert(bsonQuery.Pipeline, DeepEquals, []bson.M{
+		bson.M{"$geoNear": bson.M{
+			"near":          geoJSONPoint(144.9631, -37.8136),
+			"key":           "__search.__near",
+			"distanceField": "__search.__distance",
+			"spherical":     true,
+			"query": bson.M{
+				"__search.__near": bson.M{"$exists": true},
+				"$or": []bson.M{
+					bson.M{"alias": bson.RegEx{Pattern: "^Clinic$", Options: "i"}},
+					bson.M{"name": bson.RegEx{Pattern: "^Clinic$", Options: "i"}},
+				},
+			},
+		}},
+	})
+
+	o := q.Options()
+	c.Assert(mongoSortFields(o), DeepEquals, bson.D{
+		bson.DocElem{Name: "__search.__distance", Value: 1},
+		bson.DocElem{Name: "_id", Value: 1},
+	})
+}
+
+func (m *MongoSearchSuite) TestLocationNearSearch(c *C) {
+	// resources get their position in the search index when they are converted to BSON
+	locations := m.Session.DB("fhir-test").C("locations")
+	for _, l := range []struct {
+		id                  string
+		latitude, longitude float64
+	}{
+		{"sydney", -33.8688, 151.2093},
+		{"geelong", -38.1499, 144.3617},
+		{"melbourne", -37.8136, 144.9631},
+	} {
+		resource, err := models2.NewResourceFromJsonBytes([]byte(fmt.Sprintf(`{
+			"resourceType": "Location",
+			"id": "%s",
+			"position": { "latitude": %v, "longitude": %v }
+		}`, l.id, l.latitude, l.longitude)))
+		util.CheckErr(err)
+		doc, err := resource.GetBSON()
+		util.CheckErr(err)
+		util.CheckErr(locations.Insert(doc))
+		defer locations.RemoveId(resource.Id())
+	}
+	ids := func(results []*models2.Resource) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Id())
+		}
+		return ids
+	}
+
+	q := Query{"Location", "near=-37.8136|144.9631|100|km&_sort=_id"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(2))
+	c.Assert(ids(results), DeepEquals, []string{"geelong", "melbourne"})
+
+	q = Query{"Location", "near=-37.8136:144.9631&near-distance=50|http://unitsofmeasure.org|[mi_i]"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(ids(results), DeepEquals, []string{"geelong", "melbourne"})
+
+	q = Query{"Location", "near=-37.8136|144.9631&_sort=near"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Sorting Location resources by distance requires a 2dsphere index (see indexes.conf)"))
+
+	// A geospatial index for sorting by distance, as configured in indexes.conf
+	util.CheckErr(locations.EnsureIndex(mgo.Index{Key: []string{"$2dsphere:__search.__near"}}))
+	defer locations.DropIndex("$2dsphere:__search.__near")
+
+	results, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(3))
+	c.Assert(ids(results), DeepEquals, []string{"melbourne", "geelong", "sydney"})
+
+	q = Query{"Location", "near=-37.8136|144.9631|1000|km&_sort=near&_offset=1&_count=1"}
+	results, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(3))
+	c.Assert(ids(results), DeepEquals, []string{"geelong"})
+}
+
+func (m *MongoSearchSuite) TestCustomSearchParameterQueryObject(c *C) {
+	definition := indigenousStatusDefinition()
+	definition.Expression += ".as(Coding)"
+	p, err := NewCustomSearchParameter("1", definition)
+	util.CheckErr(err)
+	util.CheckErr(RegisterCustomSearchParameter(p))
+	defer UnregisterCustomSearchParameter("1")
+
+	q := Query{"Patient", "indigenous-status=4"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"__search.indigenous-status.Coding.code": bson.RegEx{Pattern: "^4$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestCustomSearchParameterSearch(c *C) {
+	p, err := NewCustomSearchParameter("1", indigenousStatusDefinition())
+	util.CheckErr(err)
+	util.CheckErr(RegisterCustomSearchParameter(p))
+	defer UnregisterCustomSearchParameter("1")
+
+	// resources get their search index when they are converted to BSON
+	patients := m.Session.DB("fhir-test").C("patients")
+	for i, code := range []string{"1", "4"} {
+		resource, err := models2.NewResourceFromJsonBytes([]byte(fmt.Sprintf(`{
+			"resourceType": "Patient",
+			"id": "indigenous-%d",
+			"extension": [
+				{ "url": "%s", "valueCoding": { "system": "https://healthterminologies.gov.au/fhir/CodeSystem/australian-indigenous-status-1", "code": "%s" } }
+			]
+		}`, i, indigenousStatusURL, code)))
+		util.CheckErr(err)
+		doc, err := resource.GetBSON()
+		util.CheckErr(err)
+		util.CheckErr(patients.Insert(doc))
+		defer patients.RemoveId(resource.Id())
+	}
+
+	q := Query{"Patient", "indigenous-status=https://healthterminologies.gov.au/fhir/CodeSystem/australian-indigenous-status-1|4"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(1))
+	c.Assert(results[0].Id(), Equals, "indigenous-1")
+
+	q = Query{"Patient", "indigenous-status:missing=false"}
+	_, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(2))
+}
+
+func (m *MongoSearchSuite) TestFilterQueryObject(c *C) {
+	q := Query{"Patient", "_filter=family eq peters and not (given sw jo or gender ne male)"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$and": []bson.M{
+			bson.M{"name.family": bson.RegEx{Pattern: "^peters$", Options: "i"}},
+			bson.M{"$nor": []bson.M{
+				bson.M{"$or": []bson.M{
+					bson.M{"name.given": bson.RegEx{Pattern: "^jo", Options: "i"}},
+					bson.M{"$nor": []bson.M{bson.M{"gender": bson.RegEx{Pattern: "^male$", Options: "i"}}}},
+				}},
+			}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestChainedFilterPipelineObject(c *C) {
+	q := Query{"Condition", "_filter=patient.gender eq male or code eq 123"}
+	o := m.MongoSearcher.createPipelineObject(q)
+	c.Assert(o, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$match": bson.M{"$or": []bson.M{
+			bson.M{"_lookup0.gender": bson.RegEx{Pattern: "^male$", Options: "i"}},
+			bson.M{"code.coding.code": bson.RegEx{Pattern: "^123$", Options: "i"}},
+		}}},
+	})
+}
+
+func (m *MongoSearchSuite) TestFilterSearch(c *C) {
+	for filter, expected := range map[string]int{
+		"family eq peters and not (given sw jo)":                 1,
+		"given ew LLY or birthdate lt 1990-01-01":                1,
+		"given eq john or birthdate lt 1990":                     2,
+		"gender ne male and family co ete":                       1,
+		"name pr true and not (given eq sally)":                  1,
+		"_id eq 4954037118555241963 or gender eq female":         2,
+		"(gender eq male or gender eq female) and name pr false": 0,
+	} {
+		q := Query{"Patient", "_filter=" + filter}
+		results, _, err := m.MongoSearcher.Search(q)
+		util.CheckErr(err)
+		c.Assert(len(results), Equals, expected, Commentf("%s", filter))
+	}
+
+	q := Query{"Patient", "_filter=family xx peters"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_filter\" content is invalid: unknown operator xx"))
+
+	q = Query{"Patient", "_filter=general-practitioner.name eq peters"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_filter\" content is invalid: the type of the resources referenced by general-practitioner must be given (general-practitioner:[type])"))
+
+	q = Query{"Patient", "_filter=gender ss male"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_filter\" content is invalid: ss needs a system|code (not male)"))
+}
+
 // Test internally used functions
 
 func (m *MongoSearchSuite) TestBuildBsonForCompositeCriteriaAndPathWithArrayAncestor(c *C) {
@@ -0,0 +1,839 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/utils"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PostgresTimeFormat is the fixed-width UTC layout used for timestamps in search documents
+// so that they can be compared as strings in SQL/JSON path expressions
+const PostgresTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// PostgresHistoryTable is the single table holding the JSON blobs of all resource versions
+const PostgresHistoryTable = "history"
+
+// PostgresQueryer is implemented by both *sql.DB and *sql.Tx
+type PostgresQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// PostgresSearcher implements FHIR searches using a PostgreSQL database.
+//
+// Every resource type has its own table holding the current version's id, versionId and
+// a JSONB search document (see PostgresSearchDocument). Search parameters are compiled
+// to SQL/JSON path expressions evaluated against that document, and the resource JSON
+// itself is then retrieved from the history table.
+type PostgresSearcher struct {
+	db                PostgresQueryer
+	schema            string
+	countTotalResults bool
+	enableCISearches  bool
+}
+
+// NewPostgresSearcher creates a new instance of a PostgresSearcher for an open database or transaction
+func NewPostgresSearcher(db PostgresQueryer, schema string, countTotalResults, enableCISearches bool) *PostgresSearcher {
+	return &PostgresSearcher{
+		db:                db,
+		schema:            schema,
+		countTotalResults: countTotalResults,
+		enableCISearches:  enableCISearches,
+	}
+}
+
+// PostgresTableName returns the quoted, schema-qualified name of a table
+func PostgresTableName(schema, table string) string {
+	return PostgresQuoteIdentifier(schema) + "." + PostgresQuoteIdentifier(table)
+}
+
+// PostgresResourceTableName returns the quoted name of the table for a resource type
+func PostgresResourceTableName(schema, resourceType string) string {
+	return PostgresTableName(schema, models.PluralizeLowerResourceName(resourceType))
+}
+
+// PostgresQuoteIdentifier quotes an SQL identifier
+func PostgresQuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// PostgresSearchDocument converts a resource into the JSON document stored in its
+// resource-type table for searching. This is the same structure as stored in MongoDB
+// (e.g. _id, reference__id, { __from, __to } for dates) so that search paths can be
+// shared, with times written using PostgresTimeFormat.
+func PostgresSearchDocument(resource *models2.Resource) ([]byte, error) {
+	doc, err := resource.GetBSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "PostgresSearchDocument: GetBSON failed")
+	}
+	return json.Marshal(bsonToSearchJSON(doc))
+}
+
+func bsonToSearchJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return bsonToSearchJSON([]bson.DocElem(v))
+	case *[]bson.DocElem:
+		return bsonToSearchJSON(*v)
+	case []bson.DocElem:
+		out := make(map[string]interface{}, len(v))
+		for _, elem := range v {
+			out[elem.Name] = bsonToSearchJSON(elem.Value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = bsonToSearchJSON(v[i])
+		}
+		return out
+	case time.Time:
+		return v.UTC().Format(PostgresTimeFormat)
+	case *int32:
+		return *v
+	case *int64:
+		return *v
+	default:
+		return v
+	}
+}
+
+// sqlBuilder collects the positional arguments of an SQL statement
+type sqlBuilder struct {
+	args       []interface{}
+	numAliases int
+}
+
+func (b *sqlBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+func (b *sqlBuilder) alias() string {
+	b.numAliases++
+	return "c" + strconv.Itoa(b.numAliases)
+}
+
+// Search takes a Query and returns a set of results (Resources).
+// Included resources are attached to the matching resources, as with the MongoSearcher.
+func (p *PostgresSearcher) Search(query Query) (resources []*models2.Resource, total uint32, err error) {
+	options := query.Options()
+	table := PostgresResourceTableName(p.schema, query.Resource)
+	if options.Cursor != nil {
+		// cursors are only generated by the MongoSearcher
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+	}
+	if options.UsesIterate() {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_include:iterate\" is not supported"))
+	}
+
+	b := &sqlBuilder{}
+	where := p.createWhereClause(b, "t", query.Params())
+
+	if p.countTotalResults || options.Summary == "count" {
+		countSQL := fmt.Sprintf("SELECT count(*) FROM %s t WHERE %s", table, where)
+		var count int64
+		err = p.db.QueryRowContext(context.TODO(), countSQL, b.args...).Scan(&count)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "search count failed")
+		}
+		total = uint32(count)
+	}
+
+	if options.Summary == "count" {
+		return resources, total, nil
+	}
+
+	resultsSQL := fmt.Sprintf("SELECT h.resource FROM %s t JOIN %s h ON h.resource_type = %s AND h.id = t.id AND h.version_id = t.version_id WHERE %s ORDER BY %s LIMIT %d OFFSET %d",
+		table, PostgresTableName(p.schema, PostgresHistoryTable), b.arg(query.Resource), where,
+		p.createOrderByClause(b, "t", options), options.Count, options.Offset)
+
+	resources, err = p.queryResources(resultsSQL, b.args)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "search failed")
+	}
+
+	if len(resources) > 0 && (len(options.Include) > 0 || len(options.RevInclude) > 0) {
+		err = p.addIncludes(query.Resource, resources, options)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "search includes failed")
+		}
+	}
+
+	// support for _summary and _elements
+	if projection := options.ElementsProjection(query.Resource); projection != nil {
+		err = subsetResources(resources, projection)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: subsetResources failed")
+		}
+	}
+
+	return resources, total, nil
+}
+
+func (p *PostgresSearcher) queryResources(query string, args []interface{}) (resources []*models2.Resource, err error) {
+	rows, err := p.db.QueryContext(context.TODO(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jsonBytes []byte
+		if err = rows.Scan(&jsonBytes); err != nil {
+			return nil, errors.Wrap(err, "row scan failed")
+		}
+		resource, err := models2.NewResourceFromJsonBytes(jsonBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewResourceFromJsonBytes failed")
+		}
+		resources = append(resources, resource)
+	}
+	return resources, rows.Err()
+}
+
+func (p *PostgresSearcher) createWhereClause(b *sqlBuilder, alias string, params []SearchParam) string {
+	if len(params) == 0 {
+		return "TRUE"
+	}
+	clauses := make([]string, len(params))
+	for i, param := range params {
+		clauses[i] = p.createParamClause(b, alias, param)
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+func (p *PostgresSearcher) createParamClause(b *sqlBuilder, alias string, param SearchParam) string {
+	panicOnUnsupportedFeatures(param)
+
+	switch param := param.(type) {
+	case *DateParam:
+		return p.pathsClause(b, alias, param.Paths, p.createDateFilter(param))
+	case *NumberParam:
+		return p.pathsClause(b, alias, param.Paths, p.createNumberFilter(param))
+	case *QuantityParam:
+		return p.pathsClause(b, alias, param.Paths, p.createQuantityFilter(param))
+	case *ReferenceParam:
+		switch ref := param.Reference.(type) {
+		case ChainedQueryReference:
+			return p.createChainedClause(b, alias, param, ref)
+		case ReverseChainedQueryReference:
+			return p.createReverseChainedClause(b, alias, param, ref)
+		}
+		return p.pathsClause(b, alias, param.Paths, p.createReferenceFilter(param))
+	case *MissingParam:
+		exists := p.pathsClause(b, alias, param.Paths, func(path SearchParamPath) string {
+			return pgJSONPath("$", path.Path)
+		})
+		if param.Missing {
+			return "NOT " + exists
+		}
+		return exists
+	case *StringParam:
+		return p.pathsClause(b, alias, param.Paths, p.createStringFilter(param))
+	case *TokenParam:
+		if param.Modifier == "not" {
+			matching := *param
+			matching.Modifier = ""
+			return "NOT " + p.pathsClause(b, alias, param.Paths, p.createTokenFilter(&matching))
+		}
+		return p.pathsClause(b, alias, param.Paths, p.createTokenFilter(param))
+	case *URIParam:
+		return p.pathsClause(b, alias, param.Paths, func(path SearchParamPath) string {
+			return pgFilter(path.Path, "@ == "+pgString(param.URI))
+		})
+	case *OrParam:
+		clauses := make([]string, len(param.Items))
+		for i, item := range param.Items {
+			clauses[i] = p.createParamClause(b, alias, item)
+		}
+		return "(" + strings.Join(clauses, " OR ") + ")"
+	default:
+		// composite and custom search parameters are not yet supported
+		panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param.getInfo().Name)))
+	}
+}
+
+// pathsClause ORs the SQL/JSON path expressions generated for each of the paths
+func (p *PostgresSearcher) pathsClause(b *sqlBuilder, alias string, paths []SearchParamPath, filter func(SearchParamPath) string) string {
+	clauses := make([]string, 0, len(paths))
+	for _, path := range paths {
+		jsonPath := filter(path)
+		if jsonPath == "" {
+			continue
+		}
+		clauses = append(clauses, fmt.Sprintf("%s.content @? %s::jsonpath", alias, b.arg(jsonPath)))
+	}
+	if len(clauses) == 0 {
+		return "FALSE"
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")"
+}
+
+func (p *PostgresSearcher) createDateFilter(d *DateParam) func(SearchParamPath) string {
+	return func(path SearchParamPath) string {
+		switch path.Type {
+		case "date", "dateTime":
+			return pgFilter(path.Path, pgDateCondition(d, `@."__from"`, `@."__to"`))
+		case "instant":
+			return pgFilter(path.Path, pgInstantCondition(d))
+		case "Period":
+			return pgFilter(path.Path, pgPeriodCondition(d))
+		case "Timing":
+			return pgFilter(path.Path+".event", pgDateCondition(d, `@."__from"`, `@."__to"`))
+		default:
+			return ""
+		}
+	}
+}
+
+func pgDateCondition(d *DateParam, from, to string) string {
+	low := pgTime(d.Date.RangeLowIncl())
+	high := pgTime(d.Date.RangeHighExcl())
+
+	switch d.Prefix {
+	case EQ:
+		// "the range of the search value fully contains the range of the target value"
+		return fmt.Sprintf("%s >= %s && %s <= %s", from, low, to, high)
+	case GT:
+		// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
+		return fmt.Sprintf("%s > %s", to, high)
+	case LT:
+		// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
+		return fmt.Sprintf("%s < %s", from, low)
+	case GE:
+		return fmt.Sprintf("(%s >= %s || %s >= %s)", to, high, from, low)
+	case LE:
+		return fmt.Sprintf("(%s <= %s || %s <= %s)", from, low, to, high)
+	case SA:
+		return fmt.Sprintf("%s > %s", from, high)
+	case EB:
+		return fmt.Sprintf("%s < %s", to, low)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+func pgInstantCondition(d *DateParam) string {
+	low := pgTime(d.Date.RangeLowIncl())
+	high := pgTime(d.Date.RangeHighExcl())
+
+	switch d.Prefix {
+	case EQ:
+		return fmt.Sprintf("@ >= %s && @ < %s", low, high)
+	case GT:
+		return fmt.Sprintf("@ > %s", low)
+	case GE:
+		return fmt.Sprintf("@ >= %s", low)
+	case SA:
+		return fmt.Sprintf("@ > %s", high)
+	case LT, EB:
+		return fmt.Sprintf("@ < %s", low)
+	case LE:
+		return fmt.Sprintf("@ < %s", high)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+func pgPeriodCondition(d *DateParam) string {
+	low := pgTime(d.Date.RangeLowIncl())
+	high := pgTime(d.Date.RangeHighExcl())
+	start := `@."start"."__from"`
+	end := `@."end"."__to"`
+	// periods without a start or end are open-ended
+	noStart := `!(exists(@."start"))`
+	noEnd := `!(exists(@."end"))`
+
+	switch d.Prefix {
+	case EQ:
+		return fmt.Sprintf("%s >= %s && %s <= %s", start, low, end, high)
+	case GT:
+		return fmt.Sprintf("(%s > %s || %s)", end, high, noEnd)
+	case LT:
+		return fmt.Sprintf("(%s < %s || %s)", start, low, noStart)
+	case GE:
+		return fmt.Sprintf("(%s >= %s || %s >= %s || %s)", end, high, start, low, noEnd)
+	case LE:
+		return fmt.Sprintf("(%s <= %s || %s <= %s || %s)", start, low, end, high, noStart)
+	case SA:
+		return fmt.Sprintf("%s > %s", start, high)
+	case EB:
+		return fmt.Sprintf("%s < %s", end, low)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+func (p *PostgresSearcher) createNumberFilter(n *NumberParam) func(SearchParamPath) string {
+	return func(path SearchParamPath) string {
+		field := "@"
+		if path.Type == "decimal" {
+			field = `@."__num"`
+		}
+		low := pgNumber(n.Number.RangeLowIncl(), n.Number.Precision+1)
+		high := pgNumber(n.Number.RangeHighExcl(), n.Number.Precision+1)
+		exact := pgNumber(n.Number.Value, n.Number.Precision)
+
+		var condition string
+		switch n.Prefix {
+		case EQ:
+			// Equality is in the range [l, h)
+			condition = fmt.Sprintf("%s >= %s && %s < %s", field, low, field, high)
+		case NE:
+			condition = fmt.Sprintf("(%s < %s || %s >= %s)", field, low, field, high)
+		case GT:
+			condition = fmt.Sprintf("%s > %s", field, exact)
+		case LT:
+			condition = fmt.Sprintf("%s < %s", field, exact)
+		case GE:
+			condition = fmt.Sprintf("%s >= %s", field, low)
+		case LE:
+			condition = fmt.Sprintf("%s <= %s", field, high)
+		default:
+			// SA, EB are not supported for Number queries
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", n.Name)))
+		}
+		return pgFilter(path.Path, condition)
+	}
+}
+
+func (p *PostgresSearcher) createQuantityFilter(q *QuantityParam) func(SearchParamPath) string {
+	return func(path SearchParamPath) string {
+		low := pgNumber(q.Number.RangeLowIncl(), q.Number.Precision+1)
+		high := pgNumber(q.Number.RangeHighExcl(), q.Number.Precision+1)
+		exact := pgNumber(q.Number.Value, q.Number.Precision)
+		condition := pgQuantityValueCondition(q, `@."value"`, low, high, exact)
+
+		if q.System != "" {
+			condition = strings.Join([]string{condition, p.ci(`@."code"`, q.Code), p.ci(`@."system"`, q.System)}, " && ")
+		} else if q.Code != "" {
+			// without a system the code may match either the code or the unit
+			condition = fmt.Sprintf("%s && (%s || %s)", condition, p.ci(`@."code"`, q.Code), p.ci(`@."unit"`, q.Code))
+		}
+
+		// values with UCUM units can also match in canonical units (see createQuantityQueryObject)
+		if q.Code != "" && (q.System == "" || q.System == utils.UCUMSystem) {
+			if unit, err := utils.ParseUCUM(q.Code); err == nil {
+				field := `@."` + models2.QuantityCanonicalField + `"`
+				canonical := strings.Join([]string{
+					pgQuantityValueCondition(q, field+`."value"`, pgFloat(unit.Convert(q.Number.RangeLowIncl())),
+						pgFloat(unit.Convert(q.Number.RangeHighExcl())), pgFloat(unit.Convert(q.Number.Value))),
+					pgExact(field+`."code"`, unit.Canonical()),
+				}, " && ")
+				condition = pgOr(canonical, condition)
+			}
+		}
+		return pgFilter(path.Path, condition)
+	}
+}
+
+// pgQuantityValueCondition compares the decimal value of a quantity at field with a search value
+func pgQuantityValueCondition(q *QuantityParam, field, low, high, exact string) string {
+	from := field + `."__from"`
+	to := field + `."__to"`
+
+	switch q.Prefix {
+	case EQ:
+		return fmt.Sprintf("%s >= %s && %s <= %s", from, low, to, high)
+	case LT:
+		return fmt.Sprintf("%s < %s", from, exact)
+	case GT:
+		return fmt.Sprintf("%s > %s", to, exact)
+	case GE:
+		return fmt.Sprintf("(%s >= %s || %s >= %s)", to, high, from, low)
+	case LE:
+		return fmt.Sprintf("(%s <= %s || %s <= %s)", from, low, to, high)
+	default:
+		// NE, SA, EB are not supported for Quantity queries
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
+	}
+}
+
+func (p *PostgresSearcher) createReferenceFilter(r *ReferenceParam) func(SearchParamPath) string {
+	return func(path SearchParamPath) string {
+		var conditions []string
+		if path.Type == "Resource" {
+			// inlined resources (e.g. Bundle.entry.resource)
+			switch ref := r.Reference.(type) {
+			case LocalReference:
+				if ref.Type != "" {
+					conditions = append(conditions, `@."resourceType" == `+pgString(ref.Type))
+				}
+				conditions = append(conditions, `@."_id" == `+pgString(ref.ID))
+			default:
+				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
+			}
+			return pgFilter(path.Path, strings.Join(conditions, " && "))
+		}
+
+		switch ref := r.Reference.(type) {
+		case LocalReference:
+			conditions = append(conditions, `@."reference__id" == `+pgString(ref.ID))
+			if ref.Type != "" {
+				conditions = append(conditions, `@."reference__type" == `+pgString(ref.Type))
+			}
+		case ExternalReference:
+			conditions = append(conditions, p.ci(`@."reference"`, ref.URL))
+		case IdentifierReference:
+			if ref.System != "" {
+				conditions = append(conditions, p.ci(`@."identifier"."system"`, ref.System))
+			} else if !ref.AnySystem {
+				conditions = append(conditions, `!(exists(@."identifier"."system"))`)
+			}
+			if ref.Value != "" {
+				conditions = append(conditions, p.ci(`@."identifier"."value"`, ref.Value))
+			}
+		default:
+			panic(createInternalServerError("", "createReferenceFilter should not be used for chained references"))
+		}
+		return pgFilter(path.Path, strings.Join(conditions, " && "))
+	}
+}
+
+// createChainedClause matches resources referencing a resource of the chained type that itself matches the chained query
+func (p *PostgresSearcher) createChainedClause(b *sqlBuilder, alias string, r *ReferenceParam, ref ChainedQueryReference) string {
+	if r.referenceIsInternal() {
+		panic(createUnsupportedSearchError("MSG_PARAM_CHAINED", fmt.Sprintf("Parameter \"%s\" chained search of inlined resources is not supported", r.Name)))
+	}
+
+	chained := b.alias()
+	var joins []string
+	for _, path := range r.Paths {
+		jsonPath := pgFilter(path.Path, `@."reference__id" == $refid && @."reference__type" == `+pgString(ref.Type))
+		joins = append(joins, fmt.Sprintf("jsonb_path_exists(%s.content, %s::jsonpath, jsonb_build_object('refid', %s.id))", alias, b.arg(jsonPath), chained))
+	}
+	where := p.createWhereClause(b, chained, ref.ChainedQuery.Params())
+
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s %s WHERE %s AND (%s))",
+		PostgresResourceTableName(p.schema, ref.Type), chained, where, strings.Join(joins, " OR "))
+}
+
+// createReverseChainedClause matches resources referenced by a resource of another type matching the _has query
+func (p *PostgresSearcher) createReverseChainedClause(b *sqlBuilder, alias string, r *ReferenceParam, ref ReverseChainedQueryReference) string {
+	referencing := b.alias()
+	var joins []string
+	for _, path := range r.Paths {
+		jsonPath := pgFilter(path.Path, `@."reference__id" == $refid && @."reference__type" == `+pgString(r.Targets[0]))
+		joins = append(joins, fmt.Sprintf("jsonb_path_exists(%s.content, %s::jsonpath, jsonb_build_object('refid', %s.id))", referencing, b.arg(jsonPath), alias))
+	}
+	where := p.createWhereClause(b, referencing, ref.Query.Params())
+
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s %s WHERE %s AND (%s))",
+		PostgresResourceTableName(p.schema, ref.Type), referencing, where, strings.Join(joins, " OR "))
+}
+
+func (p *PostgresSearcher) createStringFilter(s *StringParam) func(SearchParamPath) string {
+	// see MongoSearcher.createStringQueryObject
+	partial, whole := p.cisw, p.ci
+	switch s.Modifier {
+	case "exact":
+		partial, whole = pgExact, pgExact
+	case "contains":
+		partial, whole = p.cic, p.cic
+	}
+
+	return func(path SearchParamPath) string {
+		switch path.Type {
+		case "HumanName":
+			return pgFilter(path.Path, pgOr(
+				partial(`@."text"`, s.String),
+				partial(`@."family"`, s.String),
+				partial(`@."given"`, s.String),
+			))
+		case "Address":
+			return pgFilter(path.Path, pgOr(
+				partial(`@."text"`, s.String),
+				partial(`@."line"`, s.String),
+				partial(`@."city"`, s.String),
+				partial(`@."state"`, s.String),
+				partial(`@."postalCode"`, s.String),
+				partial(`@."country"`, s.String),
+			))
+		default:
+			if s.Name == "_id" {
+				return pgFilter(path.Path, "@ == "+pgString(s.String))
+			}
+			return pgFilter(path.Path, whole("@", s.String))
+		}
+	}
+}
+
+func (p *PostgresSearcher) createTokenFilter(t *TokenParam) func(SearchParamPath) string {
+	// conditions on the system and code relative to the given fields
+	criteria := func(systemField, codeField string) []string {
+		var conditions []string
+		if t.Code == "" {
+			// [parameter]=[system]|
+			conditions = append(conditions, p.ci(systemField, t.System))
+		} else if t.System == "" {
+			conditions = append(conditions, p.ci(codeField, t.Code))
+			if !t.AnySystem {
+				// [parameter]=|[code]
+				conditions = append(conditions, fmt.Sprintf("!(exists(%s))", systemField))
+			}
+		} else {
+			// [parameter]=[system]|[code]
+			conditions = append(conditions, p.ci(codeField, t.Code), p.ci(systemField, t.System))
+		}
+		return conditions
+	}
+
+	if t.Modifier == "text" {
+		// see MongoSearcher.createTokenTextQueryObject
+		return func(path SearchParamPath) string {
+			switch path.Type {
+			case "Coding":
+				return pgFilter(path.Path, p.cisw(`@."display"`, t.Code))
+			case "CodeableConcept":
+				return pgFilter(path.Path, pgOr(p.cisw(`@."text"`, t.Code), p.cisw(`@."coding"."display"`, t.Code)))
+			case "Identifier":
+				return pgFilter(path.Path, p.cisw(`@."type"."text"`, t.Code))
+			}
+			return ""
+		}
+	}
+
+	return func(path SearchParamPath) string {
+		var conditions []string
+		switch path.Type {
+		case "Coding":
+			conditions = criteria(`@."system"`, `@."code"`)
+		case "CodeableConcept":
+			conditions = []string{fmt.Sprintf(`exists(@."coding" ? (%s))`, strings.Join(criteria(`@."system"`, `@."code"`), " && "))}
+		case "Identifier":
+			conditions = criteria(`@."system"`, `@."value"`)
+		case "ContactPoint":
+			conditions = []string{p.ci(`@."value"`, t.Code)}
+			if !t.AnySystem {
+				conditions = append(conditions, p.ci(`@."use"`, t.System))
+			}
+		case "boolean":
+			switch t.Code {
+			case "true", "false":
+				conditions = []string{"@ == " + t.Code}
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", t.Name)))
+			}
+		case "id":
+			// IDs do not need the case-insensitive match.
+			conditions = []string{"@ == " + pgString(t.Code)}
+		default:
+			conditions = []string{p.ci("@", t.Code)}
+		}
+		return pgFilter(path.Path, strings.Join(conditions, " && "))
+	}
+}
+
+func (p *PostgresSearcher) createOrderByClause(b *sqlBuilder, alias string, options *QueryOptions) string {
+	var terms []string
+	for _, sort := range options.Sort {
+		// Note: If there are multiple paths, we only look at the first one (as in the MongoSearcher)
+		path := sort.Parameter.Paths[0]
+		sortPath := pgJSONPath("$", path.Path)
+		switch path.Type {
+		case "date", "dateTime":
+			sortPath += `."__from"`
+		case "Period":
+			sortPath += `."start"."__from"`
+		case "Timing":
+			sortPath += `."event"."__from"`
+		case "decimal":
+			sortPath += `."__num"`
+		case "Quantity":
+			sortPath += `."value"."__num"`
+		case "HumanName":
+			sortPath += `."family"`
+		}
+		term := fmt.Sprintf("jsonb_path_query_first(%s.content, %s::jsonpath)", alias, b.arg(sortPath))
+		if sort.Descending {
+			term += " DESC"
+		}
+		terms = append(terms, term)
+	}
+	// ensure a stable order for paging
+	terms = append(terms, alias+".id")
+	return strings.Join(terms, ", ")
+}
+
+// addIncludes retrieves _include and _revinclude resources and attaches them to the matching resources
+func (p *PostgresSearcher) addIncludes(resourceType string, resources []*models2.Resource, options *QueryOptions) error {
+	byId := make(map[string]*models2.Resource, len(resources))
+	for _, resource := range resources {
+		byId[resource.Id()] = resource
+	}
+	history := PostgresTableName(p.schema, PostgresHistoryTable)
+
+	for _, incl := range options.Include {
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, inclTarget := range incl.Parameter.Targets {
+				if inclTarget == "Any" {
+					continue
+				}
+				b := &sqlBuilder{}
+				refIdsPath := pgFilter(inclPath.Path, `@."reference__type" == `+pgString(inclTarget)) + `."reference__id"`
+				query := fmt.Sprintf("SELECT s.id, h.resource FROM %s s CROSS JOIN LATERAL jsonb_path_query(s.content, %s::jsonpath) AS r(refid) JOIN %s i ON i.id = (r.refid #>> '{}') JOIN %s h ON h.resource_type = %s AND h.id = i.id AND h.version_id = i.version_id WHERE s.id IN (%s)",
+					PostgresResourceTableName(p.schema, resourceType), b.arg(refIdsPath),
+					PostgresResourceTableName(p.schema, inclTarget), history, b.arg(inclTarget), pgInList(b, byId))
+				if err := p.attachIncludes(query, b.args, byId); err != nil {
+					return errors.Wrapf(err, "_include %s:%s failed", incl.Resource, incl.Parameter.Name)
+				}
+			}
+		}
+	}
+
+	for _, incl := range options.RevInclude {
+		if !isValidTarget(resourceType, incl.Parameter) {
+			continue
+		}
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			b := &sqlBuilder{}
+			refIdsPath := pgFilter(inclPath.Path, `@."reference__type" == `+pgString(resourceType)) + `."reference__id"`
+			var matches []string
+			for id := range byId {
+				jsonPath := pgFilter(inclPath.Path, `@."reference__type" == `+pgString(resourceType)+` && @."reference__id" == `+pgString(id))
+				matches = append(matches, fmt.Sprintf("i.content @? %s::jsonpath", b.arg(jsonPath)))
+			}
+			query := fmt.Sprintf("SELECT r.refid #>> '{}', h.resource FROM %s i CROSS JOIN LATERAL jsonb_path_query(i.content, %s::jsonpath) AS r(refid) JOIN %s h ON h.resource_type = %s AND h.id = i.id AND h.version_id = i.version_id WHERE %s",
+				PostgresResourceTableName(p.schema, incl.Parameter.Resource), b.arg(refIdsPath),
+				history, b.arg(incl.Parameter.Resource), strings.Join(matches, " OR "))
+			if err := p.attachIncludes(query, b.args, byId); err != nil {
+				return errors.Wrapf(err, "_revinclude %s:%s failed", incl.Resource, incl.Parameter.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// attachIncludes runs a query returning (id of a search result, included resource JSON) rows
+func (p *PostgresSearcher) attachIncludes(query string, args []interface{}, byId map[string]*models2.Resource) error {
+	rows, err := p.db.QueryContext(context.TODO(), query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var jsonBytes []byte
+		if err = rows.Scan(&id, &jsonBytes); err != nil {
+			return errors.Wrap(err, "row scan failed")
+		}
+		resource, found := byId[id]
+		if !found {
+			continue
+		}
+		included, err := models2.NewResourceFromJsonBytes(jsonBytes)
+		if err != nil {
+			return errors.Wrap(err, "NewResourceFromJsonBytes failed")
+		}
+		resource.AddSearchInclude(included)
+	}
+	return rows.Err()
+}
+
+func pgInList(b *sqlBuilder, ids map[string]*models2.Resource) string {
+	placeholders := make([]string, 0, len(ids))
+	for id := range ids {
+		placeholders = append(placeholders, b.arg(id))
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// Case-insensitive match
+func (p *PostgresSearcher) ci(field, s string) string {
+	if p.enableCISearches {
+		return fmt.Sprintf(`%s like_regex %s flag "i"`, field, pgString("^"+regexp.QuoteMeta(s)+"$"))
+	}
+	return fmt.Sprintf("%s == %s", field, pgString(s))
+}
+
+// Case-insensitive contains
+func (p *PostgresSearcher) cic(field, s string) string {
+	if p.enableCISearches {
+		return fmt.Sprintf(`%s like_regex %s flag "i"`, field, pgString(regexp.QuoteMeta(s)))
+	}
+	return fmt.Sprintf(`%s like_regex %s`, field, pgString(regexp.QuoteMeta(s)))
+}
+
+func pgExact(field, s string) string {
+	return fmt.Sprintf("%s == %s", field, pgString(s))
+}
+
+// Case-insensitive starts-with
+func (p *PostgresSearcher) cisw(field, s string) string {
+	if p.enableCISearches {
+		return fmt.Sprintf(`%s like_regex %s flag "i"`, field, pgString("^"+regexp.QuoteMeta(s)))
+	}
+	return fmt.Sprintf("%s == %s", field, pgString(s))
+}
+
+var pgIndexedPathElement = regexp.MustCompile(`^\[(\d+)\](.+)$`)
+
+// pgJSONPath converts a search path (e.g. "order.[]item.name" or "[0]item.entry") into an
+// SQL/JSON path starting at root. Arrays are unwrapped automatically in lax mode.
+func pgJSONPath(root, path string) string {
+	out := root
+	if path == "" {
+		return out
+	}
+	for _, element := range strings.Split(path, ".") {
+		index := ""
+		if m := pgIndexedPathElement.FindStringSubmatch(element); m != nil {
+			index = m[1]
+			element = m[2]
+		}
+		out += "." + pgString(strings.TrimPrefix(element, "[]"))
+		if index != "" {
+			out += "[" + index + "]"
+		}
+	}
+	return out
+}
+
+// pgFilter returns an SQL/JSON path selecting items at the search path satisfying the condition
+func pgFilter(path, condition string) string {
+	return fmt.Sprintf("%s ? (%s)", pgJSONPath("$", path), condition)
+}
+
+func pgOr(conditions ...string) string {
+	return "(" + strings.Join(conditions, " || ") + ")"
+}
+
+// pgString returns an SQL/JSON path string literal
+func pgString(s string) string {
+	quoted, err := json.Marshal(s)
+	if err != nil {
+		panic(errors.Wrap(err, "pgString"))
+	}
+	return string(quoted)
+}
+
+func pgTime(t time.Time) string {
+	return pgString(t.UTC().Format(PostgresTimeFormat))
+}
+
+func pgNumber(r *big.Rat, precision int) string {
+	return r.FloatString(precision)
+}
+
+// pgFloat returns a number as it is stored in the search document, i.e. as a float
+func pgFloat(r *big.Rat) string {
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,114 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type PostgresSearchSuite struct {
+	searcher *PostgresSearcher
+}
+
+var _ = Suite(&PostgresSearchSuite{})
+
+func (s *PostgresSearchSuite) SetUpTest(c *C) {
+	s.searcher = NewPostgresSearcher(nil, "fhir", false, true)
+}
+
+func (s *PostgresSearchSuite) TestJSONPath(c *C) {
+	c.Assert(pgJSONPath("$", ""), Equals, `$`)
+	c.Assert(pgJSONPath("$", "name"), Equals, `$."name"`)
+	c.Assert(pgJSONPath("$", "order.[]item.name"), Equals, `$."order"."item"."name"`)
+	c.Assert(pgJSONPath("$", "[0]item.entry"), Equals, `$."item"[0]."entry"`)
+}
+
+func (s *PostgresSearchSuite) TestTableNames(c *C) {
+	c.Assert(PostgresTableName("fhir", "history"), Equals, `"fhir"."history"`)
+	c.Assert(PostgresResourceTableName("fhir", "Patient"), Equals, `"fhir"."patients"`)
+	c.Assert(PostgresQuoteIdentifier(`a"b`), Equals, `"a""b"`)
+}
+
+func (s *PostgresSearchSuite) TestStringClause(c *C) {
+	b := &sqlBuilder{}
+	clause := s.searcher.createParamClause(b, "t", ParseStringParam("Hello", stringParamInfo))
+	c.Assert(clause, Equals, `(t.content @? $1::jsonpath)`)
+	c.Assert(b.args, DeepEquals, []interface{}{`$."bar" ? (@ like_regex "^Hello$" flag "i")`})
+}
+
+func (s *PostgresSearchSuite) TestTokenClause(c *C) {
+	b := &sqlBuilder{}
+	clause := s.searcher.createParamClause(b, "t", ParseTokenParam("http://example.org|ABC", tokenParamInfo))
+	c.Assert(clause, Equals, `(t.content @? $1::jsonpath)`)
+	c.Assert(b.args, DeepEquals, []interface{}{
+		`$."bar" ? (exists(@."coding" ? (@."code" like_regex "^ABC$" flag "i" && @."system" like_regex "^http://example\\.org$" flag "i")))`,
+	})
+}
+
+func (s *PostgresSearchSuite) TestQuantityClause(c *C) {
+	info := SearchParameterDictionary["Observation"]["value-quantity"]
+	b := &sqlBuilder{}
+	s.searcher.createParamClause(b, "t", ParseQuantityParam("gt5.5|http://unitsofmeasure.org|mmol/L", info))
+	c.Assert(b.args, DeepEquals, []interface{}{
+		`$."valueQuantity" ? ((@."__canonical"."value"."__to" > 3312175185000000000000000 && @."__canonical"."code" == "m-3"` +
+			` || @."value"."__to" > 5.5 && @."code" like_regex "^mmol/L$" flag "i" && @."system" like_regex "^http://unitsofmeasure\\.org$" flag "i"))`,
+	})
+
+	b = &sqlBuilder{}
+	s.searcher.createParamClause(b, "t", ParseQuantityParam("185||lbs", info))
+	c.Assert(b.args, DeepEquals, []interface{}{
+		`$."valueQuantity" ? (@."value"."__from" >= 184.5 && @."value"."__to" <= 185.5 && (@."code" like_regex "^lbs$" flag "i" || @."unit" like_regex "^lbs$" flag "i"))`,
+	})
+}
+
+func (s *PostgresSearchSuite) TestOrClause(c *C) {
+	b := &sqlBuilder{}
+	or := &OrParam{
+		SearchParamInfo: stringParamInfo,
+		Items: []SearchParam{
+			ParseStringParam("a", stringParamInfo),
+			ParseStringParam("b", stringParamInfo),
+		},
+	}
+	clause := s.searcher.createParamClause(b, "t", or)
+	c.Assert(clause, Equals, `((t.content @? $1::jsonpath) OR (t.content @? $2::jsonpath))`)
+	c.Assert(b.args, HasLen, 2)
+}
+
+func (s *PostgresSearchSuite) TestStringModifierClauses(c *C) {
+	modInfo := stringParamInfo
+	modInfo.Modifier = "exact"
+	b := &sqlBuilder{}
+	s.searcher.createParamClause(b, "t", ParseStringParam("Hello", modInfo))
+	c.Assert(b.args, DeepEquals, []interface{}{`$."bar" ? (@ == "Hello")`})
+
+	modInfo.Modifier = "contains"
+	b = &sqlBuilder{}
+	s.searcher.createParamClause(b, "t", ParseStringParam("ell", modInfo))
+	c.Assert(b.args, DeepEquals, []interface{}{`$."bar" ? (@ like_regex "ell" flag "i")`})
+}
+
+func (s *PostgresSearchSuite) TestTokenModifierClauses(c *C) {
+	modInfo := tokenParamInfo
+	modInfo.Modifier = "not"
+	b := &sqlBuilder{}
+	clause := s.searcher.createParamClause(b, "t", ParseTokenParam("ABC", modInfo))
+	c.Assert(clause, Equals, `NOT (t.content @? $1::jsonpath)`)
+	c.Assert(b.args, DeepEquals, []interface{}{
+		`$."bar" ? (exists(@."coding" ? (@."code" like_regex "^ABC$" flag "i")))`,
+	})
+
+	modInfo.Modifier = "text"
+	b = &sqlBuilder{}
+	s.searcher.createParamClause(b, "t", ParseTokenParam("Blood", modInfo))
+	c.Assert(b.args, DeepEquals, []interface{}{
+		`$."bar" ? ((@."text" like_regex "^Blood" flag "i" || @."coding"."display" like_regex "^Blood" flag "i"))`,
+	})
+}
+
+func (s *PostgresSearchSuite) TestMissingClause(c *C) {
+	modInfo := stringParamInfo
+	modInfo.Modifier = "missing"
+	b := &sqlBuilder{}
+	clause := s.searcher.createParamClause(b, "t", modInfo.CreateSearchParam("true"))
+	c.Assert(clause, Equals, `NOT (t.content @? $1::jsonpath)`)
+	c.Assert(b.args, DeepEquals, []interface{}{`$."bar"`})
+}
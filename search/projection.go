@@ -0,0 +1,85 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ElementsProjection describes which top-level elements of a resource are returned for a search
+// with _summary or _elements. Either only the Included elements are returned, or all elements
+// other than the Excluded ones. Elements are named as in JSON, e.g. valueQuantity rather than
+// value[x].
+type ElementsProjection struct {
+	Included []string
+	Excluded []string
+}
+
+// ElementsProjection returns the projection requested by the _summary and _elements options for
+// resources of the given type, or nil if whole resources should be returned.
+func (o *QueryOptions) ElementsProjection(resourceType string) *ElementsProjection {
+	switch {
+	case len(o.Elements) > 0:
+		included := []string{"resourceType", "id", "meta"}
+		for _, element := range o.Elements {
+			included = append(included, models2.ElementNames(resourceType, element)...)
+		}
+		return &ElementsProjection{Included: included}
+
+	case o.Summary == "true":
+		summary, found := models2.SummaryElements(resourceType)
+		if !found {
+			// without knowing the summary elements, at least leave out the narrative
+			return &ElementsProjection{Excluded: []string{"text"}}
+		}
+		return &ElementsProjection{Included: append([]string{"resourceType"}, summary...)}
+
+	case o.Summary == "text":
+		return &ElementsProjection{Included: []string{"resourceType", "id", "meta", "implicitRules", "text"}}
+
+	case o.Summary == "data":
+		return &ElementsProjection{Excluded: []string{"text"}}
+	}
+	return nil
+}
+
+// Keeps returns true if the projection returns the given top-level element
+func (p *ElementsProjection) Keeps(element string) bool {
+	if p.Included != nil {
+		return contains(p.Included, element)
+	}
+	return !contains(p.Excluded, element)
+}
+
+// MongoProjection returns the projection as a MongoDB projection document. The extensions of
+// primitive elements (e.g. _birthDate) are projected along with the elements themselves.
+func (p *ElementsProjection) MongoProjection() bson.M {
+	projection := bson.M{}
+	elements, value := p.Excluded, 0
+	if p.Included != nil {
+		elements, value = p.Included, 1
+	}
+	for _, element := range elements {
+		if element == "id" {
+			// id is stored as _id and its extensions as __id
+			projection["_id"] = value
+			projection["__id"] = value
+			continue
+		}
+		projection[element] = value
+		projection["_"+element] = value
+	}
+	return projection
+}
+
+// subsetResources replaces the resources with their subsets for the projection, which also tags
+// them as SUBSETTED
+func subsetResources(resources []*models2.Resource, projection *ElementsProjection) error {
+	for i, resource := range resources {
+		subset, err := resource.Subset(projection.Keeps)
+		if err != nil {
+			return err
+		}
+		resources[i] = subset
+	}
+	return nil
+}
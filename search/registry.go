@@ -41,12 +41,38 @@ func (r *Registry) RegisterParameterInfo(param SearchParamInfo) {
 	rMap[param.Name] = param
 
 	// For now, also register in SearchParameterDictionary
-	rMap, ok = SearchParameterDictionary[param.Resource]
-	if !ok {
-		rMap = make(map[string]SearchParamInfo)
-		SearchParameterDictionary[param.Resource] = rMap
+	updateSearchParameterDictionary(param.Resource, func(params map[string]SearchParamInfo) {
+		params[param.Name] = param
+	})
+}
+
+// UnregisterParameterInfo removes the search param info for a given resource and name, if there is any.
+func (r *Registry) UnregisterParameterInfo(resource, name string) {
+	r.infosLock.Lock()
+	defer r.infosLock.Unlock()
+	delete(r.infos[resource], name)
+
+	updateSearchParameterDictionary(resource, func(params map[string]SearchParamInfo) {
+		delete(params, name)
+	})
+}
+
+// updateSearchParameterDictionary changes the search parameters of a resource in the SearchParameterDictionary.
+// Searches read the dictionary without locking, so rather than being modified in place it is replaced by an
+// updated copy, which allows parameters to be registered while the server is running.
+func updateSearchParameterDictionary(resource string, update func(params map[string]SearchParamInfo)) {
+	params := make(map[string]SearchParamInfo, len(SearchParameterDictionary[resource])+1)
+	for name, info := range SearchParameterDictionary[resource] {
+		params[name] = info
 	}
-	rMap[param.Name] = param
+	update(params)
+
+	dictionary := make(map[string]map[string]SearchParamInfo, len(SearchParameterDictionary)+1)
+	for name, resourceParams := range SearchParameterDictionary {
+		dictionary[name] = resourceParams
+	}
+	dictionary[resource] = params
+	SearchParameterDictionary = dictionary
 }
 
 // LookupParameterInfo looks up search parameter info by resource and name.  If no parameter info is registered, it will
@@ -18,6 +18,7 @@ const (
 	SecurityParam      = "_security"
 	TextParam          = "_text"
 	ContentParam       = "_content"
+	FilterParam        = "_filter"
 	ListParam          = "_list"
 	QueryParam         = "_query"
 	HasParam           = "_has"
@@ -30,12 +31,13 @@ const (
 	ContainedParam     = "_contained"
 	ContainedTypeParam = "_containedType"
 	OffsetParam        = "_offset" // Custom param, not in FHIR spec
+	CursorParam        = "_cursor" // Custom param, not in FHIR spec
 	FormatParam        = "_format"
 )
 
 var globalSearchParams = map[string]bool{IDParam: true, LastUpdatedParam: true, TagParam: true,
 	ProfileParam: true, SecurityParam: true, TextParam: true, ContentParam: true, ListParam: true,
-	QueryParam: true, HasParam: true}
+	QueryParam: true, HasParam: true, FilterParam: true}
 
 func isGlobalSearchParam(param string) bool {
 	_, found := globalSearchParams[param]
@@ -44,7 +46,7 @@ func isGlobalSearchParam(param string) bool {
 
 var searchResultParams = map[string]bool{SortParam: true, CountParam: true, IncludeParam: true,
 	RevIncludeParam: true, SummaryParam: true, ElementsParam: true, ContainedParam: true,
-	ContainedTypeParam: true, OffsetParam: true, FormatParam: true}
+	ContainedTypeParam: true, OffsetParam: true, CursorParam: true, FormatParam: true}
 
 func isSearchResultParam(param string) bool {
 	_, found := searchResultParams[param]
@@ -100,7 +102,7 @@ func (q *Query) Params() []SearchParam {
 			}
 		}
 	}
-	return results
+	return combineNearDistance(results)
 }
 
 // Options parses the query string and returns the QueryOptions.
@@ -108,12 +110,16 @@ func (q *Query) Options() *QueryOptions {
 	options := NewQueryOptions()
 	queryParams, _ := ParseQuery(q.Query)
 
-	if strings.Contains(q.Query, "_include=*") {
-		options.IsIncludeAll = true
-	}
-
-	if strings.Contains(q.Query, "_revinclude=*") {
-		options.IsRevincludeAll = true
+	// checked on the parsed values as the * may have been escaped
+	for _, queryParam := range queryParams.All() {
+		if queryParam.Value == "*" {
+			switch queryParam.Key {
+			case IncludeParam:
+				options.IsIncludeAll = true
+			case RevIncludeParam:
+				options.IsRevincludeAll = true
+			}
+		}
 	}
 
 	for _, queryParam := range queryParams.All() {
@@ -142,15 +148,38 @@ func (q *Query) Options() *QueryOptions {
 				options.Offset = offset
 			}
 
+		case CursorParam:
+			cursor, err := ParsePageCursor(queryParam.Value)
+			if err != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+			}
+			options.Cursor = cursor
+
 		case SortParam:
 			// The following supports both DSTU2-style sorts and STU3-style sorts
 			keys := strings.Split(queryParam.Value, ",")
 			for _, key := range keys {
 				desc := strings.HasPrefix(key, "-") || modifier == "desc"
+				if key == ScoreParam {
+					// relevance to a _text or _content search, always with the best matches first
+					if !usesFullTextSearch(queryParams) || desc {
+						panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+					}
+					options.Sort = append(options.Sort, SortOption{Parameter: scoreSortParam(q.Resource)})
+					continue
+				}
 				sortParam, ok := SearchParameterDictionary[q.Resource][strings.TrimPrefix(key, "-")]
-				if !ok {
+				if !ok || sortParam.Type == "text" || sortParam.Type == "filter" || sortParam.Type == "near-distance" {
 					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
 				}
+				if sortParam.Type == "near" {
+					// distance from the position of a near search, always with the nearest first
+					if !usesNearSearch(queryParams, q.Resource) || desc {
+						panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+					}
+					options.Sort = append(options.Sort, SortOption{Parameter: distanceSortParam(sortParam)})
+					continue
+				}
 				options.Sort = append(options.Sort, SortOption{Descending: desc, Parameter: sortParam})
 			}
 			// If this was an STU3-style sort, remember that so we reconstruct the query URL correctly
@@ -164,6 +193,10 @@ func (q *Query) Options() *QueryOptions {
 				continue
 			}
 
+			iterate := isIterateModifier(modifier)
+			if modifier != "" && !iterate {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
+			}
 			incls := strings.Split(queryParam.Value, ":")
 			if len(incls) < 2 || len(incls) > 3 {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
@@ -184,7 +217,7 @@ func (q *Query) Options() *QueryOptions {
 					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
 				}
 			}
-			options.Include = append(options.Include, IncludeOption{Resource: incls[0], Parameter: inclParam})
+			options.Include = append(options.Include, IncludeOption{Resource: incls[0], Parameter: inclParam, Iterate: iterate})
 
 		case RevIncludeParam:
 
@@ -192,6 +225,10 @@ func (q *Query) Options() *QueryOptions {
 				continue
 			}
 
+			iterate := isIterateModifier(modifier)
+			if modifier != "" && !iterate {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
+			}
 			incls := strings.Split(queryParam.Value, ":")
 			if len(incls) < 2 || len(incls) > 3 {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
@@ -204,6 +241,17 @@ func (q *Query) Options() *QueryOptions {
 			if revInclParam.Type != "reference" {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
 			}
+			if iterate {
+				// Iterated revincludes apply to included resources, so may target any resource type
+				if len(incls) == 3 {
+					if !isValidTarget(incls[2], revInclParam) {
+						panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
+					}
+					revInclParam.Targets = []string{incls[2]}
+				}
+				options.RevInclude = append(options.RevInclude, RevIncludeOption{Resource: incls[0], Parameter: revInclParam, Iterate: true})
+				continue
+			}
 			// Only the currently searched on resource is a valid target (or "Any")
 			target := q.Resource
 			if len(incls) == 3 && incls[2] != target && incls[2] != "Any" {
@@ -229,17 +277,39 @@ func (q *Query) Options() *QueryOptions {
 			}
 
 		case SummaryParam:
-			if queryParam.Value != "count" && queryParam.Value != "false" {
-				// We only support "count", and the default (implicit) setting is "false".
-				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+			switch queryParam.Value {
+			case "true", "text", "data", "count", "false":
+				options.Summary = queryParam.Value
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+			}
+
+		case ElementsParam:
+			for _, element := range strings.Split(queryParam.Value, ",") {
+				element = strings.TrimSpace(element)
+				if element == "" || strings.ContainsAny(element, ".:") {
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" content is invalid"))
+				}
+				options.Elements = append(options.Elements, element)
 			}
-			options.Summary = queryParam.Value
 
 		default:
 			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param)))
 		}
 	}
 
+	if len(options.Elements) > 0 && options.Summary != "" && options.Summary != "false" && options.Summary != "count" {
+		// _summary and _elements each choose which elements to return, so can't be combined
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" cannot be combined with \"_summary\""))
+	}
+
+	if options.Cursor != nil {
+		// A cursor can only continue the search it was created for, which is sorted the same way
+		if options.Offset > 0 || len(options.Cursor.Values) != len(options.Sort) || options.SortsByScore() || options.SortsByDistance() {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+		}
+	}
+
 	if options.IsIncludeAll {
 		// check if this resource has any includes
 		inclParams := SearchParameterDictionary[q.Resource]
@@ -296,7 +366,8 @@ func (q *Query) UsesReverseChainedSearch() bool {
 
 // UsesPipeline returns true if the query requires a pipeline to execute
 func (q *Query) UsesPipeline() bool {
-	return q.UsesIncludes() || q.UsesRevIncludes() || q.UsesChainedSearch() || q.UsesReverseChainedSearch()
+	options := q.Options()
+	return q.UsesIncludes() || q.UsesRevIncludes() || q.UsesChainedSearch() || q.UsesReverseChainedSearch() || options.SortsByScore() || options.SortsByDistance()
 }
 
 // SupportsPaging returns true if the query results can be paginated, false if not.
@@ -383,6 +454,7 @@ func (q *Query) URLQueryParameters(withOptions bool) URLQueryParameters {
 type QueryOptions struct {
 	Count           int
 	Offset          int
+	Cursor          *PageCursor
 	Sort            []SortOption
 	Include         []IncludeOption
 	RevInclude      []RevIncludeOption
@@ -390,6 +462,7 @@ type QueryOptions struct {
 	IsIncludeAll    bool
 	IsRevincludeAll bool
 	Summary         string
+	Elements        []string
 }
 
 // NewQueryOptions constructs a new QueryOptions with default values (offset = 0, Count = 100)
@@ -419,27 +492,68 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 			queryParams.Add(sortParamKey, sort.Parameter.Name)
 		}
 	}
-	queryParams.Set(OffsetParam, strconv.Itoa(o.Offset))
+	if o.Cursor != nil {
+		queryParams.Set(CursorParam, o.Cursor.Token())
+	} else {
+		queryParams.Set(OffsetParam, strconv.Itoa(o.Offset))
+	}
 	queryParams.Set(CountParam, strconv.Itoa(o.Count))
 	for _, incl := range o.Include {
-		queryParams.Add(IncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+		queryParams.Add(includeParamKey(IncludeParam, incl.Iterate), fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
 	}
 	for _, incl := range o.RevInclude {
-		queryParams.Add(RevIncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+		queryParams.Add(includeParamKey(RevIncludeParam, incl.Iterate), fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+	}
+	if o.Summary != "" && o.Summary != "false" && o.Summary != "count" {
+		queryParams.Set(SummaryParam, o.Summary)
+	}
+	if len(o.Elements) > 0 {
+		queryParams.Set(ElementsParam, strings.Join(o.Elements, ","))
 	}
 	return queryParams
 }
 
-// IncludeOption describes the data that should be included in query results
+// UsesIterate returns true if any of the _include or _revinclude options have the :iterate modifier
+func (o *QueryOptions) UsesIterate() bool {
+	for _, incl := range o.Include {
+		if incl.Iterate {
+			return true
+		}
+	}
+	for _, incl := range o.RevInclude {
+		if incl.Iterate {
+			return true
+		}
+	}
+	return false
+}
+
+// isIterateModifier checks for the :iterate modifier on _include and _revinclude, or its STU3 name :recurse
+func isIterateModifier(modifier string) bool {
+	return modifier == "iterate" || modifier == "recurse"
+}
+
+func includeParamKey(param string, iterate bool) string {
+	if iterate {
+		return param + ":iterate"
+	}
+	return param
+}
+
+// IncludeOption describes the data that should be included in query results.
+// Iterate includes also apply to the included resources.
 type IncludeOption struct {
 	Resource  string
 	Parameter SearchParamInfo
+	Iterate   bool
 }
 
-// RevIncludeOption describes the data that should be included in query results
+// RevIncludeOption describes the data that should be included in query results.
+// Iterate revincludes also apply to the included resources.
 type RevIncludeOption struct {
 	Resource  string
 	Parameter SearchParamInfo
+	Iterate   bool
 }
 
 // SortOption indicates what parameter to sort on and the sort order
@@ -474,6 +588,8 @@ func usesChainedSearch(param SearchParam) bool {
 				}
 			}
 		}
+	case *FilterExpressionParam:
+		return p.Expression.usesChains()
 	}
 	return false
 }
@@ -564,6 +680,19 @@ func createReverseChainedQueryInfo(resource, modifier string) SearchParamInfo {
 // CreateSearchParam converts a singular string query value (e.g. "2012") into
 // a SearchParam object corresponding to the SearchParamInfo.
 func (s SearchParamInfo) CreateSearchParam(paramStr string) SearchParam {
+	if s.Type == "text" {
+		// commas are part of the text search syntax
+		return ParseFullTextParam(paramStr, s)
+	}
+
+	if s.Type == "filter" {
+		return ParseFilterExpressionParam(paramStr, s)
+	}
+
+	if s.Modifier == "missing" {
+		return ParseMissingParam(paramStr, s)
+	}
+
 	if ors := escapeFriendlySplit(paramStr, ','); len(ors) > 1 {
 		return ParseOrParam(ors, s)
 	}
@@ -573,6 +702,10 @@ func (s SearchParamInfo) CreateSearchParam(paramStr string) SearchParam {
 		return ParseCompositeParam(paramStr, s)
 	case "date":
 		return ParseDateParam(paramStr, s)
+	case "near":
+		return ParseNearParam(paramStr, s)
+	case "near-distance":
+		return ParseNearDistanceParam(paramStr, s)
 	case "number":
 		return ParseNumberParam(paramStr, s)
 	case "quantity":
@@ -649,6 +782,115 @@ func ParseCompositeParam(paramString string, info SearchParamInfo) *CompositePar
 	return &CompositeParam{info, escapeFriendlySplit(paramString, '$')}
 }
 
+// FullTextParam represents a _text or _content search.  The following
+// description is from the FHIR STU3 specification:
+//
+// The _content parameter allows the search of the entire content of the
+// resource, while the _text parameter searches the narrative of the resource.
+// The search syntax supports AND, OR and NOT operators, parentheses and
+// quoted phrases.
+type FullTextParam struct {
+	SearchParamInfo
+	Expression *TextExpression
+}
+
+func (f *FullTextParam) getInfo() SearchParamInfo {
+	return f.SearchParamInfo
+}
+
+func (f *FullTextParam) setInfo(info SearchParamInfo) {
+	f.SearchParamInfo = info
+}
+
+func (f *FullTextParam) getQueryParamAndValue() (string, string) {
+	return queryParamAndValue(f.SearchParamInfo, f.Expression.String())
+}
+
+// ParseFullTextParam parses a _text or _content query string and returns a
+// pointer to a FullTextParam based on the query and the parameter definition.
+func ParseFullTextParam(paramString string, info SearchParamInfo) *FullTextParam {
+	if info.Modifier != "" || info.Postfix != "" {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", info.Name)))
+	}
+	expression, err := ParseTextExpression(paramString)
+	if err != nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s", info.Name, err)))
+	}
+	return &FullTextParam{info, expression}
+}
+
+// FilterExpressionParam represents a _filter search, which combines
+// comparisons of other search parameters with and, or and not, e.g.
+// _filter=given eq "peter" and (birthdate ge 1980 or not (gender eq male)).
+type FilterExpressionParam struct {
+	SearchParamInfo
+	Expression *FilterExpression
+}
+
+func (f *FilterExpressionParam) getInfo() SearchParamInfo {
+	return f.SearchParamInfo
+}
+
+func (f *FilterExpressionParam) setInfo(info SearchParamInfo) {
+	f.SearchParamInfo = info
+}
+
+func (f *FilterExpressionParam) getQueryParamAndValue() (string, string) {
+	return queryParamAndValue(f.SearchParamInfo, f.Expression.String())
+}
+
+// ParseFilterExpressionParam parses a _filter query string and returns a
+// pointer to a FilterExpressionParam based on the query and the parameter
+// definition.
+func ParseFilterExpressionParam(paramString string, info SearchParamInfo) *FilterExpressionParam {
+	if info.Modifier != "" || info.Postfix != "" {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", info.Name)))
+	}
+	expression, err := ParseFilterExpression(info.Resource, paramString)
+	if _, unsupported := err.(filterUnsupportedError); unsupported {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is not supported: %s", info.Name, err)))
+	} else if err != nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s", info.Name, err)))
+	}
+	return &FilterExpressionParam{info, expression}
+}
+
+// MissingParam represents a search parameter of any type with the :missing
+// modifier.  The following description is from the FHIR STU3 specification:
+//
+// For all parameters (except combination), searching for name:missing=true
+// will return all resources that don't have a value for the param, while
+// name:missing=false will return all resources that do.
+type MissingParam struct {
+	SearchParamInfo
+	Missing bool
+}
+
+func (m *MissingParam) getInfo() SearchParamInfo {
+	return m.SearchParamInfo
+}
+
+func (m *MissingParam) setInfo(info SearchParamInfo) {
+	m.SearchParamInfo = info
+}
+
+func (m *MissingParam) getQueryParamAndValue() (string, string) {
+	return queryParamAndValue(m.SearchParamInfo, strconv.FormatBool(m.Missing))
+}
+
+// ParseMissingParam parses the value of a :missing search parameter and returns
+// a pointer to a MissingParam based on the query and the parameter definition.
+func ParseMissingParam(paramStr string, info SearchParamInfo) *MissingParam {
+	switch paramStr {
+	case "true":
+		return &MissingParam{info, true}
+	case "false":
+		return &MissingParam{info, false}
+	default:
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", info.Name)))
+	}
+}
+
 // DateParam represents a date-flavored search parameter.  The following
 // description is from the FHIR DSTU2 specification:
 //
@@ -813,6 +1055,8 @@ func (r *ReferenceParam) getQueryParamAndValue() (string, string) {
 		return fmt.Sprintf("%s.%s", referenceParam, cqParam), cqValue
 	case ExternalReference:
 		return r.Name, escape(t.URL)
+	case IdentifierReference:
+		return queryParamAndValue(r.SearchParamInfo, fmt.Sprintf("%s|%s", escape(t.System), escape(t.Value)))
 	case LocalReference:
 		return r.Name, fmt.Sprintf("%s/%s", t.Type, escape(t.ID))
 	}
@@ -864,6 +1108,11 @@ func ParseReferenceParam(paramStr string, info SearchParamInfo) *ReferenceParam
 		q := Query{Resource: parts[0], Query: parts[2] + "=" + paramStr}
 		return &ReferenceParam{info, ReverseChainedQueryReference{ReferenceName: parts[1], Type: parts[0], Query: q}}
 	}
+	if info.Modifier == "identifier" {
+		// [parameter]:identifier=[system]|[value] matches the identifiers of the references
+		token := ParseTokenParam(paramStr, info)
+		return &ReferenceParam{info, IdentifierReference{System: token.System, Value: token.Code, AnySystem: token.AnySystem}}
+	}
 	if info.Postfix != "" {
 		typ := findReferencedType("", info)
 		q := Query{Resource: typ, Query: info.Postfix + "=" + paramStr}
@@ -936,6 +1185,14 @@ type ExternalReference struct {
 	URL  string
 }
 
+// IdentifierReference represents a reference by the identifier of the referenced
+// resource, as searched for with the :identifier modifier
+type IdentifierReference struct {
+	System    string
+	Value     string
+	AnySystem bool
+}
+
 // ChainedQueryReference represents a chained query
 type ChainedQueryReference struct {
 	Type         string // The type of resource being searched
@@ -1019,6 +1276,13 @@ func ParseTokenParam(paramString string, info SearchParamInfo) *TokenParam {
 
 	t := &TokenParam{SearchParamInfo: info}
 
+	if info.Modifier == "text" {
+		// [parameter]:text=[string] matches the text of codes rather than a system and code
+		t.AnySystem = true
+		t.Code = unescape(paramString)
+		return t
+	}
+
 	splitCode := escapeFriendlySplit(paramString, '|')
 	if len(splitCode) == 2 {
 		t.System = unescape(splitCode[0])
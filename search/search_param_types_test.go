@@ -7,6 +7,7 @@ import (
 	"time"
 
 	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type SearchPTSuite struct {
@@ -101,6 +102,42 @@ func (s *SearchPTSuite) TestCompositeParamReconstitution(c *C) {
 	c.Assert(v, Equals, "abc$1\\$23")
 }
 
+/******************************************************************************
+ * MISSING
+ ******************************************************************************/
+
+func (s *SearchPTSuite) TestMissingParam(c *C) {
+	modInfo := tokenParamInfo
+	modInfo.Modifier = "missing"
+	m := modInfo.CreateSearchParam("true")
+
+	c.Assert(m, FitsTypeOf, &MissingParam{})
+	mp := m.(*MissingParam)
+	c.Assert(mp.Name, Equals, "foo")
+	c.Assert(mp.Type, Equals, "token")
+	c.Assert(mp.Paths, HasLen, 1)
+	c.Assert(mp.Paths[0], DeepEquals, SearchParamPath{Path: "bar", Type: "CodeableConcept"})
+	c.Assert(mp.Missing, Equals, true)
+
+	mp = ParseMissingParam("false", modInfo)
+	c.Assert(mp.Missing, Equals, false)
+}
+
+func (s *SearchPTSuite) TestMissingParamInvalidValue(c *C) {
+	modInfo := stringParamInfo
+	modInfo.Modifier = "missing"
+	c.Assert(func() { ParseMissingParam("yes", modInfo) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"foo\" content is invalid"))
+}
+
+func (s *SearchPTSuite) TestMissingParamReconstitution(c *C) {
+	modInfo := dateParamInfo
+	modInfo.Modifier = "missing"
+	mp := ParseMissingParam("true", modInfo)
+	p, v := mp.getQueryParamAndValue()
+	c.Assert(p, Equals, "foo:missing")
+	c.Assert(v, Equals, "true")
+}
+
 /******************************************************************************
  * DATE (Type)
  ******************************************************************************/
@@ -1301,6 +1338,35 @@ func (s *SearchPTSuite) TestReferenceReverseChainedQueryReconstitution(c *C) {
 	c.Assert(v, Equals, "1234-5")
 }
 
+func (s *SearchPTSuite) TestReferenceIdentifier(c *C) {
+	modInfo := referenceParamInfo
+	modInfo.Modifier = "identifier"
+	r := ParseReferenceParam("http://example.org/mrn|12345", modInfo)
+
+	c.Assert(r.Name, Equals, "foo")
+	c.Assert(r.Modifier, Equals, "identifier")
+	c.Assert(r.Reference, FitsTypeOf, IdentifierReference{})
+	iRef := r.Reference.(IdentifierReference)
+	c.Assert(iRef.System, Equals, "http://example.org/mrn")
+	c.Assert(iRef.Value, Equals, "12345")
+	c.Assert(iRef.AnySystem, Equals, false)
+
+	r = ParseReferenceParam("12345", modInfo)
+	iRef = r.Reference.(IdentifierReference)
+	c.Assert(iRef.System, Equals, "")
+	c.Assert(iRef.Value, Equals, "12345")
+	c.Assert(iRef.AnySystem, Equals, true)
+}
+
+func (s *SearchPTSuite) TestReferenceIdentifierReconstitution(c *C) {
+	modInfo := referenceParamInfo
+	modInfo.Modifier = "identifier"
+	r := ParseReferenceParam("http://example.org/mrn|12\\|345", modInfo)
+	p, v := r.getQueryParamAndValue()
+	c.Assert(p, Equals, "foo:identifier")
+	c.Assert(v, Equals, "http://example.org/mrn|12\\|345")
+}
+
 /******************************************************************************
  * STRING
  ******************************************************************************/
@@ -1410,6 +1476,18 @@ func (s *SearchPTSuite) TestTokenParamsWithEscapedPipesAndSlashes(c *C) {
 	c.Assert(t.System, Equals, "foo|bar")
 }
 
+func (s *SearchPTSuite) TestTokenParamText(c *C) {
+	modInfo := tokenParamInfo
+	modInfo.Modifier = "text"
+	t := ParseTokenParam("Blood pressure|systolic", modInfo)
+
+	c.Assert(t.Name, Equals, "foo")
+	c.Assert(t.Modifier, Equals, "text")
+	c.Assert(t.AnySystem, Equals, true)
+	c.Assert(t.Code, Equals, "Blood pressure|systolic")
+	c.Assert(t.System, Equals, "")
+}
+
 func (s *SearchPTSuite) TestTokenParamReconstitution(c *C) {
 	t := ParseTokenParam("http://hl7.org/fhir/v2/0001|M", tokenParamInfo)
 	p, v := t.getQueryParamAndValue()
@@ -1721,6 +1799,127 @@ func (s *SearchPTSuite) TestQueryOptions(c *C) {
 	c.Assert(o.RevInclude[1].Parameter.Name, Equals, "patient")
 }
 
+func (s *SearchPTSuite) TestQueryOptionsCursor(c *C) {
+	cursor := &PageCursor{Values: []interface{}{"male", nil}, ID: "5aa3a2e1e4ae5e6b5fa1b2c3"}
+	q := Query{Resource: "Patient", Query: "gender=male&_sort=gender&_sort=birthdate&_count=10&_cursor=" + cursor.Token()}
+	o := q.Options()
+	c.Assert(o.Cursor, DeepEquals, cursor)
+	c.Assert(o.Offset, Equals, 0)
+
+	queryParams := q.URLQueryParameters(true)
+	c.Assert(queryParams.Get(CursorParam), Equals, cursor.Token())
+	c.Assert(queryParams.Get(OffsetParam), Equals, "")
+	c.Assert(queryParams.Get(CountParam), Equals, "10")
+}
+
+func (s *SearchPTSuite) TestQueryOptionsInvalidCursor(c *C) {
+	invalid := createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid")
+
+	q := Query{Resource: "Patient", Query: "_cursor=foo"}
+	c.Assert(func() { q.Options() }, Panics, invalid)
+
+	// the cursor must have a value for each sort
+	cursor := &PageCursor{Values: []interface{}{"male"}, ID: "5aa3a2e1e4ae5e6b5fa1b2c3"}
+	q = Query{Resource: "Patient", Query: "_sort=gender&_sort=birthdate&_cursor=" + cursor.Token()}
+	c.Assert(func() { q.Options() }, Panics, invalid)
+
+	// and can't be combined with an offset
+	q = Query{Resource: "Patient", Query: "_sort=gender&_offset=10&_cursor=" + cursor.Token()}
+	c.Assert(func() { q.Options() }, Panics, invalid)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsIterate(c *C) {
+	q := Query{Resource: "MedicationRequest", Query: "_include=MedicationRequest:medication&_include:iterate=Medication:manufacturer&_revinclude:iterate=Provenance:target:Medication&_include:recurse=Medication:ingredient"}
+	o := q.Options()
+	c.Assert(o.UsesIterate(), Equals, true)
+	c.Assert(o.Include, HasLen, 3)
+	c.Assert(o.Include[0].Parameter.Name, Equals, "medication")
+	c.Assert(o.Include[0].Iterate, Equals, false)
+	c.Assert(o.Include[1].Resource, Equals, "Medication")
+	c.Assert(o.Include[1].Parameter.Name, Equals, "manufacturer")
+	c.Assert(o.Include[1].Iterate, Equals, true)
+	c.Assert(o.Include[2].Parameter.Name, Equals, "ingredient")
+	c.Assert(o.Include[2].Iterate, Equals, true)
+
+	// iterated revincludes may target resources other than the one searched on
+	c.Assert(o.RevInclude, HasLen, 1)
+	c.Assert(o.RevInclude[0].Resource, Equals, "Provenance")
+	c.Assert(o.RevInclude[0].Parameter.Targets, DeepEquals, []string{"Medication"})
+	c.Assert(o.RevInclude[0].Iterate, Equals, true)
+
+	queryParams := o.URLQueryParameters()
+	c.Assert(queryParams.GetMulti(IncludeParam), DeepEquals, []string{"MedicationRequest:medication"})
+	c.Assert(queryParams.GetMulti("_include:iterate"), DeepEquals, []string{"Medication:manufacturer", "Medication:ingredient"})
+	c.Assert(queryParams.GetMulti("_revinclude:iterate"), DeepEquals, []string{"Provenance:target"})
+
+	q = Query{Resource: "MedicationRequest", Query: "_include=MedicationRequest:medication"}
+	c.Assert(q.Options().UsesIterate(), Equals, false)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsInvalidIncludeModifier(c *C) {
+	q := Query{Resource: "MedicationRequest", Query: "_include:foo=MedicationRequest:medication"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
+
+	q = Query{Resource: "Medication", Query: "_revinclude:iterate=Encounter:patient:Practitioner"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
+}
+
+func (s *SearchPTSuite) TestQueryOptionsSummaryAndElements(c *C) {
+	for _, summary := range []string{"true", "text", "data", "count", "false"} {
+		q := Query{Resource: "Patient", Query: "_summary=" + summary}
+		c.Assert(q.Options().Summary, Equals, summary)
+	}
+
+	q := Query{Resource: "Observation", Query: "_elements=status,value[x], code"}
+	o := q.Options()
+	c.Assert(o.Elements, DeepEquals, []string{"status", "value[x]", "code"})
+	params := o.URLQueryParameters()
+	c.Assert(params.Get("_elements"), Equals, "status,value[x],code")
+
+	q = Query{Resource: "Patient", Query: "_summary=true"}
+	params = q.Options().URLQueryParameters()
+	c.Assert(params.Get("_summary"), Equals, "true")
+}
+
+func (s *SearchPTSuite) TestQueryOptionsInvalidSummaryAndElements(c *C) {
+	q := Query{Resource: "Patient", Query: "_summary=foo"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+
+	q = Query{Resource: "Patient", Query: "_elements=name.family"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" content is invalid"))
+
+	q = Query{Resource: "Patient", Query: "_elements=name&_summary=true"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" cannot be combined with \"_summary\""))
+}
+
+func (s *SearchPTSuite) TestQueryOptionsElementsProjection(c *C) {
+	q := Query{Resource: "Patient", Query: "gender=male"}
+	c.Assert(q.Options().ElementsProjection("Patient"), IsNil)
+
+	q = Query{Resource: "Observation", Query: "_elements=value"}
+	p := q.Options().ElementsProjection("Observation")
+	c.Assert(p.Keeps("valueQuantity"), Equals, true)
+	c.Assert(p.Keeps("meta"), Equals, true)
+	c.Assert(p.Keeps("code"), Equals, false)
+	mp := p.MongoProjection()
+	c.Assert(mp["valueQuantity"], Equals, 1)
+	c.Assert(mp["_valueString"], Equals, 1)
+	c.Assert(mp["_id"], Equals, 1)
+	c.Assert(mp["code"], IsNil)
+
+	q = Query{Resource: "Patient", Query: "_summary=true"}
+	p = q.Options().ElementsProjection("Patient")
+	c.Assert(p.Keeps("birthDate"), Equals, true)
+	c.Assert(p.Keeps("text"), Equals, false)
+	c.Assert(p.Keeps("photo"), Equals, false)
+
+	q = Query{Resource: "Patient", Query: "_summary=data"}
+	p = q.Options().ElementsProjection("Patient")
+	c.Assert(p.Keeps("photo"), Equals, true)
+	c.Assert(p.Keeps("text"), Equals, false)
+	c.Assert(p.MongoProjection(), DeepEquals, bson.M{"text": 0, "_text": 0})
+}
+
 func (s *SearchPTSuite) TestQueryOptionsWithSTU3Sort(c *C) {
 	q := Query{Resource: "Patient", Query: "_sort=family,given,-birthdate"}
 	o := q.Options()
@@ -1779,6 +1978,12 @@ func (s *SearchPTSuite) TestQueryOptionsIncludeTargets(c *C) {
 		c.Assert(include.Resource, Equals, "Patient")
 		c.Assert(elementInSlice(include.Parameter.Name, inclNames), Equals, true)
 	}
+
+	// as encoded by URLQueryParameters
+	q = Query{Resource: "Patient", Query: "_include=%2A"}
+	o = q.Options()
+	c.Assert(o.Include, HasLen, len(inclNames))
+	c.Assert(o.IsIncludeAll, Equals, true)
 }
 
 func (s *SearchPTSuite) TestQueryOptionsInvalidIncludeParams(c *C) {
@@ -1830,6 +2035,9 @@ func (s *SearchPTSuite) TestQueryOptionsRevIncludeTargets(c *C) {
 	c.Assert(o.IsIncludeAll, Equals, false)
 	c.Assert(o.IsRevincludeAll, Equals, true)
 
+	q = Query{Resource: "Patient", Query: "_revinclude=%2A"}
+	c.Assert(q.Options().IsRevincludeAll, Equals, true)
+
 	// The order of these revincludes is not deterministic, so we just check for their existence
 	for _, include := range o.RevInclude {
 		c.Assert(elementInSlice("Patient", include.Parameter.Targets), Equals, true)
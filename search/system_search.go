@@ -0,0 +1,186 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TypeParam lists the resource types searched by a whole-system search
+const TypeParam = "_type"
+
+// MaxSystemSearchResults limits the _offset plus _count of a whole-system search, as each resource type is
+// searched for all of the results up to the end of the requested page
+const MaxSystemSearchResults = 1000
+
+// SystemQuery describes a whole-system search (http://hl7.org/fhir/search.html#all), which runs the same
+// query against several resource types and merges the results. For example, the URL
+// http://acme.com/?_type=Patient,Practitioner&_lastUpdated=gt2018-01-01 should be represented as:
+//
+//	SystemQuery { ResourceTypes: []string{"Patient", "Practitioner"}, Query: "_lastUpdated=gt2018-01-01" }
+type SystemQuery struct {
+	ResourceTypes []string
+	Query         string
+}
+
+// ParseSystemQuery parses the query string of a whole-system search, which searches the default resource
+// types unless it has a _type parameter. Only the search parameters defined for all of the resource types
+// searched can be used, e.g. _id, _lastUpdated, _tag, _profile and _security.
+func ParseSystemQuery(rawQuery string, defaultResourceTypes []string) SystemQuery {
+	queryParams, err := ParseQuery(rawQuery)
+	if err != nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Failed to parse query string"))
+	}
+
+	var q SystemQuery
+	var rest URLQueryParameters
+	for _, queryParam := range queryParams.All() {
+		if queryParam.Key != TypeParam {
+			rest.Add(queryParam.Key, queryParam.Value)
+			continue
+		}
+		for _, resourceType := range strings.Split(queryParam.Value, ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if !contains(defaultResourceTypes, resourceType) {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_type\" content is invalid"))
+			}
+			if !contains(q.ResourceTypes, resourceType) {
+				q.ResourceTypes = append(q.ResourceTypes, resourceType)
+			}
+		}
+	}
+	if len(q.ResourceTypes) == 0 {
+		q.ResourceTypes = defaultResourceTypes
+	}
+	q.Query = rest.Encode()
+
+	for _, queryParam := range rest.All() {
+		param, _, postfix := ParseParamNameModifierAndPostFix(queryParam.Key)
+		switch {
+		case param == IncludeParam || param == RevIncludeParam || param == CursorParam || param == HasParam:
+			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" is not supported by whole-system searches", param)))
+		case param == SortParam:
+			for _, key := range strings.Split(queryParam.Value, ",") {
+				key = strings.TrimPrefix(key, "-")
+				if key == ScoreParam {
+					// relevance scores of different collections can't be compared
+					panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" by _score is not supported by whole-system searches"))
+				}
+				q.checkDefinedForAllTypes(SortParam, key)
+			}
+		case isSearchResultParam(param):
+		case postfix != "":
+			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Chained parameter \"%s\" is not supported by whole-system searches", queryParam.Key)))
+		default:
+			q.checkDefinedForAllTypes(param, param)
+		}
+	}
+
+	options := q.Options()
+	if options.Offset+options.Count > MaxSystemSearchResults {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameters \"_offset\" and \"_count\" can't exceed %d results in total in whole-system searches", MaxSystemSearchResults)))
+	}
+	return q
+}
+
+// checkDefinedForAllTypes panics unless a search parameter (used by param) has the same name in all of the
+// resource types searched
+func (q *SystemQuery) checkDefinedForAllTypes(param string, name string) {
+	for _, resourceType := range q.ResourceTypes {
+		if _, ok := SearchParameterDictionary[resourceType][name]; ok {
+			continue
+		}
+		if param == name && isGlobalSearchParam(name) {
+			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", name)))
+		}
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s is not a search parameter of %s", param, name, resourceType)))
+	}
+}
+
+// Options parses the query string and returns the QueryOptions, which apply to the merged results
+func (q *SystemQuery) Options() *QueryOptions {
+	typeQuery := Query{Resource: q.ResourceTypes[0], Query: q.Query}
+	return typeQuery.Options()
+}
+
+// TypeQuery returns the search of one of the resource types, which finds its resources up to the end of the
+// requested page. Unsorted searches are sorted by _lastUpdated (most recent first) so that the first results
+// of each resource type are also the first results of the whole-system search.
+func (q *SystemQuery) TypeQuery(resourceType string) Query {
+	options := q.Options()
+	queryParams, _ := ParseQuery(q.Query)
+	queryParams = queryParams.Without(OffsetParam)
+	queryParams.Set(CountParam, strconv.Itoa(options.Offset+options.Count))
+	if len(options.Sort) == 0 {
+		queryParams.Set(SortParam, "-"+LastUpdatedParam)
+	}
+	return Query{Resource: resourceType, Query: queryParams.Encode()}
+}
+
+// URLQueryParameters reconstructs the URL-encoded query, including the _type parameter if it was given
+func (q *SystemQuery) URLQueryParameters(defaultResourceTypes []string) URLQueryParameters {
+	queryParams, _ := ParseQuery(q.Query)
+	if len(q.ResourceTypes) != len(defaultResourceTypes) {
+		queryParams.Set(TypeParam, strings.Join(q.ResourceTypes, ","))
+	}
+	return queryParams
+}
+
+// SortResults sorts the merged results of the searches of each resource type like the TypeQuery searches
+// sorted them. Resources that sort the same keep their order, so are grouped by resource type.
+func (q *SystemQuery) SortResults(resources []*models2.Resource) error {
+	sortOptions := make(map[string][]SortOption)
+	for _, resourceType := range q.ResourceTypes {
+		typeQuery := q.TypeQuery(resourceType)
+		sortOptions[resourceType] = typeQuery.Options().Sort
+	}
+
+	// Sort parameters with the same name can have different paths in each resource type
+	keys := make([][]interface{}, len(resources))
+	var descending []bool
+	for i, resource := range resources {
+		asBSON, err := resource.GetBSON()
+		if err != nil {
+			return errors.Wrapf(err, "GetBSON failed for %s/%s", resource.ResourceType(), resource.Id())
+		}
+		doc := normalizeBSON(asBSON).(bson.M)
+		options := sortOptions[resource.ResourceType()]
+		keys[i] = make([]interface{}, len(options))
+		descending = make([]bool, len(options))
+		for j, option := range options {
+			// Note: If there are multiple paths, we only look at the first one (like the MongoSearcher)
+			values := lookupValues(doc, mongoFieldParts(option.Parameter.Paths[0].Path))
+			keys[i][j] = sortKey(values, option.Descending)
+			descending[j] = option.Descending
+		}
+	}
+
+	indexes := make([]int, len(resources))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(x, y int) bool {
+		for j := range descending {
+			cmp := compareSortValues(keys[indexes[x]][j], keys[indexes[y]][j])
+			if descending[j] {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	sorted := make([]*models2.Resource, len(resources))
+	for i, index := range indexes {
+		sorted[i] = resources[index]
+	}
+	copy(resources, sorted)
+	return nil
+}
@@ -0,0 +1,98 @@
+package search
+
+import (
+	"fmt"
+
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+)
+
+type SystemSearchSuite struct{}
+
+var _ = Suite(&SystemSearchSuite{})
+
+var systemSearchResourceTypes = []string{"Observation", "Patient", "Practitioner"}
+
+func (s *SystemSearchSuite) TestParseSystemQuery(c *C) {
+	q := ParseSystemQuery("_type=Patient,Practitioner&_lastUpdated=gt2018-01-01&_count=10", systemSearchResourceTypes)
+	c.Assert(q.ResourceTypes, DeepEquals, []string{"Patient", "Practitioner"})
+	c.Assert(q.Query, Equals, "_lastUpdated=gt2018-01-01&_count=10")
+	params := q.URLQueryParameters(systemSearchResourceTypes)
+	c.Assert(params.Get(TypeParam), Equals, "Patient,Practitioner")
+
+	// parameters shared by all of the resource types can be used
+	q = ParseSystemQuery("_type=Patient,Practitioner&family=Peters&_sort=-gender", systemSearchResourceTypes)
+	c.Assert(q.ResourceTypes, DeepEquals, []string{"Patient", "Practitioner"})
+
+	q = ParseSystemQuery("_id=123&_tag=foo", systemSearchResourceTypes)
+	c.Assert(q.ResourceTypes, DeepEquals, systemSearchResourceTypes)
+	params = q.URLQueryParameters(systemSearchResourceTypes)
+	c.Assert(params.Get(TypeParam), Equals, "")
+}
+
+func (s *SystemSearchSuite) TestParseSystemQueryErrors(c *C) {
+	for _, invalid := range []string{
+		"_type=Patient,Foo",
+		"family=Peters",
+		"_type=Patient,Observation&family=Peters",
+		"_type=Patient,Observation&_sort=birthdate",
+		"_count=1001",
+		"_offset=950&_count=100",
+	} {
+		c.Assert(func() { ParseSystemQuery(invalid, systemSearchResourceTypes) }, PanicMatches, "HTTP 400.*", Commentf(invalid))
+	}
+	for _, unsupported := range []string{
+		"_include=Observation:subject",
+		"_revinclude=Observation:subject",
+		"_type=Observation&subject.name=Peters",
+		"_text=cough&_sort=_score",
+		"_list=123",
+	} {
+		c.Assert(func() { ParseSystemQuery(unsupported, systemSearchResourceTypes) }, PanicMatches, "HTTP 501.*", Commentf(unsupported))
+	}
+}
+
+func (s *SystemSearchSuite) TestTypeQuery(c *C) {
+	q := ParseSystemQuery("_type=Patient,Practitioner&_lastUpdated=gt2018-01-01&_offset=20&_count=10", systemSearchResourceTypes)
+	typeQuery := q.TypeQuery("Patient")
+	c.Assert(typeQuery.Resource, Equals, "Patient")
+	c.Assert(typeQuery.Query, Equals, "_lastUpdated=gt2018-01-01&_count=30&_sort=-_lastUpdated")
+
+	q = ParseSystemQuery("_type=Patient,Practitioner&_sort=family", systemSearchResourceTypes)
+	typeQuery = q.TypeQuery("Practitioner")
+	c.Assert(typeQuery.Query, Equals, "_sort=family&_count=100")
+}
+
+func (s *SystemSearchSuite) TestSortResults(c *C) {
+	var resources []*models2.Resource
+	for _, r := range []struct{ resourceType, id, family, lastUpdated string }{
+		{"Patient", "p1", "Smith", "2018-03-01T00:00:00Z"},
+		{"Patient", "p2", "Jones", "2018-01-01T00:00:00Z"},
+		{"Practitioner", "d1", "Brown", "2018-02-01T00:00:00Z"},
+		{"Practitioner", "d2", "Taylor", "2018-04-01T00:00:00Z"},
+	} {
+		resource, err := models2.NewResourceFromJsonBytes([]byte(fmt.Sprintf(`{
+			"resourceType": "%s",
+			"id": "%s",
+			"meta": { "lastUpdated": "%s" },
+			"name": [ { "family": "%s" } ]
+		}`, r.resourceType, r.id, r.lastUpdated, r.family)))
+		c.Assert(err, IsNil)
+		resources = append(resources, resource)
+	}
+	ids := func() []string {
+		var ids []string
+		for _, resource := range resources {
+			ids = append(ids, resource.Id())
+		}
+		return ids
+	}
+
+	q := ParseSystemQuery("_type=Patient,Practitioner", systemSearchResourceTypes)
+	c.Assert(q.SortResults(resources), IsNil)
+	c.Assert(ids(), DeepEquals, []string{"d2", "p1", "d1", "p2"})
+
+	q = ParseSystemQuery("_type=Patient,Practitioner&_sort=family", systemSearchResourceTypes)
+	c.Assert(q.SortResults(resources), IsNil)
+	c.Assert(ids(), DeepEquals, []string{"d1", "p2", "p1", "d2"})
+}
@@ -0,0 +1,312 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ScoreParam is the _sort key that orders the results of a _text or _content search by relevance
+const ScoreParam = "_score"
+
+// nonDomainResources are the resources without a narrative
+var nonDomainResources = map[string]bool{"Binary": true, "Bundle": true, "Parameters": true}
+
+// The _text and _content parameters apply to all resources but are missing from the generated
+// SearchParameterDictionary. _text searches the narrative (text.div) and _content the whole resource.
+func init() {
+	for resource, params := range SearchParameterDictionary {
+		if !nonDomainResources[resource] {
+			params[TextParam] = SearchParamInfo{
+				Resource: resource,
+				Name:     TextParam,
+				Type:     "text",
+				Paths: []SearchParamPath{
+					SearchParamPath{Path: "text.div", Type: "xhtml"},
+				},
+			}
+		}
+		params[ContentParam] = SearchParamInfo{
+			Resource: resource,
+			Name:     ContentParam,
+			Type:     "text",
+		}
+	}
+}
+
+// TextExpression is a parsed _text or _content search, which uses the boolean syntax of the FHIR
+// specification: terms (single words or quoted phrases) combined with AND, OR, NOT and
+// parentheses. Terms without an operator between them must all match, while commas separate
+// alternatives, as for other parameters. Either Term is set, or Operator and Operands are.
+type TextExpression struct {
+	Term     string
+	Operator string
+	Operands []*TextExpression
+}
+
+func (e *TextExpression) String() string {
+	if e.Operator == "" {
+		if strings.ContainsAny(e.Term, " \t") {
+			return fmt.Sprintf("\"%s\"", e.Term)
+		}
+		return e.Term
+	}
+	if e.Operator == "NOT" {
+		return "NOT " + e.Operands[0].operandString()
+	}
+	operands := make([]string, len(e.Operands))
+	for i, operand := range e.Operands {
+		operands[i] = operand.operandString()
+	}
+	return strings.Join(operands, " "+e.Operator+" ")
+}
+
+// operandString returns the expression as an operand of another operation, in parentheses if it
+// is an AND or OR operation
+func (e *TextExpression) operandString() string {
+	if e.Operator == "AND" || e.Operator == "OR" {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// ParseTextExpression parses a _text or _content search value
+func ParseTextExpression(value string) (*TextExpression, error) {
+	alternatives := escapeFriendlySplit(value, ',')
+	operands := make([]*TextExpression, len(alternatives))
+	for i, alternative := range alternatives {
+		parser := &textExpressionParser{tokens: tokenizeTextExpression(unescape(alternative))}
+		if len(parser.tokens) == 0 {
+			return nil, errors.New("empty expression")
+		}
+		operand, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.pos < len(parser.tokens) {
+			return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+		}
+		operands[i] = operand
+	}
+	return newTextOperation("OR", operands), nil
+}
+
+// tokenizeTextExpression splits an expression into words, quoted phrases and parentheses. Phrases
+// keep their opening quote to distinguish them from the operators.
+func tokenizeTextExpression(value string) []string {
+	var tokens []string
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case unicode.IsSpace(runes[i]):
+		case runes[i] == '(' || runes[i] == ')':
+			tokens = append(tokens, string(runes[i]))
+		case runes[i] == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			// an unterminated phrase runs to the end of the expression
+			tokens = append(tokens, "\""+strings.TrimSpace(string(runes[i+1:end])))
+			i = end
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end - 1
+		}
+	}
+	return tokens
+}
+
+type textExpressionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *textExpressionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *textExpressionParser) parseOr() (*TextExpression, error) {
+	var operands []*TextExpression
+	for {
+		operand, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if p.peek() != "OR" {
+			return newTextOperation("OR", operands), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *textExpressionParser) parseAnd() (*TextExpression, error) {
+	var operands []*TextExpression
+	for {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		switch p.peek() {
+		case "AND":
+			p.pos++
+		case "", "OR", ")":
+			return newTextOperation("AND", operands), nil
+		}
+	}
+}
+
+func (p *textExpressionParser) parseNot() (*TextExpression, error) {
+	switch token := p.peek(); token {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "NOT":
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &TextExpression{Operator: "NOT", Operands: []*TextExpression{operand}}, nil
+	case "(":
+		p.pos++
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return operand, nil
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected %s", token)
+	default:
+		p.pos++
+		term := strings.TrimPrefix(token, "\"")
+		if term == "" {
+			return nil, errors.New("empty phrase")
+		}
+		return &TextExpression{Term: term}, nil
+	}
+}
+
+// newTextOperation combines operands, flattening nested operations with the same operator
+func newTextOperation(operator string, operands []*TextExpression) *TextExpression {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	var flattened []*TextExpression
+	for _, operand := range operands {
+		if operand.Operator == operator {
+			flattened = append(flattened, operand.Operands...)
+		} else {
+			flattened = append(flattened, operand)
+		}
+	}
+	return &TextExpression{Operator: operator, Operands: flattened}
+}
+
+// mongoTextSearch is a text expression translated to the $search string of a MongoDB $text
+// query. This only has a single level of boolean logic: either any of a list of words, or all
+// of a list of words and phrases, excluding resources with any of a list of negated words.
+type mongoTextSearch struct {
+	Search   string
+	AllOf    []string
+	AnyOf    []string
+	Excluded []string
+}
+
+func newMongoTextSearch(e *TextExpression) (*mongoTextSearch, error) {
+	s := &mongoTextSearch{}
+	switch e.Operator {
+	case "":
+		s.AllOf = []string{e.Term}
+	case "OR":
+		for _, operand := range e.Operands {
+			if operand.Operator != "" || isTextPhrase(operand.Term) {
+				return nil, fmt.Errorf("OR can only combine single words (%s)", e)
+			}
+			s.AnyOf = append(s.AnyOf, operand.Term)
+		}
+	case "AND":
+		for _, operand := range e.Operands {
+			switch {
+			case operand.Operator == "":
+				s.AllOf = append(s.AllOf, operand.Term)
+			case operand.Operator == "NOT" && operand.Operands[0].Operator == "" && !isTextPhrase(operand.Operands[0].Term):
+				s.Excluded = append(s.Excluded, operand.Operands[0].Term)
+			default:
+				return nil, fmt.Errorf("AND can only combine words, phrases and negated words (%s)", e)
+			}
+		}
+		if len(s.AllOf) == 0 {
+			return nil, fmt.Errorf("at least one word must be required (%s)", e)
+		}
+	default:
+		return nil, fmt.Errorf("at least one word must be required (%s)", e)
+	}
+
+	var search []string
+	if len(s.AnyOf) > 0 {
+		search = append(search, s.AnyOf...)
+	} else if len(s.AllOf) == 1 && !isTextPhrase(s.AllOf[0]) && len(s.Excluded) == 0 {
+		search = append(search, s.AllOf[0])
+	} else {
+		// MongoDB requires all of the phrases in a search to be present
+		for _, term := range s.AllOf {
+			search = append(search, fmt.Sprintf("\"%s\"", strings.Replace(term, "\"", "", -1)))
+		}
+	}
+	for _, term := range s.Excluded {
+		search = append(search, "-"+term)
+	}
+	s.Search = strings.Join(search, " ")
+	return s, nil
+}
+
+func isTextPhrase(term string) bool {
+	return strings.IndexFunc(term, unicode.IsSpace) >= 0
+}
+
+// SortsByScore returns true if the results should be ordered by their relevance to a _text or
+// _content search
+func (o *QueryOptions) SortsByScore() bool {
+	for _, sort := range o.Sort {
+		if sort.Parameter.Type == "score" {
+			return true
+		}
+	}
+	return false
+}
+
+func scoreSortParam(resource string) SearchParamInfo {
+	return SearchParamInfo{
+		Resource: resource,
+		Name:     ScoreParam,
+		Type:     "score",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: ScoreParam, Type: "score"},
+		},
+	}
+}
+
+// usesFullTextSearch returns true if the query parameters include _text or _content
+func usesFullTextSearch(queryParams URLQueryParameters) bool {
+	for _, queryParam := range queryParams.All() {
+		param, _, _ := ParseParamNameModifierAndPostFix(queryParam.Key)
+		if param == TextParam || param == ContentParam {
+			return true
+		}
+	}
+	return false
+}
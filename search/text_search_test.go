@@ -0,0 +1,97 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TextSearchSuite struct{}
+
+var _ = Suite(&TextSearchSuite{})
+
+func (s *TextSearchSuite) TestParseTextExpression(c *C) {
+	e, err := ParseTextExpression("aspirin")
+	c.Assert(err, IsNil)
+	c.Assert(e, DeepEquals, &TextExpression{Term: "aspirin"})
+
+	e, err = ParseTextExpression("aspirin tablet")
+	c.Assert(err, IsNil)
+	c.Assert(e.String(), Equals, "aspirin AND tablet")
+
+	e, err = ParseTextExpression("aspirin OR paracetamol,ibuprofen")
+	c.Assert(err, IsNil)
+	c.Assert(e.String(), Equals, "aspirin OR paracetamol OR ibuprofen")
+
+	e, err = ParseTextExpression("\"chest pain\" AND NOT (cardiac OR heart)")
+	c.Assert(err, IsNil)
+	c.Assert(e.String(), Equals, "\"chest pain\" AND NOT (cardiac OR heart)")
+
+	for _, invalid := range []string{"", "aspirin AND", "(aspirin", "aspirin)", "OR aspirin", "\"\""} {
+		_, err = ParseTextExpression(invalid)
+		c.Assert(err, NotNil, Commentf("%s", invalid))
+	}
+}
+
+func (s *TextSearchSuite) TestMongoTextSearch(c *C) {
+	search := s.mongoTextSearch(c, "aspirin")
+	c.Assert(search.Search, Equals, "aspirin")
+	c.Assert(search.AllOf, DeepEquals, []string{"aspirin"})
+
+	search = s.mongoTextSearch(c, "aspirin OR paracetamol")
+	c.Assert(search.Search, Equals, "aspirin paracetamol")
+	c.Assert(search.AnyOf, DeepEquals, []string{"aspirin", "paracetamol"})
+
+	search = s.mongoTextSearch(c, "\"aspirin tablet\" daily NOT overdose")
+	c.Assert(search.Search, Equals, "\"aspirin tablet\" \"daily\" -overdose")
+	c.Assert(search.AllOf, DeepEquals, []string{"aspirin tablet", "daily"})
+	c.Assert(search.Excluded, DeepEquals, []string{"overdose"})
+
+	for _, unsupported := range []string{"NOT aspirin", "(aspirin OR paracetamol) AND tablet", "\"aspirin tablet\" OR paracetamol", "aspirin NOT \"low dose\""} {
+		e, err := ParseTextExpression(unsupported)
+		c.Assert(err, IsNil)
+		_, err = newMongoTextSearch(e)
+		c.Assert(err, NotNil, Commentf("%s", unsupported))
+	}
+}
+
+func (s *TextSearchSuite) mongoTextSearch(c *C, expression string) *mongoTextSearch {
+	e, err := ParseTextExpression(expression)
+	c.Assert(err, IsNil)
+	search, err := newMongoTextSearch(e)
+	c.Assert(err, IsNil)
+	return search
+}
+
+func (s *TextSearchSuite) TestFullTextParams(c *C) {
+	q := Query{Resource: "Observation", Query: "_text=aspirin&_content=tablet"}
+	params := q.Params()
+	c.Assert(params, HasLen, 2)
+	text, ok := params[0].(*FullTextParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(text.Name, Equals, "_text")
+	c.Assert(text.Paths[0].Path, Equals, "text.div")
+	content, ok := params[1].(*FullTextParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(content.Name, Equals, "_content")
+	c.Assert(content.Expression.Term, Equals, "tablet")
+
+	q = Query{Resource: "Observation", Query: "_text=aspirin AND"}
+	c.Assert(func() { q.Params() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_text\" content is invalid: unexpected end of expression"))
+
+	q = Query{Resource: "Observation", Query: "_text:exact=aspirin"}
+	c.Assert(func() { q.Params() }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"_text\" modifier is invalid"))
+}
+
+func (s *TextSearchSuite) TestSortByScore(c *C) {
+	q := Query{Resource: "Observation", Query: "_content=aspirin&_sort=_score"}
+	o := q.Options()
+	c.Assert(o.SortsByScore(), Equals, true)
+	c.Assert(q.UsesPipeline(), Equals, true)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get("_sort"), Equals, "_score")
+
+	q = Query{Resource: "Observation", Query: "code=1234-5&_sort=_score"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+
+	q = Query{Resource: "Observation", Query: "_content=aspirin&_sort=-_score"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+}
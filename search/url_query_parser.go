@@ -86,6 +86,18 @@ func (u *URLQueryParameters) Set(key string, value string) {
 	}
 }
 
+// Without returns a copy of the URLQueryParameters with all of the query parameters with the specified key removed.
+// The original URLQueryParameters are left unchanged.
+func (u *URLQueryParameters) Without(key string) URLQueryParameters {
+	var without URLQueryParameters
+	for _, param := range u.params {
+		if param.Key != key {
+			without.Add(param.Key, param.Value)
+		}
+	}
+	return without
+}
+
 // Get returns the value of the first query parameter with the specified key.  If no query parameters have the specified
 // key, an empty string is returned.
 func (u *URLQueryParameters) Get(key string) string {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"math/rand"
 	"strconv"
 	"github.com/pkg/errors"
 	"github.com/eug48/fhir/utils"
@@ -20,6 +21,13 @@ import (
 	"github.com/eug48/fhir/search"
 )
 
+// Transactions failing with transient MongoDB errors (e.g. write conflicts with concurrent transactions)
+// are retried up to this many attempts in total, starting with this delay and doubling it each time
+const (
+	maxTransactionAttempts = 5
+	transactionRetryDelay  = 50 * time.Millisecond
+)
+
 // BatchController handles FHIR batch operations via input bundles
 type BatchController struct {
 	DAL    DataAccessLayer
@@ -47,319 +55,314 @@ func (b *BatchController) Post(c *gin.Context) {
 		return
 	}
 
+	// ids of new resources, kept when a transaction is retried
+	var assignedIDs []string
+
+	retryDelay := transactionRetryDelay
+	for attempt := 1; ; attempt++ {
+		bundle, err := bundleResource.AsShallowBundle(b.Config.FailedRequestsDir)
+		if err != nil {
+			abortWithErr(c, err)
+			return
+		}
+		if assignedIDs == nil {
+			assignedIDs = make([]string, len(bundle.Entry))
+		}
+
+		status, reply, err := b.processBundle(c, bundle, assignedIDs)
+		if err != nil && bundle.Type == "transaction" && isTransientTransactionError(err) && attempt < maxTransactionAttempts {
+			// replay all the entries in a new transaction after a randomised delay
+			debug("transaction attempt %d failed with a transient error, retrying: %+v", attempt, err)
+			time.Sleep(retryDelay + time.Duration(rand.Int63n(int64(retryDelay))))
+			retryDelay *= 2
+			continue
+		}
+
+		switch {
+		case err == nil:
+			sendReply(c, status, reply)
+		case status == 0:
+			statusCode, outcome := ErrorToOpOutcome(err)
+			sendReply(c, statusCode, outcome)
+		default:
+			c.AbortWithError(status, err)
+		}
+		return
+	}
+}
+
+// processBundle handles the entries of a batch or transaction, returning the reply to send or an
+// error together with its status code (0 if the status should be determined from the error)
+func (b *BatchController) processBundle(c *gin.Context, bundle *models2.ShallowBundle, assignedIDs []string) (status int, reply interface{}, err error) {
 	session := b.DAL.StartSession(c.GetHeader("Db"))
 	defer session.Finish()
 
-	bundle, err := bundleResource.AsShallowBundle(b.Config.FailedRequestsDir)
-	if err != nil {
-		abortWithErr(c, err)
-		return
+	if bundle.Type == "transaction" {
+		// errors from MongoDB during a transaction may be transient, so are returned to be retried
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr, isError := r.(error)
+				if !isError || !isTransientTransactionError(panicErr) {
+					panic(r)
+				}
+				status, reply, err = 0, nil, panicErr
+			}
+		}()
 	}
 
 	switch bundle.Type {
 	case "transaction":
 		err := session.StartTransaction()
 		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, errors.Wrap(err, "error starting MongoDB transaction"))
-			return
+			return http.StatusBadRequest, nil, errors.Wrap(err, "error starting MongoDB transaction")
 		}
 	case "batch":
-		// TODO: If type is batch, ensure there are no interdependent resources
 	default:
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Bundle type is neither 'batch' nor 'transaction'"))
-		return
+		return http.StatusBadRequest, nil, fmt.Errorf("Bundle type is neither 'batch' nor 'transaction'")
 	}
 
 	// Loop through the entries, ensuring they have a request and that we support the method,
 	// while also creating a new entries array that can be sorted by method.
-	entries := make([]*models2.ShallowBundleEntryComponent, len(bundle.Entry))
+	// Invalid entries fail a transaction but in a batch just fail on their own.
+	entries := make([]*models2.ShallowBundleEntryComponent, 0, len(bundle.Entry))
 	for i := range bundle.Entry {
-		if bundle.Entry[i].Request == nil {
-			c.AbortWithError(http.StatusBadRequest, errors.New("Entries in a batch operation require a request"))
-			return
-		}
-
-		switch bundle.Entry[i].Request.Method {
-		default:
-			c.AbortWithError(http.StatusNotImplemented,
-				errors.New("Operation currently unsupported in batch requests: "+bundle.Entry[i].Request.Method))
-			return
-		case "DELETE":
-			if bundle.Entry[i].Request.Url == "" {
-				c.AbortWithError(http.StatusBadRequest, errors.New("Batch DELETE must have a URL"))
-				return
+		entry := &bundle.Entry[i]
+		if statusCode, err := validateEntry(entry); err != nil {
+			if bundle.Type == "transaction" {
+				return statusCode, nil, err
 			}
-		case "POST":
-			if bundle.Entry[i].Resource == nil {
-				c.AbortWithError(http.StatusBadRequest, errors.New("Batch POST must have a resource body"))
-				return
-			}
-		case "PUT":
-			if bundle.Entry[i].Resource == nil {
-				c.AbortWithError(http.StatusBadRequest, errors.New("Batch PUT must have a resource body"))
-				return
-			}
-			if !strings.Contains(bundle.Entry[i].Request.Url, "/") && !strings.Contains(bundle.Entry[i].Request.Url, "?") {
-				c.AbortWithError(http.StatusBadRequest, errors.New("Batch PUT url must have an id or a condition"))
-				return
-			}
-		case "GET":
-			if bundle.Entry[i].Request.Url == "" {
-				c.AbortWithError(http.StatusBadRequest, errors.New("Batch GET must have a URL"))
-				return
+			issueCode := "invalid"
+			if statusCode == http.StatusNotImplemented {
+				issueCode = "not-supported"
 			}
+			failBatchEntry(entry, statusCode, models.CreateOpOutcome("error", issueCode, "", err.Error()))
+			continue
 		}
-		entries[i] = &bundle.Entry[i]
+		entries = append(entries, entry)
 	}
 
 	sort.Sort(byRequestMethod(entries))
 
-	// Now loop through the entries, assigning new IDs to those that are POST or Conditional PUT and fixing any
-	// references to reference the new ID.
+	if bundle.Type == "batch" {
+		// batch entries are processed independently so can't depend on each other
+		failInterdependentBatchEntries(bundle)
+	}
+
+	// Entries of a transaction are processed after the entries they depend on, e.g. those creating
+	// resources matched by their conditional references (see transactionOrder)
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	if bundle.Type == "transaction" {
+		order, err = transactionOrder(entries)
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+	}
+
+	// Assign IDs to unconditional POSTs up-front so that entries can reference each other in any order
 	refMap := make(map[string]string)
 	newIDs := make([]string, len(entries))
 	createStatus := make([]string, len(entries))
 	for i, entry := range entries {
-		if entry.Request.Method == "POST" {
-
-			id := ""
+		if entry.Response == nil && entry.Request.Method == "POST" && len(entry.Request.IfNoneExist) == 0 {
+			createStatus[i] = "201"
+			newIDs[i] = assignID(assignedIDs, i)
+			b.mapEntryID(c.Request, entry, entry.Request.Url, newIDs[i], refMap)
+		}
+	}
 
-			if len(entry.Request.IfNoneExist) > 0 {
-				// Conditional Create
-				query := search.Query{Resource: entry.Request.Url, Query: entry.Request.IfNoneExist}
-				existingIds, err := session.FindIDs(query)
-				if err != nil {
-					c.AbortWithError(http.StatusInternalServerError, err)
-					return
-				}
+	// Batch entries can't reference other entries or use conditional references so their references are stored as-is
+	if bundle.Type == "transaction" {
+		// When being converted to BSON references will be updated to reflect newly assigned or conditional IDs
+		bundle.SetTransformReferencesMap(refMap)
+	}
 
-				if len(existingIds) == 0 {
-					createStatus[i] = "201"
-				} else if len(existingIds) == 1 {
-					createStatus[i] = "200"
-					id = existingIds[0]
-				} else if len(existingIds) > 1 {
-					createStatus[i] = "412" // HTTP 412 - Precondition Failed
+	// Resolve each entry and make the changes in the database, updating the entry responses
+	requests := make([]*models.BundleEntryRequestComponent, len(entries))
+	for _, i := range order {
+		entry := entries[i]
+		if entry.Response == nil {
+			if statusCode, err := b.resolveEntry(c.Request, session, bundle.Type, i, entry, createStatus, newIDs, assignedIDs, refMap); err != nil {
+				if bundle.Type == "transaction" {
+					return statusCode, nil, err
 				}
-			} else {
-				// Unconditional create
-				createStatus[i] = "201"
-			}
-
-			if createStatus[i] == "201" {
-				// Create a new ID
-				id = bson.NewObjectId().Hex()
-				newIDs[i] = id
-			}
-
-			if len(id) > 0 {
-				// Add id to the reference map
-				refMap[entry.FullUrl] = entry.Request.Url + "/" + id
-				// Rewrite the FullUrl using the new ID
-				entry.FullUrl = b.Config.responseURL(c.Request, entry.Request.Url, id).String()
-			}
-
-		} else if entry.Request.Method == "PUT" && isConditional(entry) {
-			// We need to process conditionals referencing temp IDs in a second pass, so skip them here
-			if hasTempID(entry.Request.Url) {
-				// fmt.Printf("hasTempID! %s\n", entry.Request.Url)
-				continue
+				failBatchEntryWithError(entry, statusCode, err)
 			}
+		}
+		if bundle.Type == "transaction" && entry.Response != nil && entry.Response.Outcome != nil {
+			// the transaction fails (see below)
+			break
+		}
 
-			if err := b.resolveConditionalPut(c.Request, session, i, entry, newIDs, refMap); err != nil {
-				c.AbortWithError(http.StatusInternalServerError, err)
-				return
+		requests[i] = entry.Request
+		if bundle.Type == "transaction" {
+			err = b.doRequest(c, session, i, entry, createStatus, newIDs)
+		} else {
+			err = b.doBatchRequest(c, session, i, entry, createStatus, newIDs)
+		}
+		if err != nil {
+			debug("  --> ERROR %+v", err)
+		}
+		if entry.Response != nil {
+			debug("  --> %s", entry.Response.DebugString())
+		} else {
+			debug("  --> nil Response")
+		}
+		if entry.Resource != nil {
+			debug("  --> %s", entry.Resource.JsonBytes())
+		} else {
+			debug("  --> nil Resource")
+		}
+		if err != nil {
+			if bundle.Type == "transaction" {
+				return 0, nil, err
+			} else {
+				statusCode, outcome := ErrorToOpOutcome(err)
+				failBatchEntry(entry, statusCode, outcome)
 			}
 		}
+		if bundle.Type == "transaction" && entry.Response != nil && entry.Response.Outcome != nil {
+			break
+		}
 	}
 
-	// Second pass to take care of conditionals referencing temporary IDs.  Known limitation: if a conditional
-	// references a temp ID also defined by a conditional, we error out if it hasn't been resolved yet -- too many
-	// rabbit holes.
-	for i, entry := range entries {
-		if entry.Request.Method == "PUT" && isConditional(entry) {
-			// Use a regex to swap out the temp IDs with the new IDs
-			for oldID, ref := range refMap {
-				re := regexp.MustCompile("([=,])(" + oldID + "|" + url.QueryEscape(oldID) + ")(&|,|$)")
-				entry.Request.Url = re.ReplaceAllString(entry.Request.Url, "${1}"+ref+"${3}")
-			}
+	// For failing transactions return a single operation-outcome
+	if bundle.Type == "transaction" {
+		for _, entry := range entries {
+			if entry.Response != nil && entry.Response.Outcome != nil {
+				// FIXME: ensure it is a "failed" outcome
 
-			if hasTempID(entry.Request.Url) {
-				c.AbortWithError(http.StatusNotImplemented,
-					errors.New("Cannot resolve conditionals referencing other conditionals"))
-				return
-			}
+				statusCode, err := strconv.Atoi(entry.Response.Status)
+				if err != nil {
+					panic(fmt.Errorf("bad Response.Status (%s)", entry.Response.Status))
+				}
 
-			if err := b.resolveConditionalPut(c.Request, session, i, entry, newIDs, refMap); err != nil {
-				c.AbortWithError(http.StatusInternalServerError, err)
-				return
+				return statusCode, entry.Response.Outcome, nil
 			}
 		}
-	}
 
-	// Process references
-	references, err := bundle.GetAllReferences()
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	}
-	for _, reference := range references {
-		
-		if _, alreadyMapped := refMap[reference]; alreadyMapped {
-			continue
+		if err := checkRequestActive(c); err != nil {
+			return 0, nil, errors.Wrap(err, "transaction not committed")
 		}
-
-		// Conditional references
-		// TODO: as per spec this needs to include in-bundle resources..
-		queryPos := strings.Index(reference, "?")
-		if queryPos >= 0 {
-
-			if bundle.Type != "transaction" {
-				c.AbortWithError(http.StatusBadRequest, errors.New("conditional references are only allowed in transactions, not batches"))
-				return
-			}
-
-			resourceType := reference[0:queryPos]
-			queryString := reference[queryPos+1:]
-			searchQuery := search.Query{Resource: resourceType, Query: queryString }
-			ids, err := session.FindIDs(searchQuery)
-			if err != nil {
-				c.AbortWithError(http.StatusBadRequest, errors.Wrapf(err, "lookup of conditional reference failed (%s)", reference))
-				return
-			}
-
-			if len(ids) == 1 {
-				refMap[reference] = resourceType + "/" + ids[0]
-			} else if len(ids) == 0 {
-				c.AbortWithError(http.StatusBadRequest, errors.Errorf("no matches for conditional reference (%s)", reference))
-				return
-			} else {
-				c.AbortWithError(http.StatusBadRequest, errors.Errorf("multiple matches for conditional reference (%s)", reference))
-				return
-			}
+		if err := session.CommmitIfTransaction(); err != nil {
+			return 0, nil, errors.Wrap(err, "failed to commit transaction")
 		}
 	}
 
-	// When being converted to BSON references will be updated to reflect newly assigned or conditional IDs
-	bundle.SetTransformReferencesMap(refMap)
+	applyReturnPreference(c, entries, requests)
 
-	// Handle If-Match
-	for _, entry := range entries {
-		switch entry.Request.Method {
-		case "PUT":
-			if entry.Request.IfMatch != "" {
-				parts := strings.SplitN(entry.Request.Url, "/", 2)
-				if len(parts) != 2 { // TODO: refactor
-					c.AbortWithError(http.StatusBadRequest,
-						fmt.Errorf("Couldn't identify resource and id to put from %s", entry.Request.Url))
-					return
-				}
-				id := parts[1]
+	total := uint32(len(bundle.Entry))
+	bundle.Total = &total
+	bundle.Type = fmt.Sprintf("%s-response", bundle.Type)
 
-				conditionalVersionId, err := utils.ETagToVersionId(entry.Request.IfMatch)
-				if err != nil {
-					c.AbortWithError(http.StatusBadRequest, err)
-					return
-				}
+	c.Set("Bundle", bundle)
+	c.Set("Resource", "Bundle")
+	c.Set("Action", "batch")
 
-				currentResource, err := session.Get(id, entry.Resource.ResourceType())
-				if err == ErrNotFound {
-					entry.Response = &models.BundleEntryResponseComponent{
-						Status: "404",
-						Outcome: models.CreateOpOutcome("error", "not-found", "", "Existing resource not found when handling If-Match"),
-					}
-					entry.Resource = nil
-				} else if err != nil {
-					err = errors.Wrapf(err, "failed to get current resource while processing If-Match for %s", entry.Request.Url)
-					c.AbortWithError(http.StatusInternalServerError, err)
-					return
-				} else if conditionalVersionId != currentResource.VersionId() {
-					entry.Response = &models.BundleEntryResponseComponent{
-						Status: "409",
-						Outcome: models.CreateOpOutcome("error", "conflict", "", fmt.Sprintf("Version mismatch when handling If-Match (current=%s wanted=%s)", currentResource.VersionId(), conditionalVersionId)),
-					}
-					entry.Resource = nil
-				}
-			}
-		}
-	}
+	return http.StatusOK, bundle, nil
+}
 
-	// If have an error for a transaction, do not proceeed
-	proceed := true
-	if bundle.Type == "transaction" {
-		for _, entry := range entries {
-			if entry.Response != nil && entry.Response.Outcome != nil {
-				// FIXME: ensure it is a "failed" outcome
+// validateEntry checks that an entry has a request with a supported method and what it needs
+func validateEntry(entry *models2.ShallowBundleEntryComponent) (statusCode int, err error) {
+	if entry.Request == nil {
+		return http.StatusBadRequest, errors.New("Entries in a batch operation require a request")
+	}
 
-				proceed = false
-				break
-			}
+	switch entry.Request.Method {
+	default:
+		return http.StatusNotImplemented, errors.New("Operation currently unsupported in batch requests: "+entry.Request.Method)
+	case "DELETE":
+		if entry.Request.Url == "" {
+			return http.StatusBadRequest, errors.New("Batch DELETE must have a URL")
+		}
+	case "POST":
+		if entry.Resource == nil {
+			return http.StatusBadRequest, errors.New("Batch POST must have a resource body")
+		}
+	case "PUT":
+		if entry.Resource == nil {
+			return http.StatusBadRequest, errors.New("Batch PUT must have a resource body")
+		}
+		if !strings.Contains(entry.Request.Url, "/") && !strings.Contains(entry.Request.Url, "?") {
+			return http.StatusBadRequest, errors.New("Batch PUT url must have an id or a condition")
+		}
+	case "PATCH":
+		if entry.Resource == nil {
+			return http.StatusBadRequest, errors.New("Batch PATCH must have a resource body")
+		}
+		if !strings.Contains(entry.Request.Url, "/") && !strings.Contains(entry.Request.Url, "?") {
+			return http.StatusBadRequest, errors.New("Batch PATCH url must have an id or a condition")
+		}
+		if _, err := patchFromResource(entry.Resource); err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "Batch PATCH of %s has an invalid patch", entry.Request.Url)
+		}
+	case "GET":
+		if entry.Request.Url == "" {
+			return http.StatusBadRequest, errors.New("Batch GET must have a URL")
 		}
 	}
+	return 0, nil
+}
 
-	// Make the changes in the database and update the entry responses
-	if (proceed) {
-		for i, entry := range entries {
-			err = b.doRequest(c, session, i, entry, createStatus, newIDs)
-			if err != nil {
-				debug("  --> ERROR %+v", err)
-			}
-			if entry.Response != nil {
-				debug("  --> %s", entry.Response.DebugString())
-			} else {
-				debug("  --> nil Response")
-			}
-			if entry.Resource != nil {
-				debug("  --> %s", entry.Resource.JsonBytes())
-			} else {
-				debug("  --> nil Resource")
-			}
-			if err != nil {
-				statusCode, outcome := ErrorToOpOutcome(err)
-				if bundle.Type == "transaction" {
-					sendReply(c, statusCode, outcome)
-					return
-				} else {
-					entry.Resource = nil
-					entry.Request = nil
-					entry.Response = &models.BundleEntryResponseComponent{
-						Status: strconv.Itoa(statusCode),
-						Outcome: outcome,
-					}
-				}
-			}
+// failInterdependentBatchEntries fails batch entries that reference other entries by their fullUrl
+// or use conditional references, as the entries of a batch are processed independently
+func failInterdependentBatchEntries(bundle *models2.ShallowBundle) {
+	fullUrls := make(map[string]bool)
+	for _, entry := range bundle.Entry {
+		if entry.FullUrl != "" {
+			fullUrls[entry.FullUrl] = true
 		}
 	}
 
-	// For failing transactions return a single operation-outcome
-	if bundle.Type == "transaction" {
-		for _, entry := range entries {
-			if entry.Response != nil && entry.Response.Outcome != nil {
-				// FIXME: ensure it is a "failed" outcome
+	for i := range bundle.Entry {
+		entry := &bundle.Entry[i]
+		if entry.Response != nil {
+			// already failed validation
+			continue
+		}
 
-				status, err := strconv.Atoi(entry.Response.Status)
-				if err != nil {
-					panic(fmt.Errorf("bad Response.Status (%s)", entry.Response.Status))
-				}
+		if (isConditional(entry) && hasTempID(entry.Request.Url)) || hasTempID(entry.Request.IfNoneExist) {
+			failBatchEntry(entry, http.StatusBadRequest, models.CreateOpOutcome("error", "invalid", "", fmt.Sprintf("Batch entry URL references another entry (%s), which is only allowed in transactions", entry.Request.Url)))
+			continue
+		}
 
-				sendReply(c, status, entry.Response.Outcome)
-				return
+		references, err := entry.GetReferences()
+		if err != nil {
+			failBatchEntry(entry, http.StatusBadRequest, models.CreateOpOutcome("error", "invalid", "", err.Error()))
+			continue
+		}
+		for _, reference := range references {
+			if fullUrls[reference] && reference != entry.FullUrl {
+				failBatchEntry(entry, http.StatusBadRequest, models.CreateOpOutcome("error", "invalid", "", fmt.Sprintf("Batch entry references another entry (%s), which is only allowed in transactions", reference)))
+				break
+			}
+			if strings.Contains(reference, "?") {
+				failBatchEntry(entry, http.StatusBadRequest, models.CreateOpOutcome("error", "invalid", "", fmt.Sprintf("Conditional references are only allowed in transactions, not batches (%s)", reference)))
+				break
 			}
 		}
-
-		session.CommmitIfTransaction()
 	}
+}
 
-	if proceed {
-		total := uint32(len(entries))
-		bundle.Total = &total
-		bundle.Type = fmt.Sprintf("%s-response", bundle.Type)
-
-		c.Set("Bundle", bundle)
-		c.Set("Resource", "Bundle")
-		c.Set("Action", "batch")
+// failBatchEntryWithError records an error processing a batch entry in its response
+func failBatchEntryWithError(entry *models2.ShallowBundleEntryComponent, statusCode int, err error) {
+	if statusCode == http.StatusBadRequest {
+		failBatchEntry(entry, statusCode, models.CreateOpOutcome("error", "invalid", "", err.Error()))
+	} else {
+		statusCode, outcome := ErrorToOpOutcome(err)
+		failBatchEntry(entry, statusCode, outcome)
+	}
+}
 
-		sendReply(c, http.StatusOK, bundle)
+// failBatchEntry records the failure of a batch entry in its response, without affecting the other entries
+func failBatchEntry(entry *models2.ShallowBundleEntryComponent, statusCode int, outcome *models.OperationOutcome) {
+	entry.Resource = nil
+	entry.Request = nil
+	entry.Response = &models.BundleEntryResponseComponent{
+		Status: strconv.Itoa(statusCode),
+		Outcome: outcome,
 	}
 }
 
@@ -373,11 +376,26 @@ func sendReply(c *gin.Context, httpStatus int, reply interface{}) {
 	}
 }
 
+// doBatchRequest does the request of a batch entry, turning panics into errors so they only fail that entry
+func (b *BatchController) doBatchRequest(c *gin.Context, session DataAccessSession, i int, entry *models2.ShallowBundleEntryComponent, createStatus []string, newIDs []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if panicErr, isError := r.(error); isError {
+				err = panicErr
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	return b.doRequest(c, session, i, entry, createStatus, newIDs)
+}
+
 func (b *BatchController) doRequest(c *gin.Context, session DataAccessSession, i int, entry *models2.ShallowBundleEntryComponent, createStatus []string, newIDs []string) error {
 	debug("doRequest %s %s", entry.Request.Method, entry.Request.Url)
 	if entry.Response != nil {
 		// already handled (e.g. conditional update returned 409)
 		debug("  already handled (%s)", entry.Response.DebugString())
+		entry.Request = nil
 		return nil
 	}
 
@@ -460,6 +478,77 @@ func (b *BatchController) doRequest(c *gin.Context, session DataAccessSession, i
 			entry.Response.Status = "200"
 		}
 		updateEntryMeta(entry)
+	case "PATCH":
+		var resourceType, id string
+		if isConditional(entry) {
+			parts := strings.SplitN(entry.Request.Url, "?", 2)
+			resourceType = parts[0]
+			query := search.Query{Resource: parts[0], Query: parts[1]}
+			IDs, err := session.FindIDs(query)
+			if err != nil {
+				return errors.Wrapf(err, "failed to find resource to patch for %s", entry.Request.Url)
+			}
+			switch len(IDs) {
+			case 0:
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status: "404",
+					Outcome: models.CreateOpOutcome("error", "not-found", "", "no matches for conditional patch"),
+				}
+			case 1:
+				id = IDs[0]
+			default:
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status: "412",
+					Outcome: models.CreateOpOutcome("error", "duplicate", "", "search criteria were not selective enough"),
+				}
+			}
+		} else {
+			parts := strings.SplitN(entry.Request.Url, "/", 2)
+			resourceType, id = parts[0], parts[1]
+		}
+
+		if id != "" {
+			conditionalVersionId := ""
+			if entry.Request.IfMatch != "" {
+				var err error
+				conditionalVersionId, err = utils.ETagToVersionId(entry.Request.IfMatch)
+				if err != nil {
+					return errors.Wrapf(err, "failed to parse If-Match for %s", entry.Request.Url)
+				}
+			}
+
+			p, err := patchFromResource(entry.Resource)
+			if err != nil {
+				return errors.Wrapf(err, "invalid patch for %s", entry.Request.Url)
+			}
+			resource, err := patchResource(session, b.Config.EnableHistory, resourceType, id, conditionalVersionId, p, shouldEncryptPatientDetails(c))
+			switch err {
+			case nil:
+				entry.FullUrl = b.Config.responseURL(c.Request, resourceType, id).String()
+				entry.Resource = resource
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status:   "200",
+					Location: entry.FullUrl,
+				}
+				updateEntryMeta(entry)
+			case ErrNotFound:
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status: "404",
+					Outcome: models.CreateOpOutcome("error", "not-found", "", "resource to patch not found"),
+				}
+			case ErrDeleted:
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status: "410",
+					Outcome: models.CreateOpOutcome("error", "deleted", "", "resource to patch has been deleted"),
+				}
+			default:
+				return errors.Wrapf(err, "failed to patch %s", entry.Request.Url)
+			}
+		}
+		if entry.Response.Status != "200" {
+			entry.Resource = nil
+		}
+		entry.Request = nil
 	case "GET":
 		/*
 		examples
@@ -468,6 +557,8 @@ func (b *BatchController) doRequest(c *gin.Context, session DataAccessSession, i
 			2 /Patient/12345
 			3 /Patient/12345/_history
 			4 /Patient/12345/_history/55
+			  /Patient/_history
+			  /_history
 		*/
 
 		pathAndQuery := strings.SplitN(entry.Request.Url, "?", 2)
@@ -488,16 +579,26 @@ func (b *BatchController) doRequest(c *gin.Context, session DataAccessSession, i
 		var historyRequest bool
 		resourceType := segments [0]
 		debug("  segments: %q (%d)", segments, len(segments))
-		if len(segments) >= 2 {
+		if resourceType == "_history" {
+			// whole-system history
+			if len(segments) > 1 {
+				return errors.Errorf("failed to parse request path: %s", entry.Request.Url)
+			}
+			resourceType = ""
+			historyRequest = true
+		} else if len(segments) >= 2 {
 			id = segments[1]
 			if id == "_search" {
 				id = ""
 			}
 			if id == "_history" {
-				return errors.Errorf("resource-level history not supported in request: %s", entry.Request.Url)
-			}
-			
-			if len(segments) >= 3 {
+				// resource-level history
+				if len(segments) > 2 {
+					return errors.Errorf("failed to parse request path: %s", entry.Request.Url)
+				}
+				id = ""
+				historyRequest = true
+			} else if len(segments) >= 3 {
 				op := segments[2]
 				debug("  op = %s", op)
 				if op != "_history" {
@@ -515,8 +616,12 @@ func (b *BatchController) doRequest(c *gin.Context, session DataAccessSession, i
 		}
 
 		if historyRequest {
-			baseURL := b.Config.responseURL(c.Request, resourceType)
-			bundle, err := session.History(*baseURL, resourceType, id)
+			query, err := ParseHistoryQuery(resourceType, id, queryString)
+			if err != nil {
+				return errors.Wrapf(err, "History request failed: %s", entry.Request.Url)
+			}
+			baseURL := b.Config.responseURL(c.Request)
+			bundle, err := session.History(*baseURL, query)
 			debug("  history request (%s/%s) --> err %+v", resourceType, id, err)
 			if err != nil && err != ErrNotFound {
 				return errors.Wrapf(err, "History request failed: %s", entry.Request.Url)
@@ -612,7 +717,133 @@ func updateEntryMeta(entry *models2.ShallowBundleEntryComponent) {
 	}
 }
 
-func (b *BatchController) resolveConditionalPut(request *http.Request, session DataAccessSession, entryIndex int, entry *models2.ShallowBundleEntryComponent, newIDs []string, refMap map[string]string) error {
+// resolveEntry prepares an entry to be processed once the entries it depends on have been: finding the ids
+// of conditional creates and updates, resolving the conditional references of transaction entries and
+// handling If-Match. Errors are returned with their HTTP status code.
+func (b *BatchController) resolveEntry(request *http.Request, session DataAccessSession, bundleType string, i int, entry *models2.ShallowBundleEntryComponent, createStatus []string, newIDs []string, assignedIDs []string, refMap map[string]string) (statusCode int, err error) {
+	switch {
+	case entry.Request.Method == "POST" && len(entry.Request.IfNoneExist) > 0:
+		// Conditional Create
+		entry.Request.IfNoneExist = replaceTempIDs(entry.Request.IfNoneExist, refMap)
+		if hasTempID(entry.Request.IfNoneExist) {
+			return http.StatusBadRequest, errors.Errorf("Conditional create of %s references an entry that wasn't resolved (%s)", entry.Request.Url, entry.Request.IfNoneExist)
+		}
+
+		query := search.Query{Resource: entry.Request.Url, Query: entry.Request.IfNoneExist}
+		existingIds, err := session.FindIDs(query)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		id := ""
+		if len(existingIds) == 0 {
+			createStatus[i] = "201"
+			id = assignID(assignedIDs, i)
+			newIDs[i] = id
+		} else if len(existingIds) == 1 {
+			createStatus[i] = "200"
+			id = existingIds[0]
+		} else if len(existingIds) > 1 {
+			createStatus[i] = "412" // HTTP 412 - Precondition Failed
+		}
+
+		if len(id) > 0 {
+			b.mapEntryID(request, entry, entry.Request.Url, id, refMap)
+		}
+
+	case entry.Request.Method == "PUT" && isConditional(entry):
+		// Swap out the temp IDs of entries already resolved with their new IDs
+		entry.Request.Url = replaceTempIDs(entry.Request.Url, refMap)
+		if hasTempID(entry.Request.Url) {
+			return http.StatusBadRequest, errors.Errorf("Conditional update references an entry that wasn't resolved (%s)", entry.Request.Url)
+		}
+
+		if err := b.resolveConditionalPut(request, session, i, entry, newIDs, assignedIDs, refMap); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if bundleType == "transaction" {
+		if err := resolveConditionalReferences(session, entry, refMap); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	// Handle If-Match
+	if entry.Request.Method == "PUT" && entry.Request.IfMatch != "" {
+		parts := strings.SplitN(entry.Request.Url, "/", 2)
+		if len(parts) != 2 { // TODO: refactor
+			return http.StatusBadRequest, fmt.Errorf("Couldn't identify resource and id to put from %s", entry.Request.Url)
+		}
+		id := parts[1]
+
+		conditionalVersionId, err := utils.ETagToVersionId(entry.Request.IfMatch)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		currentResource, err := session.Get(id, entry.Resource.ResourceType())
+		if err == ErrNotFound {
+			entry.Response = &models.BundleEntryResponseComponent{
+				Status: "404",
+				Outcome: models.CreateOpOutcome("error", "not-found", "", "Existing resource not found when handling If-Match"),
+			}
+			entry.Resource = nil
+		} else if err != nil {
+			err = errors.Wrapf(err, "failed to get current resource while processing If-Match for %s", entry.Request.Url)
+			return http.StatusInternalServerError, err
+		} else if conditionalVersionId != currentResource.VersionId() {
+			entry.Response = &models.BundleEntryResponseComponent{
+				Status: "409",
+				Outcome: models.CreateOpOutcome("error", "conflict", "", fmt.Sprintf("Version mismatch when handling If-Match (current=%s wanted=%s)", currentResource.VersionId(), conditionalVersionId)),
+			}
+			entry.Resource = nil
+		}
+	}
+
+	return 0, nil
+}
+
+// resolveConditionalReferences finds the resources matched by the conditional references (e.g. Patient?identifier=123)
+// of an entry's resource, including those created or updated by entries already processed in the transaction
+func resolveConditionalReferences(session DataAccessSession, entry *models2.ShallowBundleEntryComponent, refMap map[string]string) error {
+	references, err := entry.GetReferences()
+	if err != nil {
+		return err
+	}
+	for _, reference := range references {
+
+		if _, alreadyMapped := refMap[reference]; alreadyMapped {
+			continue
+		}
+
+		queryPos := strings.Index(reference, "?")
+		if queryPos >= 0 {
+
+			resourceType := reference[0:queryPos]
+			queryString := replaceTempIDs(reference[queryPos+1:], refMap)
+			if hasTempID(queryString) {
+				return errors.Errorf("conditional reference refers to an entry that wasn't resolved (%s)", reference)
+			}
+			searchQuery := search.Query{Resource: resourceType, Query: queryString }
+			ids, err := session.FindIDs(searchQuery)
+			if err != nil {
+				return errors.Wrapf(err, "lookup of conditional reference failed (%s)", reference)
+			}
+
+			if len(ids) == 1 {
+				refMap[reference] = resourceType + "/" + ids[0]
+			} else if len(ids) == 0 {
+				return errors.Errorf("no matches for conditional reference (%s)", reference)
+			} else {
+				return errors.Errorf("multiple matches for conditional reference (%s)", reference)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BatchController) resolveConditionalPut(request *http.Request, session DataAccessSession, entryIndex int, entry *models2.ShallowBundleEntryComponent, newIDs []string, assignedIDs []string, refMap map[string]string) error {
 	// Do a preflight to either get the existing ID, get a new ID, or detect multiple matches (not allowed)
 	parts := strings.SplitN(entry.Request.Url, "?", 2)
 	query := search.Query{Resource: parts[0], Query: parts[1]}
@@ -621,7 +852,7 @@ func (b *BatchController) resolveConditionalPut(request *http.Request, session D
 	if IDs, err := session.FindIDs(query); err == nil {
 		switch len(IDs) {
 		case 0:
-			id = bson.NewObjectId().Hex()
+			id = assignID(assignedIDs, entryIndex)
 		case 1:
 			id = IDs[0]
 		default:
@@ -634,20 +865,43 @@ func (b *BatchController) resolveConditionalPut(request *http.Request, session D
 	// Rewrite the PUT as a normal (non-conditional) PUT
 	entry.Request.Url = query.Resource + "/" + id
 
-	// Add the new ID to the reference map
+	// Add the new ID to the reference map and rewrite the FullUrl using it
 	newIDs[entryIndex] = id
-	refMap[entry.FullUrl] = entry.Request.Url
-
-	// Rewrite the FullUrl using the new ID
-	entry.FullUrl = b.Config.responseURL(request, query.Resource, id).String()
+	b.mapEntryID(request, entry, query.Resource, id, refMap)
 
 	return nil
 }
 
+// mapEntryID records the id assigned to the resource of an entry, so that references to its fullUrl
+// can be updated, and rewrites the fullUrl using the new id
+func (b *BatchController) mapEntryID(request *http.Request, entry *models2.ShallowBundleEntryComponent, resourceType string, id string, refMap map[string]string) {
+	refMap[entry.FullUrl] = resourceType + "/" + id
+	entry.FullUrl = b.Config.responseURL(request, resourceType, id).String()
+}
+
+// replaceTempIDs swaps out the temp IDs (fullUrls of other entries) in a conditional URL or query
+// with the references to the resources of entries already resolved
+func replaceTempIDs(str string, refMap map[string]string) string {
+	for oldID, ref := range refMap {
+		re := regexp.MustCompile("([=,])(" + regexp.QuoteMeta(oldID) + "|" + regexp.QuoteMeta(url.QueryEscape(oldID)) + ")(&|,|$)")
+		str = re.ReplaceAllString(str, "${1}"+ref+"${3}")
+	}
+	return str
+}
+
+// assignID returns the id for a new resource created by the entry at index i, reusing the id assigned
+// by an earlier attempt if a transaction is being retried
+func assignID(assignedIDs []string, i int) string {
+	if assignedIDs[i] == "" {
+		assignedIDs[i] = bson.NewObjectId().Hex()
+	}
+	return assignedIDs[i]
+}
+
 func isConditional(entry *models2.ShallowBundleEntryComponent) bool {
 	if entry.Request == nil {
 		return false
-	} else if entry.Request.Method != "PUT" && entry.Request.Method != "DELETE" {
+	} else if entry.Request.Method != "PUT" && entry.Request.Method != "DELETE" && entry.Request.Method != "PATCH" {
 		return false
 	}
 	return !strings.Contains(entry.Request.Url, "/") || strings.Contains(entry.Request.Url, "?")
@@ -678,6 +932,6 @@ func (e byRequestMethod) Swap(i, j int) {
 	e[i], e[j] = e[j], e[i]
 }
 func (e byRequestMethod) Less(i, j int) bool {
-	methodMap := map[string]int{"DELETE": 0, "POST": 1, "PUT": 2, "GET": 3}
+	methodMap := map[string]int{"DELETE": 0, "POST": 1, "PUT": 2, "PATCH": 2, "GET": 3}
 	return methodMap[e[i].Request.Method] < methodMap[e[j].Request.Method]
 }
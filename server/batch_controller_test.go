@@ -16,6 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/eug48/fhir/models"
 	"github.com/pebbe/util"
+	"github.com/pkg/errors"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -754,39 +755,17 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch409(c *C) {
 	c.Assert(oo.Issue[0].Code, Equals, "conflict")
 	c.Assert(oo.Issue[0].Details.Text, Equals, "Version mismatch when handling If-Match (current=1 wanted=5)")
 
-	// Now check other entries
-	expectedIDs := []string{"56afe6b85cdc7ec329dfe6a2", "56afe6b85cdc7ec329dfe6a3", "56afe6b85cdc7ec329dfe6a1"}
+	// the conditions reference the patient entry by its fullUrl, so fail as batch entries are independent
 	for i := 1; i < len(responseBundle.Entry); i++ {
 		resEntry := responseBundle.Entry[i]
-
-		// response resource type should be a condition
-		c.Assert(resEntry.Resource, FitsTypeOf, &models.Condition{})
-
-		// Reference to patient should be to upserted patient
-		s.checkReference(c, resEntry.Resource.(*models.Condition).Subject, "56afe6b85cdc7ec329dfe6a0", "Patient")
-
-		// check full URL and ID match expected values
-		c.Assert(resEntry.FullUrl, Equals, s.Server.URL+"/Condition/"+expectedIDs[i-1])
-		c.Assert(s.getResourceID(resEntry), Equals, expectedIDs[i-1])
-
-		// resource should have lastUpdatedTime
-		m := reflect.ValueOf(resEntry.Resource).Elem().FieldByName("Meta").Interface().(*models.Meta)
-		c.Assert(m, NotNil)
-		c.Assert(m.LastUpdated, NotNil)
-		c.Assert(m.LastUpdated.Precision, Equals, models.Precision(models.Timestamp))
-		c.Assert(time.Since(m.LastUpdated.Time).Minutes() < float64(1), Equals, true)
-
-		// response should not contain the request
+		c.Assert(resEntry.Resource, IsNil)
 		c.Assert(resEntry.Request, IsNil)
+		c.Assert(resEntry.Response.Status, Equals, "400")
 
-		// response should have 200 or 201 status and location
-		switch i {
-		case 1, 3:
-			c.Assert(resEntry.Response.Status, Equals, "200")
-		case 2:
-			c.Assert(resEntry.Response.Status, Equals, "201")
-		}
-		c.Assert(resEntry.Response.Location, Equals, resEntry.FullUrl)
+		oo := resEntry.Response.Outcome.(*models.OperationOutcome)
+		c.Assert(oo.Issue[0].Severity, Equals, "error")
+		c.Assert(oo.Issue[0].Code, Equals, "invalid")
+		c.Assert(oo.Issue[0].Details.Text, Matches, ".*urn:uuid:61ebe359-bfdc-4613-8bf2-c5e3009a5d12.*")
 	}
 
 	// Now do a quick content check
@@ -794,7 +773,7 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch409(c *C) {
 	patCollection := s.MgoDB().C("patients")
 	count, err := condCollection.Count()
 	util.CheckErr(err)
-	c.Assert(count, Equals, 3)
+	c.Assert(count, Equals, 2)
 
 	pat1 := models.Patient{}
 	err = patCollection.FindId("56afe6b85cdc7ec329dfe6a0").One(&pat1)
@@ -805,19 +784,13 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch409(c *C) {
 	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a1").One(&cond1)
 	util.CheckErr(err)
 	c.Assert(cond1.Code.Coding, HasLen, 1)
-	c.Assert(cond1.Code.Coding[0].Code, Equals, "Bar2")
+	c.Assert(cond1.Code.Coding[0].Code, Equals, "Bar")
 
 	cond2 := models.Condition{}
 	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a2").One(&cond2)
 	util.CheckErr(err)
 	c.Assert(cond2.Code.Coding, HasLen, 1)
-	c.Assert(cond2.Code.Coding[0].Code, Equals, "Baz2")
-
-	cond3 := models.Condition{}
-	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a3").One(&cond3)
-	util.CheckErr(err)
-	c.Assert(cond3.Code.Coding, HasLen, 1)
-	c.Assert(cond3.Code.Coding[0].Code, Equals, "Bat")
+	c.Assert(cond2.Code.Coding[0].Code, Equals, "Baz")
 }
 
 func (s *BatchControllerSuite) TestVersionedPutEntriesBatch200(c *C) {
@@ -853,39 +826,17 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch200(c *C) {
 	c.Assert(patEntry.Response.Status, Equals, "200")
 	c.Assert(patEntry.Response.Location, Equals, patEntry.FullUrl)
 
-	// Now check other entries
-	expectedIDs := []string{"56afe6b85cdc7ec329dfe6a2", "56afe6b85cdc7ec329dfe6a3", "56afe6b85cdc7ec329dfe6a1"}
+	// the conditions reference the patient entry by its fullUrl, so fail as batch entries are independent
 	for i := 1; i < len(responseBundle.Entry); i++ {
 		resEntry := responseBundle.Entry[i]
-
-		// response resource type should be a condition
-		c.Assert(resEntry.Resource, FitsTypeOf, &models.Condition{})
-
-		// Reference to patient should be to upserted patient
-		s.checkReference(c, resEntry.Resource.(*models.Condition).Subject, "56afe6b85cdc7ec329dfe6a0", "Patient")
-
-		// check full URL and ID match expected values
-		c.Assert(resEntry.FullUrl, Equals, s.Server.URL+"/Condition/"+expectedIDs[i-1])
-		c.Assert(s.getResourceID(resEntry), Equals, expectedIDs[i-1])
-
-		// resource should have lastUpdatedTime
-		m := reflect.ValueOf(resEntry.Resource).Elem().FieldByName("Meta").Interface().(*models.Meta)
-		c.Assert(m, NotNil)
-		c.Assert(m.LastUpdated, NotNil)
-		c.Assert(m.LastUpdated.Precision, Equals, models.Precision(models.Timestamp))
-		c.Assert(time.Since(m.LastUpdated.Time).Minutes() < float64(1), Equals, true)
-
-		// response should not contain the request
+		c.Assert(resEntry.Resource, IsNil)
 		c.Assert(resEntry.Request, IsNil)
+		c.Assert(resEntry.Response.Status, Equals, "400")
 
-		// response should have 200 or 201 status and location
-		switch i {
-		case 1, 3:
-			c.Assert(resEntry.Response.Status, Equals, "200")
-		case 2:
-			c.Assert(resEntry.Response.Status, Equals, "201")
-		}
-		c.Assert(resEntry.Response.Location, Equals, resEntry.FullUrl)
+		oo := resEntry.Response.Outcome.(*models.OperationOutcome)
+		c.Assert(oo.Issue[0].Severity, Equals, "error")
+		c.Assert(oo.Issue[0].Code, Equals, "invalid")
+		c.Assert(oo.Issue[0].Details.Text, Matches, ".*urn:uuid:61ebe359-bfdc-4613-8bf2-c5e3009a5d12.*")
 	}
 
 	// Now do a quick content check
@@ -893,7 +844,7 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch200(c *C) {
 	patCollection := s.MgoDB().C("patients")
 	count, err := condCollection.Count()
 	util.CheckErr(err)
-	c.Assert(count, Equals, 3)
+	c.Assert(count, Equals, 2)
 
 	pat1 := models.Patient{}
 	err = patCollection.FindId("56afe6b85cdc7ec329dfe6a0").One(&pat1)
@@ -904,19 +855,13 @@ func (s *BatchControllerSuite) TestVersionedPutEntriesBatch200(c *C) {
 	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a1").One(&cond1)
 	util.CheckErr(err)
 	c.Assert(cond1.Code.Coding, HasLen, 1)
-	c.Assert(cond1.Code.Coding[0].Code, Equals, "Bar2")
+	c.Assert(cond1.Code.Coding[0].Code, Equals, "Bar")
 
 	cond2 := models.Condition{}
 	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a2").One(&cond2)
 	util.CheckErr(err)
 	c.Assert(cond2.Code.Coding, HasLen, 1)
-	c.Assert(cond2.Code.Coding[0].Code, Equals, "Baz2")
-
-	cond3 := models.Condition{}
-	err = condCollection.FindId("56afe6b85cdc7ec329dfe6a3").One(&cond3)
-	util.CheckErr(err)
-	c.Assert(cond3.Code.Coding, HasLen, 1)
-	c.Assert(cond3.Code.Coding[0].Code, Equals, "Bat")
+	c.Assert(cond2.Code.Coding[0].Code, Equals, "Baz")
 }
 
 func (s *BatchControllerSuite) TestConditionalUpdatesBundle(c *C) {
@@ -979,6 +924,228 @@ func (s *BatchControllerSuite) TestConditionalUpdatesBundle(c *C) {
 	}
 }
 
+func (s *BatchControllerSuite) TestBatchEntriesFailIndependently(c *C) {
+
+	body := `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [{
+			"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+			"resource": { "resourceType": "Patient", "gender": "female" },
+			"request": { "method": "POST", "url": "Patient" }
+		}, {
+			"resource": { "resourceType": "Observation", "status": "final", "code": { "text": "test" }, "subject": { "reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a" } },
+			"request": { "method": "POST", "url": "Observation" }
+		}, {
+			"resource": { "resourceType": "Observation", "status": "final", "code": { "text": "test" } },
+			"request": { "method": "PUT", "url": "Observation" }
+		}, {
+			"resource": { "resourceType": "Observation", "status": "final", "code": { "text": "test" }, "subject": { "reference": "Patient?identifier=12345" } },
+			"request": { "method": "POST", "url": "Observation" }
+		}, {
+			"resource": { "resourceType": "Observation", "status": "final", "code": { "text": "test" } },
+			"request": { "method": "POST", "url": "Observation" }
+		}]
+	}`
+
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	responseBundle := &models.Bundle{}
+	err = json.NewDecoder(res.Body).Decode(responseBundle)
+	util.CheckErr(err)
+	c.Assert(responseBundle.Type, Equals, "batch-response")
+	c.Assert(*responseBundle.Total, Equals, uint32(5))
+	c.Assert(responseBundle.Entry, HasLen, 5)
+
+	expectedStatuses := []string{"201", "400", "400", "400", "201"}
+	for i, entry := range responseBundle.Entry {
+		c.Assert(entry.Response.Status, Equals, expectedStatuses[i])
+		c.Assert(entry.Request, IsNil)
+		if expectedStatuses[i] == "400" {
+			c.Assert(entry.Resource, IsNil)
+			c.Assert(entry.Response.Outcome, NotNil)
+		}
+	}
+
+	count, err := s.MgoDB().C("observations").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *BatchControllerSuite) TestChainedConditionalTransaction(c *C) {
+
+	// entries are listed in the reverse of the order they need to be resolved in
+	body := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"fullUrl": "urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0003",
+			"resource": {
+				"resourceType": "Observation",
+				"identifier": [{ "system": "http://example.org/obs", "value": "obs-1" }],
+				"status": "final",
+				"code": { "text": "test" },
+				"subject": { "reference": "Patient?identifier=http://example.org/mrn|chain-1" },
+				"context": { "reference": "urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0002" }
+			},
+			"request": { "method": "PUT", "url": "Observation?identifier=http://example.org/obs|obs-1&context=urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0002" }
+		}, {
+			"fullUrl": "urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0002",
+			"resource": {
+				"resourceType": "Encounter",
+				"identifier": [{ "system": "http://example.org/enc", "value": "enc-1" }],
+				"status": "finished",
+				"subject": { "reference": "urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0001" }
+			},
+			"request": { "method": "PUT", "url": "Encounter?identifier=http://example.org/enc|enc-1&patient=urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0001" }
+		}, {
+			"fullUrl": "urn:uuid:5c9a4d42-7a2b-4fb8-8bd0-3c1a0c5e0001",
+			"resource": {
+				"resourceType": "Patient",
+				"identifier": [{ "system": "http://example.org/mrn", "value": "chain-1" }]
+			},
+			"request": { "method": "PUT", "url": "Patient?identifier=http://example.org/mrn|chain-1" }
+		}]
+	}`
+
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	responseBundle := &models.Bundle{}
+	err = json.NewDecoder(res.Body).Decode(responseBundle)
+	util.CheckErr(err)
+	c.Assert(responseBundle.Entry, HasLen, 3)
+	for _, entry := range responseBundle.Entry {
+		c.Assert(entry.Response.Status, Equals, "201")
+	}
+	observationID := s.getResourceID(responseBundle.Entry[0])
+	encounterID := s.getResourceID(responseBundle.Entry[1])
+	patientID := s.getResourceID(responseBundle.Entry[2])
+
+	observation := &models.Observation{}
+	err = s.MgoDB().C("observations").FindId(observationID).One(observation)
+	util.CheckErr(err)
+	s.checkReference(c, observation.Subject, patientID, "Patient")
+	s.checkReference(c, observation.Context, encounterID, "Encounter")
+
+	encounter := &models.Encounter{}
+	err = s.MgoDB().C("encounters").FindId(encounterID).One(encounter)
+	util.CheckErr(err)
+	s.checkReference(c, encounter.Subject, patientID, "Patient")
+
+	// entries depending on each other's conditional references can't be ordered
+	circular := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"resource": { "resourceType": "Patient", "name": [{ "family": "Smith" }], "link": [{ "other": { "reference": "Patient?name=Jones" }, "type": "seealso" }] },
+			"request": { "method": "POST", "url": "Patient" }
+		}, {
+			"resource": { "resourceType": "Patient", "name": [{ "family": "Jones" }], "link": [{ "other": { "reference": "Patient?name=Smith" }, "type": "seealso" }] },
+			"request": { "method": "POST", "url": "Patient" }
+		}]
+	}`
+	res, err = http.Post(s.Server.URL+"/", "application/json", strings.NewReader(circular))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *BatchControllerSuite) TestInterdependentBatchEntry(c *C) {
+
+	responseBundle := &models.Bundle{}
+	s.sendRequest(c, "../fixtures/batch_interdependent_entries.json", 200, responseBundle)
+
+	c.Assert(responseBundle.Type, Equals, "batch-response")
+	c.Assert(responseBundle.Entry, HasLen, 3)
+	c.Assert(responseBundle.Entry[0].Response.Status, Equals, "201")
+	c.Assert(responseBundle.Entry[2].Response.Status, Equals, "201")
+
+	// the observation referencing the patient entry fails on its own
+	obsEntry := responseBundle.Entry[1]
+	c.Assert(obsEntry.Resource, IsNil)
+	c.Assert(obsEntry.Response.Status, Equals, "400")
+	oo := obsEntry.Response.Outcome.(*models.OperationOutcome)
+	c.Assert(oo.Issue[0].Severity, Equals, "error")
+	c.Assert(oo.Issue[0].Code, Equals, "invalid")
+	c.Assert(oo.Issue[0].Details.Text, Equals, "Batch entry references another entry (urn:uuid:3f5ab7a4-9d2c-4c58-a0e4-2f0c1b9d7e61), which is only allowed in transactions")
+
+	count, err := s.MgoDB().C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+	count, err = s.MgoDB().C("observations").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *BatchControllerSuite) TestConcurrentTransactionsAreRetried(c *C) {
+
+	// concurrent transactions updating the same resource conflict with each other
+	id := bson.NewObjectId().Hex()
+	const count = 5
+	results := make(chan int, count)
+	for i := 0; i < count; i++ {
+		body := fmt.Sprintf(`{
+			"resourceType": "Bundle",
+			"type": "transaction",
+			"entry": [{
+				"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+				"resource": { "resourceType": "Patient", "id": "%s", "gender": "female", "birthDate": "1980-01-0%d" },
+				"request": { "method": "PUT", "url": "Patient/%s" }
+			}, {
+				"fullUrl": "urn:uuid:05efabf0-4be2-4561-91ce-51548425acb9",
+				"resource": { "resourceType": "Observation", "status": "final", "code": { "text": "test" }, "subject": { "reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a" } },
+				"request": { "method": "POST", "url": "Observation" }
+			}]
+		}`, id, i+1, id)
+
+		go func() {
+			res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(body))
+			util.CheckErr(err)
+			res.Body.Close()
+			results <- res.StatusCode
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		c.Assert(<-results, Equals, 200)
+	}
+
+	res, err := http.Get(s.Server.URL + "/Patient/" + id + "/_history")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	historyBundle := &models.Bundle{}
+	err = json.NewDecoder(res.Body).Decode(historyBundle)
+	util.CheckErr(err)
+	c.Assert(historyBundle.Entry, HasLen, count)
+}
+
+type labelledError []string
+
+func (e labelledError) Error() string { return "labelled error" }
+
+func (e labelledError) HasErrorLabel(label string) bool {
+	for _, l := range e {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BatchControllerSuite) TestIsTransientTransactionError(c *C) {
+	c.Assert(isTransientTransactionError(nil), Equals, false)
+	c.Assert(isTransientTransactionError(labelledError{}), Equals, false)
+	c.Assert(isTransientTransactionError(labelledError{"TransientTransactionError"}), Equals, true)
+	c.Assert(isTransientTransactionError(errors.Wrap(labelledError{"TransientTransactionError"}, "commit failed")), Equals, true)
+	c.Assert(isTransientTransactionError(errors.New("(WriteConflict) WriteConflict")), Equals, true)
+	c.Assert(isTransientTransactionError(labelledError{"UnknownTransactionCommitResult"}), Equals, false)
+	c.Assert(isTransientTransactionError(errors.Wrap(labelledError{"UnknownTransactionCommitResult"}, "mongoSession.CommmitIfTransaction")), Equals, false)
+	c.Assert(isTransientTransactionError(errors.New("duplicate key")), Equals, false)
+}
+
 func (s *BatchControllerSuite) TestAllSupportedMethodsBundle(c *C) {
 
 	// Create some records to delete or update
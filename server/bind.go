@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/gin-gonic/gin"
+	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 )
 
@@ -48,7 +50,13 @@ func FHIRBind(c *gin.Context, validatorURL string) (resource *models2.Resource,
 			if err != nil {
 				return nil, errors.Wrapf(err, "FHIRBind: error calling validator (%s)", validatorURL)
 			}
-			resp.Location()
+			defer resp.Body.Close()
+
+			// keep any issues found so they can be returned (e.g. with Prefer: return=OperationOutcome)
+			outcome := &models.OperationOutcome{}
+			if json.NewDecoder(resp.Body).Decode(outcome) == nil {
+				c.Set("ValidationOutcome", outcome)
+			}
 		}
 	}
 
@@ -0,0 +1,540 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/utils"
+	"github.com/gin-gonic/gin"
+	bson2 "github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NDJSONContentType is the media type of the files produced by the $export operation
+const NDJSONContentType = "application/fhir+ndjson"
+
+// DefaultBulkExportRetention is how long the files of a finished export job are kept unless configured otherwise
+const DefaultBulkExportRetention = 24 * time.Hour
+
+// BulkExportController implements the Bulk Data $export operation (http://hl7.org/fhir/uv/bulkdata/export/index.html)
+// at the system, Patient and Group levels.  Exports run in the background, streaming resources straight from the
+// MongoDB collections into an NDJSON file per resource type.  Jobs are only known to the server instance that
+// accepted them, so status and file requests need to reach the same instance.  Finished jobs and their files
+// are removed once they are older than the BulkExportRetention, as are files left behind by a previous run.
+type BulkExportController struct {
+	dal       *mongoDataAccessLayer
+	Config    Config
+	dir       string
+	retention time.Duration
+
+	lock sync.Mutex
+	jobs map[string]*exportJob
+}
+
+// NewBulkExportController creates a BulkExportController, or returns nil if the DataAccessLayer isn't
+// backed by MongoDB
+func NewBulkExportController(dal DataAccessLayer, config Config) *BulkExportController {
+	mongoDAL, isMongo := dal.(*mongoDataAccessLayer)
+	if !isMongo {
+		return nil
+	}
+
+	dir := config.BulkExportDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gofhir-export")
+	}
+
+	retention := config.BulkExportRetention
+	if retention <= 0 {
+		retention = DefaultBulkExportRetention
+	}
+
+	b := &BulkExportController{
+		dal:       mongoDAL,
+		Config:    config,
+		dir:       dir,
+		retention: retention,
+		jobs:      make(map[string]*exportJob),
+	}
+	go func() {
+		for {
+			b.sweep(time.Now())
+			time.Sleep(retention / 24)
+		}
+	}()
+	return b
+}
+
+type exportJob struct {
+	id              string
+	dbName          string
+	request         string
+	statusURL       string
+	transactionTime time.Time
+	resourceTypes   []string
+	since           *time.Time
+
+	// Patient and Group-level exports only include Patient resources and resources with a patient
+	// search parameter, restricted to the given patients unless patientIds is nil
+	patientLevel bool
+	patientIds   []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock     sync.Mutex
+	progress string
+	outputs  []exportOutput
+	err      error
+	done     bool
+	finished time.Time
+}
+
+type exportOutput struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+	file  string
+}
+
+type exportManifest struct {
+	TransactionTime     string         `json:"transactionTime"`
+	Request             string         `json:"request"`
+	RequiresAccessToken bool           `json:"requiresAccessToken"`
+	Output              []exportOutput `json:"output"`
+	Error               []exportOutput `json:"error"`
+}
+
+// SystemExportHandler handles requests to export all resources (GET [base]/$export)
+func (b *BulkExportController) SystemExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+	b.kickOff(c, false, nil)
+}
+
+// PatientExportHandler handles requests to export the resources of all patients (GET [base]/Patient/$export)
+func (b *BulkExportController) PatientExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+	b.kickOff(c, true, nil)
+}
+
+// GroupExportHandler handles requests to export the resources of the patients in a group (GET [base]/Group/[id]/$export)
+func (b *BulkExportController) GroupExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := b.dal.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	resource, err := session.Get(c.Param("id"), "Group")
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "GroupExportHandler: failed to get group"))
+	}
+
+	var group models.Group
+	err = resource.Unmarshal(&group)
+	if err != nil {
+		panic(errors.Wrap(err, "GroupExportHandler: failed to decode group"))
+	}
+
+	patientIds := make([]string, 0, len(group.Member))
+	for _, member := range group.Member {
+		if member.Entity == nil {
+			continue
+		}
+		segments := strings.Split(member.Entity.Reference, "/")
+		if len(segments) >= 2 && segments[len(segments)-2] == "Patient" {
+			patientIds = append(patientIds, segments[len(segments)-1])
+		}
+	}
+	b.kickOff(c, true, patientIds)
+}
+
+func (b *BulkExportController) kickOff(c *gin.Context, patientLevel bool, patientIds []string) {
+	if !strings.Contains(c.GetHeader("Prefer"), "respond-async") {
+		renderOperationError(c, http.StatusBadRequest, "the $export operation requires a Prefer: respond-async header")
+		return
+	}
+
+	job := &exportJob{
+		id:              bson.NewObjectId().Hex(),
+		dbName:          c.GetHeader("Db"),
+		request:         b.Config.responseURL(c.Request, strings.TrimPrefix(c.Request.URL.Path, "/")).String(),
+		transactionTime: time.Now(),
+		patientLevel:    patientLevel,
+		patientIds:      patientIds,
+	}
+	if c.Request.URL.RawQuery != "" {
+		job.request += "?" + c.Request.URL.RawQuery
+	}
+	job.statusURL = b.Config.responseURL(c.Request, "$export-jobs", job.id).String()
+
+	err := job.parseParameters(c.Request.URL.RawQuery)
+	if err != nil {
+		renderOperationError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.progress = "queued"
+	b.lock.Lock()
+	b.jobs[job.id] = job
+	b.lock.Unlock()
+
+	go b.run(job)
+
+	c.Header("Content-Location", job.statusURL)
+	c.Status(http.StatusAccepted)
+}
+
+// parseParameters handles the _outputFormat, _since and _type parameters of a kick-off request
+func (job *exportJob) parseParameters(rawQuery string) error {
+	params, err := search.ParseQuery(rawQuery)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse query string")
+	}
+
+	storedTypes := make(map[string]bool)
+	for _, resourceType := range historyResourceTypes() {
+		storedTypes[resourceType] = true
+	}
+
+	for _, param := range params.All() {
+		switch param.Key {
+		case "_outputFormat":
+			// an unescaped + in application/fhir+ndjson becomes a space
+			switch strings.Replace(param.Value, " ", "+", -1) {
+			case NDJSONContentType, "application/ndjson", "ndjson":
+			default:
+				return errors.Errorf("unsupported _outputFormat: %s", param.Value)
+			}
+		case "_since":
+			since, err := utils.ParseDate(param.Value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid _since: %s", param.Value)
+			}
+			sinceTime := since.RangeLowIncl()
+			job.since = &sinceTime
+		case "_type":
+			for _, resourceType := range strings.Split(param.Value, ",") {
+				resourceType = strings.TrimSpace(resourceType)
+				if !storedTypes[resourceType] {
+					return errors.Errorf("unknown resource type in _type: %s", resourceType)
+				}
+				job.resourceTypes = append(job.resourceTypes, resourceType)
+			}
+		}
+	}
+
+	if job.resourceTypes == nil {
+		job.resourceTypes = historyResourceTypes()
+	}
+	return nil
+}
+
+// filter returns the query selecting the resources of a type to export, or false if the type isn't exported.
+// Resources updated after the transactionTime are left out, as they will be exported with a later _since.
+func (job *exportJob) filter(resourceType string) (bson.M, bool) {
+	var conditions []bson.M
+	if job.since != nil {
+		conditions = append(conditions, bson.M{"meta.lastUpdated": bson.M{"$gte": *job.since, "$lte": job.transactionTime}})
+	} else {
+		// also matches resources without a lastUpdated
+		conditions = append(conditions, bson.M{"meta.lastUpdated": bson.M{"$not": bson.M{"$gt": job.transactionTime}}})
+	}
+
+	if job.patientLevel {
+		if resourceType == "Patient" {
+			if job.patientIds != nil {
+				conditions = append(conditions, bson.M{"_id": bson.M{"$in": job.patientIds}})
+			}
+		} else {
+			info, hasPatientParam := search.SearchParameterDictionary[resourceType]["patient"]
+			if !hasPatientParam || info.Type != "reference" || (job.patientIds != nil && len(job.patientIds) == 0) {
+				return nil, false
+			}
+			patientFilter := search.ReferenceFilter(info, "Patient", job.patientIds)
+			if patientFilter == nil {
+				return nil, false
+			}
+			conditions = append(conditions, patientFilter)
+		}
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0], true
+	}
+	return bson.M{"$and": conditions}, true
+}
+
+func (b *BulkExportController) run(job *exportJob) {
+	dir := filepath.Join(b.dir, job.id)
+	defer func() {
+		if r := recover(); r != nil {
+			job.finish(errors.Errorf("export failed: %v", r))
+		}
+		if job.ctx.Err() != nil {
+			// cancelled
+			os.RemoveAll(dir)
+		}
+	}()
+
+	session := b.dal.StartSession(job.dbName).(*mongoSession)
+	defer session.Finish()
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		job.finish(errors.Wrap(err, "failed to create export directory"))
+		return
+	}
+
+	for i, resourceType := range job.resourceTypes {
+		filter, exported := job.filter(resourceType)
+		if !exported {
+			continue
+		}
+		job.setProgress(fmt.Sprintf("exporting %s (%d of %d resource types)", resourceType, i+1, len(job.resourceTypes)))
+
+		fileName := resourceType + ".ndjson"
+		count, err := exportResources(job.ctx, session, resourceType, filter, filepath.Join(dir, fileName))
+		if err != nil {
+			job.finish(err)
+			return
+		}
+		if count > 0 {
+			job.lock.Lock()
+			job.outputs = append(job.outputs, exportOutput{
+				Type:  resourceType,
+				URL:   job.statusURL + "/" + fileName,
+				Count: count,
+				file:  fileName,
+			})
+			job.lock.Unlock()
+		}
+	}
+	job.finish(nil)
+}
+
+// exportResources writes the current versions of the resources of a type matching filter to an NDJSON
+// file, returning how many were written.  The file is removed if there aren't any.
+func exportResources(ctx context.Context, ms *mongoSession, resourceType string, filter bson.M, path string) (count int, err error) {
+	filterBytes, err := bson.Marshal(filter)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to marshal %s export filter", resourceType)
+	}
+
+	cursor, err := ms.CurrentVersionCollection(resourceType).Find(ctx, filterBytes, ms.session)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query %s resources", resourceType)
+	}
+	defer cursor.Close(ctx)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to create %s", path)
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if count == 0 || err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	writer := bufio.NewWriter(file)
+	var line bytes.Buffer
+	for cursor.Next(ctx) {
+		var doc bson2.Document
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to decode %s", resourceType)
+		}
+		resource, err := models2.NewResourceFromBSON2(&doc)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to convert %s", resourceType)
+		}
+
+		line.Reset()
+		err = json.Compact(&line, resource.JsonBytes())
+		if err != nil {
+			return count, errors.Wrapf(err, "invalid JSON for %s/%s", resourceType, resource.Id())
+		}
+		line.WriteByte('\n')
+		_, err = writer.Write(line.Bytes())
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to write %s", path)
+		}
+		count++
+	}
+	if err = cursor.Err(); err != nil {
+		return count, errors.Wrapf(err, "failed to read %s resources", resourceType)
+	}
+	err = writer.Flush()
+	return count, err
+}
+
+func (job *exportJob) setProgress(progress string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.progress = progress
+}
+
+func (job *exportJob) finish(err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if !job.done {
+		job.done = true
+		job.err = err
+		job.progress = "done"
+		job.finished = time.Now()
+	}
+}
+
+// sweep forgets the jobs that finished before the retention period and removes their files, as well as
+// any other directories in the export directory that haven't been modified since then
+func (b *BulkExportController) sweep(now time.Time) {
+	cutoff := now.Add(-b.retention)
+	current := make(map[string]bool)
+	b.lock.Lock()
+	for id, job := range b.jobs {
+		job.lock.Lock()
+		expired := job.done && job.finished.Before(cutoff)
+		job.lock.Unlock()
+		if expired {
+			delete(b.jobs, id)
+		} else {
+			current[id] = true
+		}
+	}
+	b.lock.Unlock()
+
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("BulkExport: failed to list %s: %s\n", b.dir, err.Error())
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !current[entry.Name()] && entry.ModTime().Before(cutoff) {
+			if err := os.RemoveAll(filepath.Join(b.dir, entry.Name())); err != nil {
+				fmt.Printf("BulkExport: failed to remove expired export files: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// job returns the job named in the request, or nil if there isn't one for the request's database
+func (b *BulkExportController) job(c *gin.Context) *exportJob {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	job := b.jobs[c.Param("jobId")]
+	if job == nil || job.dbName != c.GetHeader("Db") {
+		return nil
+	}
+	return job
+}
+
+// StatusHandler handles requests for the status of an export job, returning the manifest once it is complete
+func (b *BulkExportController) StatusHandler(c *gin.Context) {
+	job := b.job(c)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	switch {
+	case !job.done:
+		c.Header("X-Progress", job.progress)
+		c.Header("Retry-After", "5")
+		c.Status(http.StatusAccepted)
+	case job.err != nil:
+		renderOperationError(c, http.StatusInternalServerError, job.err.Error())
+	default:
+		manifest := exportManifest{
+			TransactionTime:     job.transactionTime.UTC().Format(time.RFC3339Nano),
+			Request:             job.request,
+			RequiresAccessToken: b.Config.Auth.Method != auth.AuthTypeNone,
+			Output:              append([]exportOutput{}, job.outputs...),
+			Error:               []exportOutput{},
+		}
+		c.JSON(http.StatusOK, manifest)
+	}
+}
+
+// CancelHandler handles requests to cancel an export job or delete its files
+func (b *BulkExportController) CancelHandler(c *gin.Context) {
+	job := b.job(c)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	b.lock.Lock()
+	delete(b.jobs, job.id)
+	b.lock.Unlock()
+
+	job.cancel()
+	job.lock.Lock()
+	done := job.done
+	job.lock.Unlock()
+	if done {
+		os.RemoveAll(filepath.Join(b.dir, job.id))
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// FileHandler handles requests for the NDJSON files produced by an export job
+func (b *BulkExportController) FileHandler(c *gin.Context) {
+	job := b.job(c)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	job.lock.Lock()
+	var fileName string
+	for _, output := range job.outputs {
+		if output.file == c.Param("file") {
+			fileName = output.file
+		}
+	}
+	job.lock.Unlock()
+
+	if fileName == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Content-Type", NDJSONContentType)
+	c.File(filepath.Join(b.dir, job.id, fileName))
+}
+
+func renderOperationError(c *gin.Context, statusCode int, message string) {
+	outcome := models.NewOperationOutcome("error", "processing", message)
+	c.Render(statusCode, CustomFhirRenderer{outcome, c})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BulkExportSuite struct{}
+
+var _ = Suite(&BulkExportSuite{})
+
+func (s *BulkExportSuite) TestFilterBoundByTransactionTime(c *C) {
+	transactionTime := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	job := &exportJob{transactionTime: transactionTime}
+	filter, exported := job.filter("Observation")
+	c.Assert(exported, Equals, true)
+	c.Assert(filter, DeepEquals, bson.M{"meta.lastUpdated": bson.M{"$not": bson.M{"$gt": transactionTime}}})
+
+	since := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	job.since = &since
+	filter, exported = job.filter("Observation")
+	c.Assert(exported, Equals, true)
+	c.Assert(filter, DeepEquals, bson.M{"meta.lastUpdated": bson.M{"$gte": since, "$lte": transactionTime}})
+
+	job.patientLevel = true
+	filter, exported = job.filter("Patient")
+	c.Assert(exported, Equals, true)
+	c.Assert(filter, DeepEquals, bson.M{"meta.lastUpdated": bson.M{"$gte": since, "$lte": transactionTime}})
+	_, exported = job.filter("Organization")
+	c.Assert(exported, Equals, false)
+}
+
+func (s *BulkExportSuite) TestSweep(c *C) {
+	dir, err := ioutil.TempDir("", "bulk_export_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	b := &BulkExportController{dir: dir, retention: time.Hour, jobs: make(map[string]*exportJob)}
+	b.jobs["expired"] = &exportJob{id: "expired", done: true, finished: now.Add(-2 * time.Hour)}
+	b.jobs["finished"] = &exportJob{id: "finished", done: true, finished: now.Add(-time.Minute)}
+	b.jobs["running"] = &exportJob{id: "running"}
+
+	// directories of jobs from before a restart are only known by their modification time
+	for _, name := range []string{"expired", "finished", "running", "orphaned", "recent"} {
+		c.Assert(os.Mkdir(filepath.Join(dir, name), 0700), IsNil)
+		modified := now.Add(-2 * time.Hour)
+		if name == "recent" {
+			modified = now
+		}
+		c.Assert(os.Chtimes(filepath.Join(dir, name), modified, modified), IsNil)
+	}
+
+	b.sweep(now)
+
+	c.Assert(b.jobs, HasLen, 2)
+	c.Assert(b.jobs["finished"], NotNil)
+	c.Assert(b.jobs["running"], NotNil)
+
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	var remaining []string
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	c.Assert(remaining, DeepEquals, []string{"finished", "recent", "running"})
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/gin-gonic/gin"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+)
+
+// Resources are written to MongoDB in batches of this size (per resource type)
+const importBatchSize = 1000
+
+// BulkImportController implements an $import operation that loads NDJSON resources (as produced by $export
+// or by tools like Synthea) straight into the MongoDB collections.  Client-supplied ids are kept, existing
+// resources are updated with their previous versions saved into the history, and every line that can't be
+// imported is reported with an OperationOutcome.
+type BulkImportController struct {
+	dal    *mongoDataAccessLayer
+	Config Config
+}
+
+// NewBulkImportController creates a BulkImportController, or returns nil if the DataAccessLayer isn't
+// backed by MongoDB
+func NewBulkImportController(dal DataAccessLayer, config Config) *BulkImportController {
+	mongoDAL, isMongo := dal.(*mongoDataAccessLayer)
+	if !isMongo {
+		return nil
+	}
+	return &BulkImportController{dal: mongoDAL, Config: config}
+}
+
+// ImportHandler handles requests to import the NDJSON resources in the request body (POST [base]/$import),
+// which may be gzipped.  The response is NDJSON with an OperationOutcome for each line that failed followed
+// by a summary OperationOutcome.
+func (b *BulkImportController) ImportHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			renderOperationError(c, http.StatusBadRequest, "failed to decompress request body: "+err.Error())
+			return
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	session := b.dal.StartSession(c.GetHeader("Db")).(*mongoSession)
+	defer session.Finish()
+
+	// errors are streamed as they are found so the status has to be sent first
+	c.Header("Content-Type", NDJSONContentType)
+	c.Status(http.StatusOK)
+
+	importer := newBulkImporter(session, c.Writer)
+	err := importer.importNDJSON(body)
+	if err != nil {
+		importer.report(models.NewOperationOutcome("fatal", "exception", fmt.Sprintf("import aborted: %s", err)))
+	}
+	importer.report(importer.summary())
+}
+
+// Import loads NDJSON files (gzipped if their names end with .gz) into the default MongoDB database,
+// writing an OperationOutcome for each line that failed and a summary to report.  It returns the number
+// of lines that failed.
+func (f *FHIRServer) Import(fileNames []string, report io.Writer) (failed int, err error) {
+	dal, isMongo := f.SetupDAL().(*mongoDataAccessLayer)
+	if !isMongo {
+		return 0, errors.New("bulk import requires MongoDB")
+	}
+	session := dal.StartSession("").(*mongoSession)
+	defer session.Finish()
+
+	importer := newBulkImporter(session, report)
+	for _, fileName := range fileNames {
+		err = importer.importFile(fileName)
+		if err != nil {
+			return importer.failed, err
+		}
+	}
+	importer.report(importer.summary())
+	return importer.failed, nil
+}
+
+type bulkImporter struct {
+	ms         *mongoSession
+	encoder    *json.Encoder
+	source     string
+	validTypes map[string]bool
+	batches    map[string]*importBatch
+	counts     map[string]int
+	failed     int
+}
+
+type importBatch struct {
+	resources []importedResource
+	ids       map[string]bool
+}
+
+type importedResource struct {
+	line     int
+	resource *models2.Resource
+}
+
+func newBulkImporter(ms *mongoSession, report io.Writer) *bulkImporter {
+	validTypes := make(map[string]bool)
+	for _, resourceType := range historyResourceTypes() {
+		validTypes[resourceType] = true
+	}
+	return &bulkImporter{
+		ms:         ms,
+		encoder:    json.NewEncoder(report),
+		validTypes: validTypes,
+		batches:    make(map[string]*importBatch),
+		counts:     make(map[string]int),
+	}
+}
+
+func (imp *bulkImporter) importFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", fileName)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(fileName, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decompress %s", fileName)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	imp.source = fileName
+	return errors.Wrap(imp.importNDJSON(reader), fileName)
+}
+
+// importNDJSON imports each line of r, returning an error only if reading or writing to the database failed
+func (imp *bulkImporter) importNDJSON(r io.Reader) error {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if addErr := imp.add(lineNumber, line); addErr != nil {
+				return addErr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read NDJSON")
+		}
+	}
+
+	for resourceType, batch := range imp.batches {
+		if err := imp.flush(resourceType, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *bulkImporter) add(lineNumber int, line []byte) error {
+	resource, err := models2.NewResourceFromJsonBytes(line)
+	if err != nil {
+		imp.lineFailed(lineNumber, err)
+		return nil
+	}
+	resourceType := resource.ResourceType()
+	if !imp.validTypes[resourceType] {
+		imp.lineFailed(lineNumber, errors.Errorf("unknown resource type: %s", resourceType))
+		return nil
+	}
+
+	if resource.Id() == "" {
+		resource.SetId(objectid.New().Hex())
+	} else if _, err := convertIDToBsonID(resource.Id()); err != nil {
+		imp.lineFailed(lineNumber, errors.Errorf("invalid id %s: %s", resource.Id(), err))
+		return nil
+	}
+
+	batch := imp.batches[resourceType]
+	if batch == nil {
+		batch = &importBatch{ids: make(map[string]bool)}
+		imp.batches[resourceType] = batch
+	}
+	if batch.ids[resource.Id()] {
+		// a later line updates a resource in this batch
+		if err := imp.flush(resourceType, batch); err != nil {
+			return err
+		}
+	}
+	batch.resources = append(batch.resources, importedResource{line: lineNumber, resource: resource})
+	batch.ids[resource.Id()] = true
+
+	if len(batch.resources) >= importBatchSize {
+		return imp.flush(resourceType, batch)
+	}
+	return nil
+}
+
+// flush writes a batch of resources to the database.  New resources are inserted together with InsertMany
+// while existing ones are updated individually, saving their current versions into the history like Put does.
+func (imp *bulkImporter) flush(resourceType string, batch *importBatch) error {
+	if len(batch.resources) == 0 {
+		return nil
+	}
+	ms := imp.ms
+	curCollection := ms.CurrentVersionCollection(resourceType)
+
+	idValues := make([]*bson.Value, len(batch.resources))
+	for i, imported := range batch.resources {
+		idValues[i] = bson.VC.String(imported.resource.Id())
+	}
+	existingQuery := bson.NewDocument(bson.EC.SubDocumentFromElements("_id", bson.EC.ArrayFromElements("$in", idValues...)))
+	cursor, err := curCollection.Find(context.TODO(), existingQuery, ms.session)
+	if err != nil {
+		return errors.Wrapf(convertMongoErr(err), "failed to find existing %s resources", resourceType)
+	}
+	existing := make(map[string]*bson.Document)
+	for cursor.Next(context.TODO()) {
+		var doc bson.Document
+		if err := cursor.Decode(&doc); err != nil {
+			return errors.Wrapf(err, "failed to decode existing %s", resourceType)
+		}
+		idValue, err := doc.LookupErr("_id")
+		if err != nil {
+			return errors.Wrapf(err, "existing %s without an _id", resourceType)
+		}
+		existing[idValue.StringValue()] = &doc
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Wrapf(err, "failed to find existing %s resources", resourceType)
+	}
+
+	var newResources []importedResource
+	var newDocs []interface{}
+	for _, imported := range batch.resources {
+		if currentDoc, found := existing[imported.resource.Id()]; found {
+			err := imp.update(resourceType, imported.resource, currentDoc)
+			if err != nil {
+				ms.invokeInterceptorsOnError("Update", resourceType, err, imported.resource)
+				imp.lineFailed(imported.line, err)
+			} else {
+				ms.invokeInterceptorsAfter("Update", resourceType, imported.resource)
+				imp.counts[resourceType]++
+			}
+			continue
+		}
+
+		updateResourceMeta(imported.resource, 1)
+		ms.invokeInterceptorsBefore("Create", resourceType, imported.resource)
+		newResources = append(newResources, imported)
+		newDocs = append(newDocs, imported.resource)
+	}
+
+	if len(newDocs) > 0 {
+		_, err = curCollection.InsertMany(context.TODO(), newDocs, ms.session)
+		inserted := len(newResources)
+		if err != nil {
+			// the insert stops at the first failure (e.g. a resource created since the existing ones were found)
+			bulkErr, isBulkErr := err.(mongo.BulkWriteError)
+			if !isBulkErr || len(bulkErr.WriteErrors) == 0 {
+				return errors.Wrapf(convertMongoErr(err), "failed to insert %s resources", resourceType)
+			}
+			inserted = bulkErr.WriteErrors[0].Index
+		}
+		for i, imported := range newResources {
+			if i < inserted {
+				ms.invokeInterceptorsAfter("Create", resourceType, imported.resource)
+				imp.counts[resourceType]++
+				continue
+			}
+			// the rest are written one at a time by Put, which keeps the history of any that now exist
+			if _, err := ms.Put(imported.resource.Id(), "", imported.resource); err != nil {
+				imp.lineFailed(imported.line, err)
+			} else {
+				imp.counts[resourceType]++
+			}
+		}
+	}
+
+	batch.resources = batch.resources[:0]
+	batch.ids = make(map[string]bool)
+	return nil
+}
+
+// update replaces an existing resource, storing its current version in the previous versions collection
+func (imp *bulkImporter) update(resourceType string, resource *models2.Resource, currentDoc *bson.Document) error {
+	ms := imp.ms
+	hasVersionId, curVersionId, curVersionIdStr := getVersionIdFromResource(currentDoc)
+	if !hasVersionId {
+		curVersionId = 0
+	}
+
+	if ms.hasInterceptorsForOpAndType("Update", resourceType) {
+		oldResource, err := models2.NewResourceFromBSON2(currentDoc)
+		if err == nil {
+			ms.invokeInterceptorsBefore("Update", resourceType, oldResource)
+		}
+	}
+
+	newVersionId := 1
+	if ms.dal.enableHistory {
+		newVersionId = curVersionId + 1
+		setVermongoId(currentDoc, curVersionId)
+		_, err := ms.PreviousVersionsCollection(resourceType).InsertOne(context.TODO(), currentDoc, ms.session)
+		if err != nil && !strings.Contains(err.Error(), "duplicate key") {
+			return errors.Wrap(convertMongoErr(err), "failed to store previous version")
+		}
+	}
+	updateResourceMeta(resource, newVersionId)
+
+	// only replace the version that was saved into the history
+	selector := bson.NewDocument(
+		bson.EC.String("_id", resource.Id()),
+		bson.EC.String("meta.versionId", curVersionIdStr),
+	)
+	if !hasVersionId {
+		selector.Set(bson.EC.SubDocumentFromElements("meta.versionId", bson.EC.Boolean("$exists", false)))
+	}
+	info, err := ms.CurrentVersionCollection(resourceType).ReplaceOne(context.TODO(), selector, resource, ms.session)
+	if err != nil {
+		return errors.Wrap(convertMongoErr(err), "failed to update current version")
+	} else if info.ModifiedCount == 0 {
+		return ErrConflict{msg: fmt.Sprintf("conflicting update of %s/%s during import", resourceType, resource.Id())}
+	}
+	return nil
+}
+
+func (imp *bulkImporter) lineFailed(lineNumber int, err error) {
+	imp.failed++
+	location := fmt.Sprintf("line %d", lineNumber)
+	if imp.source != "" {
+		location = fmt.Sprintf("%s line %d", imp.source, lineNumber)
+	}
+	outcome := models.NewOperationOutcome("error", "processing", fmt.Sprintf("%s: %s", location, err))
+	outcome.Issue[0].Location = []string{location}
+	imp.report(outcome)
+}
+
+func (imp *bulkImporter) report(outcome *models.OperationOutcome) {
+	err := imp.encoder.Encode(outcome)
+	if err != nil {
+		panic(errors.Wrap(err, "failed to write import report"))
+	}
+}
+
+func (imp *bulkImporter) summary() *models.OperationOutcome {
+	var resourceTypes []string
+	total := 0
+	for resourceType, count := range imp.counts {
+		resourceTypes = append(resourceTypes, resourceType)
+		total += count
+	}
+	sort.Strings(resourceTypes)
+
+	var counts []string
+	for _, resourceType := range resourceTypes {
+		counts = append(counts, fmt.Sprintf("%s: %d", resourceType, imp.counts[resourceType]))
+	}
+	message := fmt.Sprintf("imported %d resources", total)
+	if len(counts) > 0 {
+		message += " (" + strings.Join(counts, ", ") + ")"
+	}
+
+	if imp.failed > 0 {
+		return models.NewOperationOutcome("warning", "incomplete", fmt.Sprintf("%s; %d lines failed", message, imp.failed))
+	}
+	return models.NewOperationOutcome("information", "informational", message)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/pkg/errors"
+)
+
+// transactionOrder works out the order in which to process the entries of a transaction (already sorted
+// by request method) so that each entry is processed after the entries it depends on:
+//
+//   - entries whose fullUrl is a temp ID in its conditional URL (e.g. Observation?subject=urn:uuid:...)
+//     or in the query of one of its conditional references, as their IDs have to be known
+//   - conditional creates and updates whose fullUrl is referenced by its resource, as their IDs are only
+//     known once they are resolved (IDs of unconditional creates are assigned up-front)
+//   - entries changing resources of the type of one of its conditional references (e.g. Patient?identifier=123),
+//     as conditional references can match resources created or updated earlier in the transaction
+//
+// Entries keep their relative order unless a dependency requires otherwise. Circular dependencies are an error.
+func transactionOrder(entries []*models2.ShallowBundleEntryComponent) ([]int, error) {
+	byFullUrl := make(map[string]int)
+	for i, entry := range entries {
+		if entry.FullUrl != "" {
+			byFullUrl[entry.FullUrl] = i
+		}
+	}
+
+	dependencies := make([]map[int]bool, len(entries))
+	for i, entry := range entries {
+		dependencies[i] = make(map[int]bool)
+		dependOn := func(j int) {
+			if j != i {
+				dependencies[i][j] = true
+			}
+		}
+		dependOnTempIDs := func(str string) {
+			for _, tempID := range findTempIDs(str) {
+				if j, found := byFullUrl[tempID]; found {
+					dependOn(j)
+				}
+			}
+		}
+
+		if entry.Response != nil {
+			continue
+		}
+		if isConditional(entry) {
+			dependOnTempIDs(entry.Request.Url)
+		}
+		dependOnTempIDs(entry.Request.IfNoneExist)
+
+		references, err := entry.GetReferences()
+		if err != nil {
+			return nil, err
+		}
+		for _, reference := range references {
+			if j, found := byFullUrl[reference]; found && hasConditionalID(entries[j]) {
+				dependOn(j)
+			}
+
+			queryPos := strings.Index(reference, "?")
+			if queryPos >= 0 {
+				dependOnTempIDs(reference[queryPos+1:])
+
+				resourceType := reference[0:queryPos]
+				for j, other := range entries {
+					if other.Response == nil && other.Request.Method != "GET" && entryResourceType(other) == resourceType {
+						dependOn(j)
+					}
+				}
+			}
+		}
+	}
+
+	// Repeatedly take the first entry whose dependencies have all been taken
+	order := make([]int, 0, len(entries))
+	taken := make([]bool, len(entries))
+	for len(order) < len(entries) {
+		next := -1
+		for i := range entries {
+			if taken[i] {
+				continue
+			}
+			ready := true
+			for j := range dependencies[i] {
+				if !taken[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+
+		if next < 0 {
+			var remaining []string
+			for i, entry := range entries {
+				if !taken[i] {
+					remaining = append(remaining, entry.FullUrl)
+				}
+			}
+			return nil, errors.Errorf("circular dependencies between transaction entries (%s)", strings.Join(remaining, ", "))
+		}
+
+		taken[next] = true
+		order = append(order, next)
+	}
+
+	return order, nil
+}
+
+// hasConditionalID checks whether the ID of an entry's resource is only known once the entry is resolved
+func hasConditionalID(entry *models2.ShallowBundleEntryComponent) bool {
+	if entry.Response != nil {
+		return false
+	}
+	return (entry.Request.Method == "POST" && len(entry.Request.IfNoneExist) > 0) ||
+		(entry.Request.Method == "PUT" && isConditional(entry))
+}
+
+// entryResourceType returns the type of the resources an entry's request acts on
+func entryResourceType(entry *models2.ShallowBundleEntryComponent) string {
+	resourceType := entry.Request.Url
+	if pos := strings.IndexAny(resourceType, "/?"); pos >= 0 {
+		resourceType = resourceType[0:pos]
+	}
+	return resourceType
+}
+
+var tempIDsRegexp = regexp.MustCompile("[=,]((urn:uuid:|urn%3Auuid%3A)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})(&|,|$)")
+
+// findTempIDs returns the temp IDs (fullUrls of other entries) in a conditional URL or query
+func findTempIDs(str string) (tempIDs []string) {
+	for _, match := range tempIDsRegexp.FindAllStringSubmatch(str, -1) {
+		tempID, err := url.QueryUnescape(match[1])
+		if err == nil {
+			tempIDs = append(tempIDs, tempID)
+		}
+	}
+	return
+}
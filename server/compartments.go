@@ -0,0 +1,296 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/utils"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// EverythingQuery describes a $everything operation on a Patient or Encounter, which returns the resources
+// in its compartment and those they refer to
+type EverythingQuery struct {
+	Compartment   string
+	Id            string
+	ResourceTypes []string
+	Since         *time.Time
+	Count         int
+	Offset        int
+
+	// the _type, _summary and _elements parameters as given
+	typeParam  string
+	projection search.URLQueryParameters
+}
+
+// ParseEverythingQuery parses the parameters of a $everything operation.  Parameters other than _since,
+// _type, _count, _offset, _summary and _elements are ignored.
+func ParseEverythingQuery(compartment, id, rawQuery string) (EverythingQuery, error) {
+	query := EverythingQuery{
+		Compartment: compartment,
+		Id:          id,
+		Count:       search.NewQueryOptions().Count,
+	}
+
+	params, err := search.ParseQuery(rawQuery)
+	if err != nil {
+		return query, invalidParamError(fmt.Sprintf("failed to parse query string: %s", err))
+	}
+
+	resourceTypes := everythingResourceTypes(compartment)
+	inCompartment := make(map[string]bool)
+	for _, resourceType := range resourceTypes {
+		inCompartment[resourceType] = true
+	}
+
+	for _, param := range params.All() {
+		switch param.Key {
+		case HistorySinceParam:
+			since, err := utils.ParseDate(param.Value)
+			if err != nil {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid: %v", param.Key, err))
+			}
+			sinceTime := since.RangeLowIncl()
+			query.Since = &sinceTime
+		case search.TypeParam:
+			query.typeParam = param.Value
+			for _, resourceType := range strings.Split(param.Value, ",") {
+				resourceType = strings.TrimSpace(resourceType)
+				if !inCompartment[resourceType] {
+					return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid: %s resources are not in the %s compartment", param.Key, resourceType, compartment))
+				}
+				query.ResourceTypes = append(query.ResourceTypes, resourceType)
+			}
+		case search.CountParam:
+			query.Count, err = strconv.Atoi(param.Value)
+			if err != nil || query.Count < 1 {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid", param.Key))
+			}
+		case search.OffsetParam:
+			query.Offset, err = strconv.Atoi(param.Value)
+			if err != nil || query.Offset < 0 {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid", param.Key))
+			}
+		case search.SummaryParam, search.ElementsParam:
+			query.projection.Add(param.Key, param.Value)
+		}
+	}
+
+	if query.ResourceTypes == nil {
+		query.ResourceTypes = resourceTypes
+	}
+	return query, nil
+}
+
+// URLQueryParameters returns the parameters of the query, used to build paging links
+func (q EverythingQuery) URLQueryParameters() search.URLQueryParameters {
+	var params search.URLQueryParameters
+	if q.Since != nil {
+		params.Set(HistorySinceParam, q.Since.Format(time.RFC3339Nano))
+	}
+	if q.typeParam != "" {
+		params.Set(search.TypeParam, q.typeParam)
+	}
+	for _, param := range q.projection.All() {
+		params.Add(param.Key, param.Value)
+	}
+	return params
+}
+
+// everythingCompartments returns the compartments whose resources are returned by $everything: a Patient's
+// everything also includes the compartments of its Encounters, so that e.g. Observations that only refer
+// to an Encounter are found
+func everythingCompartments(compartment string) []string {
+	if compartment == "Patient" {
+		return []string{"Patient", "Encounter"}
+	}
+	return []string{compartment}
+}
+
+// everythingResourceTypes returns the resource types returned by $everything, starting with the
+// compartment's own type
+func everythingResourceTypes(compartment string) []string {
+	var resourceTypes []string
+	seen := make(map[string]bool)
+	for _, c := range everythingCompartments(compartment) {
+		for _, resourceType := range search.CompartmentResourceTypes(c) {
+			if !seen[resourceType] {
+				seen[resourceType] = true
+				resourceTypes = append(resourceTypes, resourceType)
+			}
+		}
+	}
+	return resourceTypes
+}
+
+// everything returns a page of the resources in the compartments of a $everything query, grouped by
+// resource type, followed by the resources they refer to.  The compartment's own resource must exist.
+func everything(session DataAccessSession, baseURL url.URL, linkURL url.URL, query EverythingQuery) (*models2.ShallowBundle, error) {
+	if _, err := session.Get(query.Id, query.Compartment); err != nil {
+		return nil, err
+	}
+
+	compartmentIDs := map[string][]string{query.Compartment: []string{query.Id}}
+	if query.Compartment == "Patient" {
+		encounterIDs, err := compartmentMemberIDs(session, baseURL, "Patient", query.Id, "Encounter")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find the patient's encounters")
+		}
+		compartmentIDs["Encounter"] = encounterIDs
+	}
+
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	// Each resource type is counted, so only the types on the requested page need to be searched
+	var entryList []models2.ShallowBundleEntryComponent
+	var included []*models2.Resource
+	found := make(map[string]bool)
+	total := 0
+	for _, resourceType := range query.ResourceTypes {
+		var filters []string
+		for _, compartment := range everythingCompartments(query.Compartment) {
+			if filter := search.CompartmentFilter(compartment, resourceType, compartmentIDs[compartment]); filter != "" {
+				filters = append(filters, filter)
+			}
+		}
+		if len(filters) == 0 {
+			continue
+		}
+		var params search.URLQueryParameters
+		params.Add(search.FilterParam, strings.Join(filters, " or "))
+		if query.Since != nil {
+			params.Add(search.LastUpdatedParam, "ge"+query.Since.Format(time.RFC3339Nano))
+		}
+
+		typeTotal, err := countResources(session, baseURL, resourceType, params)
+		if err != nil {
+			return nil, err
+		}
+		typeOffset := query.Offset - total
+		total += typeTotal
+		if typeOffset >= typeTotal || len(entryList) >= query.Count {
+			continue
+		}
+		if typeOffset < 0 {
+			typeOffset = 0
+		}
+
+		params.Add(search.SortParam, search.IDParam)
+		params.Add(search.OffsetParam, strconv.Itoa(typeOffset))
+		params.Add(search.CountParam, strconv.Itoa(query.Count-len(entryList)))
+		params.Add(search.IncludeParam, "*")
+		for _, param := range query.projection.All() {
+			params.Add(param.Key, param.Value)
+		}
+		bundle, err := session.Search(baseURL, search.Query{Resource: resourceType, Query: params.Encode()})
+		if err != nil {
+			return nil, errors.Wrapf(err, "search of %s resources failed", resourceType)
+		}
+		for _, entry := range bundle.Entry {
+			if entry.Search == nil || entry.Search.Mode != "match" {
+				included = append(included, entry.Resource)
+				continue
+			}
+			found[resourceType+"/"+entry.Resource.Id()] = true
+			entryList = append(entryList, models2.ShallowBundleEntryComponent{
+				Resource: entry.Resource,
+				FullUrl:  baseURLstr + resourceType + "/" + entry.Resource.Id(),
+				Search:   &models.BundleEntrySearchComponent{Mode: "match"},
+			})
+		}
+	}
+	numResults := len(entryList)
+
+	for _, resource := range included {
+		key := resource.ResourceType() + "/" + resource.Id()
+		if found[key] {
+			continue
+		}
+		found[key] = true
+		entryList = append(entryList, models2.ShallowBundleEntryComponent{
+			Resource: resource,
+			FullUrl:  baseURLstr + key,
+			Search:   &models.BundleEntrySearchComponent{Mode: "include"},
+		})
+	}
+
+	totalResults := uint32(total)
+	bundle := models2.ShallowBundle{
+		Id:    objectid.New().Hex(),
+		Type:  "searchset",
+		Entry: entryList,
+		Total: &totalResults,
+	}
+	bundle.Link = newPagingLinks(linkURL, query.URLQueryParameters(), query.Offset, query.Count, totalResults, uint32(numResults), true, nil)
+
+	return &bundle, nil
+}
+
+// countResources returns the number of resources of a type matching the search parameters
+func countResources(session DataAccessSession, baseURL url.URL, resourceType string, params search.URLQueryParameters) (int, error) {
+	countParams := params.Without(search.SummaryParam)
+	countParams.Add(search.SummaryParam, "count")
+	bundle, err := session.Search(baseURL, search.Query{Resource: resourceType, Query: countParams.Encode()})
+	if err != nil {
+		return 0, errors.Wrapf(err, "count of %s resources failed", resourceType)
+	}
+	if bundle.Total == nil {
+		return 0, errors.Errorf("count of %s resources has no total", resourceType)
+	}
+	return int(*bundle.Total), nil
+}
+
+// compartmentMemberIDs returns the ids of the resources of a type in the compartment of a resource
+func compartmentMemberIDs(session DataAccessSession, baseURL url.URL, compartment, id, resourceType string) ([]string, error) {
+	var params search.URLQueryParameters
+	params.Add(search.FilterParam, search.CompartmentFilter(compartment, resourceType, []string{id}))
+	count, err := countResources(session, baseURL, resourceType, params)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	params.Set(search.CountParam, strconv.Itoa(count))
+	return session.FindIDs(search.Query{Resource: resourceType, Query: params.Encode()})
+}
+
+// compartmentLink returns a paging link of a compartment search relative to the compartment's URL, without
+// the _filter parameter that restricted the search to the compartment
+func compartmentLink(compartmentURL url.URL, link string, filter string) string {
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	params, err := search.ParseQuery(linkURL.RawQuery)
+	if err != nil {
+		return link
+	}
+
+	// the compartment's filter was added after the request's parameters
+	all := params.All()
+	removed := -1
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Key == search.FilterParam && all[i].Value == filter {
+			removed = i
+			break
+		}
+	}
+	var kept search.URLQueryParameters
+	for i, param := range all {
+		if i != removed {
+			kept.Add(param.Key, param.Value)
+		}
+	}
+
+	compartmentURL.RawQuery = kept.Encode()
+	return compartmentURL.String()
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/gin-gonic/gin"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+// CompartmentSuite tests $everything and compartment searches against the in-memory data access layer,
+// so runs without MongoDB
+type CompartmentSuite struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&CompartmentSuite{})
+
+func (s *CompartmentSuite) SetUpTest(c *C) {
+	config := DefaultConfig
+	config.CountTotalResults = true
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMemoryDataAccessLayer("fhir", false, "", make(map[string]InterceptorList), config), config)
+	s.server = httptest.NewServer(engine)
+}
+
+func (s *CompartmentSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *CompartmentSuite) post(c *C, resourceType string, body string) string {
+	res, err := http.Post(s.server.URL+"/"+resourceType, "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	return resourceIdFromLocation(res)
+}
+
+func (s *CompartmentSuite) TestEverything(c *C) {
+	patientID := s.post(c, "Patient", `{"resourceType":"Patient","gender":"female"}`)
+	s.post(c, "Observation", fmt.Sprintf(`{"resourceType":"Observation","status":"final","code":{"text":"weight"},"subject":{"reference":"Patient/%s"}}`, patientID))
+	everythingURL := s.server.URL + "/Patient/" + patientID + "/$everything"
+
+	bundle := assertBundleCount(c, everythingURL, 2, 2)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.server.URL+"/Patient/"+patientID)
+	c.Assert(bundle.Entry[1].Resource, FitsTypeOf, &models.Observation{})
+	c.Assert(bundle.Link[0].Url, Equals, everythingURL+"?_offset=0&_count=100")
+
+	// the Patient isn't on the second page, so is included as the Observation refers to it
+	bundle = assertBundleCount(c, everythingURL+"?_count=1&_offset=1", 2, 2)
+	c.Assert(bundle.Entry[0].Search.Mode, Equals, "match")
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "include")
+	c.Assert(bundle.Entry[1].FullUrl, Equals, s.server.URL+"/Patient/"+patientID)
+}
+
+func (s *CompartmentSuite) TestCompartmentSearchLinks(c *C) {
+	patientID := s.post(c, "Patient", `{"resourceType":"Patient","gender":"female"}`)
+	for _, code := range []string{"weight", "height"} {
+		s.post(c, "Observation", fmt.Sprintf(`{"resourceType":"Observation","status":"final","code":{"text":"%s"},"subject":{"reference":"Patient/%s"}}`, code, patientID))
+	}
+	s.post(c, "Observation", `{"resourceType":"Observation","status":"final","code":{"text":"weight"},"subject":{"reference":"Patient/other"}}`)
+	searchURL := s.server.URL + "/Patient/" + patientID + "/Observation"
+
+	bundle := assertBundleCount(c, searchURL+"?status=final&_count=1", 1, 2)
+	c.Assert(bundle.Entry[0].FullUrl, Matches, s.server.URL+"/Observation/.*")
+	for _, link := range bundle.Link {
+		c.Assert(link.Url, Matches, searchURL+`\?status=final&.*`)
+		c.Assert(link.Url, Not(Matches), ".*_filter.*")
+	}
+	assertPagingLink(c, bundle.Link[0], "self", 1, 0)
+	assertPagingLink(c, bundle.Link[2], "next", 1, 1)
+
+	// the next page excludes the other patient's Observation
+	bundle = assertBundleCount(c, bundle.Link[2].Url, 1, 2)
+	c.Assert(len(bundle.Link), Equals, 4)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// notModified implements the If-None-Match and If-Modified-Since preconditions of a conditional read
+// (http://hl7.org/fhir/http.html#cread), returning true if the client's cached copy is still current.
+// etagValue is the value within the weak ETag of the current representation, and lastModified its
+// last modification time (or the zero time if unknown).  As in RFC 7232, If-Modified-Since is
+// ignored when If-None-Match is present.
+func notModified(c *gin.Context, etagValue string, lastModified time.Time) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		if etagValue == "" {
+			return false
+		}
+		for _, etag := range strings.Split(ifNoneMatch, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" {
+				return true
+			}
+			value, err := utils.ETagToVersionId(etag)
+			if err == nil && value == etagValue {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := c.GetHeader("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			// invalid dates are ignored
+			return false
+		}
+		// HTTP dates only have a precision of seconds
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// setSearchETag sets the ETag header of a search response and returns its value for use with notModified.
+// The ETag is a hash of the ids and versions of the resources in the bundle, so it changes whenever a resource
+// is added, updated or removed.
+func setSearchETag(c *gin.Context, bundle *models2.ShallowBundle) string {
+	hash := sha1.New()
+	if bundle.Total != nil {
+		fmt.Fprintf(hash, "total:%d\n", *bundle.Total)
+	}
+	for _, entry := range bundle.Entry {
+		if entry.Resource == nil {
+			continue
+		}
+		mode := ""
+		if entry.Search != nil {
+			mode = entry.Search.Mode
+		}
+		fmt.Fprintf(hash, "%s/%s/%s/%s\n", entry.Resource.ResourceType(), entry.Resource.Id(), entry.Resource.VersionId(), mode)
+	}
+	etagValue := hex.EncodeToString(hash.Sum(nil))
+
+	c.Header("ETag", "W/\""+etagValue+"\"")
+	return etagValue
+}
+
+// searchLastModified returns when the results of a search last changed, for use with notModified. That is the
+// latest meta.lastUpdated of the resources in the bundle, or now if resources of the given type (of any type if
+// it's "") were created, updated or deleted after the If-Modified-Since date, as that can change the results
+// without changing the resources in them. The zero time, for which If-Modified-Since is ignored, is returned
+// when history is disabled, as deletions then aren't recorded, and when If-Modified-Since won't be used.
+func searchLastModified(c *gin.Context, session DataAccessSession, enableHistory bool, resourceType string, bundle *models2.ShallowBundle) (time.Time, error) {
+	ifModifiedSince := c.GetHeader("If-Modified-Since")
+	if !enableHistory || ifModifiedSince == "" || c.GetHeader("If-None-Match") != "" ||
+		(c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+		return time.Time{}, nil
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return time.Time{}, nil
+	}
+
+	var lastModified time.Time
+	for _, entry := range bundle.Entry {
+		if entry.Resource != nil && entry.Resource.LastUpdated() != "" && entry.Resource.LastUpdatedTime().After(lastModified) {
+			lastModified = entry.Resource.LastUpdatedTime()
+		}
+	}
+	// HTTP dates only have a precision of seconds
+	changedSince := since.Add(time.Second)
+	if !lastModified.Before(changedSince) {
+		return lastModified, nil
+	}
+
+	changes, err := session.History(url.URL{}, HistoryQuery{ResourceType: resourceType, Since: &changedSince, Count: 1})
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "history of changes since If-Modified-Since failed")
+	}
+	if changes.Total != nil && *changes.Total > 0 {
+		return time.Now(), nil
+	}
+	return lastModified, nil
+}
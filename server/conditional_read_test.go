@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+// ConditionalSearchSuite tests If-Modified-Since on searches against the in-memory data access layer,
+// so runs without MongoDB
+type ConditionalSearchSuite struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&ConditionalSearchSuite{})
+
+func (s *ConditionalSearchSuite) SetUpTest(c *C) {
+	config := DefaultConfig
+	config.EnableHistory = true
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMemoryDataAccessLayer("fhir", false, "", make(map[string]InterceptorList), config), config)
+	s.server = httptest.NewServer(engine)
+}
+
+func (s *ConditionalSearchSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *ConditionalSearchSuite) post(c *C, resourceType string, body string) string {
+	res, err := http.Post(s.server.URL+"/"+resourceType, "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	return resourceIdFromLocation(res)
+}
+
+func (s *ConditionalSearchSuite) getModifiedSince(c *C, url string, since time.Time) int {
+	req, err := http.NewRequest("GET", url, nil)
+	util.CheckErr(err)
+	req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res.StatusCode
+}
+
+func (s *ConditionalSearchSuite) TestIfModifiedSince(c *C) {
+	s.post(c, "Patient", `{"resourceType":"Patient","gender":"male"}`)
+	deletedID := s.post(c, "Patient", `{"resourceType":"Patient","gender":"male"}`)
+	observationID := s.post(c, "Observation", `{"resourceType":"Observation","status":"final","code":{"text":"weight"}}`)
+	searchURL := s.server.URL + "/Patient?gender=male"
+	since := time.Now().Truncate(time.Second)
+
+	c.Assert(s.getModifiedSince(c, searchURL, since), Equals, 304)
+	c.Assert(s.getModifiedSince(c, searchURL, since.Add(-time.Hour)), Equals, 200)
+
+	// wait for changes to be after the If-Modified-Since date
+	time.Sleep(time.Until(since.Add(time.Second)))
+
+	// changes of other types of resources don't matter, unless they're included
+	req, err := http.NewRequest("DELETE", s.server.URL+"/Observation/"+observationID, nil)
+	util.CheckErr(err)
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 204)
+	c.Assert(s.getModifiedSince(c, searchURL, since), Equals, 304)
+	c.Assert(s.getModifiedSince(c, searchURL+"&_revinclude=Observation:subject", since), Equals, 200)
+
+	// deleting a match leaves the remaining ones unchanged, but not the results
+	req, err = http.NewRequest("DELETE", s.server.URL+"/Patient/"+deletedID, nil)
+	util.CheckErr(err)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 204)
+	c.Assert(s.getModifiedSince(c, searchURL, since), Equals, 200)
+}
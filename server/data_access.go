@@ -3,7 +3,9 @@ package server
 import (
 	"errors"
 	"net/url"
+	"regexp"
 
+	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
 )
@@ -25,6 +27,9 @@ type DataAccessSession interface {
 	Get(id, resourceType string) (resource *models2.Resource, err error)
 	// GetVersion retrieves a single resource instance identified by its resource type, ID and versionId
 	GetVersion(id, versionId, resourceType string) (resource *models2.Resource, err error)
+	// GetSubset retrieves a resource like Get, or like GetVersion if the versionId isn't empty, with only the
+	// elements chosen by the projection (from _summary or _elements).  The resource is tagged as SUBSETTED.
+	GetSubset(id, versionId, resourceType string, projection *search.ElementsProjection) (resource *models2.Resource, err error)
 	// Post creates a resource instance, returning its new ID.
 	Post(resource *models2.Resource) (id string, err error)
 	// ConditionalPost creates a resource if the query finds no matches
@@ -48,8 +53,9 @@ type DataAccessSession interface {
 	// search options that don't make sense in this context: _include, _revinclude, _summary, _elements, _contained,
 	// and _containedType.  It honors search options such as _count, _sort, and _offset.
 	FindIDs(searchQuery search.Query) (result []string, err error)
-	// History executes the history operation (partial support)
-	History(baseURL url.URL, resoureType string, id string) (bundle *models2.ShallowBundle, err error)
+	// History executes the history interaction for a resource instance, a resource type or the whole system.
+	// The baseURL is the server's base URL, used to build the fullUrl of each entry and the paging links.
+	History(baseURL url.URL, query HistoryQuery) (bundle *models2.ShallowBundle, err error)
 }
 
 // ErrNotFound indicates that the resource was not found (HTTP 404)
@@ -75,3 +81,37 @@ type ErrConflict struct {
 func (e ErrConflict) Error() string {
 	return e.msg
 }
+
+// ErrInvalidResource indicates that a resource can't be stored because of its content (HTTP 422)
+type ErrInvalidResource struct {
+	msg string
+}
+func (e ErrInvalidResource) Error() string {
+	return e.msg
+}
+
+var fhirIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// isValidFhirID checks whether an id is valid according to the FHIR id datatype
+func isValidFhirID(id string) bool {
+	return fhirIDRegex.MatchString(id)
+}
+
+func invalidFhirIDError() error {
+	return models.NewOperationOutcome("fatal", "exception", "Id must be a valid FHIR id")
+}
+
+// getAndSubset implements GetSubset for data access layers that subset resources after reading them
+func getAndSubset(session DataAccessSession, id, versionId, resourceType string, projection *search.ElementsProjection) (*models2.Resource, error) {
+	var resource *models2.Resource
+	var err error
+	if versionId == "" {
+		resource, err = session.Get(id, resourceType)
+	} else {
+		resource, err = session.GetVersion(id, versionId, resourceType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resource.Subset(projection.Keeps)
+}
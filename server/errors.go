@@ -1,13 +1,16 @@
 package server
 
 import (
+	"context"
 	"os"
 	"fmt"
 	"net/http"
 	runtime_debug "runtime/debug"
+	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/patch"
 	"github.com/eug48/fhir/search"
 )
 
@@ -19,12 +22,20 @@ func ErrorToOpOutcome(err interface{}) (statusCode int, outcome *models.Operatio
 		cause := errors.Cause(x)
 		_, isSchemaError := cause.(models2.FhirSchemaError)
 		_, isVersionConflict := cause.(ErrConflict)
-		if isSchemaError {
+		_, isPatchError := cause.(patch.Error)
+		_, isInvalidResource := cause.(ErrInvalidResource)
+		if cause == context.Canceled {
+			outcome := models.NewOperationOutcome("error", "lock-error", x.Error())
+			return http.StatusLocked, outcome
+		} else if isSchemaError {
 			outcome := models.NewOperationOutcome("fatal", "structure", cause.Error())
 			return http.StatusBadRequest, outcome
 		} else if isVersionConflict {
 			outcome := models.NewOperationOutcome("error", "conflict", cause.Error())
 			return http.StatusConflict, outcome // TODO (FHIR R4): changed to 412
+		} else if isPatchError || isInvalidResource {
+			outcome := models.NewOperationOutcome("error", "processing", cause.Error())
+			return http.StatusUnprocessableEntity, outcome
 		} else {
 			stacktrace := "    " + string(runtime_debug.Stack())
 			fmt.Fprintf(os.Stderr, "handlePanics: recovered: %+v\n%s", x, stacktrace)
@@ -41,3 +52,12 @@ func ErrorToOpOutcome(err interface{}) (statusCode int, outcome *models.Operatio
 		return http.StatusInternalServerError, outcome
 	}
 }
+
+// checkRequestActive returns an error if the request's context has been cancelled, e.g. by the
+// X-Mutex-Name middleware after the request's lock was lost, so that it makes no further changes
+func checkRequestActive(c *gin.Context) error {
+	if err := c.Request.Context().Err(); err != nil {
+		return errors.Wrap(err, "request cancelled (its X-Mutex-Name lock may have been lost)")
+	}
+	return nil
+}
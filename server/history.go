@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/utils"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HistorySinceParam only includes versions created at or after the given instant
+	HistorySinceParam = "_since"
+	// HistoryAtParam only includes versions that were current at some point during the given period
+	HistoryAtParam = "_at"
+)
+
+// HistoryQuery describes a history interaction (http://hl7.org/fhir/http.html#history).
+// An empty Id requests the history of all resources of a type, and an empty ResourceType
+// the history of the whole system.
+type HistoryQuery struct {
+	ResourceType string
+	Id           string
+	Since        *time.Time
+	At           *utils.Date
+	Count        int
+	Offset       int
+}
+
+// ParseHistoryQuery parses the parameters of a history interaction.  Parameters other than
+// _since, _at, _count and _offset are ignored.
+func ParseHistoryQuery(resourceType, id, rawQuery string) (HistoryQuery, error) {
+	query := HistoryQuery{
+		ResourceType: resourceType,
+		Id:           id,
+		Count:        search.NewQueryOptions().Count,
+	}
+
+	params, err := search.ParseQuery(rawQuery)
+	if err != nil {
+		return query, invalidParamError(fmt.Sprintf("failed to parse query string: %s", err))
+	}
+
+	for _, param := range params.All() {
+		switch param.Key {
+		case HistorySinceParam:
+			since, err := utils.ParseDate(param.Value)
+			if err != nil {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid: %v", param.Key, err))
+			}
+			sinceTime := since.RangeLowIncl()
+			query.Since = &sinceTime
+		case HistoryAtParam:
+			query.At, err = utils.ParseDate(param.Value)
+			if err != nil {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid: %v", param.Key, err))
+			}
+		case search.CountParam:
+			query.Count, err = strconv.Atoi(param.Value)
+			if err != nil || query.Count < 1 {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid", param.Key))
+			}
+		case search.OffsetParam:
+			query.Offset, err = strconv.Atoi(param.Value)
+			if err != nil || query.Offset < 0 {
+				return query, invalidParamError(fmt.Sprintf("Parameter \"%s\" content is invalid", param.Key))
+			}
+		}
+	}
+	return query, nil
+}
+
+func invalidParamError(display string) *search.Error {
+	return &search.Error{
+		HTTPStatus:       http.StatusBadRequest,
+		OperationOutcome: models.CreateOpOutcome("error", "processing", "MSG_PARAM_INVALID", display),
+	}
+}
+
+// URLQueryParameters returns the parameters of the query, used to build paging links
+func (q HistoryQuery) URLQueryParameters() search.URLQueryParameters {
+	var params search.URLQueryParameters
+	if q.Since != nil {
+		params.Set(HistorySinceParam, q.Since.Format(time.RFC3339Nano))
+	}
+	if q.At != nil {
+		params.Set(HistoryAtParam, q.At.String())
+	}
+	return params
+}
+
+// path returns the path of the history endpoint relative to the server's base URL
+func (q HistoryQuery) path() string {
+	switch {
+	case q.ResourceType == "":
+		return "_history"
+	case q.Id == "":
+		return q.ResourceType + "/_history"
+	default:
+		return q.ResourceType + "/" + q.Id + "/_history"
+	}
+}
+
+// historyVersion identifies one version of a resource
+type historyVersion struct {
+	resourceType string
+	id           string
+	versionId    int
+	lastUpdated  time.Time
+	deleted      bool
+}
+
+// matches returns whether a version is included in the history, given when it was replaced by the
+// next version of the resource (nil if it hasn't been).  Data access layers that can't call this
+// apply the same conditions in their queries.
+func (q HistoryQuery) matches(version historyVersion, replaced *time.Time) bool {
+	if q.Since != nil && version.lastUpdated.Before(*q.Since) {
+		return false
+	}
+	if q.At != nil {
+		if !version.lastUpdated.Before(q.At.RangeHighExcl()) {
+			return false
+		}
+		// versions replaced before the _at period weren't current during it
+		if replaced != nil && !replaced.After(q.At.RangeLowIncl()) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortHistoryVersions sorts versions most recent first, breaking ties by resource and then version
+// so that pages don't overlap.  Data access layers sort their queries in the same order.
+func sortHistoryVersions(versions []historyVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if !a.lastUpdated.Equal(b.lastUpdated) {
+			return a.lastUpdated.After(b.lastUpdated)
+		}
+		if a.resourceType != b.resourceType {
+			return a.resourceType < b.resourceType
+		}
+		if a.id != b.id {
+			return a.id < b.id
+		}
+		return a.versionId > b.versionId
+	})
+}
+
+// limit returns the number of matching versions needed to fill the requested page
+func (q HistoryQuery) limit() int {
+	return q.Offset + q.Count
+}
+
+// page returns the versions on the requested page given the sorted matching versions, of which
+// there must be at least limit() if there are that many
+func (q HistoryQuery) page(sorted []historyVersion) []historyVersion {
+	if q.Offset >= len(sorted) {
+		return nil
+	}
+	end := q.limit()
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	return sorted[q.Offset:end]
+}
+
+// newHistoryBundle returns a history bundle for a page of versions, calling loadVersion to fetch
+// the resources of versions that aren't deletions
+func newHistoryBundle(baseURL url.URL, query HistoryQuery, page []historyVersion, total int, loadVersion func(historyVersion) (*models2.Resource, error)) (*models2.ShallowBundle, error) {
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	entryList := make([]models2.ShallowBundleEntryComponent, 0, len(page))
+	for _, version := range page {
+		var entry models2.ShallowBundleEntryComponent
+		entry.FullUrl = baseURLstr + version.resourceType + "/" + version.id
+		entry.Request = &models.BundleEntryRequestComponent{
+			Url: version.resourceType + "/" + version.id,
+		}
+
+		switch {
+		case version.deleted:
+			entry.Request.Method = "DELETE"
+		case version.versionId <= 1:
+			// first version (or one created before versioning was enabled)
+			entry.Request.Method = "POST"
+			entry.Request.Url = version.resourceType
+		default:
+			entry.Request.Method = "PUT"
+		}
+
+		if !version.deleted {
+			var err error
+			entry.Resource, err = loadVersion(version)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to load %s/%s version %d", version.resourceType, version.id, version.versionId)
+			}
+		}
+		entryList = append(entryList, entry)
+	}
+
+	totalDocs := uint32(total)
+	bundle := &models2.ShallowBundle{
+		Id:    objectid.New().Hex(),
+		Type:  "history",
+		Entry: entryList,
+		Total: &totalDocs,
+	}
+
+	linkURL, err := url.Parse(baseURLstr + query.path())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build history link")
+	}
+	bundle.Link = newPagingLinks(*linkURL, query.URLQueryParameters(), query.Offset, query.Count, totalDocs, uint32(len(entryList)), true, nil)
+
+	return bundle, nil
+}
+
+// historyResourceTypes returns the resource types included in whole-system history
+func historyResourceTypes() []string {
+	collections := make(map[string]bool)
+	for _, name := range models2.AllFhirResourceCollectionNames() {
+		collections[name] = true
+	}
+
+	var resourceTypes []string
+	for resourceType := range search.SearchParameterDictionary {
+		if collections[models.PluralizeLowerResourceName(resourceType)] {
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HistorySuite struct{}
+
+var _ = Suite(&HistorySuite{})
+
+func historyTestTime(c *C, value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	c.Assert(err, IsNil)
+	return t
+}
+
+func (s *HistorySuite) versions(c *C) []historyVersion {
+	return []historyVersion{
+		{resourceType: "Patient", id: "a", versionId: 1, lastUpdated: historyTestTime(c, "2018-01-15T00:00:00Z")},
+		{resourceType: "Patient", id: "a", versionId: 2, lastUpdated: historyTestTime(c, "2018-03-15T00:00:00Z")},
+		{resourceType: "Patient", id: "a", versionId: 3, lastUpdated: historyTestTime(c, "2018-05-15T00:00:00Z"), deleted: true},
+		{resourceType: "Patient", id: "b", versionId: 1, lastUpdated: historyTestTime(c, "2018-02-15T00:00:00Z")},
+		{resourceType: "Observation", id: "c", versionId: 1, lastUpdated: historyTestTime(c, "2018-04-15T00:00:00Z")},
+	}
+}
+
+func describeVersions(versions []historyVersion) []string {
+	var described []string
+	for _, version := range versions {
+		described = append(described, version.resourceType+"/"+version.id+"/"+version.lastUpdated.Format("01"))
+	}
+	return described
+}
+
+func (s *HistorySuite) TestParseHistoryQuery(c *C) {
+	query, err := ParseHistoryQuery("Patient", "", "_since=2018-03-01T10:00:00Z&_at=2018-02&_count=5&_offset=10&_format=json")
+	c.Assert(err, IsNil)
+	c.Assert(query.Since.Equal(historyTestTime(c, "2018-03-01T10:00:00Z")), Equals, true)
+	c.Assert(query.At.String(), Equals, "2018-02")
+	c.Assert(query.Count, Equals, 5)
+	c.Assert(query.Offset, Equals, 10)
+	c.Assert(query.path(), Equals, "Patient/_history")
+
+	_, err = ParseHistoryQuery("Patient", "", "_count=0")
+	c.Assert(err, NotNil)
+	_, err = ParseHistoryQuery("", "", "_since=yesterday")
+	c.Assert(err, NotNil)
+}
+
+// matching returns the versions matching a query, most recent first.  Each resource's versions are
+// listed in order, so a version is replaced by the next one of the same resource.
+func matching(query HistoryQuery, versions []historyVersion) []historyVersion {
+	var matches []historyVersion
+	for i, version := range versions {
+		var replaced *time.Time
+		if next := i + 1; next < len(versions) && versions[next].resourceType == version.resourceType && versions[next].id == version.id {
+			replaced = &versions[next].lastUpdated
+		}
+		if query.matches(version, replaced) {
+			matches = append(matches, version)
+		}
+	}
+	sortHistoryVersions(matches)
+	return matches
+}
+
+func (s *HistorySuite) TestPageSortsMostRecentFirst(c *C) {
+	query := HistoryQuery{Count: 2, Offset: 1}
+	matches := matching(query, s.versions(c))
+	c.Assert(matches, HasLen, 5)
+	c.Assert(describeVersions(query.page(matches)), DeepEquals, []string{"Observation/c/04", "Patient/a/03"})
+	c.Assert(query.limit(), Equals, 3)
+
+	// past the end
+	query.Offset = 5
+	c.Assert(query.page(matches), HasLen, 0)
+}
+
+func (s *HistorySuite) TestSortBreaksTiesByResourceAndVersion(c *C) {
+	lastUpdated := historyTestTime(c, "2018-01-15T00:00:00Z")
+	versions := []historyVersion{
+		{resourceType: "Patient", id: "b", versionId: 1, lastUpdated: lastUpdated},
+		{resourceType: "Patient", id: "a", versionId: 1, lastUpdated: lastUpdated},
+		{resourceType: "Observation", id: "c", versionId: 1, lastUpdated: lastUpdated},
+		{resourceType: "Patient", id: "a", versionId: 2, lastUpdated: lastUpdated},
+	}
+	sortHistoryVersions(versions)
+	var described []string
+	for _, version := range versions {
+		described = append(described, fmt.Sprintf("%s/%s/%d", version.resourceType, version.id, version.versionId))
+	}
+	c.Assert(described, DeepEquals, []string{"Observation/c/1", "Patient/a/2", "Patient/a/1", "Patient/b/1"})
+}
+
+func (s *HistorySuite) TestMatchesSince(c *C) {
+	since := historyTestTime(c, "2018-03-15T00:00:00Z")
+	matches := matching(HistoryQuery{Since: &since, Count: 10}, s.versions(c))
+	c.Assert(describeVersions(matches), DeepEquals, []string{"Patient/a/05", "Observation/c/04", "Patient/a/03"})
+}
+
+func (s *HistorySuite) TestMatchesAt(c *C) {
+	// versions current at some point in February: a's first version was only replaced in March
+	query, err := ParseHistoryQuery("", "", "_at=2018-02")
+	c.Assert(err, IsNil)
+	c.Assert(describeVersions(matching(query, s.versions(c))), DeepEquals, []string{"Patient/b/02", "Patient/a/01"})
+
+	// a's second version was still current in April, when c was created
+	query, err = ParseHistoryQuery("", "", "_at=2018-04")
+	c.Assert(err, IsNil)
+	c.Assert(describeVersions(matching(query, s.versions(c))), DeepEquals, []string{"Observation/c/04", "Patient/a/03", "Patient/b/02"})
+}
@@ -0,0 +1,582 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// In-memory storage, intended for embedding GoFHIR in tests and tools without a database.
+// Every version of a resource is kept as the JSON it was stored as; searches are evaluated
+// by a search.MemorySearcher. Operations on a database are serialised: each operation (or
+// transaction) holds the database's lock, and transactions are rolled back by restoring a
+// snapshot taken when they started.
+
+type memoryDataAccessLayer struct {
+	mutex             sync.Mutex
+	databases         map[string]*memoryDatabase
+	defaultDbName     string
+	enableMultiDB     bool
+	dbSuffix          string
+	Interceptors      map[string]InterceptorList
+	countTotalResults bool
+	enableCISearches  bool
+	enableHistory     bool
+}
+
+type memoryDatabase struct {
+	lock        sync.Mutex
+	collections map[string]*memoryCollection
+}
+
+type memoryCollection struct {
+	ids      []string                   // in the order resources were first created
+	versions map[string][]memoryVersion // oldest first
+}
+
+type memoryVersion struct {
+	versionId   int
+	lastUpdated time.Time
+	deleted     bool
+	jsonBytes   []byte
+}
+
+type memorySession struct {
+	dal           *memoryDataAccessLayer
+	db            *memoryDatabase
+	inTransaction bool
+	snapshot      map[string]*memoryCollection
+	holdsLock     bool
+}
+
+// NewMemoryDataAccessLayer returns an implementation of DataAccessLayer that keeps all data in memory
+func NewMemoryDataAccessLayer(defaultDbName string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
+	return &memoryDataAccessLayer{
+		databases:         make(map[string]*memoryDatabase),
+		defaultDbName:     defaultDbName,
+		enableMultiDB:     enableMultiDB,
+		dbSuffix:          dbSuffix,
+		Interceptors:      interceptors,
+		countTotalResults: config.CountTotalResults,
+		enableCISearches:  config.EnableCISearches,
+		enableHistory:     config.EnableHistory,
+	}
+}
+
+func (dal *memoryDataAccessLayer) StartSession(customDbName string) DataAccessSession {
+	var dbName string
+	if dal.enableMultiDB && customDbName != "" {
+		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
+			panic(errors.Errorf("database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
+		}
+		dbName = customDbName
+	} else {
+		dbName = dal.defaultDbName
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	db, exists := dal.databases[dbName]
+	if !exists {
+		db = &memoryDatabase{collections: make(map[string]*memoryCollection)}
+		dal.databases[dbName] = db
+	}
+
+	return &memorySession{
+		dal: dal,
+		db:  db,
+	}
+}
+
+func (ms *memorySession) debug(format string, a ...interface{}) {
+	// fmt.Printf("[memory] " + format + "\n", a...)
+}
+
+// lock acquires the database lock for a single operation, unless it is already held by this
+// session. The returned function releases it.
+func (ms *memorySession) lock() func() {
+	if ms.holdsLock {
+		return func() {}
+	}
+	ms.db.lock.Lock()
+	ms.holdsLock = true
+	return func() {
+		ms.holdsLock = false
+		ms.db.lock.Unlock()
+	}
+}
+
+func (ms *memorySession) StartTransaction() error {
+	if ms.inTransaction {
+		// sucess if already in a transaction
+		return nil
+	}
+
+	ms.db.lock.Lock()
+	ms.holdsLock = true
+	ms.inTransaction = true
+	ms.snapshot = ms.db.cloneCollections()
+	ms.debug("StartTransaction")
+	return nil
+}
+
+func (ms *memorySession) CommmitIfTransaction() error {
+	if ms.inTransaction {
+		ms.debug("CommmitTransaction")
+		ms.endTransaction()
+	}
+	return nil
+}
+
+func (ms *memorySession) Finish() {
+	if ms.inTransaction {
+		ms.debug("AbortTransaction called from memorySession.Finish")
+		ms.db.collections = ms.snapshot
+		ms.endTransaction()
+	}
+}
+
+func (ms *memorySession) endTransaction() {
+	ms.inTransaction = false
+	ms.snapshot = nil
+	ms.holdsLock = false
+	ms.db.lock.Unlock()
+}
+
+func (db *memoryDatabase) cloneCollections() map[string]*memoryCollection {
+	clone := make(map[string]*memoryCollection, len(db.collections))
+	for resourceType, collection := range db.collections {
+		versions := make(map[string][]memoryVersion, len(collection.versions))
+		for id, resourceVersions := range collection.versions {
+			versions[id] = append([]memoryVersion(nil), resourceVersions...)
+		}
+		clone[resourceType] = &memoryCollection{
+			ids:      append([]string(nil), collection.ids...),
+			versions: versions,
+		}
+	}
+	return clone
+}
+
+func (ms *memorySession) collection(resourceType string) *memoryCollection {
+	collection, exists := ms.db.collections[resourceType]
+	if !exists {
+		collection = &memoryCollection{versions: make(map[string][]memoryVersion)}
+		ms.db.collections[resourceType] = collection
+	}
+	return collection
+}
+
+// latestVersion returns the most recently stored version of a resource (which may be a deletion)
+func (c *memoryCollection) latestVersion(id string) (version memoryVersion, exists bool) {
+	versions := c.versions[id]
+	if len(versions) == 0 {
+		return memoryVersion{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// currentVersion returns the current version of a resource, if it exists and hasn't been deleted
+func (c *memoryCollection) currentVersion(id string) (version memoryVersion, exists bool) {
+	version, exists = c.latestVersion(id)
+	if version.deleted {
+		return memoryVersion{}, false
+	}
+	return
+}
+
+func (c *memoryCollection) addVersion(id string, version memoryVersion, keepHistory bool) {
+	if _, exists := c.versions[id]; !exists {
+		c.ids = append(c.ids, id)
+	}
+	if keepHistory {
+		c.versions[id] = append(c.versions[id], version)
+	} else {
+		c.versions[id] = []memoryVersion{version}
+	}
+}
+
+func (c *memoryCollection) remove(id string) {
+	delete(c.versions, id)
+	for i, existing := range c.ids {
+		if existing == id {
+			c.ids = append(c.ids[:i], c.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+// Resources implements search.MemoryStore
+func (ms *memorySession) Resources(resourceType string) ([]*models2.Resource, error) {
+	collection := ms.collection(resourceType)
+	resources := make([]*models2.Resource, 0, len(collection.ids))
+	for _, id := range collection.ids {
+		version, exists := collection.currentVersion(id)
+		if !exists {
+			continue
+		}
+		resource, err := models2.NewResourceFromJsonBytes(version.jsonBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load %s/%s", resourceType, id)
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+func (ms *memorySession) Get(id, resourceType string) (resource *models2.Resource, err error) {
+	defer ms.lock()()
+
+	if !isValidFhirID(id) {
+		return nil, ErrNotFound
+	}
+
+	version, exists := ms.collection(resourceType).latestVersion(id)
+	ms.debug("Get %s/%s --> %s", resourceType, id, version.jsonBytes)
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if version.deleted {
+		return nil, ErrDeleted
+	}
+	return models2.NewResourceFromJsonBytes(version.jsonBytes)
+}
+
+func (ms *memorySession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
+	defer ms.lock()()
+
+	if !isValidFhirID(id) {
+		return nil, ErrNotFound
+	}
+
+	versionIdInt, err := strconv.Atoi(versionIdStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert versionId to an integer (%s)", versionIdStr)
+	}
+
+	for _, version := range ms.collection(resourceType).versions[id] {
+		if version.versionId == versionIdInt {
+			if version.deleted {
+				return nil, ErrDeleted
+			}
+			return models2.NewResourceFromJsonBytes(version.jsonBytes)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *memorySession) GetSubset(id, versionId, resourceType string, projection *search.ElementsProjection) (resource *models2.Resource, err error) {
+	return getAndSubset(ms, id, versionId, resourceType, projection)
+}
+
+func (ms *memorySession) Post(resource *models2.Resource) (id string, err error) {
+	id = objectid.New().Hex()
+	err = ms.PostWithID(id, resource)
+	return
+}
+
+func (ms *memorySession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	defer ms.lock()()
+
+	existingIds, err := ms.FindIDs(query)
+	if err != nil {
+		return
+	}
+
+	if len(existingIds) == 0 {
+		httpStatus = 201
+		id = objectid.New().Hex()
+		err = ms.PostWithID(id, resource)
+		if err == nil {
+			outputResource = resource
+		}
+
+	} else if len(existingIds) == 1 {
+		httpStatus = 200
+		id = existingIds[0]
+		outputResource, err = ms.Get(id, query.Resource)
+
+	} else if len(existingIds) > 1 {
+		httpStatus = 412
+	}
+
+	return
+}
+
+func (ms *memorySession) PostWithID(id string, resource *models2.Resource) error {
+	defer ms.lock()()
+
+	if !isValidFhirID(id) {
+		return invalidFhirIDError()
+	}
+
+	resourceType := resource.ResourceType()
+	collection := ms.collection(resourceType)
+	if _, exists := collection.currentVersion(id); exists {
+		return ErrConflict{msg: fmt.Sprintf("%s/%s already exists", resourceType, id)}
+	}
+
+	// versions continue from any previously deleted resource with the same id
+	latest, _ := collection.latestVersion(id)
+	resource.SetId(id)
+	updateResourceMeta(resource, latest.versionId+1)
+
+	invokeInterceptorsBefore(ms.dal.Interceptors, "Create", resourceType, resource)
+
+	ms.debug("PostWithID: inserting %s", resource)
+	err := ms.store(collection, resource)
+
+	if err == nil {
+		invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
+	} else {
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Create", resourceType, err, resource)
+	}
+
+	return err
+}
+
+// store adds a new version of the resource, whose metadata must have already been updated
+func (ms *memorySession) store(collection *memoryCollection, resource *models2.Resource) error {
+	versionId, err := strconv.Atoi(resource.VersionId())
+	if err != nil {
+		return errors.Wrapf(err, "invalid versionId (%s)", resource.VersionId())
+	}
+	jsonBytes, err := resource.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "resource.MarshalJSON failed")
+	}
+
+	collection.addVersion(resource.Id(), memoryVersion{versionId: versionId, lastUpdated: resource.LastUpdatedTime(), jsonBytes: jsonBytes}, ms.dal.enableHistory)
+	return nil
+}
+
+func (ms *memorySession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	defer ms.lock()()
+
+	if !isValidFhirID(id) {
+		return false, invalidFhirIDError()
+	}
+
+	resourceType := resource.ResourceType()
+	collection := ms.collection(resourceType)
+	resource.SetId(id)
+	if conditionalVersionId != "" {
+		ms.debug("PUT %s/%s (If-Match %s)", resourceType, id, conditionalVersionId)
+	} else {
+		ms.debug("PUT %s/%s", resourceType, id)
+	}
+
+	if ms.dal.enableHistory == false && conditionalVersionId != "" {
+		return false, errors.Errorf("If-Match specified for a conditional put, but version histories are disabled")
+	}
+
+	latest, _ := collection.latestVersion(id)
+	current, exists := collection.currentVersion(id)
+	if !exists {
+		if conditionalVersionId != "" {
+			return false, ErrConflict{msg: "If-Match specified for a resource that doesn't exist"}
+		}
+		createdNew = true
+	} else if conditionalVersionId != "" && conditionalVersionId != strconv.Itoa(current.versionId) {
+		return false, ErrConflict{msg: "If-Match doesn't match current versionId"}
+	}
+
+	newVersionId := latest.versionId + 1
+	ms.debug("  versionIds: current %d; new %d", current.versionId, newVersionId)
+	updateResourceMeta(resource, newVersionId)
+
+	if !createdNew && hasInterceptorsForOpAndType(ms.dal.Interceptors, "Update", resourceType) {
+		oldResource, getError := ms.Get(id, resourceType)
+		if getError == nil {
+			invokeInterceptorsBefore(ms.dal.Interceptors, "Update", resourceType, oldResource)
+		}
+	}
+
+	err = ms.store(collection, resource)
+
+	if err == nil {
+		if createdNew {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
+		} else {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Update", resourceType, resource)
+		}
+	} else {
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Update", resourceType, err, resource)
+	}
+
+	return createdNew, err
+}
+
+func (ms *memorySession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	defer ms.lock()()
+
+	if IDs, err := ms.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = objectid.New().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, &ErrMultipleMatches{msg: fmt.Sprintf("Multiple matches for %s?%s", query.Resource, query.Query)}
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = ms.Put(id, conditionalVersionId, resource)
+	return id, createdNew, err
+}
+
+func (ms *memorySession) Delete(id, resourceType string) (newVersionId string, err error) {
+	defer ms.lock()()
+
+	if !isValidFhirID(id) {
+		return "", ErrNotFound
+	}
+
+	collection := ms.collection(resourceType)
+	current, exists := collection.currentVersion(id)
+	if !exists {
+		return "", ErrNotFound
+	}
+
+	var resource interface{}
+	var getError error
+	hasInterceptor := hasInterceptorsForOpAndType(ms.dal.Interceptors, "Delete", resourceType)
+	if hasInterceptor {
+		// Although this is a delete operation we need to get the resource first so we can
+		// run any interceptors on the resource before it's deleted.
+		resource, getError = ms.Get(id, resourceType)
+		invokeInterceptorsBefore(ms.dal.Interceptors, "Delete", resourceType, resource)
+	}
+
+	if ms.dal.enableHistory {
+		// record the deletion as a new version
+		collection.addVersion(id, memoryVersion{versionId: current.versionId + 1, lastUpdated: time.Now(), deleted: true}, true)
+		newVersionId = strconv.Itoa(current.versionId + 1)
+	} else {
+		collection.remove(id)
+	}
+
+	if hasInterceptor {
+		if getError == nil {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Delete", resourceType, resource)
+		} else {
+			invokeInterceptorsOnError(ms.dal.Interceptors, "Delete", resourceType, getError, resource)
+		}
+	}
+
+	return newVersionId, nil
+}
+
+func (ms *memorySession) ConditionalDelete(query search.Query) (count int64, err error) {
+	defer ms.lock()()
+
+	IDsToDelete, err := ms.FindIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range IDsToDelete {
+		_, err = ms.Delete(id, query.Resource)
+		if err != nil {
+			return count, errors.Wrapf(err, "ConditionalDelete: failed to delete %s/%s", query.Resource, id)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (ms *memorySession) History(baseURL url.URL, query HistoryQuery) (bundle *models2.ShallowBundle, err error) {
+	defer ms.lock()()
+
+	var versions []historyVersion
+	addVersions := func(resourceType, id string) {
+		stored := ms.collection(resourceType).versions[id]
+		for i, version := range stored {
+			var replaced *time.Time
+			if i+1 < len(stored) {
+				replaced = &stored[i+1].lastUpdated
+			}
+			candidate := historyVersion{
+				resourceType: resourceType,
+				id:           id,
+				versionId:    version.versionId,
+				lastUpdated:  version.lastUpdated,
+				deleted:      version.deleted,
+			}
+			if query.matches(candidate, replaced) {
+				versions = append(versions, candidate)
+			}
+		}
+	}
+
+	if query.Id != "" {
+		if !isValidFhirID(query.Id) {
+			return nil, ErrNotFound
+		}
+		if len(ms.collection(query.ResourceType).versions[query.Id]) == 0 {
+			return nil, ErrNotFound
+		}
+		addVersions(query.ResourceType, query.Id)
+	} else {
+		resourceTypes := []string{query.ResourceType}
+		if query.ResourceType == "" {
+			resourceTypes = nil
+			for resourceType := range ms.db.collections {
+				resourceTypes = append(resourceTypes, resourceType)
+			}
+		}
+		for _, resourceType := range resourceTypes {
+			for _, id := range ms.collection(resourceType).ids {
+				addVersions(resourceType, id)
+			}
+		}
+	}
+
+	sortHistoryVersions(versions)
+	return newHistoryBundle(baseURL, query, query.page(versions), len(versions), func(version historyVersion) (*models2.Resource, error) {
+		return ms.GetVersion(version.id, strconv.Itoa(version.versionId), version.resourceType)
+	})
+}
+
+func (ms *memorySession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+	defer ms.lock()()
+
+	searcher := search.NewMemorySearcher(ms, ms.dal.countTotalResults, ms.dal.enableCISearches)
+
+	resources, total, err := searcher.Search(searchQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSearchBundle(baseURL, searchQuery, resources, total, ms.dal.countTotalResults, false), nil
+}
+
+func (ms *memorySession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	defer ms.lock()()
+
+	// First create a new query with the unsupported query options filtered out
+	newQuery := findIDsQuery(searchQuery)
+
+	searcher := search.NewMemorySearcher(ms, false, ms.dal.enableCISearches)
+	results, _, err := searcher.Search(newQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	IDs = make([]string, len(results))
+	for i, result := range results {
+		IDs[i] = result.Id()
+	}
+
+	return IDs, nil
+}
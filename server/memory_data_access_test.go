@@ -0,0 +1,271 @@
+package server
+
+import (
+	"net/url"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	. "gopkg.in/check.v1"
+)
+
+type MemoryDALSuite struct {
+	dal DataAccessLayer
+}
+
+var _ = Suite(&MemoryDALSuite{})
+
+func (s *MemoryDALSuite) SetUpTest(c *C) {
+	config := DefaultConfig
+	config.EnableHistory = true
+	config.CountTotalResults = true
+	config.EnableCISearches = true
+	s.dal = NewMemoryDataAccessLayer("fhir", false, "", make(map[string]InterceptorList), config)
+}
+
+func memoryTestResource(c *C, json string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	c.Assert(err, IsNil)
+	return resource
+}
+
+func (s *MemoryDALSuite) insertFixtures(c *C, session DataAccessSession) {
+	c.Assert(session.PostWithID("p1", memoryTestResource(c, `{"resourceType":"Patient","name":[{"family":"Duck","given":["Donald"]}],"gender":"male","birthDate":"1934-06-09"}`)), IsNil)
+	c.Assert(session.PostWithID("p2", memoryTestResource(c, `{"resourceType":"Patient","name":[{"family":"Mouse","given":["Minnie"]}],"gender":"female","birthDate":"1928-11-18"}`)), IsNil)
+	c.Assert(session.PostWithID("o1", memoryTestResource(c, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},"subject":{"reference":"Patient/p1"}}`)), IsNil)
+	c.Assert(session.PostWithID("o2", memoryTestResource(c, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8310-5"}]},"subject":{"reference":"Patient/p2"}}`)), IsNil)
+}
+
+func (s *MemoryDALSuite) search(c *C, session DataAccessSession, resourceType, query string) []string {
+	bundle, err := session.Search(url.URL{}, search.Query{Resource: resourceType, Query: query})
+	c.Assert(err, IsNil)
+	var ids []string
+	for _, entry := range bundle.Entry {
+		ids = append(ids, entry.Resource.ResourceType()+"/"+entry.Resource.Id())
+	}
+	return ids
+}
+
+func (s *MemoryDALSuite) TestCreateReadUpdateDelete(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+
+	id, err := session.Post(memoryTestResource(c, `{"resourceType":"Patient","gender":"male"}`))
+	c.Assert(err, IsNil)
+
+	patient, err := session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(patient.Id(), Equals, id)
+	c.Assert(patient.VersionId(), Equals, "1")
+
+	createdNew, err := session.Put(id, "1", memoryTestResource(c, `{"resourceType":"Patient","gender":"female"}`))
+	c.Assert(err, IsNil)
+	c.Assert(createdNew, Equals, false)
+
+	_, err = session.Put(id, "1", memoryTestResource(c, `{"resourceType":"Patient","gender":"other"}`))
+	c.Assert(err, FitsTypeOf, ErrConflict{})
+
+	patient, err = session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(patient.VersionId(), Equals, "2")
+	c.Assert(string(patient.JsonBytes()), Matches, `.*"female".*`)
+
+	oldVersion, err := session.GetVersion(id, "1", "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(string(oldVersion.JsonBytes()), Matches, `.*"male".*`)
+
+	newVersionId, err := session.Delete(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(newVersionId, Equals, "3")
+
+	_, err = session.Get(id, "Patient")
+	c.Assert(err, Equals, ErrDeleted)
+	_, err = session.Get("unknown", "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+
+	history, err := session.History(url.URL{}, HistoryQuery{ResourceType: "Patient", Id: id, Count: 100})
+	c.Assert(err, IsNil)
+	c.Assert(history.Entry, HasLen, 3)
+	c.Assert(history.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(history.Entry[1].Request.Method, Equals, "PUT")
+	c.Assert(history.Entry[2].Request.Method, Equals, "POST")
+}
+
+func (s *MemoryDALSuite) TestGetSubset(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+	_, err := session.Put("p1", "", memoryTestResource(c, `{"resourceType":"Patient","gender":"male","text":{"status":"generated","div":"<div>Donald</div>"}}`))
+	c.Assert(err, IsNil)
+
+	summary := search.Query{Resource: "Patient", Query: "_summary=true"}
+	patient, err := session.GetSubset("p1", "", "Patient", summary.Options().ElementsProjection("Patient"))
+	c.Assert(err, IsNil)
+	c.Assert(patient.VersionId(), Equals, "2")
+	c.Assert(string(patient.JsonBytes()), Matches, `.*"SUBSETTED".*`)
+	c.Assert(string(patient.JsonBytes()), Matches, `.*"gender": "male".*`)
+	c.Assert(string(patient.JsonBytes()), Not(Matches), `.*"text".*`)
+
+	elements := search.Query{Resource: "Patient", Query: "_elements=birthDate"}
+	patient, err = session.GetSubset("p1", "1", "Patient", elements.Options().ElementsProjection("Patient"))
+	c.Assert(err, IsNil)
+	c.Assert(string(patient.JsonBytes()), Matches, `.*"birthDate": "1934-06-09".*`)
+	c.Assert(string(patient.JsonBytes()), Not(Matches), `.*"name".*`)
+
+	_, err = session.GetSubset("unknown", "", "Patient", summary.Options().ElementsProjection("Patient"))
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (s *MemoryDALSuite) TestPostWithExistingIDConflicts(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+
+	c.Assert(session.PostWithID("a1", memoryTestResource(c, `{"resourceType":"Patient"}`)), IsNil)
+	c.Assert(session.PostWithID("a1", memoryTestResource(c, `{"resourceType":"Patient"}`)), FitsTypeOf, ErrConflict{})
+	c.Assert(session.PostWithID("not valid!", memoryTestResource(c, `{"resourceType":"Patient"}`)), NotNil)
+}
+
+func (s *MemoryDALSuite) TestConditionalOperations(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+
+	status, id, _, err := session.ConditionalPost(search.Query{Resource: "Patient", Query: "family=Duck"}, memoryTestResource(c, `{"resourceType":"Patient"}`))
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(id, Equals, "p1")
+
+	status, _, _, err = session.ConditionalPost(search.Query{Resource: "Patient", Query: "family=Goofy"}, memoryTestResource(c, `{"resourceType":"Patient","name":[{"family":"Goofy"}]}`))
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 201)
+
+	id, createdNew, err := session.ConditionalPut(search.Query{Resource: "Patient", Query: "family=Mouse"}, "", memoryTestResource(c, `{"resourceType":"Patient","name":[{"family":"Mouse","given":["Mickey"]}],"gender":"female"}`))
+	c.Assert(err, IsNil)
+	c.Assert(createdNew, Equals, false)
+	c.Assert(id, Equals, "p2")
+
+	_, _, err = session.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=male,female"}, "", memoryTestResource(c, `{"resourceType":"Patient"}`))
+	c.Assert(err, FitsTypeOf, &ErrMultipleMatches{})
+
+	count, err := session.ConditionalDelete(search.Query{Resource: "Observation", Query: "code=http://loinc.org|8867-4"})
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(1))
+	c.Assert(s.search(c, session, "Observation", ""), DeepEquals, []string{"Observation/o2"})
+}
+
+func (s *MemoryDALSuite) TestTransactionRollback(c *C) {
+	session := s.dal.StartSession("")
+	c.Assert(session.StartTransaction(), IsNil)
+	c.Assert(session.PostWithID("t1", memoryTestResource(c, `{"resourceType":"Patient"}`)), IsNil)
+	session.Finish()
+
+	session = s.dal.StartSession("")
+	defer session.Finish()
+	_, err := session.Get("t1", "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+
+	c.Assert(session.StartTransaction(), IsNil)
+	c.Assert(session.PostWithID("t2", memoryTestResource(c, `{"resourceType":"Patient"}`)), IsNil)
+	c.Assert(session.CommmitIfTransaction(), IsNil)
+	_, err = session.Get("t2", "Patient")
+	c.Assert(err, IsNil)
+}
+
+func (s *MemoryDALSuite) TestSearch(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+
+	// tokens and strings
+	c.Assert(s.search(c, session, "Patient", "gender=female"), DeepEquals, []string{"Patient/p2"})
+	c.Assert(s.search(c, session, "Patient", "name=don"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.search(c, session, "Observation", "code=http://loinc.org|8310-5"), DeepEquals, []string{"Observation/o2"})
+
+	// dates
+	c.Assert(s.search(c, session, "Patient", "birthdate=1934"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.search(c, session, "Patient", "birthdate=lt1930-01-01"), DeepEquals, []string{"Patient/p2"})
+
+	// references and chaining
+	c.Assert(s.search(c, session, "Observation", "subject=Patient/p1"), DeepEquals, []string{"Observation/o1"})
+	c.Assert(s.search(c, session, "Observation", "subject:Patient.family=Mouse"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.search(c, session, "Patient", "_has:Observation:subject:code=8867-4"), DeepEquals, []string{"Patient/p1"})
+
+	// sorting and paging
+	c.Assert(s.search(c, session, "Patient", "_sort=birthdate"), DeepEquals, []string{"Patient/p2", "Patient/p1"})
+	c.Assert(s.search(c, session, "Patient", "_sort=-birthdate&_count=1"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.search(c, session, "Patient", "_offset=1"), DeepEquals, []string{"Patient/p2"})
+
+	// includes
+	c.Assert(s.search(c, session, "Observation", "code=8867-4&_include=Observation:subject"), DeepEquals, []string{"Observation/o1", "Patient/p1"})
+	c.Assert(s.search(c, session, "Patient", "gender=female&_revinclude=Observation:subject"), DeepEquals, []string{"Patient/p2", "Observation/o2"})
+}
+
+func (s *MemoryDALSuite) TestFilterSearch(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+	c.Assert(session.PostWithID("pr1", memoryTestResource(c, `{"resourceType":"Practitioner","name":[{"family":"Hall"}]}`)), IsNil)
+	c.Assert(session.PostWithID("p3", memoryTestResource(c, `{"resourceType":"Patient","gender":"male","generalPractitioner":[{"reference":"Practitioner/pr1"}]}`)), IsNil)
+	c.Assert(session.PostWithID("o3", memoryTestResource(c, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8480-6"}]},"subject":{"reference":"Patient/p3"}}`)), IsNil)
+	c.Assert(session.PostWithID("vs1", memoryTestResource(c, `{"resourceType":"ValueSet","url":"http://example.org/vitals","status":"active","compose":{"include":[{"system":"http://loinc.org","concept":[{"code":"8867-4"},{"code":"8480-6"}]}]}}`)), IsNil)
+	c.Assert(session.PostWithID("vs2", memoryTestResource(c, `{"resourceType":"ValueSet","url":"http://example.org/genders","status":"active","compose":{"include":[{"system":"http://hl7.org/fhir/administrative-gender"}]}}`)), IsNil)
+	c.Assert(session.PostWithID("cs1", memoryTestResource(c, `{"resourceType":"CodeSystem","url":"http://hl7.org/fhir/administrative-gender","status":"active","content":"complete","concept":[{"code":"male"},{"code":"female"},{"code":"other"}]}`)), IsNil)
+	c.Assert(session.PostWithID("cs2", memoryTestResource(c, `{"resourceType":"CodeSystem","url":"http://loinc.org","status":"active","content":"fragment","concept":[{"code":"vitals","concept":[{"code":"8867-4"},{"code":"blood-pressure","concept":[{"code":"8480-6"}]}]}]}`)), IsNil)
+
+	// chained comparisons
+	c.Assert(s.search(c, session, "Observation", "_filter=subject:Patient.family eq Mouse"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.search(c, session, "Observation", "_filter=subject:Patient.general-practitioner:Practitioner.family eq hall or subject:Patient.gender eq female"), DeepEquals, []string{"Observation/o2", "Observation/o3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=not (subject:Patient.gender eq male)"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.search(c, session, "Patient", "_filter=general-practitioner:Practitioner.name pr true"), DeepEquals, []string{"Patient/p3"})
+
+	// terminology operators
+	c.Assert(s.search(c, session, "Observation", "_filter=code in http://example.org/vitals"), DeepEquals, []string{"Observation/o1", "Observation/o3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=code ni http://example.org/vitals"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.search(c, session, "Patient", "_filter=gender in http://example.org/genders"), DeepEquals, []string{"Patient/p1", "Patient/p2", "Patient/p3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=code ss http://loinc.org|vitals"), DeepEquals, []string{"Observation/o1", "Observation/o3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=code ss http://loinc.org|blood-pressure"), DeepEquals, []string{"Observation/o3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=code sb http://loinc.org|8480-6"), DeepEquals, []string{"Observation/o3"})
+	c.Assert(s.search(c, session, "Observation", "_filter=code sb http://loinc.org|vitals"), HasLen, 0)
+	c.Assert(s.search(c, session, "Observation", "_filter=subject:Patient.gender in http://example.org/genders and code ss http://loinc.org|8867-4"), DeepEquals, []string{"Observation/o1"})
+
+	unknownValueSet := func() {
+		session.Search(url.URL{}, search.Query{Resource: "Observation", Query: "_filter=code in http://example.org/unknown"})
+	}
+	c.Assert(unknownValueSet, PanicMatches, `.*ValueSet http://example.org/unknown not found.*`)
+}
+
+func (s *MemoryDALSuite) TestTypeAndSystemHistory(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+	_, err := session.Delete("o2", "Observation")
+	c.Assert(err, IsNil)
+
+	baseURL, _ := url.Parse("http://localhost/")
+	query, err := ParseHistoryQuery("Patient", "", "_count=1")
+	c.Assert(err, IsNil)
+	history, err := session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(2))
+	c.Assert(history.Entry, HasLen, 1)
+	c.Assert(history.Entry[0].Request.Method, Equals, "POST")
+	c.Assert(history.Entry[0].FullUrl, Matches, `http://localhost/Patient/p[12]`)
+	c.Assert(history.Link[0].Url, Equals, "http://localhost/Patient/_history?_offset=0&_count=1")
+	c.Assert(history.Link[2].Relation, Equals, "next")
+
+	query, err = ParseHistoryQuery("", "", "")
+	c.Assert(err, IsNil)
+	history, err = session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(5))
+	c.Assert(history.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(history.Entry[0].Request.Url, Equals, "Observation/o2")
+
+	// type-level history of an empty type isn't an error, unlike instance history
+	query, err = ParseHistoryQuery("Encounter", "", "")
+	c.Assert(err, IsNil)
+	history, err = session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(0))
+	_, err = session.History(*baseURL, HistoryQuery{ResourceType: "Encounter", Id: "e1", Count: 100})
+	c.Assert(err, Equals, ErrNotFound)
+}
@@ -49,7 +49,7 @@ func hasJsonMimeType(acceptHeader string, formatOption string) int {
 	case "json", "text/json", "application/json", "application/fhir+json":
 		return 2
 	}
-	if strings.Contains(acceptHeader, "application/fhir+json") || strings.Contains(acceptHeader, "application/json+fhir") {
+	if strings.Contains(acceptHeader, "application/fhir+json") || strings.Contains(acceptHeader, "application/json+fhir") || strings.Contains(acceptHeader, "ndjson") {
 		return 1
 	} else {
 		return 0
@@ -22,15 +22,16 @@ import (
 )
 
 type mongoDataAccessLayer struct {
-	client            *mongo.Client
-	defaultDbName     string
-	enableMultiDB     bool
-	dbSuffix          string
-	Interceptors      map[string]InterceptorList
-	countTotalResults bool
-	enableCISearches  bool
-	enableHistory     bool
-	readonly          bool
+	client               *mongo.Client
+	defaultDbName        string
+	enableMultiDB        bool
+	dbSuffix             string
+	Interceptors         map[string]InterceptorList
+	countTotalResults    bool
+	enableCISearches     bool
+	enableHistory        bool
+	readonly             bool
+	maxIncludeIterations int
 }
 
 type mongoSession struct {
@@ -93,6 +94,11 @@ func (ms *mongoSession) CommmitIfTransaction() error {
 	if ms.inTransaction {
 		err := ms.session.CommitTransaction(context.TODO())
 		ms.debug("CommmitTransaction")
+		for attempt := 1; err != nil && hasErrorLabel(err, "UnknownTransactionCommitResult") && attempt < maxTransactionAttempts; attempt++ {
+			// commit is idempotent so can be retried until the outcome is known
+			ms.debug("CommmitTransaction retry %d after %s", attempt, err.Error())
+			err = ms.session.CommitTransaction(context.TODO())
+		}
 		if err == nil {
 			ms.inTransaction = false
 		}
@@ -119,15 +125,16 @@ func (ms *mongoSession) Finish() {
 // NewMongoDataAccessLayer returns an implementation of DataAccessLayer that is backed by a Mongo database
 func NewMongoDataAccessLayer(client *mongo.Client, defaultDbName string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
 	return &mongoDataAccessLayer{
-		client:            client,
-		defaultDbName:     defaultDbName,
-		enableMultiDB:     enableMultiDB,
-		dbSuffix:          dbSuffix,
-		Interceptors:      interceptors,
-		countTotalResults: config.CountTotalResults,
-		enableCISearches:  config.EnableCISearches,
-		enableHistory:     config.EnableHistory,
-		readonly:          config.ReadOnly,
+		client:               client,
+		defaultDbName:        defaultDbName,
+		enableMultiDB:        enableMultiDB,
+		dbSuffix:             dbSuffix,
+		Interceptors:         interceptors,
+		countTotalResults:    config.CountTotalResults,
+		enableCISearches:     config.EnableCISearches,
+		enableHistory:        config.EnableHistory,
+		readonly:             config.ReadOnly,
+		maxIncludeIterations: config.MaxIncludeIterations,
 	}
 }
 
@@ -158,41 +165,57 @@ type InterceptorHandler interface {
 // invokeInterceptorsBefore invokes the interceptor list for the given resource type before a database
 // operation occurs.
 func (ms *mongoSession) invokeInterceptorsBefore(op, resourceType string, resource interface{}) {
+	invokeInterceptorsBefore(ms.dal.Interceptors, op, resourceType, resource)
+}
+
+// invokeInterceptorsAfter invokes the interceptor list for the given resource type after a database
+// operation occurs and succeeds.
+func (ms *mongoSession) invokeInterceptorsAfter(op, resourceType string, resource interface{}) {
+	invokeInterceptorsAfter(ms.dal.Interceptors, op, resourceType, resource)
+}
+
+// invokeInterceptorsOnError invokes the interceptor list for the given resource type after a database
+// operation occurs and fails.
+func (ms *mongoSession) invokeInterceptorsOnError(op, resourceType string, err error, resource interface{}) {
+	invokeInterceptorsOnError(ms.dal.Interceptors, op, resourceType, err, resource)
+}
+
+// hasInterceptorsForOpAndType checks if any interceptors are registered for a particular database operation AND resource type
+func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) bool {
+	return hasInterceptorsForOpAndType(ms.dal.Interceptors, op, resourceType)
+}
+
+func invokeInterceptorsBefore(interceptors map[string]InterceptorList, op, resourceType string, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.Before(resource)
 		}
 	}
 }
 
-// invokeInterceptorsAfter invokes the interceptor list for the given resource type after a database
-// operation occurs and succeeds.
-func (ms *mongoSession) invokeInterceptorsAfter(op, resourceType string, resource interface{}) {
+func invokeInterceptorsAfter(interceptors map[string]InterceptorList, op, resourceType string, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.After(resource)
 		}
 	}
 }
 
-// invokeInterceptorsOnError invokes the interceptor list for the given resource type after a database
-// operation occurs and fails.
-func (ms *mongoSession) invokeInterceptorsOnError(op, resourceType string, err error, resource interface{}) {
+func invokeInterceptorsOnError(interceptors map[string]InterceptorList, op, resourceType string, err error, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.OnError(err, resource)
 		}
 	}
 }
 
-// hasInterceptorsForOpAndType checks if any interceptors are registered for a particular database operation AND resource type
-func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) bool {
+func hasInterceptorsForOpAndType(interceptors map[string]InterceptorList, op, resourceType string) bool {
 
-	if len(ms.dal.Interceptors[op]) > 0 {
-		for _, interceptor := range ms.dal.Interceptors[op] {
+	if len(interceptors[op]) > 0 {
+		for _, interceptor := range interceptors[op] {
 			if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 				// At least 1 interceptor is registered for this database operation and resource type
 				return true
@@ -203,6 +226,11 @@ func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) boo
 }
 
 func (ms *mongoSession) Get(id, resourceType string) (resource *models2.Resource, err error) {
+	return ms.get(id, resourceType, nil)
+}
+
+// get retrieves the current version of a resource, only returning the elements in the projection if it isn't nil
+func (ms *mongoSession) get(id, resourceType string, projection *bson.Document) (resource *models2.Resource, err error) {
 	bsonID, err := convertIDToBsonID(id)
 	if err != nil {
 		return nil, ErrNotFound
@@ -210,8 +238,12 @@ func (ms *mongoSession) Get(id, resourceType string) (resource *models2.Resource
 
 	collection := ms.CurrentVersionCollection(resourceType)
 	filter := bson.NewDocument(bson.EC.String("_id", bsonID.Hex()))
+	opts := []findopt.One{ms.session}
+	if projection != nil {
+		opts = append(opts, findopt.Projection(projection))
+	}
 	var doc bson.Document
-	err = collection.FindOne(context.TODO(), filter, ms.session).Decode(&doc)
+	err = collection.FindOne(context.TODO(), filter, opts...).Decode(&doc)
 	ms.debug("Get %s/%s --> %s (err %+v)", resourceType, id, doc.String(), err)
 	if err == mongo.ErrNoDocuments && ms.dal.enableHistory {
 		// check whether this is a deleted record
@@ -248,6 +280,11 @@ func (ms *mongoSession) Get(id, resourceType string) (resource *models2.Resource
 }
 
 func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
+	return ms.getVersion(id, versionIdStr, resourceType, nil)
+}
+
+// getVersion retrieves a version of a resource, only returning the elements in the projection if it isn't nil
+func (ms *mongoSession) getVersion(id, versionIdStr, resourceType string, projection *bson.Document) (resource *models2.Resource, err error) {
 	bsonID, err := convertIDToBsonID(id)
 	if err != nil {
 		return nil, ErrNotFound
@@ -264,8 +301,14 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 		bson.EC.String("meta.versionId", versionIdStr),
 	)
 	curCollection := ms.CurrentVersionCollection(resourceType)
+	curOpts := []findopt.One{ms.session}
+	prevOpts := []findopt.Find{ms.session, findopt.Limit(1)}
+	if projection != nil {
+		curOpts = append(curOpts, findopt.Projection(projection))
+		prevOpts = append(prevOpts, findopt.Projection(projection))
+	}
 	var result bson.Document
-	err = curCollection.FindOne(context.TODO(), curQuery, ms.session).Decode(&result)
+	err = curCollection.FindOne(context.TODO(), curQuery, curOpts...).Decode(&result)
 	// fmt.Printf("GetVersion: curQuery=%+v; err=%+v\n", curQuery, err)
 
 	if err == mongo.ErrNoDocuments {
@@ -275,7 +318,7 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 			bson.EC.Int32("_id._version", int32(versionIdInt)),
 		)
 		prevCollection := ms.PreviousVersionsCollection(resourceType)
-		cur, err := prevCollection.Find(context.TODO(), prevQuery, ms.session, findopt.Limit(1))
+		cur, err := prevCollection.Find(context.TODO(), prevQuery, prevOpts...)
 		if err != nil {
 			return nil, errors.Wrap(err, "GetVersion --> prevCollection.Find")
 		}
@@ -314,6 +357,26 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 	return
 }
 
+// GetSubset projects the resource in MongoDB, as searches with _summary and _elements do
+func (ms *mongoSession) GetSubset(id, versionId, resourceType string, projection *search.ElementsProjection) (resource *models2.Resource, err error) {
+	mongoProjection := bson.NewDocument()
+	for element, value := range projection.MongoProjection() {
+		mongoProjection.Append(bson.EC.Int32(element, int32(value.(int))))
+	}
+
+	if versionId == "" {
+		resource, err = ms.get(id, resourceType, mongoProjection)
+	} else {
+		resource, err = ms.getVersion(id, versionId, resourceType, mongoProjection)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// only tags the resource as SUBSETTED as its elements have already been projected
+	return resource.Subset(nil)
+}
+
 // Convert document stored in one of the _prev collections into a resource
 func unmarshalPreviousVersion(asBSON *bson.Document) (deleted bool, resource *models2.Resource, err error) {
 	// fmt.Printf("[unmarshalPreviousVersion] %+v\n", asBSON)
@@ -420,6 +483,13 @@ func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) error
 	resourceType := resource.ResourceType()
 	curCollection := ms.CurrentVersionCollection(resourceType)
 
+	var searchParameter *search.CustomSearchParameter
+	if resourceType == "SearchParameter" {
+		if searchParameter, err = newCustomSearchParameter(bsonID.Hex(), resource); err != nil {
+			return err
+		}
+	}
+
 	ms.invokeInterceptorsBefore("Create", resourceType, resource)
 
 	ms.debug("PostWithID: inserting %s", resource)
@@ -431,6 +501,9 @@ func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) error
 		ms.invokeInterceptorsOnError("Create", resourceType, err, resource)
 	}
 
+	if err == nil && resourceType == "SearchParameter" {
+		return ms.applySearchParameter(bsonID.Hex(), searchParameter)
+	}
 	return convertMongoErr(err)
 }
 
@@ -443,6 +516,14 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	resourceType := resource.ResourceType()
 	curCollection := ms.CurrentVersionCollection(resourceType)
 	resource.SetId(bsonID.Hex())
+
+	var searchParameter *search.CustomSearchParameter
+	if resourceType == "SearchParameter" {
+		if searchParameter, err = newCustomSearchParameter(bsonID.Hex(), resource); err != nil {
+			return false, err
+		}
+	}
+
 	if conditionalVersionId != "" {
 		ms.debug("PUT %s/%s (If-Match %s)", resourceType, resource.Id(), conditionalVersionId)
 	} else {
@@ -569,6 +650,9 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 		ms.invokeInterceptorsOnError("Update", resourceType, err, resource)
 	}
 
+	if err == nil && resourceType == "SearchParameter" {
+		return createdNew, ms.applySearchParameter(bsonID.Hex(), searchParameter)
+	}
 	return createdNew, convertMongoErr(err)
 }
 
@@ -670,6 +754,10 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 		}
 	}
 
+	if err == nil && resourceType == "SearchParameter" {
+		search.UnregisterCustomSearchParameter(bsonID.Hex())
+	}
+
 	err = convertMongoErr(err)
 	return
 }
@@ -738,6 +826,15 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 	if err != nil {
 		return 0, err
 	}
+	if query.Resource == "SearchParameter" {
+		defer func() {
+			if err == nil {
+				for _, id := range IDsToDelete {
+					search.UnregisterCustomSearchParameter(id)
+				}
+			}
+		}()
+	}
 	// There is the potential here for the delete to fail if the slice of IDs
 	// is too large (exceeding Mongo's 16MB document size limit).
 	IDsToDeleteValues := make([]*bson.Value, len(IDsToDelete))
@@ -837,117 +934,319 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 	}
 }
 
-func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string) (bundle *models2.ShallowBundle, err error) {
+func (ms *mongoSession) History(baseURL url.URL, query HistoryQuery) (bundle *models2.ShallowBundle, err error) {
 
-	// check id
-	_, err = convertIDToBsonID(id)
-	if err != nil {
-		return nil, ErrNotFound
+	resourceTypes := []string{query.ResourceType}
+	if query.Id != "" {
+		// check id
+		_, err = convertIDToBsonID(query.Id)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+	} else if query.ResourceType == "" {
+		resourceTypes = historyResourceTypes()
 	}
 
-	baseURLstr := baseURL.String()
-	if !strings.HasSuffix(baseURLstr, "/") {
-		baseURLstr = baseURLstr + "/"
+	// each resource type's collections return the versions that could be on the page,
+	// of which only the most recent are kept when merging them
+	var versions []historyVersion
+	total := 0
+	for _, resourceType := range resourceTypes {
+		typeVersions, typeTotal, err := ms.findHistoryVersions(resourceType, query)
+		if err != nil {
+			return nil, err
+		}
+		total += typeTotal
+		versions = append(versions, typeVersions...)
+		sortHistoryVersions(versions)
+		if len(versions) > query.limit() {
+			versions = versions[:query.limit()]
+		}
 	}
-	fullUrl := baseURLstr + id
 
+	if query.Id != "" && total == 0 {
+		exists, err := ms.historyExists(query.ResourceType, query.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+	}
+
+	return newHistoryBundle(baseURL, query, query.page(versions), total, func(version historyVersion) (*models2.Resource, error) {
+		if version.versionId == 0 {
+			// document created by previous versions not supporting versioning
+			return ms.Get(version.id, version.resourceType)
+		}
+		return ms.GetVersion(version.id, strconv.Itoa(version.versionId), version.resourceType)
+	})
+}
+
+// findHistoryVersions returns the number of versions of resources of a type that match a history query,
+// and the ids, versions and update times of the first limit() of them, without fetching the resources themselves
+func (ms *mongoSession) findHistoryVersions(resourceType string, query HistoryQuery) (versions []historyVersion, total int, err error) {
 	curCollection := ms.CurrentVersionCollection(resourceType)
 	prevCollection := ms.PreviousVersionsCollection(resourceType)
 
-	var entryList []models2.ShallowBundleEntryComponent
-	makeEntryRequest := func(method string) *models.BundleEntryRequestComponent {
-		return &models.BundleEntryRequestComponent{
-			Url:    resourceType + "/" + id,
-			Method: method,
+	// previous versions and deletions have vermongo-style ids
+	curIdFilter := bson.NewDocument()
+	prevFilter := bson.NewDocument()
+	if query.Id != "" {
+		curIdFilter.Append(bson.EC.String("_id", query.Id))
+		prevFilter.Append(bson.EC.String("_id._id", query.Id))
+	}
+	withBounds := func(filter *bson.Document, bounds ...*bson.Element) *bson.Document {
+		filter = filter.Copy()
+		if len(bounds) > 0 {
+			filter.Append(bson.EC.SubDocumentFromElements("meta.lastUpdated", bounds...))
 		}
+		return filter
+	}
+	var bounds []*bson.Element
+	if query.Since != nil {
+		bounds = append(bounds, bson.EC.Time("$gte", *query.Since))
 	}
+	if query.At != nil {
+		bounds = append(bounds, bson.EC.SubDocumentFromElements("$not", bson.EC.Time("$gte", query.At.RangeHighExcl())))
+	}
+	curFilter := withBounds(curIdFilter, bounds...)
 
-	// add current version
-	var curDoc bson.Document
-	curDocQuery := bson.NewDocument(bson.EC.String("_id", id))
-	err = curCollection.FindOne(context.TODO(), curDocQuery, ms.session).Decode(&curDoc)
-	if err == nil {
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
-		entry.Resource, err = models2.NewResourceFromBSON2(&curDoc)
+	curSort := bson.NewDocument(bson.EC.Int32("meta.lastUpdated", -1), bson.EC.Int32("_id", 1))
+	prevSort := bson.NewDocument(bson.EC.Int32("meta.lastUpdated", -1), bson.EC.Int32("_id._id", 1), bson.EC.Int32("_id._version", -1))
+	projection := bson.NewDocument(
+		bson.EC.Int32("_id", 1),
+		bson.EC.Int32("meta.versionId", 1),
+		bson.EC.Int32("meta.lastUpdated", 1),
+	)
+
+	// current versions haven't been replaced
+	versions, total, err = ms.findHistoryVersionsIn(curCollection, resourceType, curFilter, curSort, projection, query.limit(), decodeCurrentHistoryVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if query.At == nil {
+		prevVersions, prevTotal, err := ms.findHistoryVersionsIn(prevCollection, resourceType, withBounds(prevFilter, bounds...), prevSort, projection, query.limit(), decodePreviousHistoryVersion)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: NewResourceFromBSON failed")
+			return nil, 0, err
 		}
-		entry.Request = makeEntryRequest("PUT")
-		entryList = append(entryList, entry)
-	} else if err != mongo.ErrNoDocuments {
-		return nil, err
+		return append(versions, prevVersions...), total + prevTotal, nil
 	}
 
-	// sort - oldest versions last
-	prevDocsQuery := bson.NewDocument(bson.EC.String("_id._id", id))
-	prevDocsSort := findopt.Sort(bson.NewDocument(bson.EC.Int32("_id._version", -1)))
-	cursor, err := prevCollection.Find(context.TODO(), prevDocsQuery, prevDocsSort, ms.session)
+	// previous versions created during the _at period were replaced after its start
+	low := query.At.RangeLowIncl()
+	duringFilter := withBounds(prevFilter, append(bounds, bson.EC.Time("$gt", low))...)
+	duringVersions, duringTotal, err := ms.findHistoryVersionsIn(prevCollection, resourceType, duringFilter, prevSort, projection, query.limit(), decodePreviousHistoryVersion)
 	if err != nil {
-		return nil, errors.Wrap(err, "History: prevCollection.Find failed")
+		return nil, 0, err
+	}
+
+	// of the previous versions created before the _at period, only the last one of each resource was current
+	// at its start, unless the current version was also created before then
+	beforeBounds := []*bson.Element{bson.EC.SubDocumentFromElements("$not", bson.EC.Time("$gt", low))}
+	if query.Since != nil {
+		beforeBounds = append(beforeBounds, bson.EC.Time("$gte", *query.Since))
+	}
+	beforeFilter := withBounds(prevFilter, beforeBounds...)
+	pipeline := []*bson.Document{
+		bson.NewDocument(bson.EC.SubDocument("$match", beforeFilter)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("_id._id", 1), bson.EC.Int32("_id._version", -1))),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$group",
+			bson.EC.String("_id", "$_id._id"),
+			bson.EC.SubDocumentFromElements("version", bson.EC.String("$first", "$$ROOT")),
+		)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$lookup",
+			bson.EC.String("from", curCollection.Name()),
+			bson.EC.String("localField", "_id"),
+			bson.EC.String("foreignField", "_id"),
+			bson.EC.String("as", "current"),
+		)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$match",
+			bson.EC.SubDocumentFromElements("current.meta.lastUpdated", bson.EC.SubDocumentFromElements("$not", bson.EC.Time("$lte", low))),
+		)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$replaceRoot", bson.EC.String("newRoot", "$version"))),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$facet",
+			bson.EC.ArrayFromElements("total", bson.VC.DocumentFromElements(bson.EC.String("$count", "count"))),
+			bson.EC.ArrayFromElements("versions",
+				bson.VC.Document(bson.NewDocument(bson.EC.SubDocument("$sort", prevSort))),
+				bson.VC.DocumentFromElements(bson.EC.Int64("$limit", int64(query.limit()))),
+				bson.VC.Document(bson.NewDocument(bson.EC.SubDocument("$project", projection))),
+			),
+		)),
+	}
+	cursor, err := prevCollection.Aggregate(context.TODO(), pipeline, ms.session)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "History: prevCollection.Aggregate failed")
+	}
+	defer cursor.Close(context.TODO())
+	var result bson.Document
+	if !cursor.Next(context.TODO()) {
+		return nil, 0, errors.Wrap(cursor.Err(), "History: MongoDB aggregation for replaced versions returned no result")
+	}
+	err = cursor.Decode(&result)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "History: cursor.Decode failed")
+	}
+	beforeTotal := 0
+	if count, err := result.LookupErr("total", "0", "count"); err == nil {
+		countInt, _ := count.Int32OK()
+		beforeTotal = int(countInt)
+	}
+	var beforeVersions []historyVersion
+	if value, err := result.LookupErr("versions"); err == nil {
+		array := value.MutableArray()
+		for i := uint(0); i < uint(array.Len()); i++ {
+			value, err := array.Lookup(i)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "History: failed to read replaced versions")
+			}
+			version, err := decodePreviousHistoryVersion(resourceType, value.MutableDocument())
+			if err != nil {
+				return nil, 0, err
+			}
+			beforeVersions = append(beforeVersions, version)
+		}
 	}
 
-	for cursor.Next(context.TODO()) {
+	versions = append(versions, duringVersions...)
+	versions = append(versions, beforeVersions...)
+	return versions, total + duringTotal + beforeTotal, nil
+}
 
-		var prevDocBson bson.Document
-		err = cursor.Decode(&prevDocBson)
-		ms.debug("History: decoded prev document: %s", prevDocBson.String())
-		if err != nil {
-			return nil, errors.Wrap(err, "History: cursor.Decode failed")
-		}
+// findHistoryVersionsIn counts the documents of a collection matching a filter and decodes the first limit of them
+func (ms *mongoSession) findHistoryVersionsIn(collection *mongo.Collection, resourceType string, filter, sort, projection *bson.Document, limit int, decode func(string, *bson.Document) (historyVersion, error)) ([]historyVersion, int, error) {
+	// CountDocuments rather than Count works in transactions
+	total, err := collection.CountDocuments(context.TODO(), filter, ms.session)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "History: %s.CountDocuments failed", collection.Name())
+	}
+	if total == 0 || limit == 0 {
+		return nil, int(total), nil
+	}
 
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
+	cursor, err := collection.Find(context.TODO(), filter, findopt.Sort(sort), findopt.Limit(int64(limit)), findopt.Projection(projection), ms.session)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "History: %s.Find failed", collection.Name())
+	}
+	defer cursor.Close(context.TODO())
 
-		deleted, resource, err := unmarshalPreviousVersion(&prevDocBson)
+	var versions []historyVersion
+	for cursor.Next(context.TODO()) {
+		var doc bson.Document
+		err = cursor.Decode(&doc)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: unmarshalPreviousVersion failed")
-		}
-		if deleted {
-			entry.Request = makeEntryRequest("DELETE")
-		} else {
-			entry.Resource = resource
-			entry.Request = makeEntryRequest("PUT")
+			return nil, 0, errors.Wrap(err, "History: cursor.Decode failed")
 		}
+		ms.debug("History: decoded document: %s", doc.String())
 
-		entryList = append(entryList, entry)
+		version, err := decode(resourceType, &doc)
+		if err != nil {
+			return nil, 0, err
+		}
+		versions = append(versions, version)
 	}
 	if err := cursor.Err(); err != nil {
-		return nil, errors.Wrap(err, "History: MongoDB query for previous versions failed")
+		return nil, 0, errors.Wrapf(err, "History: MongoDB query of %s failed", collection.Name())
 	}
+	return versions, int(total), nil
+}
 
-	totalDocs := uint32(len(entryList))
-	if totalDocs == 0 {
-		return nil, ErrNotFound
+// historyExists returns whether a resource has any current or previous versions
+func (ms *mongoSession) historyExists(resourceType, id string) (bool, error) {
+	count, err := ms.CurrentVersionCollection(resourceType).CountDocuments(context.TODO(), bson.NewDocument(bson.EC.String("_id", id)), ms.session)
+	if err != nil {
+		return false, errors.Wrap(err, "History: curCollection.CountDocuments failed")
 	}
+	if count > 0 {
+		return true, nil
+	}
+	count, err = ms.PreviousVersionsCollection(resourceType).CountDocuments(context.TODO(), bson.NewDocument(bson.EC.String("_id._id", id)), ms.session)
+	if err != nil {
+		return false, errors.Wrap(err, "History: prevCollection.CountDocuments failed")
+	}
+	return count > 0, nil
+}
 
-	// last entry should be a POST
-	entryList[len(entryList)-1].Request.Method = "POST"
-	entryList[len(entryList)-1].Request.Url = resourceType
-
-	// output a Bundle
-	bundle = &models2.ShallowBundle{
-		Id:    objectid.New().Hex(),
-		Type:  "history",
-		Entry: entryList,
-		Total: &totalDocs,
+// decodeCurrentHistoryVersion returns the id, version and update time of a current version
+func decodeCurrentHistoryVersion(resourceType string, curDoc *bson.Document) (historyVersion, error) {
+	version := historyVersion{resourceType: resourceType}
+	idValue, err := curDoc.LookupErr("_id")
+	if err != nil {
+		return version, errors.Wrap(err, "History: current version without an _id")
+	}
+	var isString bool
+	version.id, isString = idValue.StringValueOK()
+	if !isString {
+		return version, errors.Errorf("History: _id of current %s is not a string", resourceType)
+	}
+	_, version.versionId, _ = getVersionIdFromResource(curDoc)
+	if version.versionId < 0 {
+		version.versionId = 0
 	}
+	version.lastUpdated = historyLastUpdated(curDoc)
+	return version, nil
+}
 
-	// TODO: use paging
-	// bundle.Link = dal.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+// decodePreviousHistoryVersion returns the id, version and update time of a previous version or deletion
+func decodePreviousHistoryVersion(resourceType string, prevDoc *bson.Document) (historyVersion, error) {
+	version := historyVersion{resourceType: resourceType}
+	idValue, err := prevDoc.LookupErr("_id", "_id")
+	if err != nil {
+		return version, errors.Wrap(err, "History: previous version without an _id._id")
+	}
+	var isString bool
+	version.id, isString = idValue.StringValueOK()
+	if !isString {
+		return version, errors.Errorf("History: _id._id of previous %s is not a string", resourceType)
+	}
+	versionValue, err := prevDoc.LookupErr("_id", "_version")
+	if err != nil {
+		return version, errors.Wrap(err, "History: previous version without an _id._version")
+	}
+	versionInt, isInt := versionValue.Int32OK()
+	if !isInt {
+		return version, errors.Errorf("History: _id._version of previous %s/%s is not an integer", resourceType, version.id)
+	}
+	version.versionId = int(versionInt)
+	if deletedValue, err := prevDoc.LookupErr("_id", "_deleted"); err == nil {
+		deletedInt, isInt := deletedValue.Int32OK()
+		version.deleted = isInt && deletedInt > 0
+	}
+	version.lastUpdated = historyLastUpdated(prevDoc)
+	return version, nil
+}
 
-	return bundle, nil
+// historyLastUpdated returns the meta.lastUpdated time of a document, or the zero time if it has none
+func historyLastUpdated(doc *bson.Document) time.Time {
+	value, err := doc.LookupErr("meta", "lastUpdated")
+	if err != nil {
+		return time.Time{}
+	}
+	lastUpdated, isTime := value.DateTimeOK()
+	if !isTime {
+		return time.Time{}
+	}
+	return lastUpdated
 }
 
 func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
 
 	searcher := search.NewMongoSearcher(ms.db, ms.session, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.readonly)
+	searcher.SetMaxIncludeIterations(ms.dal.maxIncludeIterations)
 
 	resources, total, err := searcher.Search(searchQuery)
 	if err != nil {
 		return nil, convertMongoErr(err)
 	}
 
+	return newSearchBundle(baseURL, searchQuery, resources, total, ms.dal.countTotalResults, true), nil
+}
+
+// newSearchBundle creates a searchset bundle from search results, including any
+// _include or _revinclude resources attached to them. If cursorPaging is set the
+// next link continues after the last result using a _cursor rather than an _offset.
+func newSearchBundle(baseURL url.URL, searchQuery search.Query, resources []*models2.Resource, total uint32, countTotalResults bool, cursorPaging bool) *models2.ShallowBundle {
 	includesMap := make(map[string]*models2.Resource)
 	var entryList []models2.ShallowBundleEntryComponent
 	numResults := len(resources)
@@ -973,7 +1272,6 @@ func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*mode
 	}
 
 	for _, v := range includesMap {
-		ms.debug("includesMap: %#v\n", v)
 		var entry models2.ShallowBundleEntryComponent
 		entry.Resource = v
 		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
@@ -987,30 +1285,28 @@ func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*mode
 	}
 
 	// Only include the total if counts are enabled, or if _summary=count was applied.
-	if ms.dal.countTotalResults || searchQuery.Options().Summary == "count" {
+	if countTotalResults || searchQuery.Options().Summary == "count" {
 		bundle.Total = &total
 	}
 
-	bundle.Link = ms.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+	// Clients paging with _offset keep getting _offset links
+	var nextCursor *search.PageCursor
+	if cursorPaging && numResults > 0 && searchQuery.Options().Offset == 0 {
+		cursor, err := search.NewPageCursor(resources[numResults-1], searchQuery.Options())
+		if err == nil {
+			nextCursor = cursor
+		}
+	}
+
+	bundle.Link = generatePagingLinks(baseURL, searchQuery, total, uint32(numResults), countTotalResults, nextCursor)
 
-	return &bundle, nil
+	return &bundle
 }
 
 func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
 
 	// First create a new query with the unsupported query options filtered out
-	oldParams := searchQuery.URLQueryParameters(false)
-	newParams := search.URLQueryParameters{}
-	for _, param := range oldParams.All() {
-		switch param.Key {
-		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
-			search.RevIncludeParam, search.SummaryParam:
-			continue
-		default:
-			newParams.Add(param.Key, param.Value)
-		}
-	}
-	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+	newQuery := findIDsQuery(searchQuery)
 
 	// Now search on that query, unmarshaling to a temporary struct and converting results to []string
 	searcher := search.NewMongoSearcher(ms.db, ms.session, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.readonly)
@@ -1028,8 +1324,27 @@ func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err err
 }
 
 func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query, total uint32, numResults uint32) []models.BundleLinkComponent {
+	return generatePagingLinks(baseURL, query, total, numResults, ms.dal.countTotalResults, nil)
+}
+
+// findIDsQuery filters out the query options not needed when only finding ids
+func findIDsQuery(searchQuery search.Query) search.Query {
+	oldParams := searchQuery.URLQueryParameters(false)
+	newParams := search.URLQueryParameters{}
+	for _, param := range oldParams.All() {
+		switch param.Key {
+		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
+			search.RevIncludeParam, search.SummaryParam:
+			continue
+		default:
+			newParams.Add(param.Key, param.Value)
+		}
+	}
+	return search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+}
+
+func generatePagingLinks(baseURL url.URL, query search.Query, total uint32, numResults uint32, countTotalResults bool, nextCursor *search.PageCursor) []models.BundleLinkComponent {
 
-	links := make([]models.BundleLinkComponent, 0, 5)
 	params := query.URLQueryParameters(true)
 	offset := 0
 	if pOffset := params.Get(search.OffsetParam); pOffset != "" {
@@ -1048,7 +1363,29 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 
 	// For queries that don't support paging, only return the "self" link created directly from the original query.
 	if !query.SupportsPaging() {
-		links = append(links, newRawSelfLink(baseURL, query))
+		return []models.BundleLinkComponent{newRawSelfLink(baseURL, query)}
+	}
+
+	return newPagingLinks(baseURL, params, offset, count, total, numResults, countTotalResults, nextCursor)
+}
+
+// newPagingLinks returns the self, first, previous, next and last links for a page of results.
+// If a nextCursor is given the next link uses it instead of an offset.
+func newPagingLinks(baseURL url.URL, params search.URLQueryParameters, offset int, count int, total uint32, numResults uint32, countTotalResults bool, nextCursor *search.PageCursor) []models.BundleLinkComponent {
+
+	links := make([]models.BundleLinkComponent, 0, 5)
+
+	// The offset of a page reached with a _cursor isn't known, so it has no previous link and
+	// its next link can only continue with another cursor
+	if cursor := params.Get(search.CursorParam); cursor != "" {
+		links = append(links, newCursorLink("self", baseURL, params, cursor, count))
+		links = append(links, newLink("first", baseURL, params, 0, count))
+		if int(numResults) == count && nextCursor != nil {
+			links = append(links, newCursorLink("next", baseURL, params, nextCursor.Token(), count))
+		}
+		if countTotalResults {
+			links = append(links, newLink("last", baseURL, params, lastPageOffset(total, 0, count), count))
+		}
 		return links
 	}
 
@@ -1070,23 +1407,14 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 	}
 
 	// If counts are enabled, the total is accurate and can be used to compute the links.
-	if ms.dal.countTotalResults {
+	if countTotalResults {
 		// Next Link
 		if total > uint32(offset+count) {
-			nextOffset := offset + count
-			links = append(links, newLink("next", baseURL, params, nextOffset, count))
+			links = append(links, newNextLink(baseURL, params, offset, count, nextCursor))
 		}
 
 		// Last Link
-		remainder := (int(total) - offset) % count
-		if int(total) < offset {
-			remainder = 0
-		}
-		newOffset := int(total) - remainder
-		if remainder == 0 && int(total) > count {
-			newOffset = int(total) - count
-		}
-		links = append(links, newLink("last", baseURL, params, newOffset, count))
+		links = append(links, newLink("last", baseURL, params, lastPageOffset(total, offset, count), count))
 
 	} else {
 		// Otherwise, we can only use the number of results returned by the search, and compare
@@ -1094,8 +1422,7 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 
 		// Next Link
 		if int(numResults) == count {
-			nextOffset := offset + count
-			links = append(links, newLink("next", baseURL, params, nextOffset, count))
+			links = append(links, newNextLink(baseURL, params, offset, count, nextCursor))
 		}
 
 		// Last Link
@@ -1106,6 +1433,19 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 	return links
 }
 
+// lastPageOffset returns the offset of the last page of results, keeping the pages aligned with the current offset
+func lastPageOffset(total uint32, offset int, count int) int {
+	remainder := (int(total) - offset) % count
+	if int(total) < offset {
+		remainder = 0
+	}
+	newOffset := int(total) - remainder
+	if remainder == 0 && int(total) > count {
+		newOffset = int(total) - count
+	}
+	return newOffset
+}
+
 func newRawSelfLink(baseURL url.URL, query search.Query) models.BundleLinkComponent {
 	queryString := ""
 	if len(query.Query) > 0 {
@@ -1118,13 +1458,29 @@ func newRawSelfLink(baseURL url.URL, query search.Query) models.BundleLinkCompon
 	}
 }
 
+func newNextLink(baseURL url.URL, params search.URLQueryParameters, offset int, count int, nextCursor *search.PageCursor) models.BundleLinkComponent {
+	if nextCursor != nil {
+		return newCursorLink("next", baseURL, params, nextCursor.Token(), count)
+	}
+	return newLink("next", baseURL, params, offset+count, count)
+}
+
 func newLink(relation string, baseURL url.URL, params search.URLQueryParameters, offset int, count int) models.BundleLinkComponent {
+	params = params.Without(search.CursorParam)
 	params.Set(search.OffsetParam, strconv.Itoa(offset))
 	params.Set(search.CountParam, strconv.Itoa(count))
 	baseURL.RawQuery = params.Encode()
 	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
 }
 
+func newCursorLink(relation string, baseURL url.URL, params search.URLQueryParameters, cursor string, count int) models.BundleLinkComponent {
+	params = params.Without(search.OffsetParam)
+	params.Set(search.CursorParam, cursor)
+	params.Set(search.CountParam, strconv.Itoa(count))
+	baseURL.RawQuery = params.Encode()
+	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
+}
+
 func convertIDToBsonID(id string) (objectid.ObjectID, error) {
 	objId, err := objectid.FromHex(id)
 	if err == nil {
@@ -1139,6 +1495,28 @@ func updateResourceMeta(resource *models2.Resource, versionId int) {
 	resource.SetVersionId(versionId)
 }
 
+// hasErrorLabel checks whether a (possibly wrapped) MongoDB server error carries the given label
+func hasErrorLabel(err error, label string) bool {
+	labelled, ok := errors.Cause(err).(interface {
+		HasErrorLabel(string) bool
+	})
+	return ok && labelled.HasErrorLabel(label)
+}
+
+// isTransientTransactionError checks whether a transaction failed in a way that means
+// the whole transaction can be retried (e.g. a write conflict with a concurrent transaction).
+// Commits whose outcome is still unknown after retrying them are not, as the transaction may
+// have been committed and replaying it would apply its entries twice.
+func isTransientTransactionError(err error) bool {
+	if err == nil || hasErrorLabel(err, "UnknownTransactionCommitResult") {
+		return false
+	}
+	if hasErrorLabel(err, "TransientTransactionError") {
+		return true
+	}
+	return strings.Contains(err.Error(), "WriteConflict")
+}
+
 func convertMongoErr(err error) error {
 	switch err {
 	case mongo.ErrNoDocuments:
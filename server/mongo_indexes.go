@@ -136,6 +136,11 @@ func parseIndex(line string) (collectionName string, newIndex *mongo.IndexModel,
 
 	// build the index in the background; do not block other connections
 	newIndex.Options = bson.NewDocument(bson.EC.Boolean("background", true))
+	if isTextIndex(indexSpec) {
+		// MongoDB would otherwise take the language of text from the resource's language
+		// element, which holds codes (e.g. en-AU) that it doesn't understand
+		newIndex.Options.Append(bson.EC.String("language_override", "__language"))
+	}
 	return collectionName, newIndex, nil
 }
 
@@ -143,15 +148,15 @@ func parseIndex(line string) (collectionName string, newIndex *mongo.IndexModel,
 // <db_name>.<collection_name>.<key>_(-)1
 func parseStandardIndex(indexSpec string) (*mongo.IndexModel, error) {
 
-	key, direction := parseIndexKey(indexSpec)
+	key := parseIndexKey(indexSpec)
 
-	if key == "" {
+	if key == nil {
 		// invalid key format, was not parsed successfully
 		return nil, errors.New("Standard key not of format: <key>_(-)1")
 	}
 
 	return &mongo.IndexModel{
-		Keys: bson.NewDocument(bson.EC.Int32(key, direction)),
+		Keys: bson.NewDocument(key),
 	}, nil
 }
 
@@ -171,11 +176,11 @@ func parseCompoundIndex(indexSpec string) (*mongo.IndexModel, error) {
 	var keys bson.Document
 
 	for _, spec := range specs {
-		key, direction := parseIndexKey(strings.Trim(spec, " ")) // trim leading and trailing whitespace before parsing
-		if key == "" {
+		key := parseIndexKey(strings.Trim(spec, " ")) // trim leading and trailing whitespace before parsing
+		if key == nil {
 			return nil, errors.New("Compound key sub-key not of format: <key>_(-)1")
 		}
-		keys.Set(bson.EC.Int32(key, direction))
+		keys.Set(key)
 	}
 	return &mongo.IndexModel{
 		Keys: &keys,
@@ -183,9 +188,13 @@ func parseCompoundIndex(indexSpec string) (*mongo.IndexModel, error) {
 }
 
 // parseIndexKey converts the standard mongo index key format: "<key>_(-)1"
-// to the format used by mongo.IndexModel: "(-)<key>"
-func parseIndexKey(spec string) (key string, direction int32) {
+// to the format used by mongo.IndexModel: "(-)<key>". Keys of text indexes,
+// which support _text and _content searches, have the format "<key>_text",
+// where the key may be the $** wildcard to index all strings in the resource.
+func parseIndexKey(spec string) *bson.Element {
 
+	var key string
+	var direction int32
 	if strings.HasSuffix(spec, "_1") {
 		// ascending
 		direction = 1
@@ -194,11 +203,36 @@ func parseIndexKey(spec string) (key string, direction int32) {
 		// descending
 		direction = -1
 		key = strings.TrimSuffix(spec, "_-1")
+	} else if strings.HasSuffix(spec, "_text") {
+		key = strings.TrimSuffix(spec, "_text")
+		if key == "" {
+			return nil // error
+		}
+		return bson.EC.String(key, "text")
+	} else if strings.HasSuffix(spec, "_2dsphere") {
+		key = strings.TrimSuffix(spec, "_2dsphere")
+		if key == "" {
+			return nil // error
+		}
+		return bson.EC.String(key, "2dsphere")
 	} else {
-		return "", 0 // error
+		return nil // error
 	}
 
-	return
+	if key == "" {
+		return nil // error
+	}
+	return bson.EC.Int32(key, direction)
+}
+
+// isTextIndex returns true if any of the keys in an index spec are text keys
+func isTextIndex(indexSpec string) bool {
+	for _, spec := range strings.Split(strings.Trim(indexSpec, "()"), ",") {
+		if strings.HasSuffix(strings.TrimSpace(spec), "_text") {
+			return true
+		}
+	}
+	return false
 }
 
 func newParseIndexError(indexName, reason string) error {
@@ -178,6 +178,32 @@ func (s *MongoIndexesTestSuite) TestParseIndexCompoundIndexMixed() {
 	s.Equal(index.Keys.ElementAt(1).Value().Int32(), int32(1), "The index key should be 1")
 }
 
+func (s *MongoIndexesTestSuite) TestParseIndexTextIndex() {
+
+	indexStr := "testcollection.$**_text"
+	collectionName, index, err := parseIndex(indexStr)
+
+	s.Nil(err, "Should return without error")
+	s.Equal(collectionName, "testcollection", "Collection name should be 'testcollection'")
+	s.Equal(index.Keys.Len(), 1, "The created index should contain one key")
+	s.Equal(index.Keys.ElementAt(0).Key(), "$**", "The index key should be '$**'")
+	s.Equal(index.Keys.ElementAt(0).Value().StringValue(), "text", "The index key should be text")
+	s.Equal(index.Options.Lookup("language_override").StringValue(), "__language", "The language of text shouldn't come from the resource")
+}
+
+func (s *MongoIndexesTestSuite) TestParseIndex2dsphereIndex() {
+
+	indexStr := "locations.__search.__near_2dsphere"
+	collectionName, index, err := parseIndex(indexStr)
+
+	s.Nil(err, "Should return without error")
+	s.Equal(collectionName, "locations", "Collection name should be 'locations'")
+	s.Equal(index.Keys.Len(), 1, "The created index should contain one key")
+	s.Equal(index.Keys.ElementAt(0).Key(), "__search.__near", "The index key should be '__search.__near'")
+	s.Equal(index.Keys.ElementAt(0).Value().StringValue(), "2dsphere", "The index key should be 2dsphere")
+	s.Nil(index.Options.Lookup("language_override"), "Only text indexes have a language")
+}
+
 func (s *MongoIndexesTestSuite) TestParseIndexNoIndex() {
 
 	indexStr := ""
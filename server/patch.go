@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/patch"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// PatchHandler handles requests to patch a resource having a given ID, using either a JSON Patch
+// document or a FHIRPath Patch Parameters resource.
+func (rc *ResourceController) PatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	rc.patch(c, session, c.Param("id"))
+}
+
+// ConditionalPatchHandler handles requests to patch the single resource matching search criteria.
+func (rc *ResourceController) ConditionalPatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
+	IDs, err := session.FindIDs(query)
+	if err != nil {
+		panic(errors.Wrap(err, "ConditionalPatch FindIDs failed"))
+	}
+
+	switch len(IDs) {
+	case 0:
+		c.Status(http.StatusNotFound)
+	case 1:
+		rc.patch(c, session, IDs[0])
+	default:
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+	}
+}
+
+func (rc *ResourceController) patch(c *gin.Context, session DataAccessSession, resourceId string) {
+	p, err := bindPatch(c, rc.Config.ValidatorURL)
+	if err != nil {
+		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	conditionalVersionId := ""
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		conditionalVersionId, err = utils.ETagToVersionId(ifMatch)
+		if err != nil {
+			oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+			return
+		}
+	}
+
+	resource, err := patchResource(session, rc.Config.EnableHistory, rc.Name, resourceId, conditionalVersionId, p, shouldEncryptPatientDetails(c))
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "Patch failed"))
+	}
+
+	c.Set(rc.Name, resource)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "update")
+
+	err = setHeaders(c, rc, false, resource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "PatchHandler setHeaders failed"))
+	}
+	renderWriteResult(c, http.StatusOK, resource, fmt.Sprintf("Patched %s/%s", rc.Name, resourceId))
+}
+
+// bindPatch reads a JSON Patch document or a FHIRPath Patch Parameters resource (in JSON or XML) from the request body
+func bindPatch(c *gin.Context, validatorURL string) (patch.Patch, error) {
+	if strings.Contains(c.ContentType(), patch.JSONPatchContentType) {
+		bodyBytes, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "bindPatch: failed to read request body")
+		}
+		return patch.ParseJSONPatch(bodyBytes)
+	}
+
+	resource, err := FHIRBind(c, validatorURL)
+	if err != nil {
+		return nil, err
+	}
+	return patchFromResource(resource)
+}
+
+// patchFromResource returns the patch contained in a resource: either a FHIRPath Patch Parameters resource
+// or a Binary containing a JSON Patch document (as used in batches and transactions)
+func patchFromResource(resource *models2.Resource) (patch.Patch, error) {
+	switch resource.ResourceType() {
+	case "Parameters":
+		return patch.ParseFHIRPathPatch(resource.JsonBytes())
+	case "Binary":
+		var binary models.Binary
+		if err := resource.Unmarshal(&binary); err != nil {
+			return nil, errors.Wrap(err, "failed to decode Binary containing a JSON Patch")
+		}
+		if binary.ContentType != patch.JSONPatchContentType {
+			return nil, errors.Errorf("Binary patches must have a contentType of %s", patch.JSONPatchContentType)
+		}
+		data, err := base64.StdEncoding.DecodeString(binary.Content)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode Binary content")
+		}
+		return patch.ParseJSONPatch(data)
+	default:
+		return nil, errors.Errorf("a patch must be a JSON Patch document or a FHIRPath Patch Parameters resource, not a %s", resource.ResourceType())
+	}
+}
+
+// patchResource applies a patch to the current version of a resource and saves the result with Put, so
+// that a new version is created just like for an update. If conditionalVersionId is given (from If-Match)
+// it must be the current versionId. When histories are enabled the Put is conditional on the version that
+// was patched so that concurrent updates aren't silently overwritten.
+func patchResource(session DataAccessSession, enableHistory bool, resourceType, id, conditionalVersionId string, p patch.Patch, encryptPatientDetails bool) (*models2.Resource, error) {
+	current, err := session.Get(id, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	if conditionalVersionId != "" && conditionalVersionId != current.VersionId() {
+		return nil, ErrConflict{msg: "If-Match doesn't match current versionId"}
+	}
+
+	patchedJSON, err := p.Apply(current.JsonBytes())
+	if err != nil {
+		return nil, err
+	}
+	patched, err := models2.NewResourceFromJsonBytes(patchedJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse patched resource")
+	}
+	if encryptPatientDetails {
+		patched.SetWhatToEncrypt(models2.WhatToEncrypt{PatientDetails: true})
+	}
+
+	versionToCheck := ""
+	if enableHistory {
+		versionToCheck = current.VersionId()
+	}
+	_, err = session.Put(id, versionToCheck, patched)
+	if err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
@@ -0,0 +1,677 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/lib/pq"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// PostgreSQL storage (see docs/PostgreSQL_ideas.md):
+//   - every version of every resource is stored as an immutable JSON blob in a single
+//     history table, identified by (resource_type, id, version_id)
+//   - each resource type has a table with a row for the current version of each resource,
+//     holding a JSONB search document indexed with GIN; searches join to the history table
+//     to retrieve the blobs
+//   - deletions are recorded as history rows without a blob
+
+type postgresDataAccessLayer struct {
+	db                *sql.DB
+	defaultSchema     string
+	enableMultiDB     bool
+	dbSuffix          string
+	Interceptors      map[string]InterceptorList
+	countTotalResults bool
+	enableCISearches  bool
+	enableHistory     bool
+	readonly          bool
+	createdSchemas    sync.Map
+}
+
+type postgresSession struct {
+	dal    *postgresDataAccessLayer
+	schema string
+	tx     *sql.Tx
+}
+
+// postgresExecutor is implemented by both *sql.DB and *sql.Tx
+type postgresExecutor interface {
+	search.PostgresQueryer
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// NewPostgresDataAccessLayer returns an implementation of DataAccessLayer that is backed by a PostgreSQL database.
+// Each database name (see EnableMultiDB) is mapped to a PostgreSQL schema.
+func NewPostgresDataAccessLayer(db *sql.DB, defaultSchema string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
+	return &postgresDataAccessLayer{
+		db:                db,
+		defaultSchema:     defaultSchema,
+		enableMultiDB:     enableMultiDB,
+		dbSuffix:          dbSuffix,
+		Interceptors:      interceptors,
+		countTotalResults: config.CountTotalResults,
+		enableCISearches:  config.EnableCISearches,
+		enableHistory:     config.EnableHistory,
+		readonly:          config.ReadOnly,
+	}
+}
+
+func (dal *postgresDataAccessLayer) StartSession(customDbName string) DataAccessSession {
+	var schema string
+	if dal.enableMultiDB && customDbName != "" {
+		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
+			panic(errors.Errorf("database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
+		}
+		schema = customDbName
+	} else {
+		schema = dal.defaultSchema
+	}
+
+	if _, created := dal.createdSchemas.Load(schema); !created {
+		err := CreatePostgresTables(dal.db, schema)
+		if err != nil {
+			panic(errors.Wrapf(err, "failed to create tables in schema %s", schema))
+		}
+		dal.createdSchemas.Store(schema, true)
+	}
+
+	return &postgresSession{
+		dal:    dal,
+		schema: schema,
+	}
+}
+
+// CreatePostgresTables creates the history table and a table for each resource type in the given schema
+func CreatePostgresTables(db *sql.DB, schema string) error {
+	history := search.PostgresTableName(schema, search.PostgresHistoryTable)
+	statements := []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", search.PostgresQuoteIdentifier(schema)),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			resource_type text NOT NULL,
+			id text NOT NULL,
+			version_id integer NOT NULL,
+			last_updated timestamptz NOT NULL,
+			deleted boolean NOT NULL DEFAULT false,
+			resource json,
+			PRIMARY KEY (resource_type, id, version_id)
+		)`, history),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS history_last_updated_idx ON %s (last_updated)", history),
+	}
+	for _, name := range models2.AllFhirResourceCollectionNames() {
+		table := search.PostgresTableName(schema, name)
+		statements = append(statements,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				id text PRIMARY KEY,
+				version_id integer NOT NULL,
+				last_updated timestamptz NOT NULL,
+				content jsonb NOT NULL
+			)`, table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING gin (content jsonb_path_ops)", search.PostgresQuoteIdentifier(name+"_content_idx"), table),
+		)
+	}
+
+	_, err := db.ExecContext(context.Background(), strings.Join(statements, ";\n"))
+	return err
+}
+
+func (ps *postgresSession) debug(format string, a ...interface{}) {
+	// fmt.Printf("[postgres] " + format + "\n", a...)
+}
+
+func (ps *postgresSession) history() string {
+	return search.PostgresTableName(ps.schema, search.PostgresHistoryTable)
+}
+
+func (ps *postgresSession) table(resourceType string) string {
+	return search.PostgresResourceTableName(ps.schema, resourceType)
+}
+
+// q returns the current transaction, if any, or otherwise the database
+func (ps *postgresSession) q() postgresExecutor {
+	if ps.tx != nil {
+		return ps.tx
+	}
+	return ps.dal.db
+}
+
+// atomically runs f in the current transaction, or in a new one if there is none
+func (ps *postgresSession) atomically(f func(q postgresExecutor) error) error {
+	if ps.tx != nil {
+		return f(ps.tx)
+	}
+
+	tx, err := ps.dal.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return errors.Wrap(err, "BeginTx failed")
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "Commit failed")
+}
+
+func (ps *postgresSession) StartTransaction() error {
+	if ps.tx != nil {
+		// sucess if already in a transaction
+		return nil
+	}
+
+	tx, err := ps.dal.db.BeginTx(context.TODO(), nil)
+	ps.debug("StartTransaction")
+	if err == nil {
+		ps.tx = tx
+	}
+	return errors.Wrap(err, "postgresSession.StartTransaction")
+}
+
+func (ps *postgresSession) CommmitIfTransaction() error {
+	if ps.tx != nil {
+		err := ps.tx.Commit()
+		ps.debug("Commit")
+		ps.tx = nil
+		return errors.Wrap(err, "postgresSession.CommmitIfTransaction")
+	}
+	return nil
+}
+
+func (ps *postgresSession) Finish() {
+	if ps.tx != nil {
+		err := ps.tx.Rollback()
+		ps.debug("Rollback called from postgresSession.Finish")
+		ps.tx = nil
+		if err != nil {
+			panic(errors.Wrap(err, "session.Finish error"))
+		}
+	}
+}
+
+func (ps *postgresSession) Get(id, resourceType string) (resource *models2.Resource, err error) {
+	if !isValidFhirID(id) {
+		return nil, ErrNotFound
+	}
+
+	query := fmt.Sprintf("SELECT h.resource FROM %s t JOIN %s h ON h.resource_type = $1 AND h.id = t.id AND h.version_id = t.version_id WHERE t.id = $2", ps.table(resourceType), ps.history())
+	var jsonBytes []byte
+	err = ps.q().QueryRowContext(context.TODO(), query, resourceType, id).Scan(&jsonBytes)
+	ps.debug("Get %s/%s --> %s (err %+v)", resourceType, id, jsonBytes, err)
+	if err == sql.ErrNoRows && ps.dal.enableHistory {
+		// check whether this is a deleted record
+		deleted, _, err := ps.latestHistoryVersion(ps.q(), resourceType, id)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get --> latestHistoryVersion")
+		}
+		if deleted {
+			return nil, ErrDeleted
+		}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	return models2.NewResourceFromJsonBytes(jsonBytes)
+}
+
+// latestHistoryVersion returns the most recent version stored in the history table, or 0 if there is none
+func (ps *postgresSession) latestHistoryVersion(q postgresExecutor, resourceType, id string) (deleted bool, versionId int, err error) {
+	query := fmt.Sprintf("SELECT deleted, version_id FROM %s WHERE resource_type = $1 AND id = $2 ORDER BY version_id DESC LIMIT 1", ps.history())
+	err = q.QueryRowContext(context.TODO(), query, resourceType, id).Scan(&deleted, &versionId)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	return
+}
+
+func (ps *postgresSession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
+	if !isValidFhirID(id) {
+		return nil, ErrNotFound
+	}
+
+	versionIdInt, err := strconv.Atoi(versionIdStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert versionId to an integer (%s)", versionIdStr)
+	}
+
+	query := fmt.Sprintf("SELECT deleted, resource FROM %s WHERE resource_type = $1 AND id = $2 AND version_id = $3", ps.history())
+	var deleted bool
+	var jsonBytes []byte
+	err = ps.q().QueryRowContext(context.TODO(), query, resourceType, id, versionIdInt).Scan(&deleted, &jsonBytes)
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+	if deleted {
+		return nil, ErrDeleted
+	}
+
+	return models2.NewResourceFromJsonBytes(jsonBytes)
+}
+
+func (ps *postgresSession) GetSubset(id, versionId, resourceType string, projection *search.ElementsProjection) (resource *models2.Resource, err error) {
+	return getAndSubset(ps, id, versionId, resourceType, projection)
+}
+
+func (ps *postgresSession) Post(resource *models2.Resource) (id string, err error) {
+	id = objectid.New().Hex()
+	err = ps.PostWithID(id, resource)
+	return
+}
+
+func (ps *postgresSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	existingIds, err := ps.FindIDs(query)
+	if err != nil {
+		return
+	}
+
+	if len(existingIds) == 0 {
+		httpStatus = 201
+		id = objectid.New().Hex()
+		err = ps.PostWithID(id, resource)
+		if err == nil {
+			outputResource = resource
+		}
+
+	} else if len(existingIds) == 1 {
+		httpStatus = 200
+		id = existingIds[0]
+		outputResource, err = ps.Get(id, query.Resource)
+
+	} else if len(existingIds) > 1 {
+		httpStatus = 412
+	}
+
+	return
+}
+
+func (ps *postgresSession) PostWithID(id string, resource *models2.Resource) error {
+	if !isValidFhirID(id) {
+		return invalidFhirIDError()
+	}
+
+	resourceType := resource.ResourceType()
+	resource.SetId(id)
+
+	invokeInterceptorsBefore(ps.dal.Interceptors, "Create", resourceType, resource)
+
+	err := ps.atomically(func(q postgresExecutor) error {
+		// versions continue from any previously deleted resource with the same id
+		_, latestVersionId, err := ps.latestHistoryVersion(q, resourceType, id)
+		if err != nil {
+			return errors.Wrap(err, "PostWithID --> latestHistoryVersion")
+		}
+		updateResourceMeta(resource, latestVersionId+1)
+
+		ps.debug("PostWithID: inserting %s", resource)
+		return ps.insertVersion(q, resource, true)
+	})
+
+	if err == nil {
+		invokeInterceptorsAfter(ps.dal.Interceptors, "Create", resourceType, resource)
+	} else {
+		invokeInterceptorsOnError(ps.dal.Interceptors, "Create", resourceType, err, resource)
+	}
+
+	return err
+}
+
+// insertVersion stores the resource's blob in the history table and
+// inserts or updates its row in the resource table
+func (ps *postgresSession) insertVersion(q postgresExecutor, resource *models2.Resource, mustBeNew bool) error {
+	resourceType := resource.ResourceType()
+	versionId, err := strconv.Atoi(resource.VersionId())
+	if err != nil {
+		return errors.Wrapf(err, "invalid versionId (%s)", resource.VersionId())
+	}
+
+	jsonBytes, err := resource.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "resource.MarshalJSON failed")
+	}
+	searchDocument, err := search.PostgresSearchDocument(resource)
+	if err != nil {
+		return errors.Wrap(err, "PostgresSearchDocument failed")
+	}
+	lastUpdated := resource.LastUpdatedTime()
+
+	insertHistory := fmt.Sprintf("INSERT INTO %s (resource_type, id, version_id, last_updated, resource) VALUES ($1, $2, $3, $4, $5)", ps.history())
+	_, err = q.ExecContext(context.TODO(), insertHistory, resourceType, resource.Id(), versionId, lastUpdated, string(jsonBytes))
+	if err != nil {
+		return errors.Wrap(convertPostgresErr(err), "failed to store version in history")
+	}
+
+	insertCurrent := fmt.Sprintf("INSERT INTO %s (id, version_id, last_updated, content) VALUES ($1, $2, $3, $4)", ps.table(resourceType))
+	if !mustBeNew {
+		insertCurrent += " ON CONFLICT (id) DO UPDATE SET version_id = EXCLUDED.version_id, last_updated = EXCLUDED.last_updated, content = EXCLUDED.content"
+	}
+	_, err = q.ExecContext(context.TODO(), insertCurrent, resource.Id(), versionId, lastUpdated, string(searchDocument))
+	if err != nil {
+		return errors.Wrap(convertPostgresErr(err), "failed to store current version")
+	}
+
+	if !ps.dal.enableHistory {
+		deletePrevious := fmt.Sprintf("DELETE FROM %s WHERE resource_type = $1 AND id = $2 AND version_id < $3", ps.history())
+		_, err = q.ExecContext(context.TODO(), deletePrevious, resourceType, resource.Id(), versionId)
+		if err != nil {
+			return errors.Wrap(convertPostgresErr(err), "failed to delete previous versions")
+		}
+	}
+	return nil
+}
+
+// lockCurrentVersion returns the current versionId of a resource (or 0 if it doesn't exist),
+// locking its row until the end of the transaction
+func (ps *postgresSession) lockCurrentVersion(q postgresExecutor, resourceType, id string) (versionId int, err error) {
+	query := fmt.Sprintf("SELECT version_id FROM %s WHERE id = $1 FOR UPDATE", ps.table(resourceType))
+	err = q.QueryRowContext(context.TODO(), query, id).Scan(&versionId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return versionId, err
+}
+
+func (ps *postgresSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	if !isValidFhirID(id) {
+		return false, invalidFhirIDError()
+	}
+
+	resourceType := resource.ResourceType()
+	resource.SetId(id)
+	if conditionalVersionId != "" {
+		ps.debug("PUT %s/%s (If-Match %s)", resourceType, id, conditionalVersionId)
+	} else {
+		ps.debug("PUT %s/%s", resourceType, id)
+	}
+
+	if ps.dal.enableHistory == false && conditionalVersionId != "" {
+		return false, errors.Errorf("If-Match specified for a conditional put, but version histories are disabled")
+	}
+
+	err = ps.atomically(func(q postgresExecutor) error {
+		curVersionId, err := ps.lockCurrentVersion(q, resourceType, id)
+		if err != nil {
+			return errors.Wrap(convertPostgresErr(err), "Put handler: error retrieving current version")
+		}
+
+		var newVersionId int
+		if curVersionId == 0 {
+			if conditionalVersionId != "" {
+				return ErrConflict{msg: "If-Match specified for a resource that doesn't exist"}
+			}
+			createdNew = true
+			_, latestVersionId, err := ps.latestHistoryVersion(q, resourceType, id)
+			if err != nil {
+				return errors.Wrap(err, "Put --> latestHistoryVersion")
+			}
+			newVersionId = latestVersionId + 1
+		} else {
+			if conditionalVersionId != "" && conditionalVersionId != strconv.Itoa(curVersionId) {
+				return ErrConflict{msg: "If-Match doesn't match current versionId"}
+			}
+			newVersionId = curVersionId + 1
+		}
+		ps.debug("  versionIds: current %d; new %d", curVersionId, newVersionId)
+		updateResourceMeta(resource, newVersionId)
+
+		if !createdNew && hasInterceptorsForOpAndType(ps.dal.Interceptors, "Update", resourceType) {
+			oldResource, getError := ps.Get(id, resourceType)
+			if getError == nil {
+				invokeInterceptorsBefore(ps.dal.Interceptors, "Update", resourceType, oldResource)
+			}
+		}
+
+		return ps.insertVersion(q, resource, false)
+	})
+
+	if err == nil {
+		if createdNew {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Create", resourceType, resource)
+		} else {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Update", resourceType, resource)
+		}
+	} else {
+		invokeInterceptorsOnError(ps.dal.Interceptors, "Update", resourceType, err, resource)
+	}
+
+	return createdNew, err
+}
+
+func (ps *postgresSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	if IDs, err := ps.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = objectid.New().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, &ErrMultipleMatches{msg: fmt.Sprintf("Multiple matches for %s?%s", query.Resource, query.Query)}
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = ps.Put(id, conditionalVersionId, resource)
+	return id, createdNew, err
+}
+
+func (ps *postgresSession) Delete(id, resourceType string) (newVersionId string, err error) {
+	if !isValidFhirID(id) {
+		return "", ErrNotFound
+	}
+
+	var resource interface{}
+	var getError error
+	hasInterceptor := hasInterceptorsForOpAndType(ps.dal.Interceptors, "Delete", resourceType)
+	if hasInterceptor {
+		// Although this is a delete operation we need to get the resource first so we can
+		// run any interceptors on the resource before it's deleted.
+		resource, getError = ps.Get(id, resourceType)
+		invokeInterceptorsBefore(ps.dal.Interceptors, "Delete", resourceType, resource)
+	}
+
+	err = ps.atomically(func(q postgresExecutor) error {
+		curVersionId, err := ps.lockCurrentVersion(q, resourceType, id)
+		if err != nil {
+			return errors.Wrap(convertPostgresErr(err), "Delete handler: error retrieving current version")
+		}
+		if curVersionId == 0 {
+			return ErrNotFound
+		}
+
+		deleteCurrent := fmt.Sprintf("DELETE FROM %s WHERE id = $1", ps.table(resourceType))
+		_, err = q.ExecContext(context.TODO(), deleteCurrent, id)
+		if err != nil {
+			return errors.Wrap(convertPostgresErr(err), "failed to delete current version")
+		}
+
+		if ps.dal.enableHistory {
+			// create a deletion record
+			newVersionId = strconv.Itoa(curVersionId + 1)
+			insertDeletion := fmt.Sprintf("INSERT INTO %s (resource_type, id, version_id, last_updated, deleted) VALUES ($1, $2, $3, now(), true)", ps.history())
+			_, err = q.ExecContext(context.TODO(), insertDeletion, resourceType, id, curVersionId+1)
+			if err != nil {
+				return errors.Wrap(convertPostgresErr(err), "failed to save deletion into history")
+			}
+		} else {
+			deleteHistory := fmt.Sprintf("DELETE FROM %s WHERE resource_type = $1 AND id = $2", ps.history())
+			_, err = q.ExecContext(context.TODO(), deleteHistory, resourceType, id)
+			if err != nil {
+				return errors.Wrap(convertPostgresErr(err), "failed to delete versions")
+			}
+		}
+		return nil
+	})
+
+	if hasInterceptor {
+		if err == nil && getError == nil {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Delete", resourceType, resource)
+		} else {
+			invokeInterceptorsOnError(ps.dal.Interceptors, "Delete", resourceType, err, resource)
+		}
+	}
+
+	return newVersionId, err
+}
+
+func (ps *postgresSession) ConditionalDelete(query search.Query) (count int64, err error) {
+	IDsToDelete, err := ps.FindIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ps.atomically(func(q postgresExecutor) error {
+		// run each deletion in the same transaction
+		outerTx := ps.tx
+		if tx, isTx := q.(*sql.Tx); isTx {
+			ps.tx = tx
+		}
+		defer func() { ps.tx = outerTx }()
+
+		for _, id := range IDsToDelete {
+			_, err := ps.Delete(id, query.Resource)
+			if err != nil {
+				return errors.Wrapf(err, "ConditionalDelete: failed to delete %s/%s", query.Resource, id)
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		count = 0
+	}
+	return count, err
+}
+
+func (ps *postgresSession) History(baseURL url.URL, query HistoryQuery) (bundle *models2.ShallowBundle, err error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if query.ResourceType != "" {
+		addCondition("resource_type = $%d", query.ResourceType)
+	}
+	if query.Id != "" {
+		if !isValidFhirID(query.Id) {
+			return nil, ErrNotFound
+		}
+		addCondition("id = $%d", query.Id)
+	}
+	if query.Since != nil {
+		addCondition("last_updated >= $%d", *query.Since)
+	}
+	if query.At != nil {
+		addCondition("last_updated < $%d", query.At.RangeHighExcl())
+	}
+
+	// versions replaced before the _at period weren't current during it.  Leaving out versions created after
+	// the period doesn't change the outcome: the versions they replaced were current until the end of it.
+	versions := fmt.Sprintf("SELECT resource_type, id, version_id, last_updated, deleted FROM %s", ps.history())
+	if query.At != nil {
+		versions = fmt.Sprintf("SELECT resource_type, id, version_id, last_updated, deleted, lead(last_updated) OVER (PARTITION BY resource_type, id ORDER BY version_id) AS replaced FROM %s", ps.history())
+	}
+	if len(conditions) > 0 {
+		versions += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	versions = fmt.Sprintf("(%s) versions", versions)
+	if query.At != nil {
+		args = append(args, query.At.RangeLowIncl())
+		versions += fmt.Sprintf(" WHERE replaced IS NULL OR replaced > $%d", len(args))
+	}
+
+	var total int
+	err = ps.q().QueryRowContext(context.TODO(), "SELECT count(*) FROM "+versions, args...).Scan(&total)
+	if err != nil {
+		return nil, errors.Wrap(err, "History: count query failed")
+	}
+	if query.Id != "" && total == 0 {
+		_, latestVersionId, err := ps.latestHistoryVersion(ps.q(), query.ResourceType, query.Id)
+		if err != nil {
+			return nil, errors.Wrap(err, "History --> latestHistoryVersion")
+		}
+		if latestVersionId == 0 {
+			return nil, ErrNotFound
+		}
+	}
+
+	sqlQuery := fmt.Sprintf("SELECT resource_type, id, version_id, last_updated, deleted FROM %s ORDER BY last_updated DESC, resource_type, id, version_id DESC LIMIT $%d OFFSET $%d", versions, len(args)+1, len(args)+2)
+	rows, err := ps.q().QueryContext(context.TODO(), sqlQuery, append(args, query.Count, query.Offset)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "History: query failed")
+	}
+	defer rows.Close()
+
+	var page []historyVersion
+	for rows.Next() {
+		var version historyVersion
+		err = rows.Scan(&version.resourceType, &version.id, &version.versionId, &version.lastUpdated, &version.deleted)
+		if err != nil {
+			return nil, errors.Wrap(err, "History: rows.Scan failed")
+		}
+		page = append(page, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "History: query for versions failed")
+	}
+
+	return newHistoryBundle(baseURL, query, page, total, func(version historyVersion) (*models2.Resource, error) {
+		return ps.GetVersion(version.id, strconv.Itoa(version.versionId), version.resourceType)
+	})
+}
+
+func (ps *postgresSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+
+	searcher := search.NewPostgresSearcher(ps.q(), ps.schema, ps.dal.countTotalResults, ps.dal.enableCISearches)
+
+	resources, total, err := searcher.Search(searchQuery)
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	return newSearchBundle(baseURL, searchQuery, resources, total, ps.dal.countTotalResults, false), nil
+}
+
+func (ps *postgresSession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+
+	// First create a new query with the unsupported query options filtered out
+	newQuery := findIDsQuery(searchQuery)
+
+	searcher := search.NewPostgresSearcher(ps.q(), ps.schema, false, ps.dal.enableCISearches)
+	results, _, err := searcher.Search(newQuery)
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	IDs = make([]string, len(results))
+	for i, result := range results {
+		IDs[i] = result.Id()
+	}
+
+	return IDs, nil
+}
+
+func convertPostgresErr(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if pqErr, isPqErr := errors.Cause(err).(*pq.Error); isPqErr {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			return ErrConflict{msg: pqErr.Message}
+		case "40001", "40P01": // serialization_failure, deadlock_detected
+			return ErrConflict{msg: pqErr.Message}
+		}
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "gopkg.in/check.v1"
+)
+
+// PostgresDALSuite runs against the PostgreSQL database given by the POSTGRES_TEST_URI environment
+// variable, e.g. postgres://localhost/fhir_test?sslmode=disable, and is skipped if it isn't set
+type PostgresDALSuite struct {
+	db     *sql.DB
+	schema string
+	dal    DataAccessLayer
+}
+
+var _ = Suite(&PostgresDALSuite{})
+
+func (s *PostgresDALSuite) SetUpSuite(c *C) {
+	uri := os.Getenv("POSTGRES_TEST_URI")
+	if uri == "" {
+		c.Skip("POSTGRES_TEST_URI not set")
+	}
+
+	var err error
+	s.db, err = sql.Open("postgres", uri)
+	c.Assert(err, IsNil)
+	c.Assert(s.db.Ping(), IsNil)
+}
+
+func (s *PostgresDALSuite) TearDownSuite(c *C) {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+func (s *PostgresDALSuite) SetUpTest(c *C) {
+	config := DefaultConfig
+	config.EnableHistory = true
+	config.CountTotalResults = true
+	config.EnableCISearches = true
+
+	// each test gets its own schema, created when the first session starts
+	s.schema = "fhir_test_" + objectid.New().Hex()
+	s.dal = NewPostgresDataAccessLayer(s.db, s.schema, false, "", make(map[string]InterceptorList), config)
+}
+
+func (s *PostgresDALSuite) TearDownTest(c *C) {
+	_, err := s.db.ExecContext(context.Background(), "DROP SCHEMA IF EXISTS "+search.PostgresQuoteIdentifier(s.schema)+" CASCADE")
+	c.Assert(err, IsNil)
+}
+
+func postgresTestResource(c *C, json string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	c.Assert(err, IsNil)
+	return resource
+}
+
+func (s *PostgresDALSuite) insertFixtures(c *C, session DataAccessSession) {
+	c.Assert(session.PostWithID("p1", postgresTestResource(c, `{"resourceType":"Patient","name":[{"family":"Duck","given":["Donald"]}],"gender":"male","birthDate":"1934-06-09"}`)), IsNil)
+	c.Assert(session.PostWithID("p2", postgresTestResource(c, `{"resourceType":"Patient","name":[{"family":"Mouse","given":["Minnie"]}],"gender":"female","birthDate":"1928-11-18"}`)), IsNil)
+	c.Assert(session.PostWithID("o1", postgresTestResource(c, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},"subject":{"reference":"Patient/p1"}}`)), IsNil)
+	c.Assert(session.PostWithID("o2", postgresTestResource(c, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8310-5"}]},"subject":{"reference":"Patient/p2"}}`)), IsNil)
+}
+
+func (s *PostgresDALSuite) search(c *C, session DataAccessSession, resourceType, query string) []string {
+	bundle, err := session.Search(url.URL{}, search.Query{Resource: resourceType, Query: query})
+	c.Assert(err, IsNil)
+	var ids []string
+	for _, entry := range bundle.Entry {
+		ids = append(ids, entry.Resource.ResourceType()+"/"+entry.Resource.Id())
+	}
+	return ids
+}
+
+func (s *PostgresDALSuite) TestCreateReadUpdateDelete(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+
+	id, err := session.Post(postgresTestResource(c, `{"resourceType":"Patient","gender":"male"}`))
+	c.Assert(err, IsNil)
+
+	patient, err := session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(patient.Id(), Equals, id)
+	c.Assert(patient.VersionId(), Equals, "1")
+
+	createdNew, err := session.Put(id, "1", postgresTestResource(c, `{"resourceType":"Patient","gender":"female"}`))
+	c.Assert(err, IsNil)
+	c.Assert(createdNew, Equals, false)
+
+	_, err = session.Put(id, "1", postgresTestResource(c, `{"resourceType":"Patient","gender":"other"}`))
+	c.Assert(err, FitsTypeOf, ErrConflict{})
+
+	patient, err = session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(patient.VersionId(), Equals, "2")
+	c.Assert(string(patient.JsonBytes()), Matches, `.*"female".*`)
+
+	oldVersion, err := session.GetVersion(id, "1", "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(string(oldVersion.JsonBytes()), Matches, `.*"male".*`)
+
+	newVersionId, err := session.Delete(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(newVersionId, Equals, "3")
+
+	_, err = session.Get(id, "Patient")
+	c.Assert(err, Equals, ErrDeleted)
+	_, err = session.Get("unknown", "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+
+	history, err := session.History(url.URL{}, HistoryQuery{ResourceType: "Patient", Id: id, Count: 100})
+	c.Assert(err, IsNil)
+	c.Assert(history.Entry, HasLen, 3)
+	c.Assert(history.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(history.Entry[1].Request.Method, Equals, "PUT")
+	c.Assert(history.Entry[2].Request.Method, Equals, "POST")
+}
+
+func (s *PostgresDALSuite) TestTransactionRollback(c *C) {
+	session := s.dal.StartSession("")
+	c.Assert(session.StartTransaction(), IsNil)
+	c.Assert(session.PostWithID("t1", postgresTestResource(c, `{"resourceType":"Patient"}`)), IsNil)
+	session.Finish()
+
+	session = s.dal.StartSession("")
+	defer session.Finish()
+	_, err := session.Get("t1", "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (s *PostgresDALSuite) TestSearch(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+
+	c.Assert(s.search(c, session, "Patient", "gender=female"), DeepEquals, []string{"Patient/p2"})
+	c.Assert(s.search(c, session, "Patient", "name=don"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.search(c, session, "Observation", "code=http://loinc.org|8310-5"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.search(c, session, "Patient", "birthdate=1934"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.search(c, session, "Observation", "subject=Patient/p1"), DeepEquals, []string{"Observation/o1"})
+	c.Assert(s.search(c, session, "Patient", "_sort=birthdate"), DeepEquals, []string{"Patient/p2", "Patient/p1"})
+	c.Assert(s.search(c, session, "Patient", "_sort=birthdate&_offset=1"), DeepEquals, []string{"Patient/p1"})
+}
+
+func (s *PostgresDALSuite) TestTypeAndSystemHistory(c *C) {
+	session := s.dal.StartSession("")
+	defer session.Finish()
+	s.insertFixtures(c, session)
+	_, err := session.Delete("o2", "Observation")
+	c.Assert(err, IsNil)
+
+	baseURL, _ := url.Parse("http://localhost/")
+	query, err := ParseHistoryQuery("Patient", "", "_count=1")
+	c.Assert(err, IsNil)
+	history, err := session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(2))
+	c.Assert(history.Entry, HasLen, 1)
+	c.Assert(history.Entry[0].Request.Method, Equals, "POST")
+	c.Assert(history.Link[2].Relation, Equals, "next")
+
+	query, err = ParseHistoryQuery("", "", "")
+	c.Assert(err, IsNil)
+	history, err = session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(5))
+	c.Assert(history.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(history.Entry[0].Request.Url, Equals, "Observation/o2")
+
+	// o2's first version was replaced by its deletion before a minute from now
+	at := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	query, err = ParseHistoryQuery("Observation", "", "_at="+url.QueryEscape(at))
+	c.Assert(err, IsNil)
+	history, err = session.History(*baseURL, query)
+	c.Assert(err, IsNil)
+	c.Assert(*history.Total, Equals, uint32(2))
+
+	_, err = session.History(*baseURL, HistoryQuery{ResourceType: "Encounter", Id: "e1", Count: 100})
+	c.Assert(err, Equals, ErrNotFound)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/gin-gonic/gin"
+)
+
+// Values of the return preference in the Prefer header (see http://hl7.org/fhir/STU3/http.html#2.21.0.5.2)
+// specifying what the response to a create, update, patch or delete should contain
+const (
+	ReturnMinimal          = "minimal"
+	ReturnRepresentation   = "representation"
+	ReturnOperationOutcome = "OperationOutcome"
+)
+
+// returnPreference reads the return preference from the Prefer headers of a request,
+// defaulting to returning the full resource
+func returnPreference(c *gin.Context) string {
+	for _, header := range c.Request.Header["Prefer"] {
+		for _, preference := range strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ';' }) {
+			parts := strings.SplitN(strings.TrimSpace(preference), "=", 2)
+			if len(parts) == 2 && strings.TrimSpace(parts[0]) == "return" {
+				switch value := strings.Trim(strings.TrimSpace(parts[1]), `"`); value {
+				case ReturnMinimal, ReturnRepresentation, ReturnOperationOutcome:
+					return value
+				}
+			}
+		}
+	}
+	return ReturnRepresentation
+}
+
+// renderWriteResult renders the response to a successful create, update or patch as requested
+// by the Prefer header: the resource, an empty body or an OperationOutcome
+func renderWriteResult(c *gin.Context, statusCode int, resource *models2.Resource, diagnostics string) {
+	switch returnPreference(c) {
+	case ReturnMinimal:
+		c.Status(statusCode)
+	case ReturnOperationOutcome:
+		c.Render(statusCode, CustomFhirRenderer{writeOutcome(c, diagnostics), c})
+	default:
+		c.Render(statusCode, CustomFhirRenderer{resource, c})
+	}
+}
+
+// renderDeleteResult renders the response to a successful delete, which only has a body
+// if an OperationOutcome is requested
+func renderDeleteResult(c *gin.Context, diagnostics string) {
+	if returnPreference(c) == ReturnOperationOutcome {
+		c.Render(http.StatusOK, CustomFhirRenderer{writeOutcome(c, diagnostics), c})
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// writeOutcome returns the issues found by the validator when the resource was written
+// or otherwise an informational OperationOutcome
+func writeOutcome(c *gin.Context, diagnostics string) *models.OperationOutcome {
+	if validation, found := c.Get("ValidationOutcome"); found {
+		outcome := validation.(*models.OperationOutcome)
+		if len(outcome.Issue) > 0 {
+			return outcome
+		}
+	}
+	return models.NewOperationOutcome("information", "informational", diagnostics)
+}
+
+// applyReturnPreference updates the responses of successful write entries of a batch or transaction
+// to omit their resources or replace them with an OperationOutcome, as requested by the Prefer header
+func applyReturnPreference(c *gin.Context, entries []*models2.ShallowBundleEntryComponent, requests []*models.BundleEntryRequestComponent) {
+	preference := returnPreference(c)
+	if preference == ReturnRepresentation {
+		return
+	}
+
+	for i, entry := range entries {
+		request := requests[i]
+		if request == nil || request.Method == "GET" || entry.Response == nil || entry.Response.Outcome != nil {
+			// not a write or failed
+			continue
+		}
+		if preference == ReturnOperationOutcome {
+			diagnostics := fmt.Sprintf("%s %s succeeded with status %s", request.Method, request.Url, entry.Response.Status)
+			entry.Response.Outcome = models.NewOperationOutcome("information", "informational", diagnostics)
+		}
+		entry.Resource = nil
+	}
+}
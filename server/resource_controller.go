@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"mime"
 	"io/ioutil"
+	"net/url"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
@@ -45,9 +47,53 @@ func handlePanics(c *gin.Context) {
 func (rc *ResourceController) IndexHandler(c *gin.Context) {
 	defer handlePanics(c)
 
-	rawQuery := c.Request.URL.RawQuery
+	rawQuery, ok := searchRawQuery(c)
+	if !ok {
+		return
+	}
+
+	session := rc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	searchQuery := search.Query{Resource: rc.Name, Query: rawQuery }
+	baseURL := rc.Config.responseURL(c.Request, rc.Name)
+	bundle, err := session.Search(*baseURL, searchQuery)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+
+	c.Set("bundle", bundle)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "search")
+
+	etagValue := setSearchETag(c, bundle)
+	lastModified, err := searchLastModified(c, session, rc.Config.EnableHistory, searchHistoryType(searchQuery), bundle)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+	if notModified(c, etagValue, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// searchHistoryType returns the type of the resources whose changes can change the results of a search, or
+// "" if changes of other types can too, for searchLastModified
+func searchHistoryType(query search.Query) string {
+	if query.UsesPipeline() {
+		// includes and chained searches
+		return ""
+	}
+	return query.Resource
+}
+
+// searchRawQuery returns the query string of a search, which is in the body of POSTed _search requests
+// (http://hl7.org/fhir/http.html#search). If the body can't be read an error is rendered and ok is false.
+func searchRawQuery(c *gin.Context) (rawQuery string, ok bool) {
+	rawQuery = c.Request.URL.RawQuery
 	if c.Request.Method == "POST" {
-		// handle _search (http://hl7.org/fhir/http.html#search)
 		// reading urlencoded form values similarly to http/request.go
 		ct := c.Request.Header.Get("Content-Type")
 		if ct == "" {
@@ -59,7 +105,7 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 		if err != nil {
 			outcome := models.NewOperationOutcome("fatal", "structure", "failed to parse Content-Type")
 			c.Render(http.StatusUnsupportedMediaType, CustomFhirRenderer{outcome, c})
-			return
+			return "", false
 		}
 		if ct == "application/x-www-form-urlencoded" {
 			bodyBytes, err := ioutil.ReadAll(c.Request.Body)
@@ -69,34 +115,21 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 			rawQuery = string(bodyBytes)
 		}
 	}
-
-	session := rc.DAL.StartSession(c.GetHeader("Db"))
-	defer session.Finish()
-
-	searchQuery := search.Query{Resource: rc.Name, Query: rawQuery }
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
-	bundle, err := session.Search(*baseURL, searchQuery)
-	if err != nil {
-		panic(errors.Wrap(err, "Search failed"))
-	}
-
-	c.Set("bundle", bundle)
-	c.Set("Resource", rc.Name)
-	c.Set("Action", "search")
-
-	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+	return rawQuery, true
 }
 
 // LoadResource uses the resource id in the request to get a resource from the DataAccessLayer and store it in the
-// context.
-func (rc *ResourceController) LoadResource(c *gin.Context) (resourceId string, resource *models2.Resource, err error) {
+// context.  If the projection isn't nil only its elements are loaded.
+func (rc *ResourceController) LoadResource(c *gin.Context, projection *search.ElementsProjection) (resourceId string, resource *models2.Resource, err error) {
 	session := rc.DAL.StartSession(c.GetHeader("Db"))
 	defer session.Finish()
 
 	resourceId = c.Param("id")
 	resourceVersionId := c.Param("vid")
 
-	if resourceVersionId == "" {
+	if projection != nil {
+		resource, err = session.GetSubset(resourceId, resourceVersionId, rc.Name, projection)
+	} else if resourceVersionId == "" {
 		resource, err = session.Get(resourceId, rc.Name)
 	} else {
 		resource, err = session.GetVersion(resourceId, resourceVersionId, rc.Name)
@@ -113,7 +146,13 @@ func (rc *ResourceController) LoadResource(c *gin.Context) (resourceId string, r
 func (rc *ResourceController) ShowHandler(c *gin.Context) {
 	defer handlePanics(c)
 	c.Set("Action", "read")
-	resourceId, resource, err := rc.LoadResource(c)
+
+	// support for _summary and _elements
+	params := projectionParams(c)
+	projectionQuery := search.Query{Resource: rc.Name, Query: params.Encode()}
+	projection := projectionQuery.Options().ElementsProjection(rc.Name)
+
+	resourceId, resource, err := rc.LoadResource(c, projection)
 	if err == nil {
 		err = setHeaders(c, rc, false, resource, resourceId)
 		if err != nil {
@@ -123,6 +162,14 @@ func (rc *ResourceController) ShowHandler(c *gin.Context) {
 
 	switch (err) {
 	case nil:
+		var lastModified time.Time
+		if resource.LastUpdated() != "" {
+			lastModified = resource.LastUpdatedTime()
+		}
+		if notModified(c, resource.VersionId(), lastModified) {
+			c.Status(http.StatusNotModified)
+			return
+		}
 		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
 	case ErrNotFound:
 		c.Status(http.StatusNotFound)
@@ -140,9 +187,13 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 
 	c.Set("Action", "history")
 
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
-	resourceId := c.Param("id")
-	bundle, err := session.History(*baseURL, rc.Name, resourceId)
+	query, err := ParseHistoryQuery(rc.Name, c.Param("id"), c.Request.URL.RawQuery)
+	if err != nil {
+		panic(err)
+	}
+
+	baseURL := rc.Config.responseURL(c.Request)
+	bundle, err := session.History(*baseURL, query)
 	if err != nil && err != ErrNotFound {
 		panic(errors.Wrap(err, "History request failed"))
 	}
@@ -154,19 +205,52 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
-// EverythingHandler handles requests for everything related to a Patient or Encounter resource.
-func (rc *ResourceController) EverythingHandler(c *gin.Context) {
+// TypeHistoryHandler handles requests for the history of all resources of this type.
+func (rc *ResourceController) TypeHistoryHandler(c *gin.Context) {
 	defer handlePanics(c)
 	session := rc.DAL.StartSession(c.GetHeader("Db"))
 	defer session.Finish()
 
-	// For now we interpret $everything as the union of _include and _revinclude
-	query := fmt.Sprintf("_id=%s&_include=*&_revinclude=*", c.Param("id"))
+	c.Set("Action", "history")
+	c.Set("Resource", rc.Name)
 
-	searchQuery := search.Query{Resource: rc.Name, Query: query}
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
-	bundle, err := session.Search(*baseURL, searchQuery)
+	query, err := ParseHistoryQuery(rc.Name, "", c.Request.URL.RawQuery)
+	if err != nil {
+		panic(err)
+	}
+
+	baseURL := rc.Config.responseURL(c.Request)
+	bundle, err := session.History(*baseURL, query)
+	if err != nil {
+		panic(errors.Wrap(err, "History request failed"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// EverythingHandler handles requests for everything related to a Patient or Encounter resource: the resources
+// in its compartment (http://hl7.org/fhir/compartmentdefinition.html) and those they refer to.
+func (rc *ResourceController) EverythingHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	query, err := ParseEverythingQuery(rc.Name, c.Param("id"), c.Request.URL.RawQuery)
 	if err != nil {
+		panic(err)
+	}
+
+	baseURL := rc.Config.responseURL(c.Request)
+	linkURL := rc.Config.responseURL(c.Request, rc.Name, query.Id, "$everything")
+	bundle, err := everything(session, *baseURL, *linkURL, query)
+	switch errors.Cause(err) {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
 		panic(errors.Wrap(err, "Search (everything) failed"))
 	}
 
@@ -174,9 +258,80 @@ func (rc *ResourceController) EverythingHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "search")
 
+	etagValue := setSearchETag(c, bundle)
+	// the compartment has resources of many types
+	lastModified, err := searchLastModified(c, session, rc.Config.EnableHistory, "", bundle)
+	if err != nil {
+		panic(errors.Wrap(err, "Search (everything) failed"))
+	}
+	if notModified(c, etagValue, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// CompartmentSearchHandler handles searches of the resources of a type in the compartment of a Patient or
+// Encounter resource, e.g. GET /Patient/123/Observation?code=...
+func (rc *ResourceController) CompartmentSearchHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	resourceType := c.Param("type")
+	filter := search.CompartmentFilter(rc.Name, resourceType, []string{c.Param("id")})
+	if filter == "" {
+		renderOperationError(c, http.StatusNotFound, fmt.Sprintf("%s resources are not in the %s compartment", resourceType, rc.Name))
+		return
+	}
+
+	session := rc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	// the compartment is searched with a _filter, which is combined with any other parameters
+	query := search.FilterParam + "=" + url.QueryEscape(filter)
+	if c.Request.URL.RawQuery != "" {
+		query = c.Request.URL.RawQuery + "&" + query
+	}
+	searchQuery := search.Query{Resource: resourceType, Query: query}
+	baseURL := rc.Config.responseURL(c.Request, resourceType)
+	bundle, err := session.Search(*baseURL, searchQuery)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+	compartmentURL := rc.Config.responseURL(c.Request, rc.Name, c.Param("id"), resourceType)
+	for i := range bundle.Link {
+		bundle.Link[i].Url = compartmentLink(*compartmentURL, bundle.Link[i].Url, filter)
+	}
+
+	c.Set("bundle", bundle)
+	c.Set("Resource", resourceType)
+	c.Set("Action", "search")
+
+	etagValue := setSearchETag(c, bundle)
+	lastModified, err := searchLastModified(c, session, rc.Config.EnableHistory, searchHistoryType(searchQuery), bundle)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+	if notModified(c, etagValue, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
+// projectionParams returns the request's _summary and _elements parameters, which choose the elements
+// returned by reads and $everything as well as by searches.
+func projectionParams(c *gin.Context) search.URLQueryParameters {
+	var params search.URLQueryParameters
+	for _, key := range []string{search.SummaryParam, search.ElementsParam} {
+		if value, found := c.GetQuery(key); found {
+			params.Add(key, value)
+		}
+	}
+	return params
+}
+
 // CreateHandler handles requests to create a new resource instance, assigning it a new ID.
 func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	defer handlePanics(c)
@@ -194,6 +349,9 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	ifNoneExist := c.GetHeader("If-None-Exist")
 	var httpStatus int
 	var resourceId string
+	if err := checkRequestActive(c); err != nil {
+		panic(err)
+	}
 	if len(ifNoneExist) > 0 {
 		query := search.Query{Resource: rc.Name, Query: ifNoneExist}
 		httpStatus, resourceId, resource, err = session.ConditionalPost(query, resource)
@@ -209,14 +367,17 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "create")
 
-	if resource != nil { // nil when e.g. HTTP status from ConditionalPost 412
-		err = setHeaders(c, rc, true, resource, resourceId)
-		if err != nil {
-			panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
-		}
+	if resource == nil { // nil when e.g. HTTP status from ConditionalPost 412
+		c.Render(httpStatus, CustomFhirRenderer{resource, c})
+		return
 	}
 
-	c.Render(httpStatus, CustomFhirRenderer{resource, c})
+	err = setHeaders(c, rc, true, resource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
+	}
+
+	renderWriteResult(c, httpStatus, resource, fmt.Sprintf("Created %s/%s", rc.Name, resourceId))
 }
 
 // UpdateHandler handles requests to update a resource having a given ID.  If the resource with that ID does not
@@ -246,6 +407,9 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 	}
 
 	// Perform update
+	if err := checkRequestActive(c); err != nil {
+		panic(err)
+	}
 	resourceId := c.Param("id")
 	createdNew, err := session.Put(resourceId, conditionalVersionId, resource)
 	if err != nil {
@@ -261,10 +425,10 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 	
 	if createdNew {
 		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		renderWriteResult(c, http.StatusCreated, resource, fmt.Sprintf("Created %s/%s", rc.Name, resourceId))
 	} else {
 		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		renderWriteResult(c, http.StatusOK, resource, fmt.Sprintf("Updated %s/%s", rc.Name, resourceId))
 	}
 }
 
@@ -297,6 +461,9 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 	}
 
 	// Perform update
+	if err := checkRequestActive(c); err != nil {
+		panic(err)
+	}
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
 	resourceId, createdNew, err := session.ConditionalPut(query, conditionalVersionId, resource)
 	
@@ -315,10 +482,10 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 
 	if createdNew {
 		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		renderWriteResult(c, http.StatusCreated, resource, fmt.Sprintf("Created %s/%s", rc.Name, resourceId))
 	} else {
 		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		renderWriteResult(c, http.StatusOK, resource, fmt.Sprintf("Updated %s/%s", rc.Name, resourceId))
 	}
 }
 
@@ -330,6 +497,9 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 
 	id := c.Param("id")
 
+	if err := checkRequestActive(c); err != nil {
+		panic(err)
+	}
 	newVersionId, err := session.Delete(id, rc.Name)
 	if err != nil && err != ErrNotFound {
 		panic(errors.Wrap(err, "Delete failed"))
@@ -342,7 +512,7 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 	if newVersionId != "" {
 		c.Header("ETag", "W/\"" + newVersionId + "\"")
 	}
-	c.Status(http.StatusNoContent)
+	renderDeleteResult(c, fmt.Sprintf("Deleted %s/%s", rc.Name, id))
 }
 
 // ConditionalDeleteHandler handles requests to delete resources identified by search criteria.  All resources
@@ -352,8 +522,11 @@ func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	session := rc.DAL.StartSession(c.GetHeader("Db"))
 	defer session.Finish()
 
+	if err := checkRequestActive(c); err != nil {
+		panic(err)
+	}
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
-	_, err := session.ConditionalDelete(query)
+	count, err := session.ConditionalDelete(query)
 	if err != nil {
 		panic(errors.Wrap(err, "ConditionalDelete failed"))
 	}
@@ -361,7 +534,7 @@ func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "delete")
 
-	c.Status(http.StatusNoContent)
+	renderDeleteResult(c, fmt.Sprintf("Deleted %d %s resources", count, rc.Name))
 }
 
 func setHeaders(c *gin.Context, rc *ResourceController, setLocationHeader bool, resource *models2.Resource, id string) error {
@@ -9,12 +9,21 @@ import (
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/search"
 	"github.com/mitre/heart"
 	"golang.org/x/oauth2"
 )
 
+// Operation is an extended operation (e.g. $export) registered for a FHIR resource, either at the
+// type level (GET /Patient/$export) or the instance level (GET /Group/123/$export)
+type Operation struct {
+	Name     string
+	Instance bool
+	Handler  gin.HandlerFunc
+}
+
 // RegisterController registers the CRUD routes (and middleware) for a FHIR resource
-func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal DataAccessLayer, config Config) {
+func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal DataAccessLayer, config Config, operations ...Operation) {
 	rc := NewResourceController(name, dal, config)
 	rcBase := e.Group("/" + name)
 
@@ -35,23 +44,88 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 	rcBase.POST("/_search", rc.IndexHandler)
 	rcBase.POST("", rc.CreateHandler)
 	rcBase.PUT("", rc.ConditionalUpdateHandler)
+	rcBase.PATCH("", rc.ConditionalPatchHandler)
 	rcBase.DELETE("", rc.ConditionalDeleteHandler)
 
-	rcItem := rcBase.Group("/:id")
-	rcItem.GET("", rc.ShowHandler)
+	// gin doesn't allow routes like /Patient/_history alongside /Patient/:id,
+	// so type-level GET interactions are dispatched on the id parameter
+	typeLevelHandlers := make(map[string]gin.HandlerFunc)
 	if config.EnableHistory {
-		rcItem.GET("/_history/:vid", rc.ShowHandler)
-		rcItem.GET("/_history", rc.HistoryHandler)
+		typeLevelHandlers["_history"] = rc.TypeHistoryHandler
 	}
+	for _, op := range operations {
+		if !op.Instance {
+			typeLevelHandlers[op.Name] = op.Handler
+		}
+	}
+
+	rcItem := rcBase.Group("/:id")
+	rcItem.GET("", dispatchOnParam("id", typeLevelHandlers, rc.ShowHandler))
 	rcItem.PUT("", rc.UpdateHandler)
+	rcItem.PATCH("", rc.PatchHandler)
 	rcItem.DELETE("", rc.DeleteHandler)
 
-	if name == "Patient" || name == "Encounter" {
-		everythingItem := rcItem.Group("/$everything")
-		everythingItem.GET("", rc.EverythingHandler)
+	instanceHandlers := make(map[string]gin.HandlerFunc)
+	if config.EnableHistory {
+		instanceHandlers["_history"] = rc.HistoryHandler
+	}
+	for _, op := range operations {
+		if op.Instance {
+			instanceHandlers[op.Name] = op.Handler
+		}
+	}
+
+	if _, isCompartment := search.CompartmentDefinitions[name]; isCompartment {
+		// Compartment searches (e.g. /Patient/123/Observation) need a route like /Patient/:id/:type, so
+		// the other instance-level GET interactions are also dispatched on a parameter
+		instanceHandlers["$everything"] = rc.EverythingHandler
+		rcItem.GET("/:type", dispatchOnParam("type", instanceHandlers, rc.CompartmentSearchHandler))
+		if config.EnableHistory {
+			versionHandlers := map[string]gin.HandlerFunc{"_history": rc.ShowHandler}
+			rcItem.GET("/:type/:vid", dispatchOnParam("type", versionHandlers, func(c *gin.Context) {
+				c.Status(http.StatusNotFound)
+			}))
+		}
+	} else {
+		for path, handler := range instanceHandlers {
+			rcItem.GET("/"+path, handler)
+		}
+		if config.EnableHistory {
+			rcItem.GET("/_history/:vid", rc.ShowHandler)
+		}
 	}
 }
 
+// dispatchOnParam returns a handler that calls the handler registered for the value of a path
+// parameter, or defaultHandler if there isn't one
+func dispatchOnParam(param string, handlers map[string]gin.HandlerFunc, defaultHandler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if handler, found := handlers[c.Param(param)]; found {
+			handler(c)
+		} else {
+			defaultHandler(c)
+		}
+	}
+}
+
+// systemHandlers returns the handlers of a route that isn't restricted to a resource type: its configured
+// middleware, a check that the scopes granted cover all resource types if authorization is enabled (write
+// scopes if the interaction modifies resources), then the handler
+func systemHandlers(middleware []gin.HandlerFunc, serverConfig Config, modifies bool, handler gin.HandlerFunc) []gin.HandlerFunc {
+	handlers := make([]gin.HandlerFunc, len(middleware), len(middleware)+2)
+	copy(handlers, middleware)
+
+	switch serverConfig.Auth.Method {
+	case auth.AuthTypeNone:
+		// do nothing
+	case auth.AuthTypeOIDC:
+		handlers = append(handlers, auth.HEARTSystemScopesHandler(modifies))
+	case auth.AuthTypeHEART:
+		handlers = append(handlers, auth.HEARTSystemScopesHandler(modifies))
+	}
+	return append(handlers, handler)
+}
+
 // RegisterRoutes registers the routes for each of the FHIR resources
 func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal DataAccessLayer, serverConfig Config) {
 
@@ -128,13 +202,59 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	batchHandlers = append(batchHandlers, batch.Post)
 	e.POST("/", batchHandlers...)
 
+	// Whole-system search and history
+	system := NewSystemController(dal, serverConfig)
+	systemSearchHandlers := systemHandlers(config["Search"], serverConfig, false, system.SearchHandler)
+	e.POST("/_search", systemSearchHandlers...)
+	if serverConfig.EnableHistory {
+		e.GET("/_history", systemHandlers(config["History"], serverConfig, false, system.HistoryHandler)...)
+	}
+
+	// Bulk data export (needs MongoDB to stream from)
+	var patientOperations, groupOperations []Operation
+	if bulkExport := NewBulkExportController(dal, serverConfig); bulkExport != nil {
+		e.GET("/$export", systemHandlers(config["Export"], serverConfig, false, bulkExport.SystemExportHandler)...)
+
+		jobs := e.Group("/$export-jobs/:jobId")
+		jobs.GET("", systemHandlers(config["Export"], serverConfig, false, bulkExport.StatusHandler)...)
+		jobs.DELETE("", systemHandlers(config["Export"], serverConfig, false, bulkExport.CancelHandler)...)
+		jobs.GET("/:file", systemHandlers(config["Export"], serverConfig, false, bulkExport.FileHandler)...)
+
+		patientOperations = append(patientOperations, Operation{Name: "$export", Handler: bulkExport.PatientExportHandler})
+		groupOperations = append(groupOperations, Operation{Name: "$export", Instance: true, Handler: bulkExport.GroupExportHandler})
+	}
+
+	// Bulk data import
+	if bulkImport := NewBulkImportController(dal, serverConfig); bulkImport != nil {
+		e.POST("/$import", systemHandlers(config["Import"], serverConfig, true, bulkImport.ImportHandler)...)
+	}
+
+	// Custom search parameters defined by SearchParameter resources
+	if searchParameters := NewSearchParameterController(dal, serverConfig); searchParameters != nil {
+		if err := searchParameters.LoadSearchParameters(); err != nil {
+			fmt.Printf("SearchParameters: failed to load custom search parameters: %+v\n", err)
+		}
+		e.POST("/$reindex", systemHandlers(config["Reindex"], serverConfig, true, searchParameters.ReindexHandler)...)
+	}
+
+	// Subscriptions (rest-hook notifications driven by MongoDB change streams)
+	if serverConfig.EnableSubscriptions {
+		if subscriptions := NewSubscriptionManager(dal, serverConfig); subscriptions != nil {
+			subscriptions.Start()
+		}
+	}
+
 	// Conformance Statement
 	e.StaticFile("metadata", "conformance/capability_statement.json")
 
-	// Redirect server root to /metadata
-	e.GET("/", func(c *gin.Context) {
-		c.Redirect(http.StatusPermanentRedirect, "/metadata")
-	})
+	// Searches of the server root are whole-system searches, otherwise redirect it to /metadata
+	rootHandlers := []gin.HandlerFunc{func(c *gin.Context) {
+		if c.Request.URL.RawQuery == "" {
+			c.Redirect(http.StatusPermanentRedirect, "/metadata")
+			c.Abort()
+		}
+	}}
+	e.GET("/", append(rootHandlers, systemSearchHandlers...)...)
 
 	// Resources
 	RegisterController("Account", e, config["Account"], dal, serverConfig)
@@ -188,7 +308,7 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	RegisterController("Flag", e, config["Flag"], dal, serverConfig)
 	RegisterController("Goal", e, config["Goal"], dal, serverConfig)
 	RegisterController("GraphDefinition", e, config["GraphDefinition"], dal, serverConfig)
-	RegisterController("Group", e, config["Group"], dal, serverConfig)
+	RegisterController("Group", e, config["Group"], dal, serverConfig, groupOperations...)
 	RegisterController("GuidanceResponse", e, config["GuidanceResponse"], dal, serverConfig)
 	RegisterController("HealthcareService", e, config["HealthcareService"], dal, serverConfig)
 	RegisterController("ImagingManifest", e, config["ImagingManifest"], dal, serverConfig)
@@ -216,7 +336,7 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	RegisterController("OperationDefinition", e, config["OperationDefinition"], dal, serverConfig)
 	RegisterController("OperationOutcome", e, config["OperationOutcome"], dal, serverConfig)
 	RegisterController("Organization", e, config["Organization"], dal, serverConfig)
-	RegisterController("Patient", e, config["Patient"], dal, serverConfig)
+	RegisterController("Patient", e, config["Patient"], dal, serverConfig, patientOperations...)
 	RegisterController("PaymentNotice", e, config["PaymentNotice"], dal, serverConfig)
 	RegisterController("PaymentReconciliation", e, config["PaymentReconciliation"], dal, serverConfig)
 	RegisterController("Person", e, config["Person"], dal, serverConfig)
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/gin-gonic/gin"
+	bson2 "github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newCustomSearchParameter checks the definition of a custom search parameter in a SearchParameter
+// resource, returning nil if the parameter has been retired
+func newCustomSearchParameter(id string, resource *models2.Resource) (*search.CustomSearchParameter, error) {
+	var definition models.SearchParameter
+	if err := resource.Unmarshal(&definition); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode SearchParameter/%s", id)
+	}
+	if definition.Status == "retired" {
+		return nil, nil
+	}
+
+	param, err := search.NewCustomSearchParameter(id, &definition)
+	if err != nil {
+		return nil, ErrInvalidResource{msg: fmt.Sprintf("SearchParameter/%s is not supported: %s", id, err.Error())}
+	}
+	return param, nil
+}
+
+// applySearchParameter registers a custom search parameter, or unregisters it if param is nil, and
+// ensures the indexes that searches with it need
+func (ms *mongoSession) applySearchParameter(id string, param *search.CustomSearchParameter) error {
+	if param == nil {
+		search.UnregisterCustomSearchParameter(id)
+		return nil
+	}
+
+	if err := search.RegisterCustomSearchParameter(param); err != nil {
+		return ErrInvalidResource{msg: err.Error()}
+	}
+
+	indexes := make(map[string][]mongo.IndexModel)
+	for _, spec := range param.IndexSpecs() {
+		collectionName, index, err := parseIndex(spec)
+		if err != nil {
+			return errors.Wrapf(err, "invalid index for SearchParameter/%s", id)
+		}
+		indexes[collectionName] = append(indexes[collectionName], *index)
+	}
+	for collectionName, collectionIndexes := range indexes {
+		if _, err := ms.db.Collection(collectionName).Indexes().CreateMany(context.TODO(), collectionIndexes); err != nil {
+			return errors.Wrapf(err, "failed to create indexes for SearchParameter/%s", id)
+		}
+	}
+	return nil
+}
+
+// SearchParameterController handles the custom search parameters defined by SearchParameter resources.
+// They are registered when SearchParameter resources are created or updated and apply to all databases,
+// but only those in the default database are loaded when the server starts.
+type SearchParameterController struct {
+	dal    *mongoDataAccessLayer
+	Config Config
+}
+
+// NewSearchParameterController creates a SearchParameterController, or returns nil if the DataAccessLayer
+// isn't backed by MongoDB
+func NewSearchParameterController(dal DataAccessLayer, config Config) *SearchParameterController {
+	mongoDAL, isMongo := dal.(*mongoDataAccessLayer)
+	if !isMongo {
+		return nil
+	}
+	return &SearchParameterController{
+		dal:    mongoDAL,
+		Config: config,
+	}
+}
+
+// LoadSearchParameters registers the custom search parameters defined by the SearchParameter resources
+// in the default database. Unsupported definitions are logged and skipped.
+func (s *SearchParameterController) LoadSearchParameters() error {
+	session := s.dal.StartSession("").(*mongoSession)
+	defer session.Finish()
+
+	cursor, err := session.CurrentVersionCollection("SearchParameter").Find(context.TODO(), bson2.NewDocument(), session.session)
+	if err != nil {
+		return errors.Wrap(convertMongoErr(err), "failed to query search parameters")
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var doc bson2.Document
+		if err := cursor.Decode(&doc); err != nil {
+			return errors.Wrap(err, "failed to decode search parameter")
+		}
+		resource, err := models2.NewResourceFromBSON2(&doc)
+		if err != nil {
+			return errors.Wrap(err, "failed to convert search parameter")
+		}
+
+		param, err := newCustomSearchParameter(resource.Id(), resource)
+		if err == nil {
+			err = session.applySearchParameter(resource.Id(), param)
+		}
+		if err != nil {
+			log.Printf("SearchParameters: skipping SearchParameter/%s: %s\n", resource.Id(), err.Error())
+		}
+	}
+	return errors.Wrap(cursor.Err(), "failed to query search parameters")
+}
+
+// ReindexHandler implements the $reindex operation, which brings the values of custom search parameters
+// that are stored with resources up to date, e.g. after a SearchParameter has been created or changed.
+// By default all resource types with custom search parameters are reindexed; the _type parameter can
+// give a comma-separated list of resource types instead.
+func (s *SearchParameterController) ReindexHandler(c *gin.Context) {
+	resourceTypes := search.CustomSearchParameterResourceTypes()
+	if types := c.Query("_type"); types != "" {
+		supported := make(map[string]bool)
+		for _, resourceType := range historyResourceTypes() {
+			supported[resourceType] = true
+		}
+		resourceTypes = nil
+		for _, resourceType := range strings.Split(types, ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if !supported[resourceType] {
+				renderOperationError(c, http.StatusBadRequest, fmt.Sprintf("unsupported resource type in _type: %s", resourceType))
+				return
+			}
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+
+	session := s.dal.StartSession(c.GetHeader("Db")).(*mongoSession)
+	defer session.Finish()
+
+	total := 0
+	for _, resourceType := range resourceTypes {
+		count, err := session.reindex(c.Request.Context(), resourceType)
+		total += count
+		if err != nil {
+			panic(errors.Wrapf(err, "$reindex failed after %d resources", total))
+		}
+	}
+
+	outcome := models.NewOperationOutcome("information", "informational", fmt.Sprintf("Reindexed %d resources", total))
+	c.Render(http.StatusOK, CustomFhirRenderer{outcome, c})
+}
+
+// reindex updates the values of custom search parameters stored with the current versions of the
+// resources of a type, returning how many resources were updated
+func (ms *mongoSession) reindex(ctx context.Context, resourceType string) (count int, err error) {
+	collection := ms.CurrentVersionCollection(resourceType)
+	cursor, err := collection.Find(ctx, bson2.NewDocument(), ms.session)
+	if err != nil {
+		return 0, errors.Wrapf(convertMongoErr(err), "failed to query %s resources", resourceType)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc bson2.Document
+		if err = cursor.Decode(&doc); err != nil {
+			return count, errors.Wrapf(err, "failed to decode %s", resourceType)
+		}
+		resource, err := models2.NewResourceFromBSON2(&doc)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to convert %s", resourceType)
+		}
+		resourceBSON, err := resource.GetBSON()
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to convert %s/%s", resourceType, resource.Id())
+		}
+
+		update := bson.M{"$unset": bson.M{models2.SearchIndexField: ""}}
+		for _, elem := range resourceBSON.([]bson.DocElem) {
+			if elem.Name == models2.SearchIndexField {
+				update = bson.M{"$set": bson.M{models2.SearchIndexField: elem.Value}}
+			}
+		}
+
+		filterBytes, err := bson.Marshal(bson.M{"_id": resource.Id()})
+		if err != nil {
+			return count, err
+		}
+		updateBytes, err := bson.Marshal(update)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to marshal search index of %s/%s", resourceType, resource.Id())
+		}
+		if _, err = collection.UpdateOne(ctx, filterBytes, updateBytes, ms.session); err != nil {
+			return count, errors.Wrapf(convertMongoErr(err), "failed to update %s/%s", resourceType, resource.Id())
+		}
+		count++
+	}
+	if err = cursor.Err(); err != nil {
+		return count, errors.Wrapf(err, "failed to read %s resources", resourceType)
+	}
+	return count, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"net/url"
@@ -11,6 +12,7 @@ import (
 	"github.com/eug48/fhir/models2"
 	"github.com/gin-gonic/gin"
 	"github.com/itsjamie/gin-cors"
+	_ "github.com/lib/pq" // PostgreSQL driver
 	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/mongo"
 	"github.com/pkg/errors"
@@ -24,6 +26,7 @@ type FHIRServer struct {
 	MiddlewareConfig map[string][]gin.HandlerFunc
 	AfterRoutes      []AfterRoutes
 	Interceptors     map[string]InterceptorList
+	DAL              DataAccessLayer
 }
 
 func (f *FHIRServer) AddMiddleware(key string, middleware gin.HandlerFunc) {
@@ -64,7 +67,7 @@ func NewServer(config Config) *FHIRServer {
 
 	server.Engine.Use(cors.Middleware(cors.Config{
 		Origins:         "*",
-		Methods:         "GET, PUT, POST, DELETE",
+		Methods:         "GET, PUT, POST, PATCH, DELETE",
 		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
 		ExposedHeaders:  "Location, ETag, Last-Modified",
 		MaxAge:          86400 * time.Second, // Preflight expires after 1 day
@@ -86,7 +89,56 @@ func NewServer(config Config) *FHIRServer {
 	return server
 }
 
+// SetupDAL connects to the database given by the DatabaseURI unless this has already been done, and
+// returns the DataAccessLayer. Run calls it, but it can be called earlier (e.g. to set up middleware).
+func (f *FHIRServer) SetupDAL() DataAccessLayer {
+	if f.DAL != nil {
+		return f.DAL
+	}
+	switch {
+	case IsPostgresURI(f.Config.DatabaseURI):
+		f.DAL = f.setupPostgres()
+	case f.Config.DatabaseURI == MemoryDatabaseURI:
+		log.Println("Server: Using in-memory storage - data will be lost when the server exits")
+		f.DAL = NewMemoryDataAccessLayer(f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
+	default:
+		f.DAL = f.setupMongo()
+	}
+	return f.DAL
+}
+
+// MongoCollection returns a collection of the default MongoDB database, or nil if the server doesn't
+// store its data in MongoDB
+func (f *FHIRServer) MongoCollection(name string) *mongo.Collection {
+	dal, isMongo := f.SetupDAL().(*mongoDataAccessLayer)
+	if !isMongo {
+		return nil
+	}
+	return dal.client.Database(dal.defaultDbName).Collection(name)
+}
+
 func (f *FHIRServer) Run() {
+	dal := f.SetupDAL()
+
+	// Register all API routes
+	RegisterRoutes(f.Engine, f.MiddlewareConfig, dal, f.Config)
+
+	for _, ar := range f.AfterRoutes {
+		ar(f.Engine)
+	}
+
+	if f.Config.ReadOnly {
+		log.Println("Server: Running in read-only mode")
+	}
+
+	url, err := url.Parse(f.Config.ServerURL)
+	if err != nil {
+		panic("Server: Failed to parse ServerURL: " + f.Config.ServerURL)
+	}
+	f.Engine.Run(":" + url.Port())
+}
+
+func (f *FHIRServer) setupMongo() DataAccessLayer {
 	var err error
 
 	// Establish initial connection to mongo
@@ -127,13 +179,6 @@ func (f *FHIRServer) Run() {
 	// TODO: disabled as requires high-grade permissions. Remove completely?
 	// go killLongRunningOps(ticker, client.ConnectionString(), "admin", f.Config)
 
-	// Register all API routes
-	RegisterRoutes(f.Engine, f.MiddlewareConfig, NewMongoDataAccessLayer(client, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config), f.Config)
-
-	for _, ar := range f.AfterRoutes {
-		ar(f.Engine)
-	}
-
 	// If not in -readonly mode, clear the count cache
 	if !f.Config.ReadOnly {
 		dbNames, err := client.ListDatabaseNames(context.TODO(), nil)
@@ -154,15 +199,37 @@ func (f *FHIRServer) Run() {
 				}
 			}
 		}
-	} else {
-		log.Println("Server: Running in read-only mode")
 	}
 
-	url, err := url.Parse(f.Config.ServerURL)
+	return NewMongoDataAccessLayer(client, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
+}
+
+func (f *FHIRServer) setupPostgres() DataAccessLayer {
+	db, err := sql.Open("postgres", f.Config.DatabaseURI)
 	if err != nil {
-		panic("Server: Failed to parse ServerURL: " + f.Config.ServerURL)
+		panic(errors.Wrap(err, "connecting to PostgreSQL"))
 	}
-	f.Engine.Run(":" + url.Port())
+	err = db.Ping()
+	if err != nil {
+		panic(errors.Wrap(err, "connecting to PostgreSQL"))
+	}
+
+	log.Printf("PostgreSQL: Connected (default schema %s)\n", f.Config.DefaultDatabaseName)
+
+	err = CreatePostgresTables(db, f.Config.DefaultDatabaseName)
+	if err != nil {
+		panic(errors.Wrap(err, "creating PostgreSQL tables"))
+	}
+
+	return NewPostgresDataAccessLayer(db, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
+}
+
+// MemoryDatabaseURI can be used as the DatabaseURI to store all data in memory
+const MemoryDatabaseURI = "memory://"
+
+// IsPostgresURI returns whether a DatabaseURI refers to a PostgreSQL database rather than MongoDB
+func IsPostgresURI(uri string) bool {
+	return strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://")
 }
 
 func (f *FHIRServer) InitDB(databaseName string) {
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -139,7 +140,7 @@ func (s *ServerSuite) TestGetPatientsPaging(c *C) {
 	c.Assert(bundle.Link, HasLen, 4)
 	assertPagingLink(c, bundle.Link[0], "self", 10, 0)
 	assertPagingLink(c, bundle.Link[1], "first", 10, 0)
-	assertPagingLink(c, bundle.Link[2], "next", 10, 10)
+	assertCursorPagingLink(c, bundle.Link[2], "next", 10)
 	assertPagingLink(c, bundle.Link[3], "last", 10, 30)
 
 	// More results than count, middle page
@@ -182,7 +183,7 @@ func (s *ServerSuite) TestGetPatientsPaging(c *C) {
 	c.Assert(bundle.Link, HasLen, 4)
 	assertPagingLink(c, bundle.Link[0], "self", 10, 0)
 	assertPagingLink(c, bundle.Link[1], "first", 10, 0)
-	assertPagingLink(c, bundle.Link[2], "next", 10, 10)
+	assertCursorPagingLink(c, bundle.Link[2], "next", 10)
 	assertPagingLink(c, bundle.Link[3], "last", 10, 30)
 
 	// Search with no results
@@ -215,6 +216,56 @@ func (s *ServerSuite) TestGetPatientsPaging(c *C) {
 	assertPagingLink(c, bundle.Link[2], "last", 100, 0)
 }
 
+func (s *ServerSuite) TestGetPatientsCursorPaging(c *C) {
+	// Add 24 more patients
+	for i := 0; i < 24; i++ {
+		s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	}
+
+	for _, query := range []string{"_count=10", "_count=10&_sort=birthdate", "_count=10&_sort:desc=gender&_sort=birthdate"} {
+		// The first page continues with a cursor
+		bundle := performSearch(c, s.Server.URL+"/Patient?"+query)
+		c.Assert(bundle.Entry, HasLen, 10)
+		c.Assert(bundle.Link, HasLen, 4)
+		nextURL := assertCursorPagingLink(c, bundle.Link[2], "next", 10)
+		ids := make(map[string]bool)
+		for _, entry := range bundle.Entry {
+			ids[entry.FullUrl] = true
+		}
+
+		// Middle page, reached by the cursor
+		bundle = performSearch(c, nextURL.String())
+		c.Assert(bundle.Entry, HasLen, 10)
+		c.Assert(bundle.Link, HasLen, 4)
+		assertCursorPagingLink(c, bundle.Link[0], "self", 10)
+		assertPagingLink(c, bundle.Link[1], "first", 10, 0)
+		nextURL = assertCursorPagingLink(c, bundle.Link[2], "next", 10)
+		assertPagingLink(c, bundle.Link[3], "last", 10, 20)
+		for _, entry := range bundle.Entry {
+			ids[entry.FullUrl] = true
+		}
+
+		// Last page
+		bundle = performSearch(c, nextURL.String())
+		c.Assert(bundle.Entry, HasLen, 5)
+		c.Assert(bundle.Link, HasLen, 3)
+		assertCursorPagingLink(c, bundle.Link[0], "self", 10)
+		assertPagingLink(c, bundle.Link[1], "first", 10, 0)
+		assertPagingLink(c, bundle.Link[2], "last", 10, 20)
+		for _, entry := range bundle.Entry {
+			ids[entry.FullUrl] = true
+		}
+
+		// Every patient was returned exactly once
+		c.Assert(ids, HasLen, 25)
+	}
+
+	// An invalid cursor is a bad request
+	res, err := http.Get(s.Server.URL + "/Patient?_cursor=foo")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *ServerSuite) TestPatientPagingWithCountsDisabled(c *C) {
 	config := DefaultConfig
 	config.CountTotalResults = false
@@ -268,8 +319,12 @@ func (s *ServerSuite) TestGetPatientSearchPagingPreservesSearchParams(c *C) {
 	c.Assert(bundle.Link, HasLen, 4)
 	assertPagingLinkWithParams(c, bundle.Link[0], "self", v, 10, 0)
 	assertPagingLinkWithParams(c, bundle.Link[1], "first", v, 10, 0)
-	assertPagingLinkWithParams(c, bundle.Link[2], "next", v, 10, 10)
+	nextURL := assertCursorPagingLink(c, bundle.Link[2], "next", 10)
 	assertPagingLinkWithParams(c, bundle.Link[3], "last", v, 10, 30)
+	nextValues := nextURL.Query()
+	for key, val := range v {
+		c.Assert(nextValues[key], DeepEquals, val)
+	}
 
 	// More results than count, middle page
 	bundle = performSearch(c, s.Server.URL+"/Patient?gender=male&name=Donald&name=Duck&_count=10&_offset=20")
@@ -293,6 +348,64 @@ func (s *ServerSuite) TestGetPatient(c *C) {
 	c.Assert(patient.Name[0].Given[0], Equals, "Donald")
 }
 
+func (s *ServerSuite) TestGetPatientSummary(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient/" + s.FixtureID + "?_summary=true")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	decoder := json.NewDecoder(res.Body)
+	patient := &models.Patient{}
+	err = decoder.Decode(patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donald")
+	c.Assert(patient.Text, IsNil)
+	c.Assert(patient.Photo, HasLen, 0)
+	c.Assert(patient.Contact, HasLen, 0)
+	c.Assert(hasSubsettedTag(patient.Meta), Equals, true)
+
+	res, err = http.Get(s.Server.URL + "/Patient/" + s.FixtureID + "?_summary=foo")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestSearchPatientElements(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient?_elements=gender")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	bundle := struct {
+		Entry []struct {
+			Resource models.Patient `json:"resource"`
+		} `json:"entry"`
+		Link []models.BundleLinkComponent `json:"link"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&bundle)
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 1)
+	patient := bundle.Entry[0].Resource
+	c.Assert(patient.Id, Equals, s.FixtureID)
+	c.Assert(patient.Gender, Equals, "male")
+	c.Assert(patient.Name, HasLen, 0)
+	c.Assert(patient.Text, IsNil)
+	c.Assert(hasSubsettedTag(patient.Meta), Equals, true)
+
+	// paging links keep the projection
+	c.Assert(bundle.Link[0].Relation, Equals, "self")
+	c.Assert(strings.Contains(bundle.Link[0].Url, "_elements=gender"), Equals, true)
+}
+
+func hasSubsettedTag(meta *models.Meta) bool {
+	if meta == nil {
+		return false
+	}
+	for _, tag := range meta.Tag {
+		if tag.Code == "SUBSETTED" {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *ServerSuite) TestGetNonExistingPatient(c *C) {
 	res, err := http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex())
 	util.CheckErr(err)
@@ -300,6 +413,85 @@ func (s *ServerSuite) TestGetNonExistingPatient(c *C) {
 	c.Assert(res.StatusCode, Equals, 404)
 }
 
+func (s *ServerSuite) getWithHeader(url, header, value string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	util.CheckErr(err)
+	req.Header.Set(header, value)
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *ServerSuite) TestConditionalRead(c *C) {
+	data, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	patientURL := s.Server.URL + "/Patient/" + resourceIdFromLocation(res)
+
+	res, err = http.Get(patientURL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, Equals, `W/"1"`)
+	lastModified := res.Header.Get("Last-Modified")
+	c.Assert(lastModified, Not(Equals), "")
+
+	res = s.getWithHeader(patientURL, "If-None-Match", etag)
+	c.Assert(res.StatusCode, Equals, 304)
+	c.Assert(res.Header.Get("ETag"), Equals, etag)
+	res = s.getWithHeader(patientURL, "If-None-Match", `W/"0", W/"1"`)
+	c.Assert(res.StatusCode, Equals, 304)
+	res = s.getWithHeader(patientURL, "If-None-Match", `W/"2"`)
+	c.Assert(res.StatusCode, Equals, 200)
+	res = s.getWithHeader(patientURL+"/_history/1", "If-None-Match", etag)
+	c.Assert(res.StatusCode, Equals, 304)
+
+	res = s.getWithHeader(patientURL, "If-Modified-Since", lastModified)
+	c.Assert(res.StatusCode, Equals, 304)
+	res = s.getWithHeader(patientURL, "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
+func (s *ServerSuite) TestConditionalSearch(c *C) {
+	data, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data.Close()
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+
+	searchURL := s.Server.URL + "/Patient?gender=male"
+	res, err = http.Get(searchURL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, Matches, `W/"[0-9a-f]+"`)
+	c.Assert(res.Header.Get("Last-Modified"), Equals, "")
+
+	res = s.getWithHeader(searchURL, "If-None-Match", etag)
+	c.Assert(res.StatusCode, Equals, 304)
+
+	res = s.getWithHeader(searchURL, "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	c.Assert(res.StatusCode, Equals, 304)
+	res = s.getWithHeader(searchURL, "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// a new match changes the ETag
+	data2, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data2.Close()
+	res, err = http.Post(s.Server.URL+"/Patient", "application/json", data2)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+
+	res = s.getWithHeader(searchURL, "If-None-Match", etag)
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
 func (s *ServerSuite) TestShowPatient(c *C) {
 
 	res, err := http.Get(s.Server.URL + "/Patient")
@@ -1005,6 +1197,533 @@ func (s *ServerSuite) TestConditionalUpdateMultipleMatches(c *C) {
 	c.Assert(patient2.Name[0].Given[0], Equals, "Don")
 }
 
+func (s *ServerSuite) patch(url, contentType, body, ifMatch string) *http.Response {
+	req, err := http.NewRequest("PATCH", url, strings.NewReader(body))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", contentType)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *ServerSuite) TestPatchPatientJSONPatch(c *C) {
+	jsonPatch := `[{"op":"test","path":"/name/0/given/0","value":"Donald"},{"op":"replace","path":"/name/0/given/0","value":"Donny"}]`
+	res := s.patch(s.Server.URL+"/Patient/"+s.FixtureID, "application/json-patch+json", jsonPatch, `W/"1"`)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"2"`)
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	patient := models.Patient{}
+	util.CheckErr(json.Unmarshal(resBody, &patient))
+	c.Assert(patient.Name[0].Given[0], Equals, "Donny")
+	c.Assert(patient.Gender, Equals, "male") // untouched elements are kept
+
+	err = s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donny")
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+
+	// previous version kept like for an update
+	prevQuery := bson.M{
+		"_id._id":      s.FixtureID,
+		"_id._version": 1,
+	}
+	patient = models.Patient{}
+	err = s.DB().C("patients_prev").Find(prevQuery).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donald")
+
+	// the test operation now fails
+	res = s.patch(s.Server.URL+"/Patient/"+s.FixtureID, "application/json-patch+json", jsonPatch, "")
+	c.Assert(res.StatusCode, Equals, 422)
+
+	// invalid patch documents are rejected
+	res = s.patch(s.Server.URL+"/Patient/"+s.FixtureID, "application/json-patch+json", `[{"op":"frobnicate"}]`, "")
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res = s.patch(s.Server.URL+"/Patient/"+bson.NewObjectId().Hex(), "application/json-patch+json", jsonPatch, "")
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *ServerSuite) TestPatchPatientFHIRPathPatch(c *C) {
+	fhirPathPatch := `{"resourceType":"Parameters","parameter":[{"name":"operation","part":[
+		{"name":"type","valueCode":"replace"},
+		{"name":"path","valueString":"Patient.name.where(use='official').given[0]"},
+		{"name":"value","valueString":"Donny"}]}]}`
+
+	res := s.patch(s.Server.URL+"/Patient/"+s.FixtureID, "application/fhir+json", fhirPathPatch, `W/"5"`)
+	c.Assert(res.StatusCode, Equals, 409)
+
+	res = s.patch(s.Server.URL+"/Patient/"+s.FixtureID, "application/fhir+json", fhirPathPatch, `W/"1"`)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	patient := models.Patient{}
+	err := s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donny")
+}
+
+func (s *ServerSuite) TestConditionalPatchPatient(c *C) {
+	jsonPatch := `[{"op":"replace","path":"/gender","value":"female"}]`
+	res := s.patch(s.Server.URL+"/Patient?identifier=urn:oid:0.1.2.3.4.5.6.7|654321", "application/json-patch+json", jsonPatch, "")
+	c.Assert(res.StatusCode, Equals, 200)
+
+	patient := models.Patient{}
+	err := s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Gender, Equals, "female")
+
+	res = s.patch(s.Server.URL+"/Patient?identifier=urn:oid:0.1.2.3.4.5.6.7|123", "application/json-patch+json", jsonPatch, "")
+	c.Assert(res.StatusCode, Equals, 404)
+
+	s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	res = s.patch(s.Server.URL+"/Patient?identifier=urn:oid:0.1.2.3.4.5.6.7|654321", "application/json-patch+json", jsonPatch, "")
+	c.Assert(res.StatusCode, Equals, 412)
+}
+
+func (s *ServerSuite) TestBatchPatch(c *C) {
+	jsonPatch := base64.StdEncoding.EncodeToString([]byte(`[{"op":"replace","path":"/gender","value":"female"}]`))
+	batch := `{"resourceType":"Bundle","type":"batch","entry":[{
+		"resource":{"resourceType":"Binary","contentType":"application/json-patch+json","content":"` + jsonPatch + `"},
+		"request":{"method":"PATCH","url":"Patient/` + s.FixtureID + `","ifMatch":"W/\"1\""}}]}`
+
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(batch))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	resBody, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	resBundle := &models.Bundle{}
+	util.CheckErr(json.Unmarshal(resBody, resBundle))
+	c.Assert(resBundle.Entry[0].Response.Status, Equals, "200")
+	c.Assert(resBundle.Entry[0].Response.Etag, Equals, `W/"2"`)
+
+	patient := models.Patient{}
+	err = s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Gender, Equals, "female")
+}
+
+func (s *ServerSuite) preferRequest(method, url, prefer, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	util.CheckErr(err)
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", "application/json-patch+json")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Prefer", prefer)
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *ServerSuite) TestPreferReturn(c *C) {
+	patient := `{"resourceType":"Patient","gender":"female"}`
+
+	// return=minimal omits the body
+	res := s.preferRequest("POST", s.Server.URL+"/Patient", "return=minimal", patient)
+	c.Assert(res.StatusCode, Equals, 201)
+	c.Assert(res.Header.Get("Location"), Not(Equals), "")
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"1"`)
+	body, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	c.Assert(body, HasLen, 0)
+
+	// return=OperationOutcome returns an informational outcome instead of the resource
+	res = s.preferRequest("PUT", s.Server.URL+"/Patient/"+s.FixtureID, "return=OperationOutcome", patient)
+	c.Assert(res.StatusCode, Equals, 200)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+
+	// return=representation is the default
+	res = s.preferRequest("PATCH", s.Server.URL+"/Patient/"+s.FixtureID, "return=representation", `[{"op":"replace","path":"/gender","value":"male"}]`)
+	c.Assert(res.StatusCode, Equals, 200)
+	updated := &models.Patient{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(updated))
+	c.Assert(updated.Gender, Equals, "male")
+
+	res = s.preferRequest("DELETE", s.Server.URL+"/Patient/"+s.FixtureID, "return=OperationOutcome", "")
+	c.Assert(res.StatusCode, Equals, 200)
+	outcome = &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue[0].Code, Equals, "informational")
+
+	// batch entries
+	batch := `{"resourceType":"Bundle","type":"batch","entry":[{
+		"resource":` + patient + `,
+		"request":{"method":"POST","url":"Patient"}}]}`
+	res = s.preferRequest("POST", s.Server.URL+"/", "return=minimal", batch)
+	c.Assert(res.StatusCode, Equals, 200)
+	resBundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(resBundle))
+	c.Assert(resBundle.Entry[0].Response.Status, Equals, "201")
+	c.Assert(resBundle.Entry[0].Response.Location, Not(Equals), "")
+	c.Assert(resBundle.Entry[0].Resource, IsNil)
+}
+
+func (s *ServerSuite) exportRequest(method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	util.CheckErr(err)
+	req.Header.Set("Prefer", "respond-async")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *ServerSuite) TestBulkExport(c *C) {
+	s.insertPatientFromFixture("../fixtures/patient-example-b.json")
+
+	res := s.exportRequest("GET", s.Server.URL+"/Patient/$export?_type=Patient&_outputFormat=application/fhir+ndjson")
+	c.Assert(res.StatusCode, Equals, 202)
+	statusURL := res.Header.Get("Content-Location")
+	c.Assert(statusURL, Matches, s.Server.URL+`/\$export-jobs/[0-9a-f]+`)
+
+	for i := 0; i < 50 && res.StatusCode == 202; i++ {
+		time.Sleep(100 * time.Millisecond)
+		res = s.exportRequest("GET", statusURL)
+	}
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var manifest struct {
+		Request             string
+		RequiresAccessToken bool
+		Output              []struct {
+			Type  string
+			URL   string
+			Count int
+		}
+	}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&manifest))
+	c.Assert(manifest.Request, Equals, s.Server.URL+"/Patient/$export?_type=Patient&_outputFormat=application/fhir+ndjson")
+	c.Assert(manifest.RequiresAccessToken, Equals, false)
+	c.Assert(manifest.Output, HasLen, 1)
+	c.Assert(manifest.Output[0].Type, Equals, "Patient")
+	c.Assert(manifest.Output[0].Count, Equals, 2)
+
+	res, err := http.Get(manifest.Output[0].URL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "application/fhir+ndjson")
+	body, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	c.Assert(lines, HasLen, 2)
+	for _, line := range lines {
+		patient := models.Patient{}
+		util.CheckErr(json.Unmarshal([]byte(line), &patient))
+		c.Assert(patient.Gender, Equals, "male")
+	}
+
+	// deleting the job removes its files
+	res = s.exportRequest("DELETE", statusURL)
+	c.Assert(res.StatusCode, Equals, 202)
+	res, err = http.Get(manifest.Output[0].URL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// kick-off requests must ask for an asynchronous response
+	res, err = http.Get(s.Server.URL + "/$export")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res = s.exportRequest("GET", s.Server.URL+"/$export?_type=Frobnicator")
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestBulkImport(c *C) {
+	newID := bson.NewObjectId().Hex()
+	ndjson := `{"resourceType":"Patient","id":"` + s.FixtureID + `","gender":"female"}
+{"resourceType":"Patient","id":"` + newID + `","gender":"other"}
+{"resourceType":"Patient",
+
+{"resourceType":"Patient","id":"not-an-object-id"}
+{"resourceType":"Frobnicator"}
+`
+	res, err := http.Post(s.Server.URL+"/$import", "application/fhir+ndjson", strings.NewReader(ndjson))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var outcomes []models.OperationOutcome
+	decoder := json.NewDecoder(res.Body)
+	for decoder.More() {
+		var outcome models.OperationOutcome
+		util.CheckErr(decoder.Decode(&outcome))
+		outcomes = append(outcomes, outcome)
+	}
+	c.Assert(outcomes, HasLen, 4)
+	c.Assert(outcomes[0].Issue[0].Location, DeepEquals, []string{"line 3"})
+	c.Assert(outcomes[1].Issue[0].Location, DeepEquals, []string{"line 5"})
+	c.Assert(outcomes[1].Issue[0].Diagnostics, Matches, ".*invalid id.*")
+	c.Assert(outcomes[2].Issue[0].Location, DeepEquals, []string{"line 6"})
+	c.Assert(outcomes[3].Issue[0].Diagnostics, Equals, "imported 2 resources (Patient: 2); 3 lines failed")
+
+	// existing resources are updated with the previous version kept
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(s.FixtureID).One(&patient))
+	c.Assert(patient.Gender, Equals, "female")
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+	prevCount, err := s.DB().C("patients_prev").Find(bson.M{"_id._id": s.FixtureID, "_id._version": 1}).Count()
+	util.CheckErr(err)
+	c.Assert(prevCount, Equals, 1)
+
+	// new resources keep their ids
+	patient = models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(newID).One(&patient))
+	c.Assert(patient.Gender, Equals, "other")
+	c.Assert(patient.Meta.VersionId, Equals, "1")
+}
+
+func (s *ServerSuite) createSubscription(c *C, criteria, endpoint string) string {
+	subscription := `{"resourceType":"Subscription","status":"requested","reason":"testing","criteria":"` + criteria + `",
+		"channel":{"type":"rest-hook","endpoint":"` + endpoint + `","payload":"application/fhir+json","header":["Authorization: Bearer secret"]}}`
+	res, err := http.Post(s.Server.URL+"/Subscription", "application/json", strings.NewReader(subscription))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	return resourceIdFromLocation(res)
+}
+
+func (s *ServerSuite) TestSubscriptionNotifications(c *C) {
+	defer s.DB().C("subscriptions").DropCollection()
+	defer s.DB().C("subscriptions_prev").DropCollection()
+
+	type notification struct {
+		method, path, authorization string
+		body                        []byte
+	}
+	notifications := make(chan notification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/failing") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		util.CheckErr(err)
+		notifications <- notification{r.Method, r.URL.Path, r.Header.Get("Authorization"), body}
+	}))
+	defer hook.Close()
+
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", s.Interceptors, DefaultConfig)
+	subscriptions := NewSubscriptionManager(dal, DefaultConfig)
+	subscriptions.Retries = 1
+	subscriptions.RetryDelay = time.Millisecond
+	session := dal.StartSession("")
+	defer session.Finish()
+
+	subscriptionStatus := func(id string) models.Subscription {
+		subscription := models.Subscription{}
+		util.CheckErr(s.DB().C("subscriptions").FindId(id).One(&subscription))
+		return subscription
+	}
+
+	// requested subscriptions are activated
+	goodID := s.createSubscription(c, "Patient?gender=male", hook.URL+"/good")
+	failingID := s.createSubscription(c, "Patient?gender=male", hook.URL+"/failing")
+	invalidID := s.createSubscription(c, "Patient?frobnicate=1", hook.URL+"/good")
+	for _, id := range []string{goodID, failingID, invalidID} {
+		resource, err := session.Get(id, "Subscription")
+		util.CheckErr(err)
+		subscriptions.subscriptionChanged(resource)
+	}
+	c.Assert(subscriptionStatus(goodID).Status, Equals, "active")
+	c.Assert(subscriptionStatus(failingID).Status, Equals, "active")
+	c.Assert(subscriptionStatus(invalidID).Status, Equals, "error")
+	c.Assert(subscriptionStatus(invalidID).Error, Matches, ".*frobnicate.*")
+
+	matches, err := subscriptions.matches(subscriptions.subscriptions[goodID], s.FixtureID)
+	util.CheckErr(err)
+	c.Assert(matches, Equals, true)
+	matches, err = subscriptions.matches(subscriptions.subscriptions[goodID], bson.NewObjectId().Hex())
+	util.CheckErr(err)
+	c.Assert(matches, Equals, false)
+
+	// the resource is PUT to the endpoint with the channel's headers
+	patient, err := session.Get(s.FixtureID, "Patient")
+	util.CheckErr(err)
+	subscriptions.resourceChanged(patient)
+	select {
+	case n := <-notifications:
+		c.Assert(n.method, Equals, "PUT")
+		c.Assert(n.path, Equals, "/good/Patient/"+s.FixtureID)
+		c.Assert(n.authorization, Equals, "Bearer secret")
+		notified := models.Patient{}
+		util.CheckErr(json.Unmarshal(n.body, &notified))
+		c.Assert(notified.Id, Equals, s.FixtureID)
+	case <-time.After(5 * time.Second):
+		c.Fatal("no notification received")
+	}
+
+	// notifications that keep failing put the subscription into an error state
+	for i := 0; i < 50 && subscriptionStatus(failingID).Status == "active"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(subscriptionStatus(failingID).Status, Equals, "error")
+	c.Assert(subscriptionStatus(failingID).Error, Matches, ".*HTTP status 500.*")
+	subscriptions.lock.Lock()
+	defer subscriptions.lock.Unlock()
+	c.Assert(subscriptions.subscriptions[failingID], IsNil)
+}
+
+func (s *ServerSuite) TestSubscriptionsLoadedAtStartup(c *C) {
+	defer s.DB().C("subscriptions").DropCollection()
+	defer s.DB().C("subscriptions_prev").DropCollection()
+
+	requestedID := s.createSubscription(c, "Patient?gender=male", "http://localhost/hook")
+
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", s.Interceptors, DefaultConfig)
+	subscriptions := NewSubscriptionManager(dal, DefaultConfig)
+	subscriptions.Start()
+	defer subscriptions.Stop()
+
+	// requested subscriptions are activated and their resource types watched
+	loaded := func() bool {
+		subscriptions.lock.Lock()
+		defer subscriptions.lock.Unlock()
+		_, watching := subscriptions.watchers["Patient"]
+		return subscriptions.subscriptions[requestedID] != nil && watching
+	}
+	for i := 0; i < 50 && !loaded(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(loaded(), Equals, true)
+
+	subscription := models.Subscription{}
+	util.CheckErr(s.DB().C("subscriptions").FindId(requestedID).One(&subscription))
+	c.Assert(subscription.Status, Equals, "active")
+}
+
+func (s *ServerSuite) searchPatientTotal(c *C, query string) int {
+	res, err := http.Get(s.Server.URL + "/Patient?" + query)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	bundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	return int(*bundle.Total)
+}
+
+func (s *ServerSuite) TestCustomSearchParameter(c *C) {
+	defer s.DB().C("searchparameters").DropCollection()
+
+	patient := `{"resourceType":"Patient","gender":"female","extension":[{"url":"http://example.org/fhir/StructureDefinition/favourite-colour","valueCodeableConcept":{"coding":[{"system":"http://example.org/colours","code":"%s"}]}}]}`
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(fmt.Sprintf(patient, "green")))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+
+	// unsupported definitions are rejected
+	invalid := `{"resourceType":"SearchParameter","status":"active","code":"colour","base":["Patient"],"type":"token","expression":"Patient.name.where(use='official')"}`
+	res, err = http.Post(s.Server.URL+"/SearchParameter", "application/json", strings.NewReader(invalid))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 422)
+
+	definition := `{"resourceType":"SearchParameter","status":"active","code":"colour","base":["Patient"],"type":"token",
+		"expression":"Patient.extension('http://example.org/fhir/StructureDefinition/favourite-colour').value"}`
+	res, err = http.Post(s.Server.URL+"/SearchParameter", "application/json", strings.NewReader(definition))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	searchParameterID := resourceIdFromLocation(res)
+	defer search.UnregisterCustomSearchParameter(searchParameterID)
+
+	res, err = http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(fmt.Sprintf(patient, "green")))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	res, err = http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(fmt.Sprintf(patient, "blue")))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+
+	// the patient created before the search parameter is only found after reindexing
+	c.Assert(s.searchPatientTotal(c, "colour=http://example.org/colours|green"), Equals, 1)
+	res, err = http.Post(s.Server.URL+"/$reindex?_type=Patient", "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(s.searchPatientTotal(c, "colour=http://example.org/colours|green"), Equals, 2)
+	c.Assert(s.searchPatientTotal(c, "colour=blue"), Equals, 1)
+
+	// deleting the SearchParameter removes the search parameter
+	req, err := http.NewRequest("DELETE", s.Server.URL+"/SearchParameter/"+searchParameterID, nil)
+	util.CheckErr(err)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 204)
+	_, registered := search.SearchParameterDictionary["Patient"]["colour"]
+	c.Assert(registered, Equals, false)
+}
+
+func (s *ServerSuite) TestSystemSearch(c *C) {
+	defer s.DB().C("practitioners").DropCollection()
+
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","name":[{"family":"Peters"}]}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	res, err = http.Post(s.Server.URL+"/Practitioner", "application/json", strings.NewReader(`{"resourceType":"Practitioner","name":[{"family":"Peters"}]}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	practitionerID := resourceIdFromLocation(res)
+
+	// the patient fixture has no meta.lastUpdated, and the most recently updated resources come first
+	bundle := assertBundleCount(c, s.Server.URL+"/?_type=Patient,Practitioner&_lastUpdated=gt2018-01-01", 2, 2)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Practitioner/"+practitionerID)
+	c.Assert(bundle.Entry[1].Resource.(*models.Patient).Name[0].Family, Equals, "Peters")
+
+	bundle = assertBundleCount(c, s.Server.URL+"/?_type=Patient,Practitioner&family=Peters&_count=1&_offset=1", 1, 2)
+	c.Assert(bundle.Entry[0].Search.Mode, Equals, "match")
+	assertPagingLink(c, bundle.Link[0], "self", 1, 1)
+	assertPagingLink(c, bundle.Link[2], "previous", 1, 0)
+
+	// POSTed _search
+	res, err = http.Post(s.Server.URL+"/_search", "application/x-www-form-urlencoded", strings.NewReader("_type=Practitioner&family=Peters"))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	bundle = &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	c.Assert(*bundle.Total, Equals, uint32(1))
+
+	// parameters must be defined for all of the resource types searched
+	res, err = http.Get(s.Server.URL + "/?_type=Patient,Observation&family=Peters")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, err = http.Get(s.Server.URL + "/?_type=Patient,Foo")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestLocationNearSearch(c *C) {
+	defer s.DB().C("locations").DropCollection()
+
+	ids := make(map[string]string)
+	for _, l := range []struct{ name, position string }{
+		{"Sydney", `{"latitude":-33.8688,"longitude":151.2093}`},
+		{"Geelong", `{"latitude":-38.1499,"longitude":144.3617}`},
+		{"Melbourne", `{"latitude":-37.8136,"longitude":144.9631}`},
+	} {
+		res, err := http.Post(s.Server.URL+"/Location", "application/json", strings.NewReader(`{"resourceType":"Location","name":"`+l.name+`","position":`+l.position+`}`))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 201)
+		ids[l.name] = resourceIdFromLocation(res)
+	}
+
+	bundle := assertBundleCount(c, s.Server.URL+"/Location?near=-37.8136|144.9631|100|km", 2, 2)
+	for _, entry := range bundle.Entry {
+		c.Assert(entry.Resource.(*models.Location).Name, Not(Equals), "Sydney")
+	}
+
+	// sorting by distance needs the 2dsphere index of indexes.conf
+	util.CheckErr(s.DB().C("locations").EnsureIndex(mgo.Index{Key: []string{"$2dsphere:__search.__near"}}))
+	bundle = assertBundleCount(c, s.Server.URL+"/Location?near=-37.8136|144.9631|1000|[mi_i]&_sort=near", 3, 3)
+	c.Assert(bundle.Entry[0].Resource.(*models.Location).Id, Equals, ids["Melbourne"])
+	c.Assert(bundle.Entry[1].Resource.(*models.Location).Id, Equals, ids["Geelong"])
+	c.Assert(bundle.Entry[2].Resource.(*models.Location).Id, Equals, ids["Sydney"])
+
+	res, err := http.Get(s.Server.URL + "/Location?near=-37.8136|144.9631|100|furlong")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *ServerSuite) TestDeletePatient(c *C) {
 
 	data, err := os.Open("../fixtures/patient-example-d.json")
@@ -1173,6 +1892,8 @@ func (s *ServerSuite) TestSummaryCount(c *C) {
 }
 
 func (s *ServerSuite) TestPatientEverything(c *C) {
+	defer s.DB().C("encounters").DropCollection()
+	defer s.DB().C("observations").DropCollection()
 
 	data, err := os.Open("../fixtures/patient-example-d.json")
 	util.CheckErr(err)
@@ -1182,28 +1903,68 @@ func (s *ServerSuite) TestPatientEverything(c *C) {
 	util.CheckErr(err)
 
 	createdPatientID := resourceIdFromLocation(res)
+	everythingURL := s.Server.URL + "/Patient/" + createdPatientID + "/$everything"
 
-	// Do the $everything query
-	res, err = http.Get(s.Server.URL + "/Patient/" + createdPatientID + "/$everything")
-	util.CheckErr(err)
-
-	// Response should be a bundle with a total of 1, a raw self link, and some entries
-	bundle := &models.Bundle{}
-	body, err := ioutil.ReadAll(res.Body)
-	util.CheckErr(err)
+	// Nothing else is in the patient's compartment yet, so we expect only the Patient resource itself
+	bundle := assertBundleCount(c, everythingURL, 1, 1)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Patient/"+createdPatientID)
+	c.Assert(len(bundle.Link), Equals, 3)
+	self := bundle.Link[0]
+	c.Assert(self.Relation, Equals, "self")
+	c.Assert(self.Url, Equals, everythingURL+"?_offset=0&_count=100")
 
-	err = json.Unmarshal(body, bundle)
+	post := func(resourceType string, body string) string {
+		res, err := http.Post(s.Server.URL+"/"+resourceType, "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 201)
+		return resourceIdFromLocation(res)
+	}
+	encounterID := post("Encounter", fmt.Sprintf(`{"resourceType":"Encounter","status":"finished","subject":{"reference":"Patient/%s"}}`, createdPatientID))
+	post("Observation", fmt.Sprintf(`{"resourceType":"Observation","status":"final","code":{"text":"weight"},"subject":{"reference":"Patient/%s"}}`, createdPatientID))
+	// this Observation is only in the patient's record through the Encounter
+	post("Observation", fmt.Sprintf(`{"resourceType":"Observation","status":"final","code":{"text":"height"},"context":{"reference":"Encounter/%s"}}`, encounterID))
+
+	// The resources are grouped by type, and the ones they refer to are already in the bundle
+	bundle = assertBundleCount(c, everythingURL, 4, 4)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Patient/"+createdPatientID)
+	c.Assert(bundle.Entry[1].FullUrl, Equals, s.Server.URL+"/Encounter/"+encounterID)
+	c.Assert(bundle.Entry[2].Resource, FitsTypeOf, &models.Observation{})
+	c.Assert(bundle.Entry[3].Resource, FitsTypeOf, &models.Observation{})
+
+	// The Patient and Encounter aren't on the second page, so are included as the Observations refer to them
+	bundle = assertBundleCount(c, everythingURL+"?_count=2&_offset=2", 4, 4)
+	c.Assert(bundle.Entry[0].Resource, FitsTypeOf, &models.Observation{})
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "match")
+	c.Assert(bundle.Entry[2].Search.Mode, Equals, "include")
+	c.Assert(bundle.Entry[3].Search.Mode, Equals, "include")
+	assertPagingLink(c, bundle.Link[0], "self", 2, 2)
+	assertPagingLink(c, bundle.Link[2], "previous", 2, 0)
+
+	bundle = assertBundleCount(c, everythingURL+"?_type=Observation,Encounter", 4, 3)
+	c.Assert(bundle.Entry[3].FullUrl, Equals, s.Server.URL+"/Patient/"+createdPatientID)
+	assertBundleCount(c, everythingURL+"?_since=2100-01-01T00:00:00Z", 0, 0)
+
+	res, err = http.Get(everythingURL + "?_type=Practitioner")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, err = http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex() + "/$everything")
 	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 404)
 
-	c.Assert(*bundle.Total, Equals, uint32(1))
-	// The only resource referring to this patient is the Patient resource itself, so we expect only 1 entry
-	c.Assert(len(bundle.Entry), Equals, 1)
+	// Encounter $everything only has the Encounter's compartment
+	bundle = assertBundleCount(c, s.Server.URL+"/Encounter/"+encounterID+"/$everything", 3, 2)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Encounter/"+encounterID)
+	c.Assert(bundle.Entry[2].Search.Mode, Equals, "include")
 
-	c.Assert(len(bundle.Link), Equals, 1)
-	self := bundle.Link[0]
-	c.Assert(self.Relation, Equals, "self")
-	// The self link should correctly show $everything as it's defined: _id=<id>&_include=*&_revinclude=*
-	c.Assert(self.Url, Equals, s.Server.URL+"/Patient?_id="+createdPatientID+"&_include=*&_revinclude=*")
+	// Compartment searches
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient/"+createdPatientID+"/Observation", 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Observation).Code.Text, Equals, "weight")
+	assertBundleCount(c, s.Server.URL+"/Patient/"+createdPatientID+"/Observation?status=cancelled", 0, 0)
+	bundle = assertBundleCount(c, s.Server.URL+"/Encounter/"+encounterID+"/Observation", 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Observation).Code.Text, Equals, "height")
+	res, err = http.Get(s.Server.URL + "/Patient/" + createdPatientID + "/Practitioner")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 404)
 }
 
 func performSearch(c *C, url string) *models.Bundle {
@@ -1235,6 +1996,19 @@ func assertPagingLink(c *C, link models.BundleLinkComponent, relation string, co
 	c.Assert(v.Get(search.OffsetParam), Equals, fmt.Sprint(offset))
 }
 
+func assertCursorPagingLink(c *C, link models.BundleLinkComponent, relation string, count int) *url.URL {
+	c.Assert(link.Relation, Equals, relation)
+
+	urlURL, err := url.Parse(link.Url)
+	util.CheckErr(err)
+	v := urlURL.Query()
+
+	c.Assert(v.Get(search.CountParam), Equals, fmt.Sprint(count))
+	c.Assert(v.Get(search.CursorParam), Not(Equals), "")
+	c.Assert(v.Get(search.OffsetParam), Equals, "")
+	return urlURL
+}
+
 func assertPagingLinkWithParams(c *C, link models.BundleLinkComponent, relation string, values url.Values, count int, offset int) {
 	c.Assert(link.Relation, Equals, relation)
 
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+)
+
+// SubscriptionManager delivers rest-hook notifications for active Subscription resources
+// (http://hl7.org/fhir/STU3/subscription.html).  The subscriptions collection is watched with a MongoDB
+// change stream, as are the collections of the resource types that subscriptions are interested in.
+// Every created or updated resource is checked against the criteria of the subscriptions for its type
+// using the MongoSearcher.  Only subscriptions in the default database are supported.
+//
+// New subscriptions with a status of "requested" are activated once their criteria and channel have been
+// checked.  If a notification still fails after the retries the subscription's status is set to "error".
+type SubscriptionManager struct {
+	dal           *mongoDataAccessLayer
+	enableHistory bool
+	client        *http.Client
+
+	// Failed notifications are retried this many times, waiting RetryDelay before the first retry
+	// and doubling the delay for each one after that
+	Retries    int
+	RetryDelay time.Duration
+
+	lock          sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+	subscriptions map[string]*activeSubscription
+	watchers      map[string]context.CancelFunc
+}
+
+type activeSubscription struct {
+	id           string
+	resourceType string
+	query        string
+	end          *time.Time
+	endpoint     string
+	payload      string
+	headers      []string
+}
+
+// NewSubscriptionManager creates a SubscriptionManager, or returns nil if the DataAccessLayer isn't
+// backed by MongoDB
+func NewSubscriptionManager(dal DataAccessLayer, config Config) *SubscriptionManager {
+	mongoDAL, isMongo := dal.(*mongoDataAccessLayer)
+	if !isMongo {
+		return nil
+	}
+	return &SubscriptionManager{
+		dal:           mongoDAL,
+		enableHistory: config.EnableHistory,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		Retries:       3,
+		RetryDelay:    5 * time.Second,
+		subscriptions: make(map[string]*activeSubscription),
+		watchers:      make(map[string]context.CancelFunc),
+	}
+}
+
+// Start loads the existing subscriptions and starts watching for changes in the background
+func (sm *SubscriptionManager) Start() {
+	sm.lock.Lock()
+	sm.ctx, sm.cancel = context.WithCancel(context.Background())
+	ctx := sm.ctx
+	sm.lock.Unlock()
+
+	go func() {
+		for ctx.Err() == nil {
+			err := sm.loadSubscriptions()
+			if err == nil {
+				break
+			}
+			log.Printf("Subscriptions: failed to load subscriptions (will retry): %+v\n", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Minute):
+			}
+		}
+		sm.watch(ctx, "Subscription", []string{"insert", "replace", "delete"}, sm.subscriptionEvent)
+	}()
+}
+
+// Stop stops watching for changes and delivering notifications
+func (sm *SubscriptionManager) Stop() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.cancel != nil {
+		sm.cancel()
+	}
+	sm.subscriptions = make(map[string]*activeSubscription)
+	sm.watchers = make(map[string]context.CancelFunc)
+}
+
+func (sm *SubscriptionManager) loadSubscriptions() error {
+	session := sm.dal.StartSession("").(*mongoSession)
+	defer session.Finish()
+
+	filter := bson.NewDocument(bson.EC.SubDocumentFromElements("status", bson.EC.ArrayFromElements("$in", bson.VC.String("requested"), bson.VC.String("active"))))
+	cursor, err := session.CurrentVersionCollection("Subscription").Find(context.TODO(), filter, session.session)
+	if err != nil {
+		return errors.Wrap(convertMongoErr(err), "failed to query subscriptions")
+	}
+
+	var resources []*models2.Resource
+	for cursor.Next(context.TODO()) {
+		var doc bson.Document
+		if err := cursor.Decode(&doc); err != nil {
+			return errors.Wrap(err, "failed to decode subscription")
+		}
+		resource, err := models2.NewResourceFromBSON2(&doc)
+		if err != nil {
+			return errors.Wrap(err, "failed to convert subscription")
+		}
+		resources = append(resources, resource)
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(err, "failed to query subscriptions")
+	}
+
+	for _, resource := range resources {
+		sm.subscriptionChanged(resource)
+	}
+	return nil
+}
+
+// watch calls handler with each change event for a resource type's collection until ctx is cancelled.
+// The change stream is reopened after errors, so changes made while it was down aren't seen.
+func (sm *SubscriptionManager) watch(ctx context.Context, resourceType string, operationTypes []string, handler func(operationType string, event *bson.Document)) {
+	operationTypeValues := make([]*bson.Value, len(operationTypes))
+	for i, operationType := range operationTypes {
+		operationTypeValues[i] = bson.VC.String(operationType)
+	}
+	pipeline := bson.NewArray(bson.VC.DocumentFromElements(
+		bson.EC.SubDocumentFromElements("$match",
+			bson.EC.SubDocumentFromElements("operationType", bson.EC.ArrayFromElements("$in", operationTypeValues...)),
+		),
+	))
+
+	for ctx.Err() == nil {
+		session := sm.dal.StartSession("").(*mongoSession)
+		cursor, err := session.CurrentVersionCollection(resourceType).Watch(ctx, pipeline)
+		if err == nil {
+			for cursor.Next(ctx) {
+				var event bson.Document
+				if err = cursor.Decode(&event); err != nil {
+					break
+				}
+				operationType, lookupErr := event.LookupErr("operationType")
+				if lookupErr != nil {
+					log.Printf("Subscriptions: %s change event without an operationType\n", resourceType)
+					continue
+				}
+				handler(operationType.StringValue(), &event)
+			}
+			if err == nil {
+				err = cursor.Err()
+			}
+			cursor.Close(context.Background())
+		}
+		session.Finish()
+
+		if ctx.Err() == nil {
+			log.Printf("Subscriptions: %s change stream failed (will retry): %+v\n", resourceType, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// subscriptionEvent handles changes to the subscriptions collection
+func (sm *SubscriptionManager) subscriptionEvent(operationType string, event *bson.Document) {
+	if operationType == "delete" {
+		id, err := event.LookupErr("documentKey", "_id")
+		if err == nil {
+			sm.remove(id.StringValue())
+		}
+		return
+	}
+
+	resource, err := changedResource(event)
+	if err != nil {
+		log.Printf("Subscriptions: %+v\n", err)
+		return
+	}
+	sm.subscriptionChanged(resource)
+}
+
+// resourceEvent handles inserts and replacements in the collection of a resource type subscribed to
+func (sm *SubscriptionManager) resourceEvent(operationType string, event *bson.Document) {
+	resource, err := changedResource(event)
+	if err != nil {
+		log.Printf("Subscriptions: %+v\n", err)
+		return
+	}
+	sm.resourceChanged(resource)
+}
+
+func changedResource(event *bson.Document) (*models2.Resource, error) {
+	fullDocument, err := event.LookupErr("fullDocument")
+	if err != nil {
+		return nil, errors.Wrap(err, "change event without a fullDocument")
+	}
+	resource, err := models2.NewResourceFromBSON2(fullDocument.MutableDocument())
+	return resource, errors.Wrap(err, "failed to convert changed resource")
+}
+
+// subscriptionChanged activates, updates or removes a subscription
+func (sm *SubscriptionManager) subscriptionChanged(resource *models2.Resource) {
+	var subscription models.Subscription
+	err := resource.Unmarshal(&subscription)
+	if err != nil {
+		log.Printf("Subscriptions: failed to decode Subscription/%s: %+v\n", resource.Id(), err)
+		return
+	}
+
+	switch subscription.Status {
+	case "requested", "active":
+		active, err := newActiveSubscription(resource.Id(), &subscription)
+		if err != nil {
+			sm.remove(resource.Id())
+			sm.setStatus(resource.Id(), "error", err.Error())
+		} else if active.ended() {
+			sm.remove(resource.Id())
+			sm.setStatus(resource.Id(), "off", "")
+		} else {
+			if subscription.Status == "requested" {
+				sm.setStatus(resource.Id(), "active", "")
+			}
+			sm.add(active)
+		}
+	default:
+		sm.remove(resource.Id())
+	}
+}
+
+// newActiveSubscription checks a subscription's criteria and channel
+func newActiveSubscription(id string, subscription *models.Subscription) (active *activeSubscription, err error) {
+	if subscription.Channel == nil || subscription.Channel.Type != "rest-hook" {
+		return nil, errors.New("only rest-hook channels are supported")
+	}
+	if subscription.Channel.Endpoint == "" {
+		return nil, errors.New("the rest-hook channel has no endpoint")
+	}
+
+	resourceType := subscription.Criteria
+	query := ""
+	if i := strings.Index(subscription.Criteria, "?"); i >= 0 {
+		resourceType = subscription.Criteria[:i]
+		query = subscription.Criteria[i+1:]
+	}
+	if _, known := search.SearchParameterDictionary[resourceType]; !known {
+		return nil, errors.Errorf("unknown resource type in criteria: %s", subscription.Criteria)
+	}
+
+	// the searcher panics for unsupported parameters
+	defer func() {
+		if r := recover(); r != nil {
+			active = nil
+			err = errors.Errorf("invalid criteria (%s): %v", subscription.Criteria, r)
+		}
+	}()
+	searchQuery := search.Query{Resource: resourceType, Query: query}
+	searchQuery.Params()
+	searchQuery.Options()
+
+	active = &activeSubscription{
+		id:           id,
+		resourceType: resourceType,
+		query:        query,
+		endpoint:     subscription.Channel.Endpoint,
+		payload:      subscription.Channel.Payload,
+		headers:      subscription.Channel.Header,
+	}
+	if subscription.End != nil {
+		end := subscription.End.Time
+		active.end = &end
+	}
+	return active, nil
+}
+
+func (sub *activeSubscription) ended() bool {
+	return sub.end != nil && sub.end.Before(time.Now())
+}
+
+// add registers an active subscription, watching its resource type if it isn't already
+func (sm *SubscriptionManager) add(sub *activeSubscription) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.subscriptions[sub.id] = sub
+	if _, watching := sm.watchers[sub.resourceType]; !watching && sm.ctx != nil {
+		ctx, cancel := context.WithCancel(sm.ctx)
+		sm.watchers[sub.resourceType] = cancel
+		go sm.watch(ctx, sub.resourceType, []string{"insert", "replace"}, sm.resourceEvent)
+	}
+}
+
+// remove unregisters a subscription, no longer watching its resource type if no other subscription needs it
+func (sm *SubscriptionManager) remove(id string) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sub, found := sm.subscriptions[id]
+	if !found {
+		return
+	}
+	delete(sm.subscriptions, id)
+
+	for _, other := range sm.subscriptions {
+		if other.resourceType == sub.resourceType {
+			return
+		}
+	}
+	if cancel, watching := sm.watchers[sub.resourceType]; watching {
+		cancel()
+		delete(sm.watchers, sub.resourceType)
+	}
+}
+
+// resourceChanged sends notifications for the subscriptions whose criteria match a created or updated resource
+func (sm *SubscriptionManager) resourceChanged(resource *models2.Resource) {
+	var interested []*activeSubscription
+	sm.lock.Lock()
+	for _, sub := range sm.subscriptions {
+		if sub.resourceType == resource.ResourceType() {
+			interested = append(interested, sub)
+		}
+	}
+	sm.lock.Unlock()
+
+	for _, sub := range interested {
+		if sub.ended() {
+			sm.remove(sub.id)
+			sm.setStatus(sub.id, "off", "")
+			continue
+		}
+
+		matches, err := sm.matches(sub, resource.Id())
+		if err != nil {
+			log.Printf("Subscriptions: failed to check Subscription/%s criteria: %+v\n", sub.id, err)
+		} else if matches {
+			go sm.notify(sub, resource)
+		}
+	}
+}
+
+// matches checks whether the resource with the given id is found by a subscription's criteria
+func (sm *SubscriptionManager) matches(sub *activeSubscription, id string) (matches bool, err error) {
+	session := sm.dal.StartSession("").(*mongoSession)
+	defer session.Finish()
+
+	query := "_id=" + id
+	if sub.query != "" {
+		query = sub.query + "&" + query
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("search panicked: %v", r)
+		}
+	}()
+	searcher := search.NewMongoSearcher(session.db, session.session, false, sm.dal.enableCISearches, false)
+	results, _, err := searcher.Search(search.Query{Resource: sub.resourceType, Query: query})
+	if err != nil {
+		return false, err
+	}
+	return len(results) > 0, nil
+}
+
+// notify delivers a notification, retrying with increasing delays and setting the subscription's status
+// to error if it keeps failing
+func (sm *SubscriptionManager) notify(sub *activeSubscription, resource *models2.Resource) {
+	var err error
+	delay := sm.RetryDelay
+	for attempt := 0; attempt <= sm.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = sm.send(sub, resource)
+		if err == nil {
+			return
+		}
+	}
+
+	log.Printf("Subscriptions: giving up on notification for Subscription/%s: %+v\n", sub.id, err)
+	sm.remove(sub.id)
+	sm.setStatus(sub.id, "error", fmt.Sprintf("notification failed after %d attempts: %s", sm.Retries+1, err))
+}
+
+// send makes a rest-hook request: an empty POST to the endpoint if the subscription has no payload,
+// otherwise a PUT of the resource to [endpoint]/[type]/[id]
+func (sm *SubscriptionManager) send(sub *activeSubscription, resource *models2.Resource) error {
+	method := "POST"
+	url := sub.endpoint
+	var body io.Reader
+	if sub.payload != "" {
+		method = "PUT"
+		url = strings.TrimSuffix(sub.endpoint, "/") + "/" + resource.ResourceType() + "/" + resource.Id()
+		body = bytes.NewReader(resource.JsonBytes())
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return errors.Wrap(err, "invalid rest-hook request")
+	}
+	if sub.payload != "" {
+		req.Header.Set("Content-Type", sub.payload)
+	}
+	for _, header := range sub.headers {
+		nameAndValue := strings.SplitN(header, ":", 2)
+		if len(nameAndValue) == 2 {
+			req.Header.Set(strings.TrimSpace(nameAndValue[0]), strings.TrimSpace(nameAndValue[1]))
+		}
+	}
+
+	res, err := sm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("%s %s returned HTTP status %d", method, url, res.StatusCode)
+	}
+	return nil
+}
+
+// setStatus updates the status and error of a subscription (creating a new version) if they have changed
+func (sm *SubscriptionManager) setStatus(id, status, errorMessage string) {
+	session := sm.dal.StartSession("")
+	defer session.Finish()
+
+	resource, err := session.Get(id, "Subscription")
+	if err != nil {
+		log.Printf("Subscriptions: failed to get Subscription/%s to set its status: %+v\n", id, err)
+		return
+	}
+	var subscription models.Subscription
+	err = resource.Unmarshal(&subscription)
+	if err != nil {
+		log.Printf("Subscriptions: failed to decode Subscription/%s: %+v\n", id, err)
+		return
+	}
+	if subscription.Status == status && subscription.Error == errorMessage {
+		return
+	}
+
+	subscription.Status = status
+	subscription.Error = errorMessage
+	jsonBytes, err := json.Marshal(&subscription)
+	if err == nil {
+		var updated *models2.Resource
+		updated, err = models2.NewResourceFromJsonBytes(jsonBytes)
+		if err == nil {
+			versionToCheck := ""
+			if sm.enableHistory {
+				versionToCheck = resource.VersionId()
+			}
+			_, err = session.Put(id, versionToCheck, updated)
+		}
+	}
+	if err != nil {
+		log.Printf("Subscriptions: failed to set Subscription/%s status to %s: %+v\n", id, status, err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/gin-gonic/gin"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// SystemController handles interactions that apply to the whole system rather than a single resource type
+type SystemController struct {
+	DAL    DataAccessLayer
+	Config Config
+}
+
+// NewSystemController creates a new SystemController based on the passed in DAL
+func NewSystemController(dal DataAccessLayer, config Config) *SystemController {
+	return &SystemController{
+		DAL:    dal,
+		Config: config,
+	}
+}
+
+// HistoryHandler handles requests for the history of all resources on the server.
+func (sc *SystemController) HistoryHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := sc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	c.Set("Action", "history")
+
+	query, err := ParseHistoryQuery("", "", c.Request.URL.RawQuery)
+	if err != nil {
+		panic(err)
+	}
+
+	baseURL := sc.Config.responseURL(c.Request)
+	bundle, err := session.History(*baseURL, query)
+	if err != nil {
+		panic(errors.Wrap(err, "History request failed"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// SearchHandler handles whole-system searches across the resource types given by the _type parameter,
+// or all resource types if it's missing.
+func (sc *SystemController) SearchHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	rawQuery, ok := searchRawQuery(c)
+	if !ok {
+		return
+	}
+
+	session := sc.DAL.StartSession(c.GetHeader("Db"))
+	defer session.Finish()
+
+	c.Set("Action", "search")
+
+	resourceTypes := historyResourceTypes()
+	query := search.ParseSystemQuery(rawQuery, resourceTypes)
+	baseURL := sc.Config.responseURL(c.Request)
+	bundle, err := systemSearch(session, *baseURL, query, query.URLQueryParameters(resourceTypes))
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+
+	c.Set("bundle", bundle)
+
+	etagValue := setSearchETag(c, bundle)
+	lastModified, err := searchLastModified(c, session, sc.Config.EnableHistory, "", bundle)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+	if notModified(c, etagValue, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// systemSearch searches each of the resource types of a whole-system search for its results up to the end of
+// the requested page, then merges and sorts them into a single page of results
+func systemSearch(session DataAccessSession, baseURL url.URL, query search.SystemQuery, params search.URLQueryParameters) (*models2.ShallowBundle, error) {
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	var resources []*models2.Resource
+	var total uint32
+	countTotalResults := true
+	for _, resourceType := range query.ResourceTypes {
+		typeURL := baseURL
+		typeURL.Path = strings.TrimSuffix(typeURL.Path, "/") + "/" + resourceType
+		bundle, err := session.Search(typeURL, query.TypeQuery(resourceType))
+		if err != nil {
+			return nil, errors.Wrapf(err, "search of %s resources failed", resourceType)
+		}
+		if bundle.Total == nil {
+			countTotalResults = false
+		} else {
+			total += *bundle.Total
+		}
+		for _, entry := range bundle.Entry {
+			if entry.Search != nil && entry.Search.Mode == "match" {
+				resources = append(resources, entry.Resource)
+			}
+		}
+	}
+
+	if err := query.SortResults(resources); err != nil {
+		return nil, errors.Wrap(err, "failed to sort search results")
+	}
+
+	options := query.Options()
+	if options.Offset >= len(resources) {
+		resources = nil
+	} else {
+		resources = resources[options.Offset:]
+	}
+	if len(resources) > options.Count {
+		resources = resources[:options.Count]
+	}
+
+	entryList := make([]models2.ShallowBundleEntryComponent, len(resources))
+	for i, resource := range resources {
+		entryList[i].Resource = resource
+		entryList[i].FullUrl = baseURLstr + resource.ResourceType() + "/" + resource.Id()
+		entryList[i].Search = &models.BundleEntrySearchComponent{Mode: "match"}
+	}
+
+	bundle := models2.ShallowBundle{
+		Id:    objectid.New().Hex(),
+		Type:  "searchset",
+		Entry: entryList,
+	}
+	if countTotalResults {
+		bundle.Total = &total
+	}
+	bundle.Link = newPagingLinks(baseURL, params, options.Offset, options.Count, total, uint32(len(resources)), countTotalResults, nil)
+
+	return &bundle, nil
+}
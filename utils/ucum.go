@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UCUMSystem is the code system of the Unified Code for Units of Measure
+const UCUMSystem = "http://unitsofmeasure.org"
+
+// UCUMUnit is a UCUM unit in terms of the UCUM base units: it is Factor times the product of the
+// base units raised to their exponents.  Factors are exact so conversions keep the precision of
+// the values being converted.
+type UCUMUnit struct {
+	Factor    *big.Rat
+	Exponents map[string]int
+}
+
+// Canonical returns the UCUM code of the canonical unit, e.g. "g.m-3" for mg/dL or "1" for a
+// dimensionless unit.  Quantities are comparable if their units have the same canonical code.
+func (u UCUMUnit) Canonical() string {
+	var bases []string
+	for base, exponent := range u.Exponents {
+		if exponent != 0 {
+			bases = append(bases, base)
+		}
+	}
+	if len(bases) == 0 {
+		return "1"
+	}
+	sort.Strings(bases)
+	for i, base := range bases {
+		if exponent := u.Exponents[base]; exponent != 1 {
+			bases[i] = base + strconv.Itoa(exponent)
+		}
+	}
+	return strings.Join(bases, ".")
+}
+
+// Convert converts a value in this unit to the canonical unit
+func (u UCUMUnit) Convert(value *big.Rat) *big.Rat {
+	return new(big.Rat).Mul(value, u.Factor)
+}
+
+func (u UCUMUnit) times(other UCUMUnit, sign int) UCUMUnit {
+	result := UCUMUnit{Factor: new(big.Rat).Set(u.Factor), Exponents: make(map[string]int)}
+	for base, exponent := range u.Exponents {
+		result.Exponents[base] = exponent
+	}
+	if sign < 0 {
+		result.Factor.Quo(result.Factor, other.Factor)
+	} else {
+		result.Factor.Mul(result.Factor, other.Factor)
+	}
+	for base, exponent := range other.Exponents {
+		result.Exponents[base] += sign * exponent
+	}
+	return result
+}
+
+func (u UCUMUnit) pow(exponent int) UCUMUnit {
+	result := ucumUnity()
+	for i := 0; i < exponent; i++ {
+		result = result.times(u, 1)
+	}
+	for i := 0; i > exponent; i-- {
+		result = result.times(u, -1)
+	}
+	return result
+}
+
+func ucumUnity() UCUMUnit {
+	return UCUMUnit{Factor: big.NewRat(1, 1), Exponents: map[string]int{}}
+}
+
+// ParseUCUM parses a UCUM unit code, e.g. "mg/dL", "mmol/L", "10*9/L" or "[lb_av]".  Only the
+// commonly used units with a linear conversion to the base units are supported, so e.g. Cel and
+// [pH] are not.  Annotations such as {cells} are ignored.
+func ParseUCUM(code string) (UCUMUnit, error) {
+	if code == "" {
+		return UCUMUnit{}, fmt.Errorf("missing UCUM unit")
+	}
+	p := &ucumParser{code: code}
+	unit, err := p.term()
+	if err == nil && p.pos < len(code) {
+		err = fmt.Errorf("unexpected %q", code[p.pos:])
+	}
+	if err != nil {
+		return UCUMUnit{}, fmt.Errorf("could not parse UCUM unit %s: %s", code, err)
+	}
+	return unit, nil
+}
+
+type ucumParser struct {
+	code string
+	pos  int
+}
+
+// term parses components joined by '.' and '/', which are applied from left to right
+func (p *ucumParser) term() (UCUMUnit, error) {
+	result := ucumUnity()
+	sign := 1
+	if p.pos < len(p.code) && p.code[p.pos] == '/' {
+		sign = -1
+		p.pos++
+	}
+	for {
+		component, err := p.component()
+		if err != nil {
+			return result, err
+		}
+		result = result.times(component, sign)
+
+		if p.pos >= len(p.code) || p.code[p.pos] == ')' {
+			return result, nil
+		}
+		switch p.code[p.pos] {
+		case '.':
+			sign = 1
+		case '/':
+			sign = -1
+		default:
+			return result, fmt.Errorf("unexpected %q", p.code[p.pos:])
+		}
+		p.pos++
+	}
+}
+
+var ucumComponentRegex = regexp.MustCompile(`^(.*?)([+-]?[0-9]+)?$`)
+
+func (p *ucumParser) component() (UCUMUnit, error) {
+	if p.pos < len(p.code) && p.code[p.pos] == '(' {
+		p.pos++
+		unit, err := p.term()
+		if err != nil {
+			return unit, err
+		}
+		if p.pos >= len(p.code) || p.code[p.pos] != ')' {
+			return unit, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return unit, nil
+	}
+
+	// the component runs to the next operator that isn't within brackets or an annotation
+	start := p.pos
+	depth := 0
+	for ; p.pos < len(p.code); p.pos++ {
+		c := p.code[p.pos]
+		if depth == 0 && (c == '.' || c == '/' || c == '(' || c == ')') {
+			break
+		}
+		switch c {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	text := p.code[start:p.pos]
+
+	symbol := text
+	annotated := false
+	if i := strings.Index(symbol, "{"); i != -1 {
+		if !strings.HasSuffix(symbol, "}") {
+			return UCUMUnit{}, fmt.Errorf("invalid annotation in %q", text)
+		}
+		symbol = symbol[:i]
+		annotated = true
+	}
+	if symbol == "" {
+		if annotated {
+			return ucumUnity(), nil
+		}
+		return UCUMUnit{}, fmt.Errorf("missing unit")
+	}
+	if factor, err := strconv.ParseUint(symbol, 10, 64); err == nil {
+		return UCUMUnit{Factor: new(big.Rat).SetInt64(int64(factor)), Exponents: map[string]int{}}, nil
+	}
+
+	m := ucumComponentRegex.FindStringSubmatch(symbol)
+	exponent := 1
+	if m[2] != "" {
+		exponent, _ = strconv.Atoi(m[2])
+	}
+	unit, err := ucumSimpleUnit(m[1])
+	if err != nil {
+		return unit, err
+	}
+	return unit.pow(exponent), nil
+}
+
+// ucumSimpleUnit looks up an atom, which may have a prefix if it is metric
+func ucumSimpleUnit(symbol string) (UCUMUnit, error) {
+	if unit, found := ucumAtoms[symbol]; found {
+		return unit, nil
+	}
+	for _, prefix := range ucumPrefixes {
+		if strings.HasPrefix(symbol, prefix.code) && ucumMetricAtoms[symbol[len(prefix.code):]] {
+			atom := ucumAtoms[symbol[len(prefix.code):]]
+			return UCUMUnit{Factor: new(big.Rat).Mul(prefix.factor, atom.Factor), Exponents: atom.Exponents}, nil
+		}
+	}
+	return UCUMUnit{}, fmt.Errorf("unknown unit %s", symbol)
+}
+
+type ucumPrefix struct {
+	code   string
+	factor *big.Rat
+}
+
+// ucumPrefixes lists "da" first so that it is tried before "d"
+var ucumPrefixes []ucumPrefix
+
+var ucumAtoms = make(map[string]UCUMUnit)
+var ucumMetricAtoms = make(map[string]bool)
+
+// ucumDefinitions defines each atom as a value times a unit in terms of the atoms defined before it,
+// following the UCUM specification.  Atoms with no unit are base units.
+var ucumDefinitions = []struct {
+	code   string
+	metric bool
+	value  string
+	unit   string
+}{
+	// base units
+	{"m", true, "1", ""},
+	{"s", true, "1", ""},
+	{"g", true, "1", ""},
+	{"rad", true, "1", ""},
+	{"K", true, "1", ""},
+	{"C", true, "1", ""},
+	{"cd", true, "1", ""},
+
+	// arbitrary units are only comparable to themselves
+	{"[iU]", true, "1", ""},
+	{"[arb'U]", true, "1", ""},
+	{"[IU]", true, "1", "[iU]"},
+
+	// dimensionless
+	{"10*", false, "10", "1"},
+	{"10^", false, "10", "1"},
+	{"%", false, "1", "10*-2"},
+	{"[ppth]", false, "1", "10*-3"},
+	{"[ppm]", false, "1", "10*-6"},
+	{"[ppb]", false, "1", "10*-9"},
+	{"[pptr]", false, "1", "10*-12"},
+	{"mol", true, "6.0221367", "10*23"},
+	{"sr", true, "1", "rad2"},
+
+	// SI
+	{"Hz", true, "1", "s-1"},
+	{"N", true, "1", "kg.m/s2"},
+	{"Pa", true, "1", "N/m2"},
+	{"J", true, "1", "N.m"},
+	{"W", true, "1", "J/s"},
+	{"A", true, "1", "C/s"},
+	{"V", true, "1", "J/C"},
+	{"F", true, "1", "C/V"},
+	{"Ohm", true, "1", "V/A"},
+	{"S", true, "1", "Ohm-1"},
+	{"Wb", true, "1", "V.s"},
+	{"T", true, "1", "Wb/m2"},
+	{"H", true, "1", "Wb/A"},
+	{"lm", true, "1", "cd.sr"},
+	{"lx", true, "1", "lm/m2"},
+	{"Bq", true, "1", "s-1"},
+	{"Gy", true, "1", "J/kg"},
+	{"Sv", true, "1", "J/kg"},
+
+	// time
+	{"min", false, "60", "s"},
+	{"h", false, "60", "min"},
+	{"d", false, "24", "h"},
+	{"wk", false, "7", "d"},
+	{"a_j", false, "365.25", "d"},
+	{"a", false, "1", "a_j"},
+	{"mo_j", false, "1", "a_j/12"},
+	{"mo", false, "1", "mo_j"},
+
+	// other metric units
+	{"L", true, "1", "dm3"},
+	{"l", true, "1", "dm3"},
+	{"ar", true, "100", "m2"},
+	{"t", true, "1000", "kg"},
+	{"bar", true, "100000", "Pa"},
+	{"u", true, "1.6605402e-24", "g"},
+	{"eq", true, "1", "mol"},
+	{"osm", true, "1", "mol"},
+	{"kat", true, "1", "mol/s"},
+	{"U", true, "1", "umol/min"},
+	{"[e]", false, "1.60217733e-19", "C"},
+	{"eV", true, "1", "[e].V"},
+	{"dyn", true, "1", "g.cm/s2"},
+	{"erg", true, "1", "dyn.cm"},
+	{"cal", true, "4.184", "J"},
+	{"[Cal]", false, "1", "kcal"},
+	{"[g]", false, "9.80665", "m/s2"},
+	{"m[Hg]", true, "133.322", "kPa"},
+	{"m[H2O]", true, "9.80665", "kPa"},
+	{"atm", false, "101325", "Pa"},
+	{"Ci", true, "37000000000", "Bq"},
+	{"R", true, "0.000258", "C/kg"},
+	{"RAD", true, "100", "erg/g"},
+	{"REM", true, "1", "RAD"},
+	{"G", true, "0.0001", "T"},
+	{"Ao", false, "0.1", "nm"},
+
+	// customary units
+	{"[in_i]", false, "2.54", "cm"},
+	{"[ft_i]", false, "12", "[in_i]"},
+	{"[yd_i]", false, "3", "[ft_i]"},
+	{"[mi_i]", false, "5280", "[ft_i]"},
+	{"[nmi_i]", false, "1852", "m"},
+	{"[lb_av]", false, "453.59237", "g"},
+	{"[oz_av]", false, "1", "[lb_av]/16"},
+	{"[stone_av]", false, "14", "[lb_av]"},
+	{"[gr]", false, "64.79891", "mg"},
+	{"[lbf_av]", false, "1", "[lb_av].[g]"},
+	{"[psi]", false, "1", "[lbf_av]/[in_i]2"},
+	{"[gal_us]", false, "231", "[in_i]3"},
+	{"[qt_us]", false, "1", "[gal_us]/4"},
+	{"[pt_us]", false, "1", "[qt_us]/2"},
+	{"[foz_us]", false, "1", "[pt_us]/16"},
+	{"[tbs_us]", false, "1", "[foz_us]/2"},
+	{"[tsp_us]", false, "1", "[tbs_us]/3"},
+	{"[cup_us]", false, "16", "[tbs_us]"},
+	{"[drp]", false, "1", "mL/20"},
+}
+
+func init() {
+	for _, prefix := range []struct {
+		code     string
+		exponent int
+	}{
+		{"da", 1}, {"Y", 24}, {"Z", 21}, {"E", 18}, {"P", 15}, {"T", 12}, {"G", 9}, {"M", 6}, {"k", 3}, {"h", 2},
+		{"d", -1}, {"c", -2}, {"m", -3}, {"u", -6}, {"n", -9}, {"p", -12}, {"f", -15}, {"a", -18}, {"z", -21}, {"y", -24},
+	} {
+		factor := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(prefix.exponent))), nil))
+		if prefix.exponent < 0 {
+			factor.Inv(factor)
+		}
+		ucumPrefixes = append(ucumPrefixes, ucumPrefix{prefix.code, factor})
+	}
+
+	for _, def := range ucumDefinitions {
+		value, ok := new(big.Rat).SetString(def.value)
+		if !ok {
+			panic(fmt.Errorf("invalid value of UCUM unit %s: %s", def.code, def.value))
+		}
+		unit := UCUMUnit{Factor: value, Exponents: map[string]int{def.code: 1}}
+		if def.unit != "" {
+			definition, err := ParseUCUM(def.unit)
+			if err != nil {
+				panic(fmt.Errorf("invalid definition of UCUM unit %s: %s", def.code, err))
+			}
+			unit = UCUMUnit{Factor: value, Exponents: map[string]int{}}.times(definition, 1)
+		}
+		ucumAtoms[def.code] = unit
+		ucumMetricAtoms[def.code] = def.metric
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
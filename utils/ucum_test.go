@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUCUM(t *testing.T) {
+	for _, test := range []struct {
+		code      string
+		factor    string
+		canonical string
+	}{
+		// atoms take precedence over a prefix and an atom
+		{"cd", "1", "cd"},
+		{"dL", "1/10000", "m3"},
+		{"mm", "1/1000", "m"},
+		{"dam", "10", "m"},
+		{"mg/dL", "10", "g.m-3"},
+		{"mmol/L", "602213670000000000000000", "m-3"},
+		{"10*9/L", "1000000000000", "m-3"},
+		{"10*-3", "1/1000", "1"},
+		{"%", "1/100", "1"},
+		// annotations are ignored
+		{"{cells}/uL", "1000000000", "m-3"},
+		{"mg{total}", "1/1000", "g"},
+		{"{score}", "1", "1"},
+		// parenthesised terms
+		{"g/(kg.d)", "1/86400000", "s-1"},
+		{"/min", "1/60", "s-1"},
+		{"mm[Hg]", "133322", "g.m-1.s-2"},
+		{"[lb_av]", "45359237/100000", "g"},
+		{"m2", "1", "m2"},
+		{"kg.m/s2", "1000", "g.m.s-2"},
+	} {
+		unit, err := ParseUCUM(test.code)
+		if assert.NoError(t, err, test.code) {
+			assert.Equal(t, test.factor, unit.Factor.RatString(), test.code)
+			assert.Equal(t, test.canonical, unit.Canonical(), test.code)
+		}
+	}
+}
+
+func TestParseUCUMErrors(t *testing.T) {
+	for _, code := range []string{"", "foo", "Cel", "[pH]", "mg/", "(mg", "mg)", "kg.foo"} {
+		_, err := ParseUCUM(code)
+		assert.Error(t, err, code)
+	}
+
+	_, err := ParseUCUM("foo")
+	assert.EqualError(t, err, "could not parse UCUM unit foo: unknown unit foo")
+}
+
+func TestUCUMConvert(t *testing.T) {
+	for _, test := range []struct {
+		value, from, to, expected string
+	}{
+		{"100", "mg/dL", "g/L", "1"},
+		{"0.3", "mg/dL", "g/L", "3/1000"},
+		{"5.5", "mmol/L", "umol/L", "5500"},
+		{"0.1", "mmol/L", "umol/L", "100"},
+		{"1", "[lb_av]", "kg", "45359237/100000000"},
+		{"90", "min", "h", "3/2"},
+	} {
+		from, err := ParseUCUM(test.from)
+		assert.NoError(t, err)
+		to, err := ParseUCUM(test.to)
+		assert.NoError(t, err)
+		assert.Equal(t, from.Canonical(), to.Canonical())
+
+		value, ok := new(big.Rat).SetString(test.value)
+		assert.True(t, ok)
+		converted := new(big.Rat).Quo(from.Convert(value), to.Factor)
+		assert.Equal(t, test.expected, converted.RatString(), "%s %s in %s", test.value, test.from, test.to)
+	}
+}